@@ -0,0 +1,245 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// defaultConfigFile is where the CLI keeps its configuration, unless CHOP_CONFIG names another
+// file. Files ending in .db or .bolt are bbolt databases, all others YAML.
+const defaultConfigFile = "/Users/alexanderpreis/Projects/infologistix/cloudHopper/chop.yaml"
+
+// app is everything a command works with: the configuration and where it is stored, the
+// client for cloud operations and the streams to talk to the user. Execute builds one and
+// hands it to the commands through the context, tests can hand in their own.
+type app struct {
+	configFile string // "" keeps the configuration in memory only
+	store      inventory.Store
+	config     *inventory.Configuration
+	client     *chop.Client
+	stdin      io.Reader
+	stdout     io.Writer
+	stderr     io.Writer
+	started    bool                     // Arguments and flags were accepted and the command began to run
+	keys       *inventory.Keys          // Keys of the encrypted configuration, once they were needed
+	command    string                   // The command line, recorded with snapshots
+	snapshot   *chop.Snapshot           // Taken before the first change of the command
+	saved      *inventory.Configuration // As last loaded or saved, to journal what changed since
+	savedFile  os.FileInfo              // The configuration file when saved was remembered
+	rekeyed    bool                     // New keys were set, the stored file cannot be read with them
+}
+
+// newApp returns an app with an empty configuration that talks to the cloud through provider.
+// Changes and connections are recorded in the audit journal next to the configuration file.
+func newApp(configFile string, provider chop.Provider) *app {
+	config := inventory.NewConfiguration()
+	a := &app{
+		configFile: configFile,
+		config:     &config,
+		stdin:      os.Stdin,
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+	}
+	a.client = &chop.Client{Configuration: &config, Provider: provider, Stdin: a.stdin, Stdout: a.stdout, Stderr: a.stderr}
+	if configFile != "" {
+		a.store = chop.OpenStore(configFile, a.keySource)
+		a.client.Journal = chop.NewJournal(configFile, "")
+		a.client.Provider = chop.AuditedProvider{Provider: provider, Journal: a.client.Journal}
+	}
+	return a
+}
+
+// appKey is the context key of the app
+type appKey struct{}
+
+// withApp returns a context that carries the app to the commands
+func withApp(ctx context.Context, a *app) context.Context {
+	return context.WithValue(ctx, appKey{}, a)
+}
+
+// appFrom returns the app of a running command
+func appFrom(cmd *cobra.Command) *app {
+	return cmd.Context().Value(appKey{}).(*app)
+}
+
+// load reads the configuration from its store, creating an empty one if none exists yet
+func (a *app) load() error {
+	if a.configFile == "" {
+		return nil
+	}
+	err := a.store.Load(a.config)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := a.save(); err != nil {
+			return err
+		}
+		fmt.Fprintln(a.stderr, "Created empty configuration file at:", a.configFile)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Ensure the accounts map is initialized if the file was empty
+	if a.config.Accounts == nil {
+		a.config.Accounts = make(map[string]inventory.Account)
+	}
+	return a.remember()
+}
+
+// remember keeps a copy of the configuration as it is stored, see saved
+func (a *app) remember() error {
+	saved, err := a.config.Clone()
+	if err != nil {
+		return err
+	}
+	a.saved = &saved
+	a.savedFile, _ = os.Stat(a.configFile)
+	return nil
+}
+
+// keySource returns the keys of an encrypted configuration from the environment, or asks for
+// the passphrase on the terminal the first time they are needed
+func (a *app) keySource() (inventory.Keys, error) {
+	if a.keys != nil {
+		return *a.keys, nil
+	}
+	keys, found, err := chop.KeysFromEnvironment()
+	if err != nil {
+		return keys, err
+	}
+	if !found {
+		if !a.interactive() {
+			return keys, fmt.Errorf("%w: set CHOP_AGE_KEY_FILE or CHOP_PASSPHRASE", inventory.ErrNoKey)
+		}
+		passphrase, err := a.askPassphrase("Passphrase for " + a.configFile + ": ")
+		if err != nil {
+			return keys, err
+		}
+		if keys, err = inventory.KeysFromPassphrase(passphrase); err != nil {
+			return keys, err
+		}
+	}
+	a.keys = &keys
+	return keys, nil
+}
+
+// askPassphrase reads a passphrase from the terminal without echoing it
+func (a *app) askPassphrase(prompt string) (string, error) {
+	fmt.Fprint(a.stderr, prompt)
+	defer fmt.Fprintln(a.stderr)
+	if file, ok := a.stdin.(*os.File); ok && term.IsTerminal(int(file.Fd())) {
+		passphrase, err := term.ReadPassword(int(file.Fd()))
+		if err != nil {
+			return "", fmt.Errorf("reading passphrase: %w", err)
+		}
+		return string(passphrase), nil
+	}
+	passphrase, err := bufio.NewReader(a.stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("reading passphrase: %w", err)
+	}
+	return strings.TrimSpace(passphrase), nil
+}
+
+// save writes the configuration back to its store, after a snapshot for 'chop undo' unless
+// only the usage of machines changed. What changed is recorded in the audit journal first,
+// changes that cannot be recorded are not saved.
+func (a *app) save() error {
+	if a.configFile == "" {
+		return nil
+	}
+	saved := a.saved
+	if saved == nil {
+		empty := inventory.NewConfiguration()
+		saved = &empty
+	}
+	changes := inventory.Changes(saved, a.config)
+	// Connecting only records the usage of machines, that is nothing to undo
+	if len(changes) > 0 {
+		if err := a.takeSnapshot(); err != nil {
+			return fmt.Errorf("saving configuration: %w", err)
+		}
+	}
+	// Record the changes only once they are saved, but refuse them if they cannot be recorded
+	err := a.client.Journal.Check()
+	if err != nil {
+		return fmt.Errorf("saving configuration: %w", err)
+	}
+	if a.mergeOnSave() {
+		err = a.store.Update(a.merge)
+	} else {
+		err = a.store.Save(a.config)
+	}
+	if err != nil {
+		return fmt.Errorf("saving configuration: %w", err)
+	}
+	a.dropSnapshotIfUnchanged()
+	if err := a.client.Journal.RecordChanges(changes, ""); err != nil {
+		return fmt.Errorf("saving configuration: %w", err)
+	}
+	if err := a.remember(); err != nil {
+		return fmt.Errorf("saving configuration: %w", err)
+	}
+	// Keep the ssh config include file in line with machines, addresses and aliases
+	if len(changes) > 0 {
+		return a.refreshSSHConfig()
+	}
+	return nil
+}
+
+// mergeOnSave reports whether save has to merge with what other chops saved meanwhile.
+// Databases always merge, in a transaction that locks them. A YAML file is not locked
+// anyway, so it is only read again when it changed since it was loaded, which spares
+// decrypting it. Nothing is merged into a new file or a file written with new keys.
+func (a *app) mergeOnSave() bool {
+	if a.saved == nil || a.rekeyed {
+		return false
+	}
+	if chop.Backend(a.configFile) == chop.BackendBolt {
+		return true
+	}
+	info, err := os.Stat(a.configFile)
+	return err != nil || a.savedFile == nil || !info.ModTime().Equal(a.savedFile.ModTime()) || info.Size() != a.savedFile.Size()
+}
+
+// merge changes the stored configuration into the command's: what the command changed
+// since it loaded the configuration is applied to what is stored now, so that changes other
+// chops saved meanwhile are kept. Where both changed the same value the command wins.
+func (a *app) merge(stored *inventory.Configuration) error {
+	merged, err := inventory.MergeConfigurations(a.saved, a.config, stored)
+	if err != nil {
+		return err
+	}
+	*a.config = merged
+	*stored = merged
+	return nil
+}
+
+// takeSnapshot copies the configuration file before the first change of the command
+func (a *app) takeSnapshot() error {
+	if a.snapshot != nil {
+		return nil
+	}
+	snapshot, err := chop.TakeSnapshot(a.configFile, a.command, time.Now())
+	a.snapshot = snapshot
+	return err
+}
+
+// dropSnapshotIfUnchanged forgets the snapshot when the command did not change the file
+func (a *app) dropSnapshotIfUnchanged() {
+	if a.snapshot != nil && chop.DropSnapshotIfUnchanged(a.configFile, *a.snapshot) {
+		a.snapshot = nil
+	}
+}
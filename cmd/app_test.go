@@ -0,0 +1,472 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// fakeProvider records the operations chop asks for and runs harmless local commands
+// in place of sessions, remote commands and copies
+type fakeProvider struct {
+	calls []string
+	fail  map[string]bool // Operations that fail, e.g. "stop db-1"
+}
+
+func (p *fakeProvider) record(call string, machine inventory.Machine) {
+	p.calls = append(p.calls, call+" "+machine.Name)
+}
+
+// err fails the operations listed in fail
+func (p *fakeProvider) err(call string, machine inventory.Machine) error {
+	if p.fail[call+" "+machine.Name] {
+		return errors.New(call + " failed")
+	}
+	return nil
+}
+
+func (p *fakeProvider) ListMachines(account string, project string) ([]inventory.Machine, error) {
+	return []inventory.Machine{{Name: "web-1", Zone: "europe-west3-a", Status: chop.StatusRunning}}, nil
+}
+
+func (p *fakeProvider) StartMachine(account string, project string, machine inventory.Machine) error {
+	p.record("start", machine)
+	return nil
+}
+
+func (p *fakeProvider) StopMachine(account string, project string, machine inventory.Machine) error {
+	p.record("stop", machine)
+	return p.err("stop", machine)
+}
+
+func (p *fakeProvider) DescribeMachine(account string, project string, machine inventory.Machine) (inventory.Machine, error) {
+	machine.Status = chop.StatusRunning
+	return machine, p.err("describe", machine)
+}
+
+func (p *fakeProvider) CreateMachine(account string, project string, name string, template inventory.Template) (inventory.Machine, error) {
+	machine := inventory.Machine{Name: name, Zone: template.Zone, Status: chop.StatusRunning}
+	p.record("create", machine)
+	return machine, nil
+}
+
+func (p *fakeProvider) UpdateMachine(account string, project string, machine inventory.Machine, update chop.MachineUpdate) error {
+	p.record("update", machine)
+	return nil
+}
+
+func (p *fakeProvider) DeleteMachine(account string, project string, machine inventory.Machine) error {
+	p.record("delete", machine)
+	return nil
+}
+
+func (p *fakeProvider) ResetMachine(account string, project string, machine inventory.Machine) error {
+	p.record("reset", machine)
+	return nil
+}
+
+func (p *fakeProvider) ConnectCommand(account string, project string, machine inventory.Machine) *exec.Cmd {
+	p.record("connect", machine)
+	return exec.Command("echo", "session on", machine.Name)
+}
+
+func (p *fakeProvider) TunnelCommand(account string, project string, machine inventory.Machine, tunnel inventory.Tunnel) *exec.Cmd {
+	p.record("tunnel", machine)
+	return exec.Command("true")
+}
+
+func (p *fakeProvider) ProxyCommand(account string, project string, machine inventory.Machine, port int) *exec.Cmd {
+	p.record("proxy", machine)
+	return exec.Command("cat")
+}
+
+func (p *fakeProvider) RunCommand(account string, project string, machine inventory.Machine, command string) *exec.Cmd {
+	p.record("run", machine)
+	return exec.Command("sh", "-c", command)
+}
+
+func (p *fakeProvider) CopyCommand(account string, project string, machine inventory.Machine, transfer chop.Transfer) *exec.Cmd {
+	p.record("copy", machine)
+	return exec.Command("true")
+}
+
+// testApp returns an app with an in-memory configuration holding acme/web with db-1 and web-1
+func testApp(t *testing.T) (*app, *fakeProvider) {
+	t.Helper()
+	provider := &fakeProvider{}
+	a := newApp("", provider)
+	a.config.AddAccount("acme")
+	for _, err := range []error{
+		a.config.SetActiveAccount("acme"),
+		a.config.AddProjectToActiveAccount("acme", "web"),
+		a.config.SetActiveProjectForAccount("acme", "web"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, machine := range []string{"db-1", "web-1"} {
+		if err := a.config.AddMachineToActiveProject("acme", machine); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a, provider
+}
+
+// run executes a command line on the app with stdin as input and returns what the command
+// printed and its exit code
+func run(a *app, stdin string, args ...string) (stdout string, stderr string, code int) {
+	var out, errOut bytes.Buffer
+	a.stdin, a.stdout, a.stderr = strings.NewReader(stdin), &out, &errOut
+	a.client.Stdin, a.client.Stdout, a.client.Stderr = a.stdin, a.stdout, a.stderr
+	a.started = false
+	resetCommands(rootCmd)
+
+	rootCmd.SetArgs(args)
+	rootCmd.SetOut(&out)
+	rootCmd.SetErr(&errOut)
+	err := rootCmd.ExecuteContext(withApp(context.Background(), a))
+	if err != nil {
+		if !a.started {
+			err = usageError{err}
+		}
+		printError(a, err)
+	}
+	return out.String(), errOut.String(), exitCode(err)
+}
+
+// resetCommands sets the flags of a command and its subcommands back to their defaults and
+// drops their context, cobra keeps both from one execution to the next
+func resetCommands(cmd *cobra.Command) {
+	reset := func(flag *pflag.Flag) {
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			slice.Replace(nil)
+		} else {
+			flag.Value.Set(flag.DefValue)
+		}
+		flag.Changed = false
+	}
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+	cmd.SetContext(nil)
+	for _, sub := range cmd.Commands() {
+		resetCommands(sub)
+	}
+}
+
+func TestAddAndList(t *testing.T) {
+	a, _ := testApp(t)
+	if _, stderr, code := run(a, "", "add", "machine", "cache-1", "--account", "acme", "--project", "web"); code != exitOK {
+		t.Fatalf("add machine: exit %d: %s", code, stderr)
+	}
+	stdout, _, code := run(a, "", "list")
+	if code != exitOK {
+		t.Fatalf("list: exit %d", code)
+	}
+	for _, machine := range []string{"cache-1", "db-1", "web-1"} {
+		if !strings.Contains(stdout, machine) {
+			t.Errorf("list does not show %s:\n%s", machine, stdout)
+		}
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"unknown machine", []string{"connect", "nope", "--account", "acme", "--project", "web"}, exitNotFound},
+		{"unknown flag", []string{"list", "--nope"}, exitUsage},
+		{"stop without machines", []string{"stop"}, exitUsage},
+		{"reset without machines", []string{"reset", "--yes"}, exitUsage},
+		{"alias with a colon", []string{"add", "alias", "db-1", "db:1"}, exitUsage},
+		{"alias with a wildcard", []string{"add", "alias", "db-1", "db*"}, exitUsage},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, provider := testApp(t)
+			_, stderr, code := run(a, "", test.args...)
+			if code != test.code {
+				t.Errorf("exit %d, want %d: %s", code, test.code, stderr)
+			}
+			if !strings.HasPrefix(stderr, "Error:") {
+				t.Errorf("stderr = %q, want the error", stderr)
+			}
+			if len(provider.calls) > 0 {
+				t.Errorf("provider was called: %v", provider.calls)
+			}
+		})
+	}
+}
+
+func TestStopConfirmation(t *testing.T) {
+	tests := []struct {
+		name  string
+		stdin string
+		args  []string
+		calls int
+	}{
+		{"declined", "no\n", []string{"stop", "db-1", "web-1"}, 0},
+		{"confirmed", "yes\n", []string{"stop", "db-1", "web-1"}, 2},
+		{"--yes", "", []string{"stop", "--yes", "--project", "web"}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, provider := testApp(t)
+			stdout, stderr, code := run(a, test.stdin, test.args...)
+			if code != exitOK {
+				t.Fatalf("exit %d: %s", code, stderr)
+			}
+			if len(provider.calls) != test.calls {
+				t.Errorf("provider calls %v, want %d", provider.calls, test.calls)
+			}
+			if test.calls == 0 && !strings.Contains(stdout, "You declined") {
+				t.Errorf("stdout = %q, want the declined message", stdout)
+			}
+			if test.calls > 0 {
+				machine, _ := a.config.GetMachine("acme", "web", "db-1")
+				if machine.Status != chop.StatusTerminated {
+					t.Errorf("status = %q after stop", machine.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestIdleFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    string
+		code    int
+		stdout  string
+		stopped bool
+	}{
+		{"all stopped", "", exitOK, "acme/web/db-1: stopped", true},
+		{"stop fails", "stop db-1", exitFailure, "acme/web/db-1: not stopped, stop failed", false},
+		{"check fails", "describe web-1", exitFailure, "Could not check acme/web/web-1: describe failed", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, provider := testApp(t)
+			provider.fail = map[string]bool{test.fail: true}
+			// db-1 was last used a month ago, web-1 just now
+			a.config.UpdateMachine("acme", "web", "db-1", func(m *inventory.Machine) { m.LastUsage = time.Now().AddDate(0, -1, 0) })
+
+			stdout, stderr, code := run(a, "", "idle", "--stop", "--yes")
+			if code != test.code {
+				t.Errorf("exit %d, want %d: %s", code, test.code, stderr)
+			}
+			if !strings.Contains(stdout, test.stdout) {
+				t.Errorf("stdout does not contain %q:\n%s", test.stdout, stdout)
+			}
+			if test.code != exitOK && !strings.Contains(stderr, "failed on 1 of 2 machines") {
+				t.Errorf("stderr = %q, want the count of failures", stderr)
+			}
+			if machine, _ := a.config.GetMachine("acme", "web", "db-1"); (machine.Status == chop.StatusTerminated) != test.stopped {
+				t.Errorf("status of db-1 = %q, stopped %v", machine.Status, test.stopped)
+			}
+		})
+	}
+}
+
+func TestStreamsReachTheClient(t *testing.T) {
+	a, provider := testApp(t)
+
+	stdout, stderr, code := run(a, "", "connect", "db-1")
+	if code != exitOK {
+		t.Fatalf("connect: exit %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "session on db-1") {
+		t.Errorf("session output %q did not reach the app's stdout", stdout)
+	}
+
+	stdout, stderr, code = run(a, "", "exec", "db-1", "--", "echo", "hello")
+	if code != exitOK {
+		t.Fatalf("exec: exit %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "hello") {
+		t.Errorf("exec output %q did not reach the app's stdout", stdout)
+	}
+
+	stdout, stderr, code = run(a, "", "cp", "app_test.go", "db-1:/tmp/")
+	if code != exitOK {
+		t.Fatalf("cp: exit %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "Uploading app_test.go to") {
+		t.Errorf("cp progress %q did not reach the app's stdout", stdout)
+	}
+
+	stdout, stderr, code = run(a, "piped through", "proxy", "db-1", "22")
+	if code != exitOK {
+		t.Fatalf("proxy: exit %d: %s", code, stderr)
+	}
+	if stdout != "piped through" {
+		t.Errorf("proxy stdout = %q, want the app's stdin", stdout)
+	}
+
+	want := []string{"connect db-1", "run db-1", "copy db-1", "proxy db-1"}
+	if strings.Join(provider.calls, ",") != strings.Join(want, ",") {
+		t.Errorf("provider calls %v, want %v", provider.calls, want)
+	}
+}
+
+// fileApp returns a testApp that keeps its configuration in filename, with the ssh config
+// include file next to it
+func fileApp(t *testing.T, filename string) *app {
+	t.Helper()
+	t.Setenv("CHOP_SYSTEM_CONFIG", filepath.Join(t.TempDir(), "none.yaml"))
+	t.Setenv("CHOP_TEAM_CONFIG", "")
+	memory, provider := testApp(t)
+	a := newApp(filename, provider)
+	*a.config = *memory.config
+	a.config.SSHConfigFile = filepath.Join(filepath.Dir(filename), "chop_config")
+	if err := a.save(); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// gitRepository makes a bare repository and a clone of it holding the configuration of app,
+// like a dotfiles repository. It returns the app and a second clone with its own copy.
+func gitRepository(t *testing.T) (*app, string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	for _, variable := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(variable, "chop")
+	}
+	for _, variable := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(variable, "chop@example.com")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	dir := t.TempDir()
+	remote, first, second := filepath.Join(dir, "remote.git"), filepath.Join(dir, "first"), filepath.Join(dir, "second")
+
+	git(t, dir, "init", "--quiet", "--bare", "--initial-branch=main", remote)
+	git(t, dir, "clone", "--quiet", remote, first)
+	git(t, first, "checkout", "--quiet", "-b", "main")
+	a := fileApp(t, filepath.Join(first, "chop.yaml"))
+	git(t, first, "add", "chop.yaml")
+	git(t, first, "commit", "--quiet", "-m", "initial")
+	git(t, first, "push", "--quiet", "-u", "origin", "main")
+	git(t, dir, "clone", "--quiet", remote, second)
+	return a, second
+}
+
+func git(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	command := exec.Command("git", args...)
+	command.Dir = dir
+	if out, err := command.CombinedOutput(); err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+}
+
+func TestSSHConfigIsRefreshed(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   [][]string
+		want    string
+		notWant string
+	}{
+		{"add machine", [][]string{{"add", "machine", "cache-1"}}, "acme.web.cache-1", ""},
+		{"rm machine", [][]string{{"rm", "machine", "web-1"}}, "", "acme.web.web-1"},
+		{"rm project", [][]string{{"rm", "project", "web"}}, "", "acme.web.db-1"},
+		{"rm account", [][]string{{"rm", "account", "acme"}}, "", "acme.web.db-1"},
+		{"set transport", [][]string{{"set", "transport", "iap", "--machine", "db-1"}}, "start-iap-tunnel db-1", ""},
+		{"set ssh", [][]string{{"set", "ssh", "db-1", "--host", "10.1.2.3"}}, "HostName 10.1.2.3", ""},
+		{"undo", [][]string{{"rm", "machine", "web-1"}, {"undo"}}, "acme.web.web-1", ""},
+		{"restore", [][]string{{"rm", "machine", "web-1"}, {"restore", "1"}}, "acme.web.web-1", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := fileApp(t, filepath.Join(t.TempDir(), "chop.yaml"))
+			for _, args := range test.steps {
+				if _, stderr, code := run(a, "", args...); code != exitOK {
+					t.Fatalf("%v: exit %d: %s", args, code, stderr)
+				}
+			}
+			assertSSHConfig(t, a, test.want, test.notWant)
+		})
+	}
+
+	t.Run("config sync", func(t *testing.T) {
+		a, second := gitRepository(t)
+		// The other computer removes web-1, without touching the ssh config of this one
+		store := chop.OpenStore(filepath.Join(second, "chop.yaml"), a.keySource)
+		configs := inventory.NewConfiguration()
+		if err := store.Load(&configs); err != nil {
+			t.Fatal(err)
+		}
+		if err := configs.DeleteMachine("acme", "web", "web-1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Save(&configs); err != nil {
+			t.Fatal(err)
+		}
+		git(t, second, "commit", "--quiet", "-m", "remove web-1", "chop.yaml")
+		git(t, second, "push", "--quiet")
+
+		if _, stderr, code := run(a, "", "config", "sync"); code != exitOK {
+			t.Fatalf("exit %d: %s", code, stderr)
+		}
+		assertSSHConfig(t, a, "acme.web.db-1", "acme.web.web-1")
+	})
+}
+
+// assertSSHConfig checks that the ssh config include file of the app contains want and
+// lacks notWant, either may be empty
+func assertSSHConfig(t *testing.T, a *app, want string, notWant string) {
+	t.Helper()
+	written, err := os.ReadFile(a.config.SSHConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != "" && !strings.Contains(string(written), want) {
+		t.Errorf("ssh config does not contain %q:\n%s", want, written)
+	}
+	if notWant != "" && strings.Contains(string(written), notWant) {
+		t.Errorf("ssh config still contains %q:\n%s", notWant, written)
+	}
+}
+
+func TestPromptShell(t *testing.T) {
+	defer func(noColor bool) { color.NoColor = noColor }(color.NoColor)
+	a, _ := testApp(t)
+	a.configFile = filepath.Join(t.TempDir(), "chop.yaml")
+	if err := chop.NewPromptState(a.config).Save(chop.PromptStateFile(a.configFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args []string
+		want string
+		code int
+	}{
+		{[]string{"prompt"}, "acme/web\n", exitOK},
+		{[]string{"prompt", "--shell", "bash"}, "acme/web\n", exitOK},
+		{[]string{"prompt", "--color", "--shell", "bash"}, "\x01\x1b[32m\x02acme\x01\x1b[0m\x02/\x01\x1b[36m\x02web\x01\x1b[0m\x02\n", exitOK},
+		{[]string{"prompt", "--shell", "fish"}, "", exitUsage},
+	}
+	for _, test := range tests {
+		color.NoColor = true
+		stdout, stderr, code := run(a, "", test.args...)
+		if stdout != test.want || code != test.code {
+			t.Errorf("%v: %q, exit %d, want %q, exit %d: %s", test.args, stdout, code, test.want, test.code, stderr)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"fmt"
+	"palexus/chop/cmd/chop"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// Bring the cloud in line with the desired machines of a project
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Create, update or delete machines to match the desired machines of a project",
+	Long: `Compares the machines declared under 'desired' in a project of the configuration with
+the machines in the cloud, shows the plan and executes it after confirmation:
+
+  desired:
+      debug-box:
+          zone: europe-west3-a
+          machinetype: e2-small
+          imagefamily: debian-12
+          imageproject: debian-cloud
+          labels: {team: ops}
+
+Only machines chop created are ever changed or deleted. Each machine remembers what was
+applied to it, so changes made outside chop show up as drift in the plan. A project
+without desired machines is refused unless --prune confirms that every machine chop created
+there is to be deleted. Replaced machines keep their tags, aliases, notes and tunnels.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return err
+		}
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		yes, _ := cmd.Flags().GetBool("yes")
+		prune, _ := cmd.Flags().GetBool("prune")
+
+		plan, err := a.client.PlanProject(account, project, prune)
+		if err != nil {
+			return fmt.Errorf("planning changes: %w", err)
+		}
+		a.printPlan(plan)
+		if !plan.HasChanges() {
+			fmt.Fprintln(a.stdout, "Nothing to do, the machines match the desired state.")
+			return nil
+		}
+		if dryRun {
+			return nil
+		}
+		if !yes && !a.askYesNo("Apply these changes?") {
+			fmt.Fprintln(a.stdout, "You declined: Aborting...")
+			return nil
+		}
+
+		batch := batchError{}
+		a.client.ApplyPlan(plan, func(change chop.PlanChange, err error) {
+			batch.total++
+			if err != nil {
+				batch.failed = append(batch.failed, fmt.Errorf("%s %s: %w", change.Action, change.Machine, err))
+				fmt.Fprintln(a.stderr, "Error:", change.Action, change.Machine+":", err)
+				return
+			}
+			fmt.Fprintln(a.stdout, "Done:", change.Action, change.Machine)
+		})
+
+		// Save the configuration to record the applied state
+		if err := a.save(); err != nil {
+			return err
+		}
+		if len(batch.failed) > 0 {
+			return batch
+		}
+		return nil
+	},
+}
+
+// printPlan shows the changes of a plan, one line per machine with details and drift below
+func (a *app) printPlan(plan chop.Plan) {
+	symbols := map[string]string{
+		chop.PlanCreate:  color.New(color.FgGreen).Sprint("+"),
+		chop.PlanUpdate:  color.New(color.FgYellow).Sprint("~"),
+		chop.PlanReplace: color.New(color.FgRed).Sprint("-/+"),
+		chop.PlanDelete:  color.New(color.FgRed).Sprint("-"),
+		chop.PlanForget:  color.New(color.FgRed).Sprint("-"),
+		chop.PlanSkip:    " ",
+	}
+	driftColor := color.New(color.FgMagenta).SprintFunc()
+
+	fmt.Fprintf(a.stdout, "Plan for %s/%s:\n", plan.Account, plan.Project)
+	for _, change := range plan.Changes {
+		line := fmt.Sprintf("  %3s %-8s %s", symbols[change.Action], change.Action, change.Machine)
+		if change.Action == chop.PlanCreate {
+			template := change.Template
+			line += " (" + strings.Join(nonEmpty(template.Zone, template.MachineType, template.ImageFamily), ", ") + ")"
+		}
+		fmt.Fprintln(a.stdout, line)
+		for _, detail := range change.Details {
+			fmt.Fprintln(a.stdout, "              ", detail)
+		}
+		for _, drift := range change.Drift {
+			fmt.Fprintln(a.stdout, "              ", driftColor("drift: "+drift))
+		}
+	}
+}
+
+// nonEmpty drops empty strings
+func nonEmpty(values ...string) []string {
+	kept := []string{}
+	for _, value := range values {
+		if value != "" {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
+
+func init() {
+	// ********** APPLY ************
+	applyCmd.Flags().String("account", "", "Account of the project (if not provided, active account will be used)")
+	applyCmd.Flags().String("project", "", "Project to apply (if not provided, active project will be used)")
+	applyCmd.Flags().BoolP("dry-run", "n", false, "Only show the plan")
+	applyCmd.Flags().BoolP("yes", "y", false, "Apply without asking")
+	applyCmd.Flags().Bool("prune", false, "Delete the machines chop created even if the project declares no desired machines")
+	applyCmd.RegisterFlagCompletionFunc("account", completeAccounts)
+	applyCmd.RegisterFlagCompletionFunc("project", completeProjects)
+	rootCmd.AddCommand(applyCmd)
+}
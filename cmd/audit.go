@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexeyco/simpletable"
+	"github.com/spf13/cobra"
+)
+
+// Query the audit journal
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Show who changed the inventory and connected to machines, and when",
+	Long: fmt.Sprintf(`chop records every change of the inventory and every connection to a machine in the
+audit journal audit.jsonl next to the configuration, one JSON object per line: the time,
+user, host and command line, the action and the account, project and machine it concerns.
+Changes list the fields that changed, never their values.
+
+Connections are sessions, tunnels, exec, cp, sync, cssh and proxy. A connection or change
+that cannot be recorded is refused. At %d MiB the journal is rotated to audit.jsonl.1, the
+last %d rotated journals are kept and searched as well.
+
+--since and --until take a time like 2026-10-19T08:00:00Z, 2026-10-19 08:00 or 2026-10-19,
+or a duration back from now like 90m, 24h or 7d. A date alone for --until includes that day.`, chop.JournalMaxSize>>20, chop.JournalFilesKept),
+	Example: `  chop audit --machine db-1 --since 7d
+  chop audit --project staging --since 2026-10-01 --until 2026-10-15
+  chop audit --action connect --json | jq .user`,
+	Args:              cobra.NoArgs,
+	PersistentPreRunE: skipLoad,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		asJSON, _ := cmd.Flags().GetBool("json")
+		var filter chop.AuditFilter
+		filter.Account, _ = cmd.Flags().GetString("account")
+		filter.Project, _ = cmd.Flags().GetString("project")
+		filter.Machine, _ = cmd.Flags().GetString("machine")
+		filter.Action, _ = cmd.Flags().GetString("action")
+		now := time.Now()
+		for _, bound := range []struct {
+			flag string
+			time *time.Time
+		}{{"since", &filter.Since}, {"until", &filter.Until}} {
+			value, _ := cmd.Flags().GetString(bound.flag)
+			if value == "" {
+				continue
+			}
+			parsed, err := parseAuditTime(value, now, bound.flag == "until")
+			if err != nil {
+				return fmt.Errorf("reading audit journal: %w: --%s %s", inventory.ErrInvalid, bound.flag, value)
+			}
+			*bound.time = parsed
+		}
+
+		entries, err := chop.ReadJournal(a.configFile, filter)
+		if err != nil {
+			return fmt.Errorf("reading audit journal: %w", err)
+		}
+
+		if asJSON {
+			// The same lines as the journal, ready for jq
+			encoder := json.NewEncoder(a.stdout)
+			for _, entry := range entries {
+				encoder.Encode(entry)
+			}
+			return nil
+		}
+		if len(entries) == 0 {
+			fmt.Fprintln(a.stdout, "No audit entries found")
+			return nil
+		}
+
+		table := simpletable.New()
+		table.Header = &simpletable.Header{
+			Cells: []*simpletable.Cell{
+				{Text: "TIME"},
+				{Text: "USER"},
+				{Text: "ACTION"},
+				{Text: "MACHINE"},
+				{Text: "DETAIL"},
+			},
+		}
+		for _, entry := range entries {
+			names := []string{}
+			for _, name := range []string{entry.Account, entry.Project, entry.Machine} {
+				if name != "" {
+					names = append(names, name)
+				}
+			}
+			detail := entry.Detail
+			if len(entry.Fields) > 0 {
+				detail = strings.Join(entry.Fields, ", ")
+			}
+			table.Body.Cells = append(table.Body.Cells, []*simpletable.Cell{
+				{Text: entry.Time.Local().Format("2006-01-02 15:04:05")},
+				{Text: entry.User + "@" + entry.Host},
+				{Text: entry.Action},
+				{Text: strings.Join(names, "/")},
+				{Text: detail},
+			})
+		}
+		table.SetStyle(simpletable.StyleDefault)
+		fmt.Fprintln(a.stdout, table.String())
+		return nil
+	},
+}
+
+// parseAuditTime reads a time for --since and --until: RFC 3339, a local date with or
+// without minutes, or a duration before now with d for days. A date alone ends the day
+// it names when end is set.
+func parseAuditTime(value string, now time.Time, end bool) (time.Time, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+		return now.Add(-duration), nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	if parsed, err := time.ParseInLocation("2006-01-02 15:04", value, time.Local); err == nil {
+		return parsed, nil
+	}
+	parsed, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		parsed = parsed.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return parsed, nil
+}
+
+func init() {
+	// ********** AUDIT ************
+	auditCmd.Flags().String("account", "", "Only entries of this account")
+	auditCmd.Flags().String("project", "", "Only entries of this project")
+	auditCmd.Flags().String("machine", "", "Only entries of this machine")
+	auditCmd.Flags().String("action", "", "Only entries of this action, e.g. Connect or DeleteMachine")
+	auditCmd.Flags().String("since", "", "Only entries from this time on")
+	auditCmd.Flags().String("until", "", "Only entries up to this time")
+	auditCmd.Flags().Bool("json", false, "Print the entries as JSON lines")
+	rootCmd.AddCommand(auditCmd)
+}
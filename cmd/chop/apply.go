@@ -0,0 +1,286 @@
+package chop
+
+import (
+	"fmt"
+	"maps"
+	"palexus/chop/pkg/inventory"
+	"slices"
+)
+
+// Actions of a plan
+const (
+	PlanCreate  = "create"  // Desired machine does not exist yet
+	PlanUpdate  = "update"  // Labels or machine type differ, changed in place
+	PlanReplace = "replace" // Zone, image or disk differ, deleted and created again
+	PlanDelete  = "delete"  // Machine chop created is no longer desired
+	PlanForget  = "forget"  // Machine chop created is gone already, only the inventory entry is removed
+	PlanSkip    = "skip"    // Desired machine exists but is not managed by chop, left untouched
+)
+
+// MachineUpdate is an in-place change of a machine
+type MachineUpdate struct {
+	MachineType  string            // New machine type, empty to keep it
+	SetLabels    map[string]string // Labels to add or change
+	RemoveLabels []string          // Labels to remove
+}
+
+// PlanChange is one step of a plan
+type PlanChange struct {
+	Action   string
+	Machine  string
+	Template inventory.Template // Desired spec for create, update and replace
+	Update   MachineUpdate      // For update
+	Details  []string           // What differs, for people
+	Drift    []string           // How the machine deviates from what chop applied last
+}
+
+// Plan lists the changes that bring a project in line with its desired machines
+type Plan struct {
+	Account string
+	Project string
+	Changes []PlanChange
+}
+
+// HasChanges reports whether applying the plan would change anything
+func (plan Plan) HasChanges() bool {
+	for _, change := range plan.Changes {
+		if change.Action != PlanSkip {
+			return true
+		}
+	}
+	return false
+}
+
+// PlanProject compares the desired machines of a project with the live machines of the
+// cloud and with what chop applied before. Only machines chop created are ever updated
+// or deleted. A project without desired machines only plans deletions with prune, so that
+// a missing desired section does not delete every machine chop created. The configuration
+// is not changed.
+func (c *Client) PlanProject(account string, project string, prune bool) (Plan, error) {
+	proj, err := c.GetProject(account, project)
+	if err != nil {
+		return Plan{}, err
+	}
+	// Without a zone a machine can neither be created nor compared with the live one
+	for _, name := range slices.Sorted(maps.Keys(proj.Desired)) {
+		if proj.Desired[name].Zone == "" {
+			return Plan{}, fmt.Errorf("%w: desired machine %s of %s/%s has no zone", inventory.ErrInvalid, name, account, project)
+		}
+	}
+	listed, err := c.Provider.ListMachines(account, project)
+	if err != nil {
+		return Plan{}, err
+	}
+	live := make(map[string]inventory.Machine, len(listed))
+	for _, machine := range listed {
+		live[machine.Name] = machine
+	}
+
+	plan := Plan{Account: account, Project: project, Changes: []PlanChange{}}
+	for _, name := range slices.Sorted(maps.Keys(proj.Desired)) {
+		desired := proj.Desired[name]
+		known, inInventory := proj.Machines[name]
+		managed := inInventory && known.Applied != nil
+		current, exists := live[name]
+
+		switch {
+		case !exists:
+			change := PlanChange{Action: PlanCreate, Machine: name, Template: desired}
+			if managed {
+				change.Drift = append(change.Drift, "deleted outside chop")
+			}
+			plan.Changes = append(plan.Changes, change)
+
+		case !managed:
+			plan.Changes = append(plan.Changes, PlanChange{Action: PlanSkip, Machine: name,
+				Details: []string{"exists but was not created by chop, left untouched"}})
+
+		default:
+			if change, differs := diffMachine(name, desired, *known.Applied, current); differs {
+				plan.Changes = append(plan.Changes, change)
+			}
+		}
+	}
+
+	// Machines chop created that are no longer desired
+	for _, name := range slices.Sorted(maps.Keys(proj.Machines)) {
+		if _, desired := proj.Desired[name]; desired || proj.Machines[name].Applied == nil {
+			continue
+		}
+		if _, exists := live[name]; exists {
+			plan.Changes = append(plan.Changes, PlanChange{Action: PlanDelete, Machine: name})
+		} else {
+			plan.Changes = append(plan.Changes, PlanChange{Action: PlanForget, Machine: name,
+				Drift: []string{"deleted outside chop"}})
+		}
+	}
+	if len(proj.Desired) == 0 && !prune && plan.HasChanges() {
+		return Plan{}, fmt.Errorf("%w: %s/%s declares no desired machines, run 'chop apply --prune' to delete the %d machines chop created there",
+			inventory.ErrInvalid, account, project, len(plan.Changes))
+	}
+	return plan, nil
+}
+
+// diffMachine compares a managed live machine with its desired and last applied spec
+func diffMachine(name string, desired inventory.Template, applied inventory.Template, current inventory.Machine) (PlanChange, bool) {
+	change := PlanChange{Machine: name, Template: desired}
+
+	// Drift: the live machine no longer looks like what chop applied
+	if current.Zone != applied.Zone {
+		change.Drift = append(change.Drift, fmt.Sprintf("zone is %s, applied %s", current.Zone, applied.Zone))
+	}
+	if applied.MachineType != "" && current.MachineType != applied.MachineType {
+		change.Drift = append(change.Drift, fmt.Sprintf("machine type is %s, applied %s", current.MachineType, applied.MachineType))
+	}
+	for _, key := range slices.Sorted(maps.Keys(applied.Labels)) {
+		if value, ok := current.Labels[key]; !ok || value != applied.Labels[key] {
+			change.Drift = append(change.Drift, fmt.Sprintf("label %s is %q, applied %q", key, value, applied.Labels[key]))
+		}
+	}
+
+	// Properties that need a new machine
+	replace := []string{}
+	if desired.Zone != current.Zone {
+		replace = append(replace, fmt.Sprintf("zone %s -> %s", current.Zone, desired.Zone))
+	}
+	if desired.ImageFamily != applied.ImageFamily || desired.ImageProject != applied.ImageProject {
+		replace = append(replace, fmt.Sprintf("image %s/%s -> %s/%s", applied.ImageProject, applied.ImageFamily, desired.ImageProject, desired.ImageFamily))
+	}
+	if desired.DiskSizeGB != applied.DiskSizeGB {
+		replace = append(replace, fmt.Sprintf("disk %d GB -> %d GB", applied.DiskSizeGB, desired.DiskSizeGB))
+	}
+	if len(replace) > 0 {
+		change.Action = PlanReplace
+		change.Details = replace
+		return change, true
+	}
+
+	// Properties that change in place
+	if desired.MachineType != "" && desired.MachineType != current.MachineType {
+		change.Update.MachineType = desired.MachineType
+		detail := fmt.Sprintf("machine type %s -> %s", current.MachineType, desired.MachineType)
+		if current.Status == StatusRunning {
+			detail += " (stops and restarts the machine)"
+		}
+		change.Details = append(change.Details, detail)
+	}
+	for _, key := range slices.Sorted(maps.Keys(desired.Labels)) {
+		if value, ok := current.Labels[key]; !ok || value != desired.Labels[key] {
+			if change.Update.SetLabels == nil {
+				change.Update.SetLabels = make(map[string]string)
+			}
+			change.Update.SetLabels[key] = desired.Labels[key]
+			change.Details = append(change.Details, fmt.Sprintf("label %s=%s", key, desired.Labels[key]))
+		}
+	}
+	// Only remove labels chop set itself, others belong to someone else
+	for _, key := range slices.Sorted(maps.Keys(applied.Labels)) {
+		if _, keep := desired.Labels[key]; !keep {
+			if _, present := current.Labels[key]; present {
+				change.Update.RemoveLabels = append(change.Update.RemoveLabels, key)
+				change.Details = append(change.Details, "remove label "+key)
+			}
+		}
+	}
+
+	if len(change.Details) > 0 {
+		change.Action = PlanUpdate
+		return change, true
+	}
+	if len(change.Drift) > 0 || !templatesEqual(desired, applied) {
+		// Nothing to change in the cloud, but the recorded state has to catch up
+		change.Action = PlanUpdate
+		change.Details = []string{"record the desired spec as applied"}
+		return change, true
+	}
+	return change, false
+}
+
+// templatesEqual compares two templates including their labels
+func templatesEqual(a inventory.Template, b inventory.Template) bool {
+	return a.Zone == b.Zone && a.MachineType == b.MachineType && a.ImageFamily == b.ImageFamily &&
+		a.ImageProject == b.ImageProject && a.DiskSizeGB == b.DiskSizeGB && maps.Equal(a.Labels, b.Labels)
+}
+
+// ApplyPlan executes a plan through the provider and records the applied specs.
+// It continues after failures; report is called after every change with its outcome.
+func (c *Client) ApplyPlan(plan Plan, report func(change PlanChange, err error)) {
+	account, project := plan.Account, plan.Project
+	for _, change := range plan.Changes {
+		var err error
+		switch change.Action {
+		case PlanCreate:
+			err = c.applyCreate(account, project, change)
+		case PlanReplace:
+			err = c.applyReplace(account, project, change)
+		case PlanUpdate:
+			err = c.applyUpdate(account, project, change)
+		case PlanDelete:
+			err = c.DestroyMachine(account, project, change.Machine)
+		case PlanForget:
+			err = c.DeleteMachine(account, project, change.Machine)
+		case PlanSkip:
+			continue
+		}
+		report(change, err)
+	}
+}
+
+// applyCreate creates a desired machine and marks it as managed
+func (c *Client) applyCreate(account string, project string, change PlanChange) error {
+	machine, err := c.Provider.CreateMachine(account, project, change.Machine, change.Template)
+	if err != nil {
+		return err
+	}
+	if err := c.MergeMachines(account, project, []inventory.Machine{machine}); err != nil {
+		return err
+	}
+	return c.markApplied(account, project, change.Machine, change.Template)
+}
+
+// applyReplace deletes a managed machine and creates it again, keeping what people
+// recorded about it in the inventory: tags, aliases, notes and tunnels
+func (c *Client) applyReplace(account string, project string, change PlanChange) error {
+	old, err := c.GetMachine(account, project, change.Machine)
+	if err != nil {
+		return err
+	}
+	if err := c.DestroyMachine(account, project, change.Machine); err != nil {
+		return err
+	}
+	if err := c.applyCreate(account, project, change); err != nil {
+		return err
+	}
+	return c.UpdateMachine(account, project, change.Machine, func(m *inventory.Machine) {
+		m.Tags, m.Aliases, m.Notes, m.Tunnels = old.Tags, old.Aliases, old.Notes, old.Tunnels
+	})
+}
+
+// applyUpdate changes a managed machine in place and records the new spec
+func (c *Client) applyUpdate(account string, project string, change PlanChange) error {
+	update := change.Update
+	if update.MachineType != "" || len(update.SetLabels) > 0 || len(update.RemoveLabels) > 0 {
+		mach, err := c.RefreshMachine(account, project, change.Machine)
+		if err != nil {
+			return err
+		}
+		if err := c.Provider.UpdateMachine(account, project, mach, update); err != nil {
+			return err
+		}
+		if _, err := c.RefreshMachine(account, project, change.Machine); err != nil {
+			return err
+		}
+	}
+	return c.markApplied(account, project, change.Machine, change.Template)
+}
+
+// markApplied records the spec a machine was brought to
+func (c *Client) markApplied(account string, project string, machine string, template inventory.Template) error {
+	applied := template
+	if template.Labels != nil {
+		applied.Labels = maps.Clone(template.Labels)
+	}
+	return c.UpdateMachine(account, project, machine, func(m *inventory.Machine) {
+		m.Applied = &applied
+	})
+}
@@ -0,0 +1,176 @@
+package chop
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"palexus/chop/pkg/inventory"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeProvider serves a fixed list of live machines and records what chop asks it to do.
+// Operations a test does not expect panic on the nil Provider.
+type fakeProvider struct {
+	Provider
+	machines []inventory.Machine
+	failStop map[string]bool // Machines that fail to stop
+	mutex    sync.Mutex      // Batches call the provider concurrently
+	calls    []string
+}
+
+func (p *fakeProvider) record(call string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.calls = append(p.calls, call)
+}
+
+func (p *fakeProvider) ListMachines(account string, project string) ([]inventory.Machine, error) {
+	p.record("list " + account + "/" + project)
+	return p.machines, nil
+}
+
+func (p *fakeProvider) DescribeMachine(account string, project string, machine inventory.Machine) (inventory.Machine, error) {
+	p.record("describe " + machine.Name)
+	for _, live := range p.machines {
+		if live.Name == machine.Name {
+			return live, nil
+		}
+	}
+	return inventory.Machine{}, fmt.Errorf("%s was not found", machine.Name)
+}
+
+func (p *fakeProvider) StopMachine(account string, project string, machine inventory.Machine) error {
+	p.record("stop " + machine.Name)
+	if p.failStop[machine.Name] {
+		return fmt.Errorf("stopping %s failed", machine.Name)
+	}
+	return nil
+}
+
+// planTemplate is the spec most machines of TestPlanProject were applied with
+var planTemplate = inventory.Template{Zone: "europe-west3-a", MachineType: "e2-small", ImageFamily: "debian-12",
+	ImageProject: "debian-cloud", DiskSizeGB: 10, Labels: map[string]string{"env": "dev"}}
+
+// changed returns a copy of planTemplate changed by fn
+func changed(fn func(template *inventory.Template)) *inventory.Template {
+	template := planTemplate
+	template.Labels = maps.Clone(planTemplate.Labels)
+	fn(&template)
+	return &template
+}
+
+// liveMachine returns web-1 as the cloud lists it after template was applied, changed by fn
+func liveMachine(template inventory.Template, fn func(machine *inventory.Machine)) *inventory.Machine {
+	machine := inventory.Machine{Name: "web-1", Zone: template.Zone, MachineType: template.MachineType,
+		Status: StatusRunning, Labels: maps.Clone(template.Labels)}
+	fn(&machine)
+	return &machine
+}
+
+func TestPlanProject(t *testing.T) {
+	asIs := func(machine *inventory.Machine) {}
+	tests := []struct {
+		name        string
+		desired     *inventory.Template // nil if web-1 is not desired
+		inInventory bool
+		applied     *inventory.Template // nil if chop did not create web-1
+		live        *inventory.Machine  // nil if web-1 does not exist in the cloud
+		want        []PlanChange
+	}{
+		{"create", &planTemplate, false, nil, nil,
+			[]PlanChange{{Action: PlanCreate, Machine: "web-1", Template: planTemplate}}},
+		{"create after deleted outside chop", &planTemplate, true, &planTemplate, nil,
+			[]PlanChange{{Action: PlanCreate, Machine: "web-1", Template: planTemplate, Drift: []string{"deleted outside chop"}}}},
+		{"skip unmanaged", &planTemplate, true, nil, liveMachine(planTemplate, asIs),
+			[]PlanChange{{Action: PlanSkip, Machine: "web-1", Details: []string{"exists but was not created by chop, left untouched"}}}},
+		{"skip unknown", &planTemplate, false, nil, liveMachine(planTemplate, asIs),
+			[]PlanChange{{Action: PlanSkip, Machine: "web-1", Details: []string{"exists but was not created by chop, left untouched"}}}},
+		{"unchanged", &planTemplate, true, &planTemplate, liveMachine(planTemplate, asIs), []PlanChange{}},
+		{"update labels", changed(func(t *inventory.Template) { t.Labels = map[string]string{"env": "prod", "team": "web"} }),
+			true, &planTemplate, liveMachine(planTemplate, asIs),
+			[]PlanChange{{Action: PlanUpdate, Machine: "web-1",
+				Template: *changed(func(t *inventory.Template) { t.Labels = map[string]string{"env": "prod", "team": "web"} }),
+				Update:   MachineUpdate{SetLabels: map[string]string{"env": "prod", "team": "web"}},
+				Details:  []string{"label env=prod", "label team=web"}}}},
+		{"remove only labels chop set", changed(func(t *inventory.Template) { t.Labels = nil }),
+			true, &planTemplate, liveMachine(planTemplate, func(m *inventory.Machine) { m.Labels["owner"] = "ops" }),
+			[]PlanChange{{Action: PlanUpdate, Machine: "web-1", Template: *changed(func(t *inventory.Template) { t.Labels = nil }),
+				Update: MachineUpdate{RemoveLabels: []string{"env"}}, Details: []string{"remove label env"}}}},
+		{"update machine type", changed(func(t *inventory.Template) { t.MachineType = "e2-medium" }),
+			true, &planTemplate, liveMachine(planTemplate, asIs),
+			[]PlanChange{{Action: PlanUpdate, Machine: "web-1", Template: *changed(func(t *inventory.Template) { t.MachineType = "e2-medium" }),
+				Update: MachineUpdate{MachineType: "e2-medium"}, Details: []string{"machine type e2-small -> e2-medium (stops and restarts the machine)"}}}},
+		{"replace", changed(func(t *inventory.Template) { t.Zone = "europe-west3-b"; t.DiskSizeGB = 20 }),
+			true, &planTemplate, liveMachine(planTemplate, asIs),
+			[]PlanChange{{Action: PlanReplace, Machine: "web-1", Template: *changed(func(t *inventory.Template) { t.Zone = "europe-west3-b"; t.DiskSizeGB = 20 }),
+				Details: []string{"zone europe-west3-a -> europe-west3-b", "disk 10 GB -> 20 GB"}}}},
+		{"drift is brought back", &planTemplate, true, &planTemplate,
+			liveMachine(planTemplate, func(m *inventory.Machine) { m.MachineType = "e2-large"; m.Labels["env"] = "test" }),
+			[]PlanChange{{Action: PlanUpdate, Machine: "web-1", Template: planTemplate,
+				Update:  MachineUpdate{MachineType: "e2-small", SetLabels: map[string]string{"env": "dev"}},
+				Details: []string{"machine type e2-large -> e2-small (stops and restarts the machine)", "label env=dev"},
+				Drift:   []string{"machine type is e2-large, applied e2-small", `label env is "test", applied "dev"`}}}},
+		{"drift of the zone replaces", &planTemplate, true, &planTemplate,
+			liveMachine(planTemplate, func(m *inventory.Machine) { m.Zone = "europe-west3-c" }),
+			[]PlanChange{{Action: PlanReplace, Machine: "web-1", Template: planTemplate,
+				Details: []string{"zone europe-west3-c -> europe-west3-a"},
+				Drift:   []string{"zone is europe-west3-c, applied europe-west3-a"}}}},
+		{"record the desired spec", changed(func(t *inventory.Template) { t.MachineType = "" }),
+			true, &planTemplate, liveMachine(planTemplate, asIs),
+			[]PlanChange{{Action: PlanUpdate, Machine: "web-1", Template: *changed(func(t *inventory.Template) { t.MachineType = "" }),
+				Details: []string{"record the desired spec as applied"}}}},
+		{"delete", nil, true, &planTemplate, liveMachine(planTemplate, asIs),
+			[]PlanChange{{Action: PlanDelete, Machine: "web-1"}}},
+		{"forget", nil, true, &planTemplate, nil,
+			[]PlanChange{{Action: PlanForget, Machine: "web-1", Drift: []string{"deleted outside chop"}}}},
+		{"leave unmanaged machines alone", nil, true, nil, liveMachine(planTemplate, asIs), []PlanChange{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configs := inventory.NewConfiguration()
+			configs.AddAccount("acme")
+			configs.AddProjectToActiveAccount("acme", "web")
+			proj := configs.Accounts["acme"].Projects["web"]
+			if test.desired != nil {
+				proj.Desired = map[string]inventory.Template{"web-1": *test.desired}
+			}
+			if test.inInventory {
+				proj.Machines["web-1"] = inventory.Machine{Name: "web-1", Applied: test.applied}
+			}
+			configs.Accounts["acme"].Projects["web"] = proj
+			provider := &fakeProvider{}
+			if test.live != nil {
+				provider.machines = []inventory.Machine{*test.live}
+			}
+			client := &Client{Configuration: &configs, Provider: provider}
+
+			plan, err := client.PlanProject("acme", "web", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(plan.Changes, test.want) {
+				t.Errorf("changes:\n%+v\nwant:\n%+v", plan.Changes, test.want)
+			}
+		})
+	}
+}
+
+func TestPlanProjectRefusesDesiredMachinesWithoutZone(t *testing.T) {
+	configs := inventory.NewConfiguration()
+	configs.AddAccount("acme")
+	configs.AddProjectToActiveAccount("acme", "web")
+	proj := configs.Accounts["acme"].Projects["web"]
+	proj.Desired = map[string]inventory.Template{"web-1": planTemplate, "web-2": {MachineType: "e2-small"}}
+	configs.Accounts["acme"].Projects["web"] = proj
+	provider := &fakeProvider{}
+	client := &Client{Configuration: &configs, Provider: provider}
+
+	if _, err := client.PlanProject("acme", "web", false); !errors.Is(err, inventory.ErrInvalid) {
+		t.Errorf("err = %v, want ErrInvalid", err)
+	}
+	if len(provider.calls) > 0 {
+		t.Errorf("provider was called: %v", provider.calls)
+	}
+}
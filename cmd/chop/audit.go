@@ -0,0 +1,284 @@
+package chop
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions of audit entries besides the changes of the inventory, see inventory.Changes
+const (
+	ActionConnect = "Connect" // A session, tunnel, command, copy or proxy to a machine
+	ActionUndo    = "Undo"    // 'chop undo' replaced the configuration
+	ActionRestore = "Restore" // 'chop restore' replaced the configuration
+	ActionSync    = "Sync"    // 'chop config sync' merged the configuration with its Git remote
+)
+
+// JournalMaxSize is the size at which the journal is rotated
+const JournalMaxSize = 10 << 20
+
+// JournalFilesKept is how many rotated journals are kept besides the current one
+const JournalFilesKept = 5
+
+// AuditEntry is one line of the audit journal
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Host    string    `json:"host"`
+	Command string    `json:"command,omitempty"` // The command line of chop that did it
+	Action  string    `json:"action"`
+	Account string    `json:"account,omitempty"`
+	Project string    `json:"project,omitempty"`
+	Machine string    `json:"machine,omitempty"`
+	Fields  []string  `json:"fields,omitempty"` // The fields that changed, never their values
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// Journal appends audit entries to a JSONL file next to the configuration. A nil Journal
+// records nothing, e.g. for a configuration that is only kept in memory.
+type Journal struct {
+	Filename string
+	Command  string // The command line recorded with every entry
+	MaxSize  int64  // Rotate the file at this size, 0 never rotates
+}
+
+// JournalFile returns the audit journal next to the configuration file
+func JournalFile(filename string) string {
+	return filepath.Join(filepath.Dir(filename), "audit.jsonl")
+}
+
+// NewJournal returns the journal of a configuration file
+func NewJournal(filename string, command string) *Journal {
+	return &Journal{Filename: JournalFile(filename), Command: command, MaxSize: JournalMaxSize}
+}
+
+// Record appends an entry to the journal, filling in the time, user, host and command line
+func (journal *Journal) Record(entry AuditEntry) error {
+	if journal == nil {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Time = entry.Time.UTC()
+	entry.User = currentUser()
+	entry.Host, _ = os.Hostname()
+	entry.Command = journal.Command
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+
+	if err := journal.rotate(); err != nil {
+		return err
+	}
+	// The journal tells where the inventory leads to, keep it as private as the configuration
+	file, err := os.OpenFile(journal.Filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit journal: %w", err)
+	}
+	defer file.Close()
+	// One write per line, so that concurrent chops append whole lines
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit journal: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write audit journal: %w", err)
+	}
+	return nil
+}
+
+// RecordChanges records the changes of the inventory made by one save, detail tells what
+// made them if it was not the command itself, e.g. ActionUndo
+func (journal *Journal) RecordChanges(changes []inventory.Change, detail string) error {
+	now := time.Now()
+	for _, change := range changes {
+		err := journal.Record(AuditEntry{
+			Time:    now,
+			Action:  change.Action,
+			Account: change.Account,
+			Project: change.Project,
+			Machine: change.Machine,
+			Fields:  change.Fields,
+			Detail:  detail,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check makes sure entries can be appended, so that a change is only made when it can be
+// recorded afterwards
+func (journal *Journal) Check() error {
+	if journal == nil {
+		return nil
+	}
+	file, err := os.OpenFile(journal.Filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit journal: %w", err)
+	}
+	return file.Close()
+}
+
+// rotate moves a full journal to audit.jsonl.1, audit.jsonl.1 to audit.jsonl.2 and so on,
+// dropping the oldest beyond JournalFilesKept
+func (journal *Journal) rotate() error {
+	if journal.MaxSize <= 0 {
+		return nil
+	}
+	info, err := os.Stat(journal.Filename)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && info.Size() < journal.MaxSize) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read audit journal: %w", err)
+	}
+	for i := JournalFilesKept - 1; i >= 1; i-- {
+		err := os.Rename(rotatedJournal(journal.Filename, i), rotatedJournal(journal.Filename, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to rotate audit journal: %w", err)
+		}
+	}
+	if err := os.Rename(journal.Filename, rotatedJournal(journal.Filename, 1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to rotate audit journal: %w", err)
+	}
+	return nil
+}
+
+// rotatedJournal returns the name of the nth rotated journal, 1 being the newest
+func rotatedJournal(filename string, n int) string {
+	return filename + "." + strconv.Itoa(n)
+}
+
+// currentUser returns the login name of the user running chop
+func currentUser() string {
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return os.Getenv("USER")
+}
+
+// AuditFilter selects entries of the journal, empty fields match all entries
+type AuditFilter struct {
+	Account string
+	Project string
+	Machine string
+	Action  string // Matched ignoring case
+	Since   time.Time
+	Until   time.Time
+}
+
+// Matches reports whether an entry passes the filter
+func (filter AuditFilter) Matches(entry AuditEntry) bool {
+	switch {
+	case filter.Account != "" && entry.Account != filter.Account,
+		filter.Project != "" && entry.Project != filter.Project,
+		filter.Machine != "" && entry.Machine != filter.Machine,
+		filter.Action != "" && !strings.EqualFold(entry.Action, filter.Action),
+		!filter.Since.IsZero() && entry.Time.Before(filter.Since),
+		!filter.Until.IsZero() && entry.Time.After(filter.Until):
+		return false
+	}
+	return true
+}
+
+// ReadJournal returns the entries of the journal of a configuration file that pass the
+// filter, the oldest first, including the rotated journals
+func ReadJournal(filename string, filter AuditFilter) ([]AuditEntry, error) {
+	journal := JournalFile(filename)
+	files := []string{}
+	for i := JournalFilesKept; i >= 1; i-- {
+		files = append(files, rotatedJournal(journal, i))
+	}
+	files = append(files, journal)
+
+	entries := []AuditEntry{}
+	for _, file := range files {
+		read, err := readJournalFile(file, filter)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, read...)
+	}
+	return entries, nil
+}
+
+// readJournalFile returns the entries of one journal file that pass the filter
+func readJournalFile(filename string, filter AuditFilter) ([]AuditEntry, error) {
+	file, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit journal: %w", err)
+	}
+	defer file.Close()
+
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for number := 1; scanner.Scan(); number++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%w: audit journal %s line %d: %v", inventory.ErrInvalid, filename, number, err)
+		}
+		if filter.Matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit journal: %w", err)
+	}
+	return entries, nil
+}
+
+// AuditedProvider records every connection to a machine in the journal before it is made.
+// Commands whose connection cannot be recorded fail to start, so none goes unrecorded.
+type AuditedProvider struct {
+	Provider
+	Journal *Journal
+}
+
+// ConnectCommand records an interactive session
+func (p AuditedProvider) ConnectCommand(account string, project string, machine inventory.Machine) *exec.Cmd {
+	return p.record(p.Provider.ConnectCommand(account, project, machine), account, project, machine, "session")
+}
+
+// TunnelCommand records a tunnel
+func (p AuditedProvider) TunnelCommand(account string, project string, machine inventory.Machine, tunnel inventory.Tunnel) *exec.Cmd {
+	return p.record(p.Provider.TunnelCommand(account, project, machine, tunnel), account, project, machine, fmt.Sprintf("tunnel %d:%s", tunnel.LocalPort, tunnel.Remote()))
+}
+
+// RunCommand records a remote command
+func (p AuditedProvider) RunCommand(account string, project string, machine inventory.Machine, command string) *exec.Cmd {
+	return p.record(p.Provider.RunCommand(account, project, machine, command), account, project, machine, "exec "+command)
+}
+
+// CopyCommand records a copy
+func (p AuditedProvider) CopyCommand(account string, project string, machine inventory.Machine, transfer Transfer) *exec.Cmd {
+	return p.record(p.Provider.CopyCommand(account, project, machine, transfer), account, project, machine, "copy")
+}
+
+// record records a connection and makes cmd fail if it cannot be recorded
+func (p AuditedProvider) record(cmd *exec.Cmd, account string, project string, machine inventory.Machine, detail string) *exec.Cmd {
+	err := p.Journal.Record(AuditEntry{Action: ActionConnect, Account: account, Project: project, Machine: machine.Name, Detail: detail})
+	if err != nil && cmd != nil && cmd.Err == nil {
+		cmd.Err = fmt.Errorf("recording connection: %w", err)
+	}
+	return cmd
+}
@@ -0,0 +1,267 @@
+package chop
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SnapshotsKept is how many snapshots BackupDir keeps, older ones are removed
+const SnapshotsKept = 50
+
+// Snapshot is a copy of the configuration file taken before a command changed it
+type Snapshot struct {
+	ID      int
+	Time    time.Time
+	Command string // The command line that changed the configuration after the snapshot
+	Undo    bool   `json:",omitempty"` // Taken by 'chop undo', which never undoes its own snapshots
+}
+
+// BackupDir returns the directory of the snapshots next to the configuration file
+func BackupDir(filename string) string {
+	return filepath.Join(filepath.Dir(filename), "backups")
+}
+
+// snapshotFiles returns the copy and the description of a snapshot
+func snapshotFiles(dir string, id int) (copyFile string, infoFile string) {
+	base := filepath.Join(dir, strconv.Itoa(id))
+	return base + ".snapshot", base + ".json"
+}
+
+// Snapshots returns the snapshots of a configuration file, the newest first
+func Snapshots(filename string) ([]Snapshot, error) {
+	dir := BackupDir(filename)
+	infoFiles, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []Snapshot{}
+	for _, infoFile := range infoFiles {
+		content, err := os.ReadFile(infoFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot: %w", err)
+		}
+		var snapshot Snapshot
+		if err := json.Unmarshal(content, &snapshot); err != nil {
+			return nil, fmt.Errorf("%w: snapshot %s: %v", inventory.ErrInvalid, infoFile, err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID > snapshots[j].ID })
+	return snapshots, nil
+}
+
+// TakeSnapshot copies the configuration file before command changes it. Nothing is taken
+// when the file does not exist yet. The oldest snapshots beyond SnapshotsKept are removed.
+func TakeSnapshot(filename string, command string, now time.Time) (*Snapshot, error) {
+	content, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration: %w", err)
+	}
+	snapshots, err := Snapshots(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := Snapshot{ID: 1, Time: now, Command: command}
+	if len(snapshots) > 0 {
+		snapshot.ID = snapshots[0].ID + 1
+	}
+	dir := BackupDir(filename)
+	// The configuration may hold secrets, keep its copies private
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	if err := writeSnapshot(dir, snapshot, content); err != nil {
+		return nil, err
+	}
+
+	for _, old := range snapshots[min(len(snapshots), SnapshotsKept-1):] {
+		removeSnapshot(dir, old.ID)
+	}
+	return &snapshot, nil
+}
+
+// DropSnapshotIfUnchanged removes a snapshot when the configuration file is still what it
+// holds, i.e. the command did not change anything after all. It reports whether it did.
+func DropSnapshotIfUnchanged(filename string, snapshot Snapshot) bool {
+	dir := BackupDir(filename)
+	copyFile, _ := snapshotFiles(dir, snapshot.ID)
+	current, err := os.ReadFile(filename)
+	if err != nil {
+		return false
+	}
+	saved, err := os.ReadFile(copyFile)
+	if err != nil || !bytes.Equal(saved, current) {
+		return false
+	}
+	removeSnapshot(dir, snapshot.ID)
+	return true
+}
+
+// RestoreSnapshot replaces the configuration file by a snapshot. The current file is
+// snapshotted first, as changed by command, so that restoring can be undone in turn.
+func RestoreSnapshot(filename string, id int, command string, now time.Time) error {
+	dir := BackupDir(filename)
+	copyFile, _ := snapshotFiles(dir, id)
+	content, err := os.ReadFile(copyFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: snapshot %d does not exist", inventory.ErrInvalid, id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if _, err := TakeSnapshot(filename, command, now); err != nil {
+		return err
+	}
+	return replaceConfiguration(filename, content)
+}
+
+// Undo restores the newest snapshot that was not taken by an earlier undo and removes it,
+// so that undoing again goes back one more change. The current file is snapshotted first.
+// It returns the snapshot that was restored.
+func Undo(filename string, now time.Time) (Snapshot, error) {
+	snapshots, err := Snapshots(filename)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var last *Snapshot
+	for i := range snapshots {
+		if !snapshots[i].Undo {
+			last = &snapshots[i]
+			break
+		}
+	}
+	if last == nil {
+		return Snapshot{}, fmt.Errorf("%w: there is no change to undo", inventory.ErrInvalid)
+	}
+
+	dir := BackupDir(filename)
+	copyFile, _ := snapshotFiles(dir, last.ID)
+	content, err := os.ReadFile(copyFile)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	current, err := TakeSnapshot(filename, "chop undo ("+last.Command+")", now)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if current != nil {
+		current.Undo = true
+		if err := writeSnapshotInfo(dir, *current); err != nil {
+			return Snapshot{}, err
+		}
+	}
+	if err := replaceConfiguration(filename, content); err != nil {
+		return Snapshot{}, err
+	}
+	removeSnapshot(dir, last.ID)
+	return *last, nil
+}
+
+// RemoveSnapshots deletes all snapshots of a configuration file, e.g. because they hold it
+// unencrypted, and returns how many there were
+func RemoveSnapshots(filename string) (int, error) {
+	snapshots, err := Snapshots(filename)
+	if err != nil {
+		return 0, err
+	}
+	dir := BackupDir(filename)
+	for _, snapshot := range snapshots {
+		copyFile, infoFile := snapshotFiles(dir, snapshot.ID)
+		for _, file := range []string{copyFile, infoFile} {
+			if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return 0, fmt.Errorf("failed to remove snapshot: %w", err)
+			}
+		}
+	}
+	return len(snapshots), nil
+}
+
+// replaceConfiguration writes the content of a snapshot over the configuration file
+func replaceConfiguration(filename string, content []byte) error {
+	// Replace the file a link points to, like WriteYAMLFile does
+	target := filename
+	if resolved, err := filepath.EvalSymlinks(filename); err == nil {
+		target = resolved
+	}
+	temp, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+	if _, err := temp.Write(content); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if info, err := os.Stat(target); err == nil {
+		if err := os.Chmod(temp.Name(), info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to set permissions: %w", err)
+		}
+	}
+	if err := os.Rename(temp.Name(), target); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+
+	// The prompt state belongs to the replaced configuration, it is rebuilt on the next prompt
+	if err := os.Remove(PromptStateFile(filename)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove prompt state: %w", err)
+	}
+	return nil
+}
+
+// writeSnapshot stores the copy and the description of a snapshot
+func writeSnapshot(dir string, snapshot Snapshot, content []byte) error {
+	copyFile, _ := snapshotFiles(dir, snapshot.ID)
+	if err := os.WriteFile(copyFile, content, 0o600); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return writeSnapshotInfo(dir, snapshot)
+}
+
+// writeSnapshotInfo stores the description of a snapshot
+func writeSnapshotInfo(dir string, snapshot Snapshot) error {
+	_, infoFile := snapshotFiles(dir, snapshot.ID)
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(infoFile, content, 0o600); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// removeSnapshot deletes a snapshot, a snapshot that cannot be removed is only clutter
+func removeSnapshot(dir string, id int) {
+	copyFile, infoFile := snapshotFiles(dir, id)
+	_ = os.Remove(infoFile)
+	_ = os.Remove(copyFile)
+}
+
+// CommandLine formats the arguments chop was started with for the history
+func CommandLine(args []string) string {
+	words := []string{"chop"}
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"") {
+			arg = strconv.Quote(arg)
+		}
+		words = append(words, arg)
+	}
+	return strings.Join(words, " ")
+}
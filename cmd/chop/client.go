@@ -0,0 +1,47 @@
+package chop
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"palexus/chop/pkg/inventory"
+)
+
+// Client runs operations like connecting, starting or creating machines on the machines of
+// an inventory through a provider. Results such as status changes are recorded in the inventory.
+type Client struct {
+	*inventory.Configuration
+	Provider Provider
+	Journal  *Journal // Records connections that bypass the provider, like rsync
+
+	// Streams of sessions, copies and progress messages, nil for those of the process
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// attach connects a command to the streams of the client
+func (c *Client) attach(cmd *exec.Cmd) {
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = c.stdin(), c.stdout(), c.stderr()
+}
+
+func (c *Client) stdin() io.Reader {
+	if c.Stdin == nil {
+		return os.Stdin
+	}
+	return c.Stdin
+}
+
+func (c *Client) stdout() io.Writer {
+	if c.Stdout == nil {
+		return os.Stdout
+	}
+	return c.Stdout
+}
+
+func (c *Client) stderr() io.Writer {
+	if c.Stderr == nil {
+		return os.Stderr
+	}
+	return c.Stderr
+}
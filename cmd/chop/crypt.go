@@ -0,0 +1,32 @@
+package chop
+
+import (
+	"fmt"
+	"os"
+	"palexus/chop/pkg/inventory"
+)
+
+// KeysFromEnvironment returns the keys of encrypted configurations set in the environment:
+// the age key file in CHOP_AGE_KEY_FILE, or else the passphrase in CHOP_PASSPHRASE.
+// found is false when neither is set.
+func KeysFromEnvironment() (keys inventory.Keys, found bool, err error) {
+	if file := os.Getenv("CHOP_AGE_KEY_FILE"); file != "" {
+		keys, err = inventory.KeysFromFile(expandHome(file))
+		return keys, true, err
+	}
+	if passphrase := os.Getenv("CHOP_PASSPHRASE"); passphrase != "" {
+		keys, err = inventory.KeysFromPassphrase(passphrase)
+		return keys, true, err
+	}
+	return inventory.Keys{}, false, nil
+}
+
+// EnvironmentKeys is a KeySource that only takes the keys from the environment and never
+// asks, for commands that must not block, like prompts
+func EnvironmentKeys() (inventory.Keys, error) {
+	keys, found, err := KeysFromEnvironment()
+	if err == nil && !found {
+		err = fmt.Errorf("%w: set CHOP_AGE_KEY_FILE or CHOP_PASSPHRASE", inventory.ErrNoKey)
+	}
+	return keys, err
+}
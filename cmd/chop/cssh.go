@@ -0,0 +1,143 @@
+package chop
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"palexus/chop/pkg/inventory"
+	"regexp"
+	"strings"
+)
+
+// ClusterToggleKey toggles input synchronization after the tmux prefix
+const ClusterToggleKey = "S"
+
+// clusterWindowOption marks the tmux windows opened by ClusterSSH
+const clusterWindowOption = "@chop-cssh"
+
+// ClusterSSH opens a tmux window with one session per machine and synchronized input.
+// Inside tmux the window is added to the current session, otherwise a new session
+// is created and attached. It returns when the user detaches or all sessions end.
+func (c *Client) ClusterSSH(refs []inventory.MachineRef, session string) error {
+	if len(refs) == 0 {
+		return errors.New("no machines selected")
+	}
+	if _, err := exec.LookPath("tmux"); err != nil {
+		return errors.New("tmux is not installed")
+	}
+
+	panes := make([]string, len(refs))
+	for i, ref := range refs {
+		machine, err := c.ResolveMachine(ref.Account, ref.Project, ref.Machine)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ref, err)
+		}
+		panes[i] = shellJoin(c.Provider.ConnectCommand(ref.Account, ref.Project, machine).Args)
+	}
+
+	// Build everything in one tmux command list: the commands after new-window or
+	// new-session address the new window, and remain-on-exit is set before tmux
+	// notices sessions that end right away
+	insideTmux := os.Getenv("TMUX") != ""
+	var args []string
+	if insideTmux {
+		args = []string{"new-window", "-n", "cssh", panes[0]}
+	} else {
+		session = freeTmuxSession(session)
+		args = []string{"new-session", "-d", "-s", session, "-n", "cssh", panes[0]}
+	}
+	args = append(args,
+		// Keep ended sessions open to show why they ended
+		";", "set-window-option", "remain-on-exit", "on",
+		";", "set-window-option", "pane-border-status", "top",
+		";", "set-window-option", "pane-border-format", " #{pane_title} ",
+		";", "select-pane", "-T", refs[0].Machine,
+	)
+	for i := 1; i < len(refs); i++ {
+		args = append(args,
+			";", "split-window", panes[i],
+			";", "select-pane", "-T", refs[i].Machine,
+			// Re-tile after every split, otherwise tmux runs out of space for new panes
+			";", "select-layout", "tiled",
+		)
+	}
+	args = append(args,
+		";", "set-window-option", "synchronize-panes", "on",
+		";", "set-window-option", clusterWindowOption, "on",
+	)
+	args = append(args, toggleKeyBinding()...)
+	if _, err := runTmux(args...); err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		c.TouchMachine(ref.Account, ref.Project, ref.Machine)
+	}
+
+	if insideTmux {
+		return nil
+	}
+	attach := exec.Command("tmux", "attach-session", "-t", session)
+	c.attach(attach)
+	return attach.Run()
+}
+
+// toggleKeyBinding returns the tmux commands that bind ClusterToggleKey. Key bindings are
+// global to the tmux server, so the key only toggles the synchronization in windows marked
+// with clusterWindowOption and keeps doing what it did before everywhere else.
+func toggleKeyBinding() []string {
+	// Without a server or binding, list-keys fails and there is nothing to keep
+	previous, _ := runTmux("list-keys", "-T", "prefix", ClusterToggleKey)
+	if strings.Contains(previous, clusterWindowOption) {
+		return nil // Bound by an earlier run
+	}
+
+	args := []string{";", "bind-key", "-T", "prefix", ClusterToggleKey, "if-shell", "-F", "#{" + clusterWindowOption + "}",
+		"set-window-option synchronize-panes ; display-message 'input to all panes: #{?synchronize-panes,on,off}'"}
+	if match := boundCommand.FindStringSubmatch(previous); match != nil {
+		args = append(args, match[1])
+	}
+	return args
+}
+
+// boundCommand extracts the command of a 'tmux list-keys' line
+var boundCommand = regexp.MustCompile(`^bind-key\s+(?:-r\s+)?-T\s+prefix\s+\S+\s+(.+)$`)
+
+// freeTmuxSession returns name, or name with a number if a session of that name exists
+func freeTmuxSession(name string) string {
+	candidate := name
+	for i := 2; exec.Command("tmux", "has-session", "-t", "="+candidate).Run() == nil; i++ {
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+	return candidate
+}
+
+// runTmux executes a tmux command and returns its trimmed output. On failure the error carries tmux's stderr.
+func runTmux(args ...string) (string, error) {
+	cmd := exec.Command("tmux", args...)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("tmux %s failed: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("tmux %s failed: %w", args[0], err)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// shellJoin quotes arguments for sh, which tmux uses to start pane commands
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:@,%+") == "" {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,69 @@
+package chop
+
+import (
+	"os/exec"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tmuxServer starts a tmux server of its own and makes chop's tmux commands use it as if
+// they ran inside one of its windows
+func tmuxServer(t *testing.T) func(args ...string) string {
+	t.Helper()
+	if _, err := exec.LookPath("tmux"); err != nil {
+		t.Skip("tmux is not installed")
+	}
+	socket := filepath.Join(t.TempDir(), "tmux")
+	tmux := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("tmux", append([]string{"-S", socket}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("tmux %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	tmux("-f", "/dev/null", "new-session", "-d", "-s", "work", "-n", "work", "sleep 600")
+	t.Cleanup(func() { exec.Command("tmux", "-S", socket, "kill-server").Run() })
+	t.Setenv("TMUX", socket+",0,0")
+	return tmux
+}
+
+func TestClusterSSHToggleKey(t *testing.T) {
+	tmux := tmuxServer(t)
+	tmux("bind-key", "-T", "prefix", ClusterToggleKey, "choose-tree")
+
+	configs := inventory.NewConfiguration()
+	configs.AddAccount("acme")
+	configs.AddProjectToActiveAccount("acme", "lab")
+	refs := []inventory.MachineRef{}
+	for _, name := range []string{"lab-1", "lab-2"} {
+		configs.Accounts["acme"].Projects["lab"].Machines[name] = inventory.Machine{
+			Name: name, Transport: inventory.TransportSSH, SSH: inventory.SSHConfig{HostName: "127.0.0.1", Port: 1},
+		}
+		refs = append(refs, inventory.MachineRef{Account: "acme", Project: "lab", Machine: name})
+	}
+	client := &Client{Configuration: &configs, Provider: SSH{}}
+
+	// A second run must not wrap the binding of the first one
+	for run := 0; run < 2; run++ {
+		if err := client.ClusterSSH(refs, "chop-cssh"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	binding := tmux("list-keys", "-T", "prefix", ClusterToggleKey)
+	if !strings.Contains(binding, "#{"+clusterWindowOption+"}") || !strings.HasSuffix(binding, "choose-tree") {
+		t.Errorf("binding = %q, want the toggle in cssh windows and choose-tree elsewhere", binding)
+	}
+	if strings.Count(binding, clusterWindowOption) != 1 {
+		t.Errorf("binding = %q, want it bound once", binding)
+	}
+
+	windows := tmux("list-windows", "-a", "-F", "#{window_name} #{"+clusterWindowOption+"} #{synchronize-panes} #{window_panes}")
+	want := "work  0 1\ncssh on 1 2\ncssh on 1 2"
+	if windows != want {
+		t.Errorf("windows:\n%s\nwant:\n%s", windows, want)
+	}
+}
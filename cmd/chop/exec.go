@@ -0,0 +1,155 @@
+package chop
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"palexus/chop/pkg/inventory"
+	"sync"
+	"time"
+)
+
+// ExecResult is the outcome of a command on one machine
+type ExecResult struct {
+	Machine  inventory.MachineRef `json:"-"`         // Written as account/project/machine, see MarshalJSON
+	ExitCode int                  `json:"exit_code"` // -1 if the command could not be run at all
+	Duration time.Duration        `json:"-"`
+	Error    string               `json:"error,omitempty"`
+	Stdout   string               `json:"stdout,omitempty"` // Only collected without ExecOptions.Stream
+	Stderr   string               `json:"stderr,omitempty"`
+}
+
+// Failed reports whether the command did not succeed
+func (result ExecResult) Failed() bool {
+	return result.ExitCode != 0 || result.Error != ""
+}
+
+// MarshalJSON writes the machine as account/project/machine and the duration in seconds
+func (result ExecResult) MarshalJSON() ([]byte, error) {
+	type plain ExecResult
+	return json.Marshal(struct {
+		Machine string `json:"machine"`
+		plain
+		Duration float64 `json:"duration_seconds"`
+	}{result.Machine.String(), plain(result), result.Duration.Seconds()})
+}
+
+// ExecOptions control how Exec runs commands and reports their output.
+// The callbacks are never called concurrently.
+type ExecOptions struct {
+	Parallel int                                                          // Maximum number of machines at once, 0 means all
+	Stream   func(machine inventory.MachineRef, stderr bool, line string) // Receives output lines as they arrive
+	Done     func(result ExecResult)                                      // Receives each result when its machine finishes
+}
+
+// Exec runs a shell command on machines concurrently and records their usage.
+// The results are returned in the order of refs.
+func (c *Client) Exec(refs []inventory.MachineRef, command string, options ExecOptions) ([]ExecResult, error) {
+	// Resolve up front, the configuration is not touched while commands run
+	cmds := make([]*exec.Cmd, len(refs))
+	for i, ref := range refs {
+		machine, err := c.ResolveMachine(ref.Account, ref.Project, ref.Machine)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ref, err)
+		}
+		cmds[i] = c.Provider.RunCommand(ref.Account, ref.Project, machine, command)
+	}
+
+	parallel := options.Parallel
+	if parallel <= 0 || parallel > len(refs) {
+		parallel = len(refs)
+	}
+
+	var report sync.Mutex
+	slots := make(chan struct{}, parallel)
+	results := make([]ExecResult, len(refs))
+	var wg sync.WaitGroup
+	for i := range refs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			results[i] = runOne(refs[i], cmds[i], options.Stream, &report)
+			if options.Done != nil {
+				report.Lock()
+				options.Done(results[i])
+				report.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if result.ExitCode != -1 {
+			c.TouchMachine(result.Machine.Account, result.Machine.Project, result.Machine.Machine)
+		}
+	}
+	return results, nil
+}
+
+// runOne runs the command of one machine, streaming or collecting its output
+func runOne(ref inventory.MachineRef, cmd *exec.Cmd, stream func(inventory.MachineRef, bool, string), report *sync.Mutex) ExecResult {
+	result := ExecResult{Machine: ref}
+	var stdout, stderr bytes.Buffer
+	var pipes sync.WaitGroup
+
+	if stream == nil {
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+	} else {
+		for _, isStderr := range []bool{false, true} {
+			reader, writer := io.Pipe()
+			if isStderr {
+				cmd.Stderr = writer
+			} else {
+				cmd.Stdout = writer
+			}
+			pipes.Add(1)
+			go func() {
+				defer pipes.Done()
+				scanner := bufio.NewScanner(reader)
+				scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+				for scanner.Scan() {
+					report.Lock()
+					stream(ref, isStderr, scanner.Text())
+					report.Unlock()
+				}
+				// Keep draining after an overlong line so the command does not block
+				io.Copy(io.Discard, reader)
+			}()
+		}
+	}
+
+	start := time.Now()
+	err := cmd.Run()
+	result.Duration = time.Since(start)
+
+	// Close the pipes to let the readers finish before the result is reported
+	if closer, ok := cmd.Stdout.(io.Closer); ok {
+		closer.Close()
+	}
+	if closer, ok := cmd.Stderr.(io.Closer); ok {
+		closer.Close()
+	}
+	pipes.Wait()
+
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitCode()
+	default:
+		result.ExitCode = -1
+		result.Error = err.Error()
+	}
+	return result
+}
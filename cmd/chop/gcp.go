@@ -3,22 +3,24 @@ package chop
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"os/exec"
+	"palexus/chop/pkg/inventory"
+	"path"
+	"sort"
 	"strings"
 )
 
-var configFile = "/Users/alexanderpreis/Projects/infologistix/cloudHopper/chop.yaml"
-
-func (config *Configuration) ReadAccounts() {
+// FetchAccounts adds the accounts of the local gcloud configurations and returns their names, sorted
+func (c *Client) FetchAccounts() ([]string, error) {
 	// Execute the gcloud command
 	cmd := exec.Command("gcloud", "config", "configurations", "list")
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	err := cmd.Run()
 	if err != nil {
-		fmt.Println("Error executing gcloud command:", err)
-		return
+		return nil, &CommandError{"gcloud config configurations list", "", err}
 	}
 
 	// Parse the output
@@ -42,28 +44,32 @@ func (config *Configuration) ReadAccounts() {
 
 	// Check for scanner errors
 	if err := scanner.Err(); err != nil {
-		fmt.Println("Error reading command output:", err)
-		return
+		return nil, fmt.Errorf("failed to read gcloud output: %w", err)
 	}
 
 	// Add accounts to chop
+	names := make([]string, 0, len(accounts))
 	for account := range accounts {
-		config.AddAccount(account)
-		fmt.Println("Adding account:", account)
+		c.AddAccount(account)
+		names = append(names, account)
 	}
-
-	config.SaveConfigurationToYAML(configFile)
+	sort.Strings(names)
+	return names, nil
 }
 
-func (config *Configuration) ReadProjects(account string) {
+// FetchProjects adds the projects gcloud can see to an account and returns their names, sorted
+func (c *Client) FetchProjects(account string) ([]string, error) {
+	if _, exists := c.Accounts[account]; !exists {
+		return nil, fmt.Errorf("%w: %s", inventory.ErrAccountNotFound, account)
+	}
+
 	// Execute the gcloud command
 	cmd := exec.Command("gcloud", "projects", "list")
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	err := cmd.Run()
 	if err != nil {
-		fmt.Println("Error executing gcloud command:", err)
-		return
+		return nil, &CommandError{"gcloud projects list", "", err}
 	}
 
 	// Parse the output
@@ -87,15 +93,368 @@ func (config *Configuration) ReadProjects(account string) {
 
 	// Check for scanner errors
 	if err := scanner.Err(); err != nil {
-		fmt.Println("Error reading command output:", err)
-		return
+		return nil, fmt.Errorf("failed to read gcloud output: %w", err)
 	}
 
 	// Add projects to chop
+	names := make([]string, 0, len(projects))
 	for project := range projects {
-		config.AddProjectToActiveAccount(account, project)
-		fmt.Println("Adding project:", project)
+		if err := c.AddProjectToActiveAccount(account, project); err != nil {
+			return nil, err
+		}
+		names = append(names, project)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// gcpInstance is the subset of 'gcloud compute instances list/describe --format=json' that chop uses
+type gcpInstance struct {
+	Name              string            `json:"name"`
+	Zone              string            `json:"zone"` // Full resource URL, the zone name is the last segment
+	Status            string            `json:"status"`
+	MachineType       string            `json:"machineType"` // Full resource URL as well
+	Labels            map[string]string `json:"labels"`
+	NetworkInterfaces []struct {
+		NetworkIP     string `json:"networkIP"`
+		AccessConfigs []struct {
+			NatIP string `json:"natIP"`
+		} `json:"accessConfigs"`
+	} `json:"networkInterfaces"`
+}
+
+// ips returns the internal and external IP of the first network interface and whether it has
+// external access at all. A stopped machine with an ephemeral IP has an access config but no IP.
+func (instance gcpInstance) ips() (internal string, external string, hasExternal bool) {
+	if len(instance.NetworkInterfaces) == 0 {
+		return "", "", false
+	}
+	nic := instance.NetworkInterfaces[0]
+	if len(nic.AccessConfigs) > 0 {
+		return nic.NetworkIP, nic.AccessConfigs[0].NatIP, true
+	}
+	return nic.NetworkIP, "", false
+}
+
+// machine converts the instance into a Machine with zone, status and IPs
+func (instance gcpInstance) machine() inventory.Machine {
+	internalIP, externalIP, external := instance.ips()
+	return inventory.Machine{
+		Name:        instance.Name,
+		Zone:        path.Base(instance.Zone),
+		Status:      instance.Status,
+		InternalIP:  internalIP,
+		ExternalIP:  externalIP,
+		External:    external,
+		MachineType: path.Base(instance.MachineType),
+		Labels:      instance.Labels,
+	}
+}
+
+// FetchMachines adds or refreshes the instances of a project.
+// Known machines keep their usage history, tags and notes.
+func (c *Client) FetchMachines(account string, project string) ([]inventory.Machine, error) {
+	if _, err := c.GetProject(account, project); err != nil {
+		return nil, err
+	}
+
+	machines, err := c.Provider.ListMachines(account, project)
+	if err != nil {
+		return nil, err
+	}
+	return machines, c.MergeMachines(account, project, machines)
+}
+
+// ConnectCommand builds the SSH command for a machine without running it
+func (c *Client) ConnectCommand(account string, project string, machine string) (*exec.Cmd, error) {
+	mach, err := c.ResolveMachine(account, project, machine)
+	if err != nil {
+		return nil, err
+	}
+	return c.Provider.ConnectCommand(account, project, mach), nil
+}
+
+// Connect opens an interactive SSH session to a machine and records its usage
+func (c *Client) Connect(account string, project string, machine string) error {
+	cmd, err := c.ConnectCommand(account, project, machine)
+	if err != nil {
+		return err
+	}
+	c.attach(cmd)
+
+	if err := cmd.Run(); err != nil {
+		return &CommandError{"ssh session", "", err}
+	}
+	return c.TouchMachine(account, project, machine)
+}
+
+// StartMachine starts a stopped instance and records its new status
+func (c *Client) StartMachine(account string, project string, machine string) error {
+	mach, err := c.ResolveMachine(account, project, machine)
+	if err != nil {
+		return err
+	}
+	if err := c.Provider.StartMachine(account, project, mach); err != nil {
+		return err
+	}
+	return c.SetMachineStatus(account, project, machine, StatusRunning)
+}
+
+// StopMachine stops a running instance and records its new status
+func (c *Client) StopMachine(account string, project string, machine string) error {
+	mach, err := c.ResolveMachine(account, project, machine)
+	if err != nil {
+		return err
+	}
+	if err := c.Provider.StopMachine(account, project, mach); err != nil {
+		return err
+	}
+	return c.SetMachineStatus(account, project, machine, StatusTerminated)
+}
+
+// GCP is the Provider backed by the gcloud CLI
+type GCP struct{}
+
+var _ Provider = GCP{}
+
+// ListMachines lists the instances of a project with their zone and status
+func (GCP) ListMachines(account string, project string) ([]inventory.Machine, error) {
+	out, err := runGcloud("compute", "instances", "list",
+		"--account", account, "--project", project, "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the output
+	var instances []gcpInstance
+	if err := json.Unmarshal(out, &instances); err != nil {
+		return nil, fmt.Errorf("failed to parse gcloud output: %w", err)
+	}
+
+	machines := make([]inventory.Machine, 0, len(instances))
+	for _, instance := range instances {
+		machines = append(machines, instance.machine())
+	}
+	return machines, nil
+}
+
+// DescribeMachine runs 'gcloud compute instances describe'. Machines without a known
+// zone are looked up in the instance list instead, describe would ask for the zone.
+func (gcp GCP) DescribeMachine(account string, project string, machine inventory.Machine) (inventory.Machine, error) {
+	if machine.Zone == "" {
+		machines, err := gcp.ListMachines(account, project)
+		if err != nil {
+			return inventory.Machine{}, err
+		}
+		for _, listed := range machines {
+			if listed.Name == machine.Name {
+				return listed, nil
+			}
+		}
+		return inventory.Machine{}, fmt.Errorf("instance %s not found in project %s", machine.Name, project)
+	}
+
+	args := append([]string{"compute", "instances", "describe", machine.Name}, gcloudMachineFlags(account, project, machine)...)
+	out, err := runGcloud(append(args, "--format=json")...)
+	if err != nil {
+		return inventory.Machine{}, err
+	}
+	var instance gcpInstance
+	if err := json.Unmarshal(out, &instance); err != nil {
+		return inventory.Machine{}, fmt.Errorf("failed to parse gcloud output: %w", err)
+	}
+	return instance.machine(), nil
+}
+
+// StartMachine runs 'gcloud compute instances start'
+func (GCP) StartMachine(account string, project string, machine inventory.Machine) error {
+	args := append([]string{"compute", "instances", "start", machine.Name}, gcloudMachineFlags(account, project, machine)...)
+	_, err := runGcloud(append(args, "--quiet")...)
+	return err
+}
+
+// StopMachine runs 'gcloud compute instances stop'
+func (GCP) StopMachine(account string, project string, machine inventory.Machine) error {
+	args := append([]string{"compute", "instances", "stop", machine.Name}, gcloudMachineFlags(account, project, machine)...)
+	_, err := runGcloud(append(args, "--quiet")...)
+	return err
+}
+
+// CreateMachine runs 'gcloud compute instances create'
+func (GCP) CreateMachine(account string, project string, name string, template inventory.Template) (inventory.Machine, error) {
+	args := []string{"compute", "instances", "create", name, "--account", account, "--project", project, "--zone", template.Zone}
+	if template.MachineType != "" {
+		args = append(args, "--machine-type", template.MachineType)
+	}
+	if template.ImageFamily != "" {
+		args = append(args, "--image-family", template.ImageFamily)
+	}
+	if template.ImageProject != "" {
+		args = append(args, "--image-project", template.ImageProject)
+	}
+	if template.DiskSizeGB != 0 {
+		args = append(args, fmt.Sprintf("--boot-disk-size=%dGB", template.DiskSizeGB))
+	}
+	if len(template.Labels) > 0 {
+		labels := make([]string, 0, len(template.Labels))
+		for key, value := range template.Labels {
+			labels = append(labels, key+"="+value)
+		}
+		sort.Strings(labels)
+		args = append(args, "--labels", strings.Join(labels, ","))
+	}
+
+	out, err := runGcloud(append(args, "--format=json")...)
+	if err != nil {
+		return inventory.Machine{}, err
+	}
+	var instances []gcpInstance
+	if err := json.Unmarshal(out, &instances); err != nil || len(instances) == 0 {
+		return inventory.Machine{}, fmt.Errorf("failed to parse gcloud output: %v", err)
+	}
+	return instances[0].machine(), nil
+}
+
+// DeleteMachine runs 'gcloud compute instances delete'
+func (GCP) DeleteMachine(account string, project string, machine inventory.Machine) error {
+	args := append([]string{"compute", "instances", "delete", machine.Name}, gcloudMachineFlags(account, project, machine)...)
+	_, err := runGcloud(append(args, "--quiet")...)
+	return err
+}
+
+// UpdateMachine changes labels with 'gcloud compute instances update' and the machine type with
+// 'gcloud compute instances set-machine-type'. Running machines are stopped for the type change
+// and started again.
+func (gcp GCP) UpdateMachine(account string, project string, machine inventory.Machine, update MachineUpdate) error {
+	flags := gcloudMachineFlags(account, project, machine)
+	if len(update.SetLabels) > 0 || len(update.RemoveLabels) > 0 {
+		args := append([]string{"compute", "instances", "update", machine.Name}, flags...)
+		if len(update.SetLabels) > 0 {
+			labels := make([]string, 0, len(update.SetLabels))
+			for key, value := range update.SetLabels {
+				labels = append(labels, key+"="+value)
+			}
+			sort.Strings(labels)
+			args = append(args, "--update-labels", strings.Join(labels, ","))
+		}
+		if len(update.RemoveLabels) > 0 {
+			args = append(args, "--remove-labels", strings.Join(update.RemoveLabels, ","))
+		}
+		if _, err := runGcloud(args...); err != nil {
+			return err
+		}
+	}
+
+	if update.MachineType == "" {
+		return nil
+	}
+	running := machine.Status == StatusRunning
+	if running {
+		if err := gcp.StopMachine(account, project, machine); err != nil {
+			return err
+		}
+	}
+	args := append([]string{"compute", "instances", "set-machine-type", machine.Name}, flags...)
+	if _, err := runGcloud(append(args, "--machine-type", update.MachineType)...); err != nil {
+		return err
 	}
+	if running {
+		return gcp.StartMachine(account, project, machine)
+	}
+	return nil
+}
+
+// ResetMachine runs 'gcloud compute instances reset'
+func (GCP) ResetMachine(account string, project string, machine inventory.Machine) error {
+	args := append([]string{"compute", "instances", "reset", machine.Name}, gcloudMachineFlags(account, project, machine)...)
+	_, err := runGcloud(append(args, "--quiet")...)
+	return err
+}
+
+// ConnectCommand builds 'gcloud compute ssh' for a machine, using machine.Transport
+func (GCP) ConnectCommand(account string, project string, machine inventory.Machine) *exec.Cmd {
+	args := append([]string{"compute", "ssh", machine.Name}, gcloudMachineFlags(account, project, machine)...)
+	args = append(args, gcloudTransportFlags(machine)...)
+	return exec.Command("gcloud", args...)
+}
+
+// TunnelCommand builds 'gcloud compute start-iap-tunnel' for IAP tunnels
+// and a port forwarding 'gcloud compute ssh' for all others
+func (GCP) TunnelCommand(account string, project string, machine inventory.Machine, tunnel inventory.Tunnel) *exec.Cmd {
+	flags := gcloudMachineFlags(account, project, machine)
+	if tunnel.IAP {
+		args := []string{"compute", "start-iap-tunnel", machine.Name, fmt.Sprint(tunnel.RemotePort),
+			fmt.Sprintf("--local-host-port=localhost:%d", tunnel.LocalPort)}
+		return exec.Command("gcloud", append(args, flags...)...)
+	}
+
+	args := append([]string{"compute", "ssh", machine.Name}, flags...)
+	args = append(args, gcloudTransportFlags(machine)...)
+	args = append(args, "--", "-N", "-o", "ExitOnForwardFailure=yes",
+		"-L", fmt.Sprintf("%d:%s", tunnel.LocalPort, tunnel.Remote()))
+	return exec.Command("gcloud", args...)
+}
+
+// ProxyCommand pipes through 'gcloud compute start-iap-tunnel' for IAP machines, all others are dialed directly
+func (GCP) ProxyCommand(account string, project string, machine inventory.Machine, port int) *exec.Cmd {
+	if machine.Transport != inventory.TransportIAP {
+		return nil
+	}
+	args := []string{"compute", "start-iap-tunnel", machine.Name, fmt.Sprint(port), "--listen-on-stdin"}
+	return exec.Command("gcloud", append(args, gcloudMachineFlags(account, project, machine)...)...)
+}
 
-	config.SaveConfigurationToYAML(configFile)
+// RunCommand builds the 'gcloud compute ssh --command' command for a machine. Like for plain
+// SSH machines, BatchMode keeps parallel runs from waiting for passwords nobody can type.
+func (GCP) RunCommand(account string, project string, machine inventory.Machine, command string) *exec.Cmd {
+	args := append([]string{"compute", "ssh", machine.Name}, gcloudMachineFlags(account, project, machine)...)
+	args = append(args, gcloudTransportFlags(machine)...)
+	args = append(args, "--ssh-flag=-T", "--ssh-flag=-o BatchMode=yes")
+	return exec.Command("gcloud", append(args, "--command", command)...)
+}
+
+// CopyCommand builds the 'gcloud compute scp' command for a transfer
+func (GCP) CopyCommand(account string, project string, machine inventory.Machine, transfer Transfer) *exec.Cmd {
+	args := append([]string{"compute", "scp"}, gcloudMachineFlags(account, project, machine)...)
+	args = append(args, gcloudTransportFlags(machine)...)
+	if transfer.Recursive {
+		args = append(args, "--recurse")
+	}
+	remote := machine.Name
+	if machine.SSH.User != "" {
+		remote = machine.SSH.User + "@" + remote
+	}
+	return exec.Command("gcloud", append(args, transfer.paths(remote)...)...)
+}
+
+// gcloudMachineFlags returns the flags that address a machine with gcloud
+func gcloudMachineFlags(account string, project string, machine inventory.Machine) []string {
+	flags := []string{"--account", account, "--project", project}
+	if machine.Zone != "" {
+		flags = append(flags, "--zone", machine.Zone)
+	}
+	return flags
+}
+
+// gcloudTransportFlags returns the 'gcloud compute ssh' flags for the machine's transport
+func gcloudTransportFlags(machine inventory.Machine) []string {
+	switch machine.Transport {
+	case inventory.TransportInternal:
+		return []string{"--internal-ip"}
+	case inventory.TransportIAP:
+		return []string{"--tunnel-through-iap"}
+	}
+	return nil
+}
+
+// runGcloud executes gcloud and returns its stdout. On failure the error carries gcloud's stderr.
+func runGcloud(args ...string) ([]byte, error) {
+	cmd := exec.Command("gcloud", args...)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, &CommandError{"gcloud " + strings.Join(args[:2], " "), strings.TrimSpace(stderr.String()), err}
+	}
+	return out.Bytes(), nil
 }
@@ -0,0 +1,18 @@
+package chop
+
+import (
+	"palexus/chop/pkg/inventory"
+	"strings"
+	"testing"
+)
+
+func TestGCPRunCommand(t *testing.T) {
+	machine := inventory.Machine{Name: "web-1", Zone: "europe-west3-a", Transport: inventory.TransportIAP}
+	cmd := GCP{}.RunCommand("me@example.com", "web", machine, "uptime")
+
+	want := "gcloud compute ssh web-1 --account me@example.com --project web --zone europe-west3-a --tunnel-through-iap " +
+		"--ssh-flag=-T --ssh-flag=-o BatchMode=yes --command uptime"
+	if got := strings.Join(cmd.Args, " "); got != want {
+		t.Errorf("command = %s\nwant      %s", got, want)
+	}
+}
@@ -0,0 +1,130 @@
+package chop
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"time"
+)
+
+// IdleMachine is a running machine that nobody used recently
+type IdleMachine struct {
+	Machine   inventory.MachineRef `json:"-"`
+	LastUsage time.Time            `json:"last_usage"` // Zero if chop never used it
+	IdleDays  int                  `json:"idle_days"`  // Days since the last usage, -1 for never
+	Zone      string               `json:"zone,omitempty"`
+	Stopped   bool                 `json:"stopped"` // Whether the report run stopped it
+	Error     string               `json:"error,omitempty"`
+}
+
+// MarshalJSON writes the machine as account/project/machine
+func (idle IdleMachine) MarshalJSON() ([]byte, error) {
+	type plain IdleMachine
+	return json.Marshal(struct {
+		Machine string `json:"machine"`
+		plain
+	}{idle.Machine.String(), plain(idle)})
+}
+
+// IdleReport lists the running machines without recent usage
+type IdleReport struct {
+	Generated time.Time     `json:"generated"`
+	Days      int           `json:"days"`
+	Machines  []IdleMachine `json:"machines"`
+	Unchecked []string      `json:"unchecked,omitempty"` // Machines whose status could not be checked, with the reason
+	Unknown   []string      `json:"unknown,omitempty"`   // Running machines chop has no usage of, left out of Machines
+}
+
+// CloudMachines keeps the machines managed by a cloud, plain SSH machines have no status to check
+func (c *Client) CloudMachines(refs []inventory.MachineRef) []inventory.MachineRef {
+	cloud := []inventory.MachineRef{}
+	for _, ref := range refs {
+		machine, err := c.ResolveMachine(ref.Account, ref.Project, ref.Machine)
+		if err == nil && machine.Transport != inventory.TransportSSH {
+			cloud = append(cloud, ref)
+		}
+	}
+	return cloud
+}
+
+// IdleMachines checks the live status of machines and reports those that are RUNNING but were not
+// used for the given number of days. Usage is what chop records on connect, exec, cp, proxy and
+// the like; a tunnel that is up counts as usage, too. tunnelDir is where tunnel states are kept.
+// A machine without any recorded usage may be used every day without chop, so it is only
+// listed as unknown, unless neverUsed counts it as idle.
+func (c *Client) IdleMachines(refs []inventory.MachineRef, days int, neverUsed bool, tunnelDir string, now time.Time) IdleReport {
+	report := IdleReport{Generated: now, Days: days, Machines: []IdleMachine{}}
+	threshold := now.AddDate(0, 0, -days)
+
+	for _, result := range c.RefreshMachines(c.CloudMachines(refs)) {
+		ref := result.Machine
+		if result.Err != nil {
+			report.Unchecked = append(report.Unchecked, fmt.Sprintf("%s: %v", ref, result.Err))
+			continue
+		}
+		if result.Status != StatusRunning || c.tunnelUp(ref, tunnelDir) {
+			continue
+		}
+
+		machine, _ := c.GetMachine(ref.Account, ref.Project, ref.Machine)
+		if machine.LastUsage.IsZero() && !neverUsed {
+			report.Unknown = append(report.Unknown, ref.String())
+			continue
+		}
+		if machine.LastUsage.After(threshold) {
+			continue
+		}
+		idle := IdleMachine{Machine: ref, LastUsage: machine.LastUsage, IdleDays: -1, Zone: machine.Zone}
+		if !machine.LastUsage.IsZero() {
+			idle.IdleDays = int(now.Sub(machine.LastUsage).Hours() / 24)
+		}
+		report.Machines = append(report.Machines, idle)
+	}
+	return report
+}
+
+// tunnelUp reports whether any tunnel of a machine is running
+func (c *Client) tunnelUp(ref inventory.MachineRef, tunnelDir string) bool {
+	for _, tunnel := range c.Tunnels(ref.Account, ref.Project, ref.Machine) {
+		if state, err := ReadTunnelState(tunnelDir, tunnel); err == nil && state.Running() {
+			return true
+		}
+	}
+	return false
+}
+
+// StopIdle stops the machines of a report and records the outcome in it
+func (c *Client) StopIdle(report *IdleReport) {
+	refs := make([]inventory.MachineRef, len(report.Machines))
+	for i, idle := range report.Machines {
+		refs[i] = idle.Machine
+	}
+	for i, result := range c.StopMachines(refs) {
+		if result.Err != nil {
+			report.Machines[i].Error = result.Err.Error()
+			continue
+		}
+		report.Machines[i].Stopped = true
+	}
+}
+
+// Write stores the report as JSON, replacing the file atomically
+func (report IdleReport) Write(filename string) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("failed to replace report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package chop
+
+import (
+	"os"
+	"palexus/chop/pkg/inventory"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestIdleMachines(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	configs := inventory.NewConfiguration()
+	configs.AddAccount("acme")
+	configs.AddProjectToActiveAccount("acme", "web")
+	machines := []inventory.Machine{
+		{Name: "busy", LastUsage: now.Add(-2 * time.Hour)},
+		{Name: "fresh"}, // Running, but never used with chop
+		{Name: "gone", LastUsage: now.AddDate(0, 0, -30)},
+		{Name: "idle", LastUsage: now.AddDate(0, 0, -10)},
+		{Name: "plain", LastUsage: now.AddDate(0, 0, -30), Transport: inventory.TransportSSH, SSH: inventory.SSHConfig{HostName: "10.1.2.3"}},
+		{Name: "stopped", LastUsage: now.AddDate(0, 0, -30)},
+		{Name: "tunneled", LastUsage: now.AddDate(0, 0, -30), Tunnels: map[string]inventory.Tunnel{"pg": {LocalPort: 5432, RemoteHost: "localhost", RemotePort: 5432}}},
+		{Name: "week-old", LastUsage: now.AddDate(0, 0, -7)},
+	}
+	refs := []inventory.MachineRef{}
+	for _, machine := range machines {
+		configs.Accounts["acme"].Projects["web"].Machines[machine.Name] = machine
+		refs = append(refs, inventory.MachineRef{Account: "acme", Project: "web", Machine: machine.Name})
+	}
+
+	// The tunnel of tunneled is up as long as this test runs
+	tunnelDir := t.TempDir()
+	tunnel := configs.Tunnels("acme", "web", "tunneled")[0]
+	if err := SaveTunnelState(tunnelDir, TunnelState{TunnelRef: tunnel, PID: os.Getpid()}); err != nil {
+		t.Fatal(err)
+	}
+
+	live := []inventory.Machine{}
+	for _, machine := range machines {
+		switch machine.Name {
+		case "gone", "plain":
+		case "stopped":
+			live = append(live, inventory.Machine{Name: machine.Name, Status: StatusTerminated})
+		default:
+			live = append(live, inventory.Machine{Name: machine.Name, Status: StatusRunning})
+		}
+	}
+
+	tests := []struct {
+		name      string
+		days      int
+		neverUsed bool
+		idle      map[string]int // Idle days by machine
+		unknown   []string
+	}{
+		{"a week", 7, false, map[string]int{"idle": 10, "week-old": 7}, []string{"acme/web/fresh"}},
+		{"never used counts", 7, true, map[string]int{"fresh": -1, "idle": 10, "week-old": 7}, nil},
+		{"a day", 1, false, map[string]int{"idle": 10, "week-old": 7}, []string{"acme/web/fresh"}},
+		{"two weeks", 14, false, map[string]int{}, []string{"acme/web/fresh"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checked, err := configs.Clone()
+			if err != nil {
+				t.Fatal(err)
+			}
+			provider := &fakeProvider{machines: live}
+			client := &Client{Configuration: &checked, Provider: provider}
+
+			report := client.IdleMachines(refs, test.days, test.neverUsed, tunnelDir, now)
+			idle := map[string]int{}
+			for _, machine := range report.Machines {
+				idle[machine.Machine.Machine] = machine.IdleDays
+			}
+			if !reflect.DeepEqual(idle, test.idle) {
+				t.Errorf("idle = %v, want %v", idle, test.idle)
+			}
+			if !slices.Equal(report.Unknown, test.unknown) {
+				t.Errorf("unknown = %v, want %v", report.Unknown, test.unknown)
+			}
+			if len(report.Unchecked) != 1 || report.Unchecked[0] != "acme/web/gone: gone was not found" {
+				t.Errorf("unchecked = %v, want only gone", report.Unchecked)
+			}
+			if slices.Contains(provider.calls, "describe plain") {
+				t.Error("the plain SSH machine was checked")
+			}
+		})
+	}
+}
+
+func TestStopIdle(t *testing.T) {
+	configs := inventory.NewConfiguration()
+	configs.AddAccount("acme")
+	configs.AddProjectToActiveAccount("acme", "web")
+	report := IdleReport{}
+	for _, name := range []string{"db-1", "web-1"} {
+		configs.Accounts["acme"].Projects["web"].Machines[name] = inventory.Machine{Name: name, Status: StatusRunning}
+		report.Machines = append(report.Machines, IdleMachine{Machine: inventory.MachineRef{Account: "acme", Project: "web", Machine: name}})
+	}
+	client := &Client{Configuration: &configs, Provider: &fakeProvider{failStop: map[string]bool{"web-1": true}}}
+
+	client.StopIdle(&report)
+	if !report.Machines[0].Stopped || report.Machines[0].Error != "" {
+		t.Errorf("db-1 = %+v, want it stopped", report.Machines[0])
+	}
+	if report.Machines[1].Stopped || report.Machines[1].Error != "stopping web-1 failed" {
+		t.Errorf("web-1 = %+v, want the error", report.Machines[1])
+	}
+	if machine, _ := configs.GetMachine("acme", "web", "db-1"); machine.Status != StatusTerminated {
+		t.Errorf("status of db-1 = %s, want %s", machine.Status, StatusTerminated)
+	}
+}
@@ -0,0 +1,191 @@
+package chop
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SystemConfigFile is the configuration shared by all users of a computer
+const SystemConfigFile = "/etc/chop/chop.yaml"
+
+// Names of the configuration layers, from the lowest to the highest precedence
+const (
+	LayerSystem = "system"
+	LayerTeam   = "team"
+	LayerUser   = "user"
+)
+
+// ConfigLayers reads the configuration layers of a user's YAML file, lowest first:
+//
+//	system  CHOP_SYSTEM_CONFIG, or /etc/chop/chop.yaml
+//	team    CHOP_TEAM_CONFIG, or the teamfile setting of the user or system file
+//	user    the file itself
+//
+// The team layer may also be an http(s) URL, see FetchRemoteLayer. Missing system and
+// team files are left out. A missing user file is an empty layer, exists reports whether
+// it was there. Encrypted layers are decrypted with keys.
+func ConfigLayers(filename string, keys inventory.KeySource) (layers []inventory.Layer, exists bool, err error) {
+	user, _, exists, err := readLayer(LayerUser, filename, keys)
+	if err != nil {
+		return nil, false, err
+	}
+	teamFile, _ := user.Values["teamfile"].(string)
+	if layers, err = lowerLayers(filename, teamFile, keys); err != nil {
+		return nil, false, err
+	}
+	return append(layers, user), exists, nil
+}
+
+// lowerLayers reads the system and team layers below a user's file, teamFile is the
+// teamfile setting of the user's file
+func lowerLayers(filename string, teamFile string, keys inventory.KeySource) (layers []inventory.Layer, err error) {
+	systemFile := SystemConfigFile
+	if file := os.Getenv("CHOP_SYSTEM_CONFIG"); file != "" {
+		systemFile = file
+	}
+	system, _, systemExists, err := readLayer(LayerSystem, systemFile, keys)
+	if err != nil {
+		return nil, err
+	}
+	if systemExists {
+		layers = append(layers, system)
+	}
+
+	if file := os.Getenv("CHOP_TEAM_CONFIG"); file != "" {
+		teamFile = file
+	}
+	if teamFile == "" {
+		teamFile, _ = system.Values["teamfile"].(string)
+	}
+	if IsRemote(teamFile) {
+		data, note, err := FetchRemoteLayer(RemoteClient, teamFile, CacheDir(filename), time.Now(), keys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s layer: %w", LayerTeam, err)
+		}
+		team, err := inventory.ReadLayer(LayerTeam, teamFile, data, keys)
+		if err != nil {
+			return nil, err
+		}
+		if note != "" {
+			team.Source += " (" + note + ")"
+		}
+		layers = append(layers, team)
+	} else if teamFile != "" {
+		team, _, teamExists, err := readLayer(LayerTeam, expandHome(teamFile), keys)
+		if err != nil {
+			return nil, err
+		}
+		if teamExists {
+			layers = append(layers, team)
+		}
+	}
+	return layers, nil
+}
+
+// readLayer reads a YAML file as a layer, an empty one if the file does not exist. It also
+// returns the decrypted document, so that it is decrypted only once.
+func readLayer(name string, filename string, keys inventory.KeySource) (layer inventory.Layer, plain []byte, exists bool, err error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return inventory.Layer{Name: name, Source: filename}, nil, false, nil
+	}
+	if err != nil {
+		return inventory.Layer{}, nil, false, fmt.Errorf("failed to read %s layer: %w", name, err)
+	}
+	if plain, err = inventory.DecryptYAML(data, keys); err != nil {
+		return inventory.Layer{}, nil, false, fmt.Errorf("failed to read %s layer %s: %w", name, filename, err)
+	}
+	layer, err = inventory.ReadLayer(name, filename, plain, nil)
+	return layer, plain, true, err
+}
+
+// expandHome replaces a leading ~/ by the home directory
+func expandHome(filename string) string {
+	if rest, found := strings.CutPrefix(filename, "~/"); found {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return filename
+}
+
+// LayeredStore keeps the user's YAML configuration on top of the shared system and team
+// layers. Loading merges all layers. Saving only ever writes the user's file and only the
+// values that differ from the layers below, so that shared accounts, projects and machines
+// stay in the shared files while active context, tags and usage stay personal. Removing
+// something a lower layer defines writes a null that hides it.
+//
+// Without system and team layers the user's file is read and written like by YAMLStore.
+type LayeredStore struct {
+	Filename string
+	Keys     inventory.KeySource // Keys of encrypted layers, only asked for when one is encrypted
+}
+
+// Load merges all layers. When the user's file does not exist, configs still holds the
+// lower layers and the error wraps fs.ErrNotExist.
+func (store LayeredStore) Load(configs *inventory.Configuration) error {
+	user, plain, exists, err := readLayer(LayerUser, store.Filename, store.Keys)
+	if err != nil {
+		return err
+	}
+	teamFile, _ := user.Values["teamfile"].(string)
+	layers, err := lowerLayers(store.Filename, teamFile, store.Keys)
+	if err != nil {
+		return err
+	}
+	if len(layers) == 0 && exists {
+		if err := yaml.Unmarshal(plain, configs); err != nil {
+			return fmt.Errorf("failed to decode YAML into configuration: %w", err)
+		}
+		return nil
+	}
+
+	merged, _, err := inventory.MergeLayers(append(layers, user))
+	if err != nil {
+		return err
+	}
+	*configs = merged
+	if !exists {
+		return fmt.Errorf("failed to open file: %w", fs.ErrNotExist)
+	}
+	return nil
+}
+
+// Save writes what configs adds to the lower layers into the user's file. The user's file
+// itself is not read, it may be encrypted with other keys than configs is saved with.
+func (store LayeredStore) Save(configs *inventory.Configuration) error {
+	lower, err := lowerLayers(store.Filename, configs.TeamFile, store.Keys)
+	if err != nil {
+		return err
+	}
+	if len(lower) == 0 {
+		return inventory.YAMLStore{Filename: store.Filename, Keys: store.Keys}.Save(configs)
+	}
+
+	overlay, err := inventory.Overlay(lower, configs)
+	if err != nil {
+		return err
+	}
+	return inventory.WriteYAMLFile(store.Filename, overlay, configs.Encryption, store.Keys)
+}
+
+// Update loads the merged configuration, applies fn and saves the result.
+// Like YAMLStore it does not lock the file.
+func (store LayeredStore) Update(fn func(configs *inventory.Configuration) error) error {
+	configs := inventory.NewConfiguration()
+	if err := store.Load(&configs); err != nil {
+		return err
+	}
+	if err := fn(&configs); err != nil {
+		return err
+	}
+	return store.Save(&configs)
+}
@@ -0,0 +1,78 @@
+package chop
+
+import (
+	"os"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sharedLayer = `accounts:
+    acme:
+        name: acme
+        projects:
+            web:
+                name: web
+                machines:
+                    db-1:
+                        name: db-1
+                        zone: europe-west3-a
+                    web-1:
+                        name: web-1
+                        zone: europe-west3-a
+`
+
+func TestLayeredStoreMachineRemovedByTeam(t *testing.T) {
+	dir := t.TempDir()
+	teamFile := filepath.Join(dir, "team.yaml")
+	if err := os.WriteFile(teamFile, []byte(sharedLayer), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CHOP_SYSTEM_CONFIG", filepath.Join(dir, "none.yaml"))
+	t.Setenv("CHOP_TEAM_CONFIG", teamFile)
+	store := LayeredStore{Filename: filepath.Join(dir, "chop.yaml"), Keys: EnvironmentKeys}
+
+	// The first save of the user only keeps what the user changed
+	configs := inventory.NewConfiguration()
+	store.Load(&configs)
+	if err := configs.SetActiveAccount("acme"); err != nil {
+		t.Fatal(err)
+	}
+	used := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	if err := configs.UpdateMachine("acme", "web", "db-1", func(m *inventory.Machine) { m.LastUsage = used }); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(&configs); err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(store.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, unwanted := range []string{"web-1", "0001-01-01", "activeprojects"} {
+		if strings.Contains(string(written), unwanted) {
+			t.Errorf("user file holds %s:\n%s", unwanted, written)
+		}
+	}
+
+	// The team removes web-1
+	if err := os.WriteFile(teamFile, []byte(strings.Replace(sharedLayer, `                    web-1:
+                        name: web-1
+                        zone: europe-west3-a
+`, "", 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	configs = inventory.NewConfiguration()
+	if err := store.Load(&configs); err != nil {
+		t.Fatal(err)
+	}
+	machines := configs.Machines("acme", "web")
+	if len(machines) != 1 || machines[0].Name != "db-1" || !machines[0].LastUsage.Equal(used) {
+		t.Errorf("machines = %+v, want only db-1 with its usage", machines)
+	}
+	if configs.ActiveAccount != "acme" {
+		t.Errorf("active account = %q, want acme", configs.ActiveAccount)
+	}
+}
@@ -0,0 +1,259 @@
+package chop
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"palexus/chop/pkg/inventory"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Further instance states as reported by gcloud
+const (
+	StatusProvisioning = "PROVISIONING"
+	StatusStaging      = "STAGING"
+	StatusStopping     = "STOPPING"
+	StatusStopped      = "STOPPED"
+	StatusSuspended    = "SUSPENDED"
+)
+
+// ErrNotRunning is returned when a machine is not running and should not be started
+var ErrNotRunning = errors.New("machine is not running")
+
+// RefreshMachine asks the provider for the current zone, status and IPs of a machine,
+// records them and returns the machine with resolved transport
+func (c *Client) RefreshMachine(account string, project string, machine string) (inventory.Machine, error) {
+	mach, err := c.ResolveMachine(account, project, machine)
+	if err != nil {
+		return inventory.Machine{}, err
+	}
+	described, err := c.Provider.DescribeMachine(account, project, mach)
+	if err != nil {
+		return inventory.Machine{}, err
+	}
+	if err := c.MergeMachines(account, project, []inventory.Machine{described}); err != nil {
+		return inventory.Machine{}, err
+	}
+	return c.ResolveMachine(account, project, machine)
+}
+
+// ResetMachine hard-resets a running instance
+func (c *Client) ResetMachine(account string, project string, machine string) error {
+	mach, err := c.ResolveMachine(account, project, machine)
+	if err != nil {
+		return err
+	}
+	return c.Provider.ResetMachine(account, project, mach)
+}
+
+// EnsureRunning makes sure a cloud machine is running and answers on its SSH port.
+// Stopped machines are only started if confirm agrees. Machines not managed by a
+// cloud are left alone. progress receives messages while waiting.
+func (c *Client) EnsureRunning(account string, project string, machine string, timeout time.Duration,
+	confirm func(status string) bool, progress func(message string)) error {
+	mach, err := c.RefreshMachine(account, project, machine)
+	if errors.Is(err, ErrNotManaged) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check status: %w", err)
+	}
+
+	switch mach.Status {
+	case StatusRunning:
+		return nil
+	case StatusProvisioning, StatusStaging:
+		// Already on its way up
+	case StatusTerminated, StatusStopped:
+		if !confirm(mach.Status) {
+			return fmt.Errorf("%w (%s)", ErrNotRunning, mach.Status)
+		}
+		progress(fmt.Sprintf("Starting %s ...", machine))
+		if err := c.StartMachine(account, project, machine); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w (%s)", ErrNotRunning, mach.Status)
+	}
+	return c.WaitUntilReady(account, project, machine, timeout, progress)
+}
+
+// WaitUntilReady polls a machine until it is RUNNING and its SSH port sends a banner.
+// The IPs are refreshed on the way, machines may get a new external IP on every start.
+func (c *Client) WaitUntilReady(account string, project string, machine string, timeout time.Duration, progress func(message string)) error {
+	deadline := time.Now().Add(timeout)
+
+	var mach inventory.Machine
+	for {
+		var err error
+		mach, err = c.RefreshMachine(account, project, machine)
+		if err != nil {
+			return err
+		}
+		if mach.Status == StatusRunning {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("machine is still %s after %s", mach.Status, timeout)
+		}
+		progress(fmt.Sprintf("Waiting for %s to run (%s) ...", machine, mach.Status))
+		time.Sleep(3 * time.Second)
+	}
+
+	progress(fmt.Sprintf("Waiting for SSH on %s ...", machine))
+	port := 22
+	if mach.SSH.Port != 0 {
+		port = mach.SSH.Port
+	}
+	for {
+		err := ProbeSSH(c.Provider, account, project, mach, port, 10*time.Second)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("SSH did not answer after %s: %w", timeout, err)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// ProbeSSH checks that a port of a machine answers with an SSH banner, going
+// through the provider's proxy command (IAP, jump hosts) where there is one
+func ProbeSSH(provider Provider, account string, project string, machine inventory.Machine, port int, timeout time.Duration) error {
+	var conn io.Reader
+	if cmd := provider.ProxyCommand(account, project, machine, port); cmd != nil {
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		// Keep stdin open until the probe is done, the proxy ends when it closes
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		defer cmd.Wait()
+		defer stdin.Close()
+		defer cmd.Process.Kill()
+		conn = stdout
+	} else {
+		address, err := DialAddress(machine, port)
+		if err != nil {
+			return err
+		}
+		tcp, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			return err
+		}
+		defer tcp.Close()
+		tcp.SetReadDeadline(time.Now().Add(timeout))
+		conn = tcp
+	}
+
+	banner := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err == nil && !strings.HasPrefix(line, "SSH-") {
+			err = fmt.Errorf("unexpected banner %q", line)
+		}
+		banner <- err
+	}()
+	select {
+	case err := <-banner:
+		return err
+	case <-time.After(timeout):
+		return errors.New("no SSH banner received")
+	}
+}
+
+// BatchParallel is how many provider calls a batch runs at once, like the default of 'chop exec'
+const BatchParallel = 10
+
+// BatchResult is the outcome of an operation on one machine of a batch
+type BatchResult struct {
+	Machine inventory.MachineRef
+	Status  string // Known status after the operation
+	Err     error
+}
+
+// StartMachines starts machines concurrently and records their status and new IPs
+func (c *Client) StartMachines(refs []inventory.MachineRef) []BatchResult {
+	return c.batch(refs, func(account string, project string, machine inventory.Machine) (inventory.Machine, error) {
+		if err := c.Provider.StartMachine(account, project, machine); err != nil {
+			return inventory.Machine{}, err
+		}
+		return c.Provider.DescribeMachine(account, project, machine)
+	})
+}
+
+// StopMachines stops machines concurrently and records their status
+func (c *Client) StopMachines(refs []inventory.MachineRef) []BatchResult {
+	return c.batch(refs, func(account string, project string, machine inventory.Machine) (inventory.Machine, error) {
+		if err := c.Provider.StopMachine(account, project, machine); err != nil {
+			return inventory.Machine{}, err
+		}
+		machine.Status = StatusTerminated
+		return machine, nil
+	})
+}
+
+// ResetMachines resets machines concurrently
+func (c *Client) ResetMachines(refs []inventory.MachineRef) []BatchResult {
+	return c.batch(refs, func(account string, project string, machine inventory.Machine) (inventory.Machine, error) {
+		if err := c.Provider.ResetMachine(account, project, machine); err != nil {
+			return inventory.Machine{}, err
+		}
+		machine.Status = StatusRunning
+		return machine, nil
+	})
+}
+
+// RefreshMachines asks for the current status of machines concurrently and records it
+func (c *Client) RefreshMachines(refs []inventory.MachineRef) []BatchResult {
+	return c.batch(refs, c.Provider.DescribeMachine)
+}
+
+// batch runs a provider operation on up to BatchParallel machines at once and merges the
+// machines it returns
+func (c *Client) batch(refs []inventory.MachineRef, operation func(account string, project string, machine inventory.Machine) (inventory.Machine, error)) []BatchResult {
+	results := make([]BatchResult, len(refs))
+	updated := make([]inventory.Machine, len(refs))
+
+	slots := make(chan struct{}, BatchParallel)
+	var wg sync.WaitGroup
+	for i, ref := range refs {
+		results[i].Machine = ref
+		machine, err := c.ResolveMachine(ref.Account, ref.Project, ref.Machine)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			updated[i], results[i].Err = operation(ref.Account, ref.Project, machine)
+		}()
+	}
+	wg.Wait()
+
+	// Record the results one by one, the configuration is not safe for concurrent use
+	for i, ref := range refs {
+		if results[i].Err != nil {
+			continue
+		}
+		if err := c.MergeMachines(ref.Account, ref.Project, []inventory.Machine{updated[i]}); err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Status = updated[i].Status
+	}
+	return results
+}
@@ -0,0 +1,100 @@
+package chop
+
+import (
+	"fmt"
+	"os"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// PromptState is the small part of the configuration that shell prompts need
+type PromptState struct {
+	Account string
+	Project string
+}
+
+// NewPromptState returns the active account of a configuration and its active project
+func NewPromptState(configs *inventory.Configuration) PromptState {
+	return PromptState{
+		Account: configs.ActiveAccount,
+		Project: configs.ActiveProjects[configs.ActiveAccount],
+	}
+}
+
+// PromptStateFile returns the path of the cached prompt state next to the configuration file
+func PromptStateFile(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".state"
+}
+
+// Save writes the prompt state as two plain lines: account and project
+func (state PromptState) Save(filename string) error {
+	content := state.Account + "\n" + state.Project + "\n"
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		return fmt.Errorf("failed to write prompt state: %w", err)
+	}
+	return nil
+}
+
+// ReadPromptState reads a prompt state written by PromptState.Save
+func ReadPromptState(filename string) (PromptState, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return PromptState{}, fmt.Errorf("failed to read prompt state: %w", err)
+	}
+
+	lines := strings.SplitN(string(content), "\n", 3)
+	state := PromptState{Account: strings.TrimSpace(lines[0])}
+	if len(lines) > 1 {
+		state.Project = strings.TrimSpace(lines[1])
+	}
+	return state, nil
+}
+
+// LoadPromptState returns the prompt state for a configuration file.
+// The cached state file is used as long as it is not older than the configuration,
+// otherwise the configuration is loaded once and the cache is rewritten.
+func LoadPromptState(filename string, keys inventory.KeySource) (PromptState, error) {
+	stateFile := PromptStateFile(filename)
+
+	configInfo, configErr := os.Stat(filename)
+	stateInfo, stateErr := os.Stat(stateFile)
+	if stateErr == nil && (configErr != nil || !stateInfo.ModTime().Before(configInfo.ModTime())) {
+		return ReadPromptState(stateFile)
+	}
+	if configErr != nil {
+		return PromptState{}, fmt.Errorf("failed to stat configuration: %w", configErr)
+	}
+
+	var configs inventory.Configuration
+	if err := OpenStore(filename, keys).Load(&configs); err != nil {
+		return PromptState{}, err
+	}
+	state := NewPromptState(&configs)
+
+	// A failing cache write only makes the next prompt slower
+	_ = state.Save(stateFile)
+	return state, nil
+}
+
+// promptMarkers are the markers around invisible text that shells understand in prompts.
+// bash handles its \[ and \] before running command substitutions, so a command has to
+// print the bytes readline uses for them instead.
+var promptMarkers = map[string][2]string{
+	"bash": {"\x01", "\x02"},
+	"zsh":  {"%{", "%}"},
+}
+
+// escapeSequence matches the color escape sequences of a prompt segment
+var escapeSequence = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// MarkPromptEscapes wraps the escape sequences of a prompt segment in the markers of a shell,
+// so that the shell does not count them towards the width of the prompt
+func MarkPromptEscapes(segment string, shell string) (string, error) {
+	markers, ok := promptMarkers[shell]
+	if !ok {
+		return "", fmt.Errorf("%w: shell %q, prompts can be marked up for bash and zsh", inventory.ErrInvalid, shell)
+	}
+	return escapeSequence.ReplaceAllString(segment, markers[0]+"${0}"+markers[1]), nil
+}
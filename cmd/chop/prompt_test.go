@@ -0,0 +1,82 @@
+package chop
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"testing"
+)
+
+func TestMarkPromptEscapes(t *testing.T) {
+	segment := "\x1b[32macme\x1b[0m/\x1b[36mweb\x1b[0m"
+	tests := []struct {
+		shell string
+		want  string
+	}{
+		{"bash", "\x01\x1b[32m\x02acme\x01\x1b[0m\x02/\x01\x1b[36m\x02web\x01\x1b[0m\x02"},
+		{"zsh", "%{\x1b[32m%}acme%{\x1b[0m%}/%{\x1b[36m%}web%{\x1b[0m%}"},
+	}
+	for _, test := range tests {
+		got, err := MarkPromptEscapes(segment, test.shell)
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %q, %v, want %q", test.shell, got, err, test.want)
+		}
+	}
+
+	if got, _ := MarkPromptEscapes("acme/web", "bash"); got != "acme/web" {
+		t.Errorf("plain segment became %q", got)
+	}
+	if _, err := MarkPromptEscapes(segment, "fish"); !errors.Is(err, inventory.ErrInvalid) {
+		t.Errorf("err = %v, want ErrInvalid", err)
+	}
+}
+
+// promptConfiguration writes a configuration with many machines, as prompts are shown
+// in front of large inventories too
+func promptConfiguration(b *testing.B) string {
+	b.Helper()
+	configs := inventory.NewConfiguration()
+	configs.AddAccount("acme")
+	configs.SetActiveAccount("acme")
+	for _, project := range []string{"api", "data", "web"} {
+		configs.AddProjectToActiveAccount("acme", project)
+		configs.SetActiveProjectForAccount("acme", project)
+		for i := 0; i < 200; i++ {
+			configs.AddMachineToActiveProject("acme", fmt.Sprintf("%s-%d", project, i))
+		}
+	}
+	filename := filepath.Join(b.TempDir(), "chop.yaml")
+	if err := OpenStore(filename, EnvironmentKeys).Save(&configs); err != nil {
+		b.Fatal(err)
+	}
+	return filename
+}
+
+// BenchmarkLoadPromptState measures the work of 'chop prompt'. Reading the cache happens on
+// every prompt and has to stay well below the 10ms budget of a prompt segment, loading the
+// configuration only happens once after each change.
+func BenchmarkLoadPromptState(b *testing.B) {
+	filename := promptConfiguration(b)
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := LoadPromptState(filename, EnvironmentKeys); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// After a change by another tool the configuration is newer than the cache
+	b.Run("stale", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			os.Remove(PromptStateFile(filename))
+			b.StartTimer()
+			if _, err := LoadPromptState(filename, EnvironmentKeys); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package chop
+
+import (
+	"fmt"
+	"os/exec"
+	"palexus/chop/pkg/inventory"
+)
+
+// Instance states as reported by the providers
+const (
+	StatusRunning    = "RUNNING"
+	StatusTerminated = "TERMINATED"
+)
+
+// CommandError is returned when a command line tool like gcloud, ssh or rsync fails
+type CommandError struct {
+	Command string // Tool and subcommand, e.g. "gcloud compute instances"
+	Output  string // What the tool wrote to stderr, if it was captured
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	if e.Output != "" {
+		return fmt.Sprintf("%s failed: %s", e.Command, e.Output)
+	}
+	return fmt.Sprintf("%s failed: %v", e.Command, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Provider talks to the cloud that hosts the machines. Implementations only run
+// remote operations; recording their results in a Configuration is up to the caller.
+// Machines passed to the command builders carry their effective transport, see ResolveMachine.
+type Provider interface {
+	// ListMachines returns the machines of a project with their zone and status
+	ListMachines(account string, project string) ([]inventory.Machine, error)
+	// StartMachine starts a stopped machine
+	StartMachine(account string, project string, machine inventory.Machine) error
+	// StopMachine stops a running machine
+	StopMachine(account string, project string, machine inventory.Machine) error
+	// DescribeMachine returns the current zone, status and IPs of a machine
+	DescribeMachine(account string, project string, machine inventory.Machine) (inventory.Machine, error)
+	// CreateMachine creates a machine from a template and returns it with zone, status and IPs
+	CreateMachine(account string, project string, name string, template inventory.Template) (inventory.Machine, error)
+	// UpdateMachine changes the labels or the machine type of a machine in place
+	UpdateMachine(account string, project string, machine inventory.Machine, update MachineUpdate) error
+	// DeleteMachine deletes a machine for good
+	DeleteMachine(account string, project string, machine inventory.Machine) error
+	// ResetMachine hard-resets a running machine
+	ResetMachine(account string, project string, machine inventory.Machine) error
+	// ConnectCommand returns the command that opens an interactive session on a machine
+	ConnectCommand(account string, project string, machine inventory.Machine) *exec.Cmd
+	// TunnelCommand returns the command that forwards a local port while it runs
+	TunnelCommand(account string, project string, machine inventory.Machine, tunnel inventory.Tunnel) *exec.Cmd
+	// ProxyCommand returns a command that connects its stdin/stdout to a port of the machine,
+	// or nil if the port can be dialed directly
+	ProxyCommand(account string, project string, machine inventory.Machine, port int) *exec.Cmd
+	// RunCommand returns the command that runs a shell command on a machine without a terminal
+	RunCommand(account string, project string, machine inventory.Machine, command string) *exec.Cmd
+	// CopyCommand returns the command that copies files between the local machine and a machine
+	CopyCommand(account string, project string, machine inventory.Machine, transfer Transfer) *exec.Cmd
+}
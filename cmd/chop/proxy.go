@@ -0,0 +1,67 @@
+package chop
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"palexus/chop/pkg/inventory"
+)
+
+// DialAddress returns the host:port to dial for a machine with resolved transport
+func DialAddress(machine inventory.Machine, port int) (string, error) {
+	var host string
+	switch machine.Transport {
+	case inventory.TransportSSH:
+		host = sshHost(machine)
+	case inventory.TransportInternal:
+		host = machine.InternalIP
+	case inventory.TransportIAP:
+		return "", errors.New("IAP machines cannot be dialed directly")
+	default:
+		host = machine.ExternalIP
+	}
+	if host == "" {
+		return "", fmt.Errorf("no IP known for %s, run 'chop fetch machines'", machine.Name)
+	}
+	return net.JoinHostPort(host, fmt.Sprint(port)), nil
+}
+
+// Proxy connects stdin and stdout to a port of a machine, as ssh expects from a ProxyCommand.
+// The machine must carry its resolved transport, see ResolveMachine.
+func Proxy(provider Provider, account string, project string, machine inventory.Machine, port int, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	// Let the provider pipe through IAP or a jump host if it has to
+	if cmd := provider.ProxyCommand(account, project, machine, port); cmd != nil {
+		cmd.Stdin = stdin
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			return &CommandError{"proxy command", "", err}
+		}
+		return nil
+	}
+
+	address, err := DialAddress(machine, port)
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+	defer conn.Close()
+
+	// Copy in both directions. When stdin ends, half-close the connection so the
+	// server sees EOF but can still send the rest of its output.
+	received := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stdout, conn)
+		received <- err
+	}()
+	if _, err := io.Copy(conn, stdin); err == nil {
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}
+	return <-received
+}
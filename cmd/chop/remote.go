@@ -0,0 +1,130 @@
+package chop
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RemoteLayerMaxAge is how long a fetched remote layer is used before the server is asked again
+const RemoteLayerMaxAge = 5 * time.Minute
+
+// RemoteLayerRetryAfter is how long the cached layer is used without asking after the server failed
+const RemoteLayerRetryAfter = time.Minute
+
+// RemoteClient fetches remote layers. Its timeout keeps chop usable when the server hangs.
+var RemoteClient = &http.Client{Timeout: 10 * time.Second}
+
+// IsRemote reports whether a layer is fetched from a URL instead of read from a file
+func IsRemote(source string) bool {
+	return strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://")
+}
+
+// CacheDir returns the directory for cached remote layers next to the configuration file
+func CacheDir(filename string) string {
+	return filepath.Join(filepath.Dir(filename), "cache")
+}
+
+// remoteCacheEntry describes the cached response for a URL
+type remoteCacheEntry struct {
+	URL          string
+	ETag         string    `json:",omitempty"`
+	LastModified string    `json:",omitempty"`
+	Fetched      time.Time // When the server last confirmed the cached document
+	Failed       time.Time `json:",omitempty"` // When asking the server last failed, zero after a success
+}
+
+// FetchRemoteLayer returns the YAML document served at url. Responses are cached in dir and
+// reused for RemoteLayerMaxAge, after that the server is asked with If-None-Match and
+// If-Modified-Since whether the document changed. When the server cannot be reached or
+// answers with an error, the cached document is used and note tells how old it is, and the
+// server is left alone for RemoteLayerRetryAfter. Only without a cached document the fetch fails. keys decrypt an encrypted document to check it.
+func FetchRemoteLayer(client *http.Client, url string, dir string, now time.Time, keys inventory.KeySource) (data []byte, note string, err error) {
+	key := sha256.Sum256([]byte(url))
+	base := filepath.Join(dir, "remote-"+hex.EncodeToString(key[:8]))
+	bodyFile, entryFile := base+".yaml", base+".json"
+
+	var entry remoteCacheEntry
+	cached, cacheErr := os.ReadFile(bodyFile)
+	if cacheErr == nil {
+		if content, err := os.ReadFile(entryFile); err == nil {
+			cacheErr = json.Unmarshal(content, &entry)
+		} else {
+			cacheErr = err
+		}
+	}
+	hasCache := cacheErr == nil && entry.URL == url
+	if hasCache && now.Sub(entry.Fetched) < RemoteLayerMaxAge {
+		return cached, "", nil
+	}
+	offline := fmt.Sprintf("offline, cached %s", entry.Fetched.Local().Format("2006-01-02 15:04"))
+	if hasCache && now.Sub(entry.Failed) < RemoteLayerRetryAfter {
+		return cached, offline, nil
+	}
+
+	// fallback uses the cached document when the server did not give a usable one and
+	// records the failure, so that the next chops do not wait for the server again
+	fallback := func(reason error) ([]byte, string, error) {
+		if !hasCache {
+			return nil, "", fmt.Errorf("failed to fetch %s: %w", url, reason)
+		}
+		entry.Failed = now
+		if content, err := json.Marshal(entry); err == nil {
+			_ = os.WriteFile(entryFile, content, 0o644)
+		}
+		return cached, offline, nil
+	}
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: layer URL %s", inventory.ErrInvalid, url)
+	}
+	if hasCache {
+		if entry.ETag != "" {
+			request.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			request.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return fallback(err)
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotModified && hasCache:
+		data = cached
+	case response.StatusCode == http.StatusOK:
+		data, err = io.ReadAll(response.Body)
+		if err != nil {
+			return fallback(err)
+		}
+		// Never replace a good cached document with one chop cannot read
+		if _, err := inventory.ReadLayer(LayerTeam, url, data, keys); err != nil {
+			return fallback(err)
+		}
+		entry.ETag = response.Header.Get("ETag")
+		entry.LastModified = response.Header.Get("Last-Modified")
+	default:
+		return fallback(fmt.Errorf("server answered %s", response.Status))
+	}
+
+	// A cache that cannot be written only means asking the server again next time
+	entry.URL, entry.Fetched, entry.Failed = url, now, time.Time{}
+	if err := os.MkdirAll(dir, 0o755); err == nil {
+		if content, err := json.Marshal(entry); err == nil && os.WriteFile(bodyFile, data, 0o644) == nil {
+			_ = os.WriteFile(entryFile, content, 0o644)
+		}
+	}
+	return data, "", nil
+}
@@ -0,0 +1,102 @@
+package chop
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const teamLayer = "accounts:\n    acme:\n        name: acme\n"
+
+// layerServer serves teamLayer with an ETag and a Last-Modified date, or fails with status
+type layerServer struct {
+	status   int // Answer with this status instead of the document, 0 serves it
+	requests []*http.Request
+}
+
+func (server *layerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.requests = append(server.requests, r)
+	if server.status != 0 {
+		w.WriteHeader(server.status)
+		return
+	}
+	if r.Header.Get("If-None-Match") == `"v1"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", `"v1"`)
+	w.Header().Set("Last-Modified", "Mon, 19 Oct 2026 08:00:00 GMT")
+	w.Write([]byte(teamLayer))
+}
+
+func TestFetchRemoteLayer(t *testing.T) {
+	layers := &layerServer{}
+	server := httptest.NewServer(layers)
+	defer server.Close()
+	url := server.URL + "/team.yaml"
+	dir := t.TempDir()
+	start := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		name     string
+		status   int           // What the server answers
+		after    time.Duration // Time since start
+		requests int           // Requests the server has seen after the step
+		note     bool          // Whether the layer comes from the cache after a failure
+		check    func(t *testing.T, request *http.Request)
+	}{
+		{name: "200 fills the cache", after: 0, requests: 1},
+		{name: "fresh cache is used without asking", after: time.Minute, requests: 1},
+		{name: "304 revalidates the cache", after: RemoteLayerMaxAge + time.Minute, requests: 2,
+			check: func(t *testing.T, request *http.Request) {
+				if got := request.Header.Get("If-None-Match"); got != `"v1"` {
+					t.Errorf("If-None-Match = %q, want the ETag", got)
+				}
+				if got := request.Header.Get("If-Modified-Since"); got != "Mon, 19 Oct 2026 08:00:00 GMT" {
+					t.Errorf("If-Modified-Since = %q, want the Last-Modified date", got)
+				}
+			}},
+		{name: "5xx falls back to the cache", status: http.StatusBadGateway, after: 2*RemoteLayerMaxAge + time.Minute, requests: 3, note: true},
+		{name: "failure backs off", status: http.StatusBadGateway, after: 2*RemoteLayerMaxAge + time.Minute + RemoteLayerRetryAfter/2, requests: 3, note: true},
+		{name: "server is asked again after the back-off", after: 2*RemoteLayerMaxAge + time.Minute + RemoteLayerRetryAfter, requests: 4},
+	}
+	for _, step := range steps {
+		layers.status = step.status
+		data, note, err := FetchRemoteLayer(server.Client(), url, dir, start.Add(step.after), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if string(data) != teamLayer {
+			t.Errorf("%s: got %q, want the team layer", step.name, data)
+		}
+		if (note != "") != step.note {
+			t.Errorf("%s: note = %q", step.name, note)
+		}
+		if len(layers.requests) != step.requests {
+			t.Fatalf("%s: server saw %d requests, want %d", step.name, len(layers.requests), step.requests)
+		}
+		if step.check != nil {
+			step.check(t, layers.requests[len(layers.requests)-1])
+		}
+	}
+}
+
+func TestFetchRemoteLayerWithoutCache(t *testing.T) {
+	layers := &layerServer{status: http.StatusInternalServerError}
+	server := httptest.NewServer(layers)
+	url := server.URL + "/team.yaml"
+	now := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+
+	_, _, err := FetchRemoteLayer(server.Client(), url, t.TempDir(), now, nil)
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("5xx without cache: err = %v, want the status", err)
+	}
+
+	// A server that is gone entirely
+	server.Close()
+	if _, _, err := FetchRemoteLayer(server.Client(), url, t.TempDir(), now, nil); err == nil {
+		t.Error("unreachable server without cache: want an error")
+	}
+}
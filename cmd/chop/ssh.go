@@ -0,0 +1,253 @@
+package chop
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"palexus/chop/pkg/inventory"
+	"sort"
+	"strconv"
+)
+
+// SSH is the Provider for machines that are reached with the system ssh binary.
+// Such machines are not managed by a cloud, so only connecting and tunneling are supported.
+type SSH struct{}
+
+var _ Provider = SSH{}
+
+// ErrNotManaged is returned for cloud operations on plain SSH machines
+var ErrNotManaged = errors.New("machine is reached over plain SSH and not managed by a cloud provider")
+
+// ListMachines is not supported for plain SSH machines
+func (SSH) ListMachines(account string, project string) ([]inventory.Machine, error) {
+	return nil, ErrNotManaged
+}
+
+// StartMachine is not supported for plain SSH machines
+func (SSH) StartMachine(account string, project string, machine inventory.Machine) error {
+	return ErrNotManaged
+}
+
+// StopMachine is not supported for plain SSH machines
+func (SSH) StopMachine(account string, project string, machine inventory.Machine) error {
+	return ErrNotManaged
+}
+
+// DescribeMachine is not supported for plain SSH machines
+func (SSH) DescribeMachine(account string, project string, machine inventory.Machine) (inventory.Machine, error) {
+	return inventory.Machine{}, ErrNotManaged
+}
+
+// CreateMachine is not supported for plain SSH machines
+func (SSH) CreateMachine(account string, project string, name string, template inventory.Template) (inventory.Machine, error) {
+	return inventory.Machine{}, ErrNotManaged
+}
+
+// UpdateMachine is not supported for plain SSH machines
+func (SSH) UpdateMachine(account string, project string, machine inventory.Machine, update MachineUpdate) error {
+	return ErrNotManaged
+}
+
+// DeleteMachine is not supported for plain SSH machines
+func (SSH) DeleteMachine(account string, project string, machine inventory.Machine) error {
+	return ErrNotManaged
+}
+
+// ResetMachine is not supported for plain SSH machines
+func (SSH) ResetMachine(account string, project string, machine inventory.Machine) error {
+	return ErrNotManaged
+}
+
+// ConnectCommand builds the ssh command for a machine
+func (SSH) ConnectCommand(account string, project string, machine inventory.Machine) *exec.Cmd {
+	return exec.Command("ssh", sshArgs(machine)...)
+}
+
+// RunCommand builds an ssh command that runs a shell command. BatchMode keeps
+// parallel runs from waiting for passwords nobody can type.
+func (SSH) RunCommand(account string, project string, machine inventory.Machine, command string) *exec.Cmd {
+	args := append([]string{"-T", "-o", "BatchMode=yes"}, sshArgs(machine)...)
+	return exec.Command("ssh", append(args, "--", command)...)
+}
+
+// TunnelCommand builds an ssh command that only forwards a port. IAP tunnels need a cloud,
+// the command fails to start for them.
+func (SSH) TunnelCommand(account string, project string, machine inventory.Machine, tunnel inventory.Tunnel) *exec.Cmd {
+	args := []string{"-N", "-o", "ExitOnForwardFailure=yes", "-L", fmt.Sprintf("%d:%s", tunnel.LocalPort, tunnel.Remote())}
+	cmd := exec.Command("ssh", append(args, sshArgs(machine)...)...)
+	if tunnel.IAP {
+		cmd.Err = fmt.Errorf("%w, so it has no IAP tunnels", ErrNotManaged)
+	}
+	return cmd
+}
+
+// ProxyCommand pipes through the jump host with 'ssh -W', machines without one are dialed directly
+func (SSH) ProxyCommand(account string, project string, machine inventory.Machine, port int) *exec.Cmd {
+	if machine.SSH.ProxyJump == "" {
+		return nil
+	}
+	return exec.Command("ssh", "-W", net.JoinHostPort(sshHost(machine), fmt.Sprint(port)), machine.SSH.ProxyJump)
+}
+
+// CopyCommand builds the scp command for a transfer
+func (SSH) CopyCommand(account string, project string, machine inventory.Machine, transfer Transfer) *exec.Cmd {
+	args := scpArgs(machine)
+	if transfer.Recursive {
+		args = append(args, "-r")
+	}
+	remote := sshHost(machine)
+	if machine.SSH.User != "" {
+		remote = machine.SSH.User + "@" + remote
+	}
+	return exec.Command("scp", append(args, transfer.paths(remote)...)...)
+}
+
+// sshHost returns the host name ssh connects to
+func sshHost(machine inventory.Machine) string {
+	if machine.SSH.HostName != "" {
+		return machine.SSH.HostName
+	}
+	return machine.Name
+}
+
+// sshArgs translates the SSH settings of a machine into ssh command line arguments, ending with the host
+func sshArgs(machine inventory.Machine) []string {
+	settings := machine.SSH
+	args := []string{}
+	if settings.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(settings.Port))
+	}
+	if settings.User != "" {
+		args = append(args, "-l", settings.User)
+	}
+	if settings.IdentityFile != "" {
+		args = append(args, "-i", settings.IdentityFile)
+	}
+	if settings.ProxyJump != "" {
+		args = append(args, "-J", settings.ProxyJump)
+	}
+	if settings.ForwardAgent {
+		args = append(args, "-A")
+	}
+
+	// Sort the options to get reproducible commands
+	keys := make([]string, 0, len(settings.Options))
+	for key := range settings.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "-o", key+"="+settings.Options[key])
+	}
+
+	return append(args, sshHost(machine))
+}
+
+// scpArgs translates the SSH settings of a machine into scp command line arguments.
+// Unlike ssh, scp takes the port with -P and the user as part of the remote path.
+func scpArgs(machine inventory.Machine) []string {
+	settings := machine.SSH
+	args := []string{}
+	if settings.Port != 0 {
+		args = append(args, "-P", strconv.Itoa(settings.Port))
+	}
+	if settings.IdentityFile != "" {
+		args = append(args, "-i", settings.IdentityFile)
+	}
+	if settings.ProxyJump != "" {
+		args = append(args, "-J", settings.ProxyJump)
+	}
+
+	keys := make([]string, 0, len(settings.Options))
+	for key := range settings.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "-o", key+"="+settings.Options[key])
+	}
+	return args
+}
+
+// Router is the Provider that sends plain SSH machines to SSH and all others to the cloud provider
+type Router struct {
+	Cloud Provider
+	SSH   Provider
+}
+
+// DefaultProvider is used by the CLI: gcloud for cloud machines, the ssh binary for the rest
+var DefaultProvider Provider = Router{Cloud: GCP{}, SSH: SSH{}}
+
+// providerFor picks the provider of a machine with resolved transport
+func (router Router) providerFor(machine inventory.Machine) Provider {
+	if machine.Transport == inventory.TransportSSH {
+		return router.SSH
+	}
+	return router.Cloud
+}
+
+// ListMachines lists machines through the cloud provider
+func (router Router) ListMachines(account string, project string) ([]inventory.Machine, error) {
+	return router.Cloud.ListMachines(account, project)
+}
+
+// StartMachine starts a machine through its provider
+func (router Router) StartMachine(account string, project string, machine inventory.Machine) error {
+	return router.providerFor(machine).StartMachine(account, project, machine)
+}
+
+// StopMachine stops a machine through its provider
+func (router Router) StopMachine(account string, project string, machine inventory.Machine) error {
+	return router.providerFor(machine).StopMachine(account, project, machine)
+}
+
+// DescribeMachine looks up a machine through its provider
+func (router Router) DescribeMachine(account string, project string, machine inventory.Machine) (inventory.Machine, error) {
+	return router.providerFor(machine).DescribeMachine(account, project, machine)
+}
+
+// CreateMachine creates machines through the cloud provider
+func (router Router) CreateMachine(account string, project string, name string, template inventory.Template) (inventory.Machine, error) {
+	return router.Cloud.CreateMachine(account, project, name, template)
+}
+
+// UpdateMachine updates a machine through its provider
+func (router Router) UpdateMachine(account string, project string, machine inventory.Machine, update MachineUpdate) error {
+	return router.providerFor(machine).UpdateMachine(account, project, machine, update)
+}
+
+// DeleteMachine deletes a machine through its provider
+func (router Router) DeleteMachine(account string, project string, machine inventory.Machine) error {
+	return router.providerFor(machine).DeleteMachine(account, project, machine)
+}
+
+// ResetMachine resets a machine through its provider
+func (router Router) ResetMachine(account string, project string, machine inventory.Machine) error {
+	return router.providerFor(machine).ResetMachine(account, project, machine)
+}
+
+// ConnectCommand builds the session command of a machine through its provider
+func (router Router) ConnectCommand(account string, project string, machine inventory.Machine) *exec.Cmd {
+	return router.providerFor(machine).ConnectCommand(account, project, machine)
+}
+
+// ProxyCommand builds the proxy command of a machine through its provider
+func (router Router) ProxyCommand(account string, project string, machine inventory.Machine, port int) *exec.Cmd {
+	return router.providerFor(machine).ProxyCommand(account, project, machine, port)
+}
+
+// TunnelCommand builds the tunnel command of a machine through its provider
+func (router Router) TunnelCommand(account string, project string, machine inventory.Machine, tunnel inventory.Tunnel) *exec.Cmd {
+	return router.providerFor(machine).TunnelCommand(account, project, machine, tunnel)
+}
+
+// RunCommand builds the remote command of a machine through its provider
+func (router Router) RunCommand(account string, project string, machine inventory.Machine, command string) *exec.Cmd {
+	return router.providerFor(machine).RunCommand(account, project, machine, command)
+}
+
+// CopyCommand builds the copy command of a machine through its provider
+func (router Router) CopyCommand(account string, project string, machine inventory.Machine, transfer Transfer) *exec.Cmd {
+	return router.providerFor(machine).CopyCommand(account, project, machine, transfer)
+}
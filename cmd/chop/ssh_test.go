@@ -0,0 +1,295 @@
+package chop
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshServer is an SSH server in the test process. It answers exec requests with the
+// command it was asked to run, fails the command "fail" with exit status 3 and forwards
+// direct-tcpip channels, which is all chop needs of a machine.
+type sshServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+}
+
+// startSSHServer accepts the user admin with the key of identityFile
+func startSSHServer(t *testing.T, authorized ssh.PublicKey) *sshServer {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == "admin" && string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := &sshServer{listener: listener, config: config}
+	go server.serve()
+	return server
+}
+
+func (server *sshServer) port() int {
+	return server.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (server *sshServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *sshServer) handle(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, server.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for request := range channels {
+		switch request.ChannelType() {
+		case "session":
+			channel, requests, err := request.Accept()
+			if err != nil {
+				continue
+			}
+			go session(channel, requests)
+		case "direct-tcpip":
+			var target struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}
+			if err := ssh.Unmarshal(request.ExtraData(), &target); err != nil {
+				request.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			forward, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+			if err != nil {
+				request.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			channel, requests, err := request.Accept()
+			if err != nil {
+				forward.Close()
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			go func() {
+				io.Copy(channel, forward)
+				channel.CloseWrite()
+			}()
+			go func() {
+				io.Copy(forward, channel)
+				forward.Close()
+			}()
+		default:
+			request.Reject(ssh.UnknownChannelType, "not supported")
+		}
+	}
+}
+
+// session answers the exec request of a session channel
+func session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for request := range requests {
+		if request.Type != "exec" {
+			request.Reply(false, nil)
+			continue
+		}
+		var exec struct{ Command string }
+		ssh.Unmarshal(request.Payload, &exec)
+		request.Reply(true, nil)
+		fmt.Fprintf(channel, "ran %s\n", exec.Command)
+		status := uint32(0)
+		if exec.Command == "fail" {
+			status = 3
+		}
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+// sshMachine returns a machine reached over plain SSH on the test server, with a key the
+// server accepts
+func sshMachine(t *testing.T) inventory.Machine {
+	t.Helper()
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(identity, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	authorized, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startSSHServer(t, authorized)
+
+	return inventory.Machine{
+		Name:      "lab-1",
+		Transport: inventory.TransportSSH,
+		SSH: inventory.SSHConfig{
+			HostName:     "127.0.0.1",
+			Port:         server.port(),
+			User:         "admin",
+			IdentityFile: identity,
+			Options: map[string]string{
+				"StrictHostKeyChecking": "no",
+				"UserKnownHostsFile":    os.DevNull,
+				"IdentitiesOnly":        "yes",
+				"LogLevel":              "ERROR",
+			},
+		},
+	}
+}
+
+func TestSSHRunCommand(t *testing.T) {
+	machine := sshMachine(t)
+
+	out, err := SSH{}.RunCommand("acme", "lab", machine, "uptime").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "ran uptime\n" {
+		t.Errorf("output = %q, want the command run on the server", out)
+	}
+
+	// The exit status of the remote command is the exit status of ssh
+	err = SSH{}.RunCommand("acme", "lab", machine, "fail").Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("err = %v, want exit status 3", err)
+	}
+}
+
+func TestSSHExec(t *testing.T) {
+	machine := sshMachine(t)
+	configs := inventory.NewConfiguration()
+	configs.AddAccount("acme")
+	configs.AddProjectToActiveAccount("acme", "lab")
+	configs.Accounts["acme"].Projects["lab"].Machines["lab-1"] = machine
+	client := &Client{Configuration: &configs, Provider: DefaultProvider}
+
+	results, err := client.Exec([]inventory.MachineRef{{Account: "acme", Project: "lab", Machine: "lab-1"}}, "hostname", ExecOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ExitCode != 0 || !strings.Contains(results[0].Stdout, "ran hostname") {
+		t.Errorf("results = %+v, want hostname run through the router's ssh provider", results)
+	}
+	if used := configs.Accounts["acme"].Projects["lab"].Machines["lab-1"].LastUsage; used.IsZero() {
+		t.Error("usage was not recorded")
+	}
+}
+
+func TestSSHTunnel(t *testing.T) {
+	machine := sshMachine(t)
+
+	// A service on the machine, here an echo server
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	go func() {
+		for {
+			conn, err := service.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localPort := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+	tunnel := inventory.Tunnel{LocalPort: localPort, RemoteHost: "127.0.0.1", RemotePort: service.Addr().(*net.TCPAddr).Port}
+
+	cmd := SSH{}.TunnelCommand("acme", "lab", machine, tunnel)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	var conn net.Conn
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if conn, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort))); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("tunnel did not come up: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping\n" {
+		t.Errorf("reply = %q, %v, want the echo through the tunnel", reply, err)
+	}
+}
+
+func TestSSHTunnelRefusesIAP(t *testing.T) {
+	machine := inventory.Machine{Name: "lab-1", Transport: inventory.TransportSSH, SSH: inventory.SSHConfig{HostName: "127.0.0.1"}}
+	cmd := SSH{}.TunnelCommand("acme", "lab", machine, inventory.Tunnel{LocalPort: 15432, RemoteHost: "localhost", RemotePort: 5432, IAP: true})
+	if err := cmd.Start(); !errors.Is(err, ErrNotManaged) {
+		t.Errorf("err = %v, want ErrNotManaged", err)
+	}
+}
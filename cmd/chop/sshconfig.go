@@ -0,0 +1,128 @@
+package chop
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultSSHConfigFile returns the default include file for 'chop ssh-config'
+func DefaultSSHConfigFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".ssh", "chop_config")
+	}
+	return filepath.Join(home, ".ssh", "chop_config")
+}
+
+// RenderSSHConfig writes one Host block per machine, named account.project.machine and by its aliases.
+// Machines that ssh cannot reach on its own (no IP known yet) are listed as comments.
+func (c *Client) RenderSSHConfig(w io.Writer) error {
+	var out bytes.Buffer
+	fmt.Fprintln(&out, "# Generated by chop, changes will be overwritten. Refresh with 'chop ssh-config'.")
+
+	for _, ref := range c.MachineRefs() {
+		machine, err := c.ResolveMachine(ref.Account, ref.Project, ref.Machine)
+		if err != nil {
+			return err
+		}
+
+		hostNames := append([]string{inventory.SSHHostName(ref)}, machine.Aliases...)
+		settings := sshConfigSettings(ref, machine)
+		if settings == nil {
+			fmt.Fprintf(&out, "\n# %s: no IP known, run 'chop fetch machines'\n", strings.Join(hostNames, " "))
+			continue
+		}
+
+		fmt.Fprintf(&out, "\nHost %s\n", strings.Join(hostNames, " "))
+		for _, setting := range settings {
+			fmt.Fprintf(&out, "    %s %s\n", setting[0], setting[1])
+		}
+	}
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// sshConfigSettings derives the ssh_config keywords of a machine with resolved transport.
+// It returns nil if ssh cannot reach the machine without further information.
+func sshConfigSettings(ref inventory.MachineRef, machine inventory.Machine) [][2]string {
+	settings := [][2]string{}
+	add := func(key string, value string) {
+		if value != "" {
+			settings = append(settings, [2]string{key, value})
+		}
+	}
+
+	switch machine.Transport {
+	case inventory.TransportSSH:
+		ssh := machine.SSH
+		add("HostName", sshHost(machine))
+		if ssh.Port != 0 {
+			add("Port", fmt.Sprint(ssh.Port))
+		}
+		add("User", ssh.User)
+		add("IdentityFile", ssh.IdentityFile)
+		add("ProxyJump", ssh.ProxyJump)
+		if ssh.ForwardAgent {
+			add("ForwardAgent", "yes")
+		}
+		keys := make([]string, 0, len(ssh.Options))
+		for key := range ssh.Options {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			add(key, ssh.Options[key])
+		}
+		return settings
+
+	case inventory.TransportIAP:
+		add("HostName", machine.Name)
+		add("ProxyCommand", strings.Join(append([]string{"gcloud", "compute", "start-iap-tunnel", machine.Name, "%p", "--listen-on-stdin"},
+			gcloudMachineFlags(ref.Account, ref.Project, machine)...), " "))
+
+	case inventory.TransportInternal:
+		if machine.InternalIP == "" {
+			return nil
+		}
+		add("HostName", machine.InternalIP)
+
+	default:
+		if machine.ExternalIP == "" {
+			return nil
+		}
+		add("HostName", machine.ExternalIP)
+	}
+
+	// Use the key that 'gcloud compute ssh' deploys to the machines
+	add("User", machine.SSH.User)
+	add("IdentityFile", "~/.ssh/google_compute_engine")
+	return settings
+}
+
+// WriteSSHConfig renders the ssh config into a file, replacing it atomically
+func (c *Client) WriteSSHConfig(filename string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	var out bytes.Buffer
+	if err := c.RenderSSHConfig(&out); err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("failed to write ssh config: %w", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("failed to replace ssh config: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package chop
+
+import (
+	"fmt"
+	"palexus/chop/pkg/inventory"
+	"palexus/chop/pkg/inventory/boltstore"
+	"path/filepath"
+)
+
+// Storage backends, chosen by the extension of the configuration file
+const (
+	BackendYAML = "yaml"
+	BackendBolt = "bolt"
+)
+
+// Backend returns the storage backend of a configuration file: .db and .bolt files
+// are bbolt databases, everything else is YAML
+func Backend(filename string) string {
+	switch filepath.Ext(filename) {
+	case ".db", ".bolt":
+		return BackendBolt
+	}
+	return BackendYAML
+}
+
+// OpenStore returns the store of a configuration file. YAML files are merged with the
+// system and team layers below them, see LayeredStore, and decrypted with keys if they
+// are encrypted. Saving through the store also keeps the cached prompt state next to the
+// file in sync.
+func OpenStore(filename string, keys inventory.KeySource) inventory.Store {
+	var store inventory.Store = LayeredStore{Filename: filename, Keys: keys}
+	if Backend(filename) == BackendBolt {
+		store = boltstore.Store{Filename: filename}
+	}
+	return promptStateStore{Store: store, filename: filename}
+}
+
+// promptStateStore rewrites the prompt state whenever the configuration is saved,
+// so 'chop prompt' never has to read the configuration itself
+type promptStateStore struct {
+	inventory.Store
+	filename string
+}
+
+func (store promptStateStore) Save(configs *inventory.Configuration) error {
+	if err := store.Store.Save(configs); err != nil {
+		return err
+	}
+	return NewPromptState(configs).Save(PromptStateFile(store.filename))
+}
+
+func (store promptStateStore) Update(fn func(configs *inventory.Configuration) error) error {
+	var state PromptState
+	err := store.Store.Update(func(configs *inventory.Configuration) error {
+		if err := fn(configs); err != nil {
+			return err
+		}
+		state = NewPromptState(configs)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return state.Save(PromptStateFile(store.filename))
+}
+
+// ConvertStore copies the configuration from one file into another, of the backend the
+// destination's name asks for. Databases keep neither encryption nor layers, so encrypted
+// and layered YAML files are refused rather than written to a database in plain text or
+// merged with the shared layers.
+func ConvertStore(from string, to string, keys inventory.KeySource) (*inventory.Configuration, error) {
+	configs := inventory.NewConfiguration()
+	if err := OpenStore(from, keys).Load(&configs); err != nil {
+		return nil, err
+	}
+	if Backend(to) == BackendBolt {
+		if configs.Encryption != nil {
+			return nil, fmt.Errorf("%w: %s is encrypted, which only YAML files can be, run 'chop config decrypt' first", inventory.ErrInvalid, from)
+		}
+		if Backend(from) == BackendYAML {
+			layers, err := lowerLayers(from, configs.TeamFile, keys)
+			if err != nil {
+				return nil, err
+			}
+			if configs.TeamFile != "" || len(layers) > 0 {
+				return nil, fmt.Errorf("%w: %s is merged with a system or team configuration, which only YAML files can be", inventory.ErrInvalid, from)
+			}
+		}
+	}
+	if err := OpenStore(to, keys).Save(&configs); err != nil {
+		return nil, err
+	}
+	return &configs, nil
+}
@@ -0,0 +1,242 @@
+package chop
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SyncResult tells what SyncConfiguration did
+type SyncResult struct {
+	Committed bool                 // Local changes were committed
+	Pulled    bool                 // Changes of other computers were fast-forwarded or merged
+	Merged    bool                 // Both sides had changes and a merge commit was made
+	Pushed    bool                 // Local commits were pushed
+	Upstream  string               // The branch synced with, e.g. origin/main
+	Conflicts []inventory.Conflict // Conflicts of the merge, with the resolution applied
+}
+
+// ErrUnresolved is what the resolve function of SyncConfiguration returns to leave a conflict open
+var ErrUnresolved = errors.New("conflict left unresolved")
+
+// ConflictError lists the conflicts a sync left open, it stopped before merging
+type ConflictError struct {
+	Conflicts []inventory.Conflict
+}
+
+func (e *ConflictError) Error() string {
+	paths := make([]string, len(e.Conflicts))
+	for i, conflict := range e.Conflicts {
+		paths[i] = conflict.String()
+	}
+	return fmt.Sprintf("%d conflict(s) left unresolved:\n  %s", len(e.Conflicts), strings.Join(paths, "\n  "))
+}
+
+// SyncConfiguration synchronizes a YAML configuration file that lives in a Git work tree with
+// the upstream branch: it commits local changes to the file, fetches, merges and pushes.
+// When both sides changed the configuration, the three versions are merged with
+// inventory.MergeThreeWay instead of line by line, and resolve decides each true conflict,
+// returning true to take the upstream value. resolve sees every conflict before anything is
+// merged; when it leaves any of them open with ErrUnresolved, a *ConflictError lists them
+// all. Then, or when resolve fails otherwise, the repository is left as it was after the
+// local commit. Other files of the repository are merged by Git; if they
+// conflict the merge is aborted. Encrypted versions of the file are decrypted with keys.
+func SyncConfiguration(filename string, keys inventory.KeySource, resolve func(conflict inventory.Conflict) (theirs bool, err error)) (SyncResult, error) {
+	var result SyncResult
+	if Backend(filename) != BackendYAML {
+		return result, fmt.Errorf("%w: only YAML configuration files can be synced", inventory.ErrInvalid)
+	}
+	// Dotfile managers often link the configuration into place
+	realFile, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		return result, err
+	}
+	repo := gitRepo{dir: filepath.Dir(realFile), keys: keys}
+	top, err := repo.run("rev-parse", "--show-toplevel")
+	if err != nil {
+		return result, fmt.Errorf("%w: %s is not in a Git repository", inventory.ErrInvalid, filename)
+	}
+	if top, err = filepath.EvalSymlinks(top); err != nil {
+		return result, err
+	}
+	rel, err := filepath.Rel(top, realFile)
+	if err != nil {
+		return result, err
+	}
+	rel = filepath.ToSlash(rel)
+	repo.dir = top
+
+	// Commit local changes
+	status, err := repo.run("status", "--porcelain", "--", rel)
+	if err != nil {
+		return result, err
+	}
+	if status != "" {
+		host, _ := os.Hostname()
+		if _, err := repo.run("add", "--", rel); err != nil {
+			return result, err
+		}
+		if _, err := repo.run("commit", "--quiet", "-m", "chop: update configuration on "+host, "--", rel); err != nil {
+			return result, err
+		}
+		result.Committed = true
+	}
+
+	// Fetch and compare with the upstream branch
+	result.Upstream, err = repo.run("rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{upstream}")
+	if err != nil {
+		return result, fmt.Errorf("%w: the branch has no upstream, set one with 'git push -u'", inventory.ErrInvalid)
+	}
+	if _, err := repo.run("fetch", "--quiet"); err != nil {
+		return result, err
+	}
+	counts, err := repo.run("rev-list", "--left-right", "--count", "HEAD...@{upstream}")
+	if err != nil {
+		return result, err
+	}
+	var ahead, behind int
+	if _, err := fmt.Sscan(counts, &ahead, &behind); err != nil {
+		return result, fmt.Errorf("unexpected output of git rev-list: %q", counts)
+	}
+
+	switch {
+	case behind > 0 && ahead == 0:
+		if _, err := repo.run("merge", "--quiet", "--ff-only", "@{upstream}"); err != nil {
+			return result, err
+		}
+		result.Pulled = true
+	case behind > 0:
+		if err := repo.mergeConfiguration(filename, rel, resolve, &result); err != nil {
+			return result, err
+		}
+		result.Pulled, result.Merged = true, true
+	}
+
+	if ahead > 0 {
+		if _, err := repo.run("push", "--quiet"); err != nil {
+			return result, err
+		}
+		result.Pushed = true
+	}
+	return result, nil
+}
+
+// mergeConfiguration makes a merge commit with the upstream branch whose configuration is
+// the semantic three-way merge of both sides
+func (repo gitRepo) mergeConfiguration(filename string, rel string, resolve func(inventory.Conflict) (bool, error), result *SyncResult) error {
+	base, err := repo.run("merge-base", "HEAD", "@{upstream}")
+	if err != nil {
+		return err
+	}
+	var documents [3]map[string]any
+	for i, rev := range []string{base, "HEAD", "@{upstream}"} {
+		if documents[i], err = repo.readDocument(rev, rel); err != nil {
+			return err
+		}
+	}
+	merged, conflicts := inventory.MergeThreeWay(documents[0], documents[1], documents[2])
+	unresolved := &ConflictError{}
+	for _, conflict := range conflicts {
+		theirs, err := resolve(conflict)
+		if errors.Is(err, ErrUnresolved) {
+			unresolved.Conflicts = append(unresolved.Conflicts, conflict)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		conflict.Apply(merged, theirs)
+	}
+	if len(unresolved.Conflicts) > 0 {
+		return unresolved
+	}
+	result.Conflicts = conflicts
+
+	// Let Git merge the rest of the repository, the configuration is replaced below
+	_, mergeErr := repo.run("merge", "--quiet", "--no-ff", "--no-commit", "@{upstream}")
+	unmerged, err := repo.run("diff", "--name-only", "--diff-filter=U")
+	if err != nil {
+		return err
+	}
+	for _, file := range strings.Fields(unmerged) {
+		if file != rel {
+			_, _ = repo.run("merge", "--abort")
+			return fmt.Errorf("%w: %s conflicts, merge the repository with git", inventory.ErrInvalid, file)
+		}
+	}
+	if mergeErr != nil && unmerged == "" {
+		_, _ = repo.run("merge", "--abort")
+		return mergeErr
+	}
+
+	// Write the merged configuration and bring it back into the usual order of the file
+	var settings struct{ Encryption *inventory.Encryption }
+	if data, err := yaml.Marshal(merged); err != nil {
+		return err
+	} else if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("%w: merged encryption settings: %v", inventory.ErrInvalid, err)
+	}
+	if err := inventory.WriteYAMLFile(filename, merged, settings.Encryption, repo.keys); err != nil {
+		return err
+	}
+	store := OpenStore(filename, repo.keys)
+	configs := inventory.NewConfiguration()
+	if err := store.Load(&configs); err != nil {
+		return err
+	}
+	if err := store.Save(&configs); err != nil {
+		return err
+	}
+
+	if _, err := repo.run("add", "--", rel); err != nil {
+		return err
+	}
+	_, err = repo.run("commit", "--quiet", "-m", "chop: merge configuration from "+result.Upstream)
+	return err
+}
+
+// readDocument decodes the configuration file of a revision, an empty one if it has none
+func (repo gitRepo) readDocument(rev string, rel string) (map[string]any, error) {
+	files, err := repo.run("ls-tree", "--name-only", rev, "--", rel)
+	if err != nil || files == "" {
+		return map[string]any{}, err
+	}
+	content, err := repo.run("show", rev+":"+rel)
+	if err != nil {
+		return nil, err
+	}
+	data, err := inventory.DecryptYAML([]byte(content), repo.keys)
+	if err != nil {
+		return nil, err
+	}
+	document := map[string]any{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("%w: %s in %s: %v", inventory.ErrInvalid, rel, rev, err)
+	}
+	return document, nil
+}
+
+// gitRepo runs git in a work tree
+type gitRepo struct {
+	dir  string
+	keys inventory.KeySource // Keys of the encrypted configuration in the work tree
+}
+
+// run executes git and returns its trimmed stdout. On failure the error carries git's stderr.
+func (repo gitRepo) run(args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", repo.dir}, args...)...)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", &CommandError{"git " + args[0], strings.TrimSpace(stderr.String()), err}
+	}
+	return strings.TrimSpace(out.String()), nil
+}
@@ -0,0 +1,213 @@
+package chop
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const syncBase = `accounts:
+    acme:
+        name: acme
+        projects:
+            web:
+                name: web
+                machines:
+                    db-1:
+                        name: db-1
+                        notes: base
+                    web-1:
+                        name: web-1
+                        notes: base
+`
+
+// syncClones makes a bare repository holding the configuration and two clones of it, like
+// two computers sharing a dotfiles repository. It returns the configuration of each clone.
+func syncClones(t *testing.T) (string, string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	for _, variable := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(variable, "chop")
+	}
+	for _, variable := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(variable, "chop@example.com")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	dir := t.TempDir()
+	remote, first, second := filepath.Join(dir, "remote.git"), filepath.Join(dir, "first"), filepath.Join(dir, "second")
+
+	git(t, dir, "init", "--quiet", "--bare", "--initial-branch=main", remote)
+	git(t, dir, "clone", "--quiet", remote, first)
+	git(t, first, "checkout", "--quiet", "-b", "main")
+	writeFile(t, filepath.Join(first, "chop.yaml"), syncBase)
+	writeFile(t, filepath.Join(first, "README"), "dotfiles\n")
+	git(t, first, "add", ".")
+	git(t, first, "commit", "--quiet", "-m", "initial")
+	git(t, first, "push", "--quiet", "-u", "origin", "main")
+	git(t, dir, "clone", "--quiet", remote, second)
+	return filepath.Join(first, "chop.yaml"), filepath.Join(second, "chop.yaml")
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := gitRepo{dir: dir}.run(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func writeFile(t *testing.T, filename string, content string) {
+	t.Helper()
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setNotes changes the notes of a machine in a configuration file
+func setNotes(t *testing.T, filename string, machine string, notes string) {
+	t.Helper()
+	store := inventory.YAMLStore{Filename: filename}
+	configs := inventory.NewConfiguration()
+	if err := store.Load(&configs); err != nil {
+		t.Fatal(err)
+	}
+	err := configs.UpdateMachine("acme", "web", machine, func(m *inventory.Machine) { m.Notes = notes })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(&configs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// notes returns the notes of a machine in a configuration file
+func notes(t *testing.T, filename string, machine string) string {
+	t.Helper()
+	configs := inventory.NewConfiguration()
+	if err := (inventory.YAMLStore{Filename: filename}).Load(&configs); err != nil {
+		t.Fatal(err)
+	}
+	return configs.Accounts["acme"].Projects["web"].Machines[machine].Notes
+}
+
+// unresolved leaves every conflict open, like sync without a terminal
+func unresolved(inventory.Conflict) (bool, error) {
+	return false, ErrUnresolved
+}
+
+func TestSyncFastForward(t *testing.T) {
+	first, second := syncClones(t)
+	setNotes(t, first, "db-1", "first")
+
+	result, err := SyncConfiguration(first, nil, unresolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Committed || !result.Pushed || result.Pulled {
+		t.Errorf("first: %+v, want committed and pushed", result)
+	}
+
+	result, err = SyncConfiguration(second, nil, unresolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Pulled || result.Merged || result.Committed || result.Pushed {
+		t.Errorf("second: %+v, want a fast-forward only", result)
+	}
+	if got := notes(t, second, "db-1"); got != "first" {
+		t.Errorf("notes = %q after fast-forward, want first", got)
+	}
+}
+
+func TestSyncSemanticMerge(t *testing.T) {
+	first, second := syncClones(t)
+	// Both computers changed the configuration, different machines
+	setNotes(t, first, "db-1", "first")
+	setNotes(t, second, "web-1", "second")
+	if _, err := SyncConfiguration(first, nil, unresolved); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := SyncConfiguration(second, nil, unresolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Merged || !result.Pushed || len(result.Conflicts) != 0 {
+		t.Errorf("second: %+v, want a merge without conflicts", result)
+	}
+	if got := notes(t, second, "db-1") + "," + notes(t, second, "web-1"); got != "first,second" {
+		t.Errorf("notes = %s after merge, want first,second", got)
+	}
+	if status := git(t, filepath.Dir(second), "status", "--porcelain", "--untracked-files=no"); status != "" {
+		t.Errorf("work tree not clean after merge:\n%s", status)
+	}
+}
+
+func TestSyncConflicts(t *testing.T) {
+	first, second := syncClones(t)
+	for _, machine := range []string{"db-1", "web-1"} {
+		setNotes(t, first, machine, "first")
+		setNotes(t, second, machine, "second")
+	}
+	if _, err := SyncConfiguration(first, nil, unresolved); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every conflict is listed, and nothing is merged
+	_, err := SyncConfiguration(second, nil, unresolved)
+	var conflicts *ConflictError
+	if !errors.As(err, &conflicts) {
+		t.Fatalf("err = %v, want a ConflictError", err)
+	}
+	if len(conflicts.Conflicts) != 2 {
+		t.Errorf("%d conflicts listed, want both: %v", len(conflicts.Conflicts), err)
+	}
+	if parents := git(t, filepath.Dir(second), "rev-list", "--parents", "-n", "1", "HEAD"); len(strings.Fields(parents)) != 2 {
+		t.Errorf("HEAD is a merge after unresolved conflicts: %s", parents)
+	}
+
+	// Resolving them merges
+	result, err := SyncConfiguration(second, nil, func(inventory.Conflict) (bool, error) { return true, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Merged || len(result.Conflicts) != 2 {
+		t.Errorf("%+v, want a merge with two resolved conflicts", result)
+	}
+	if got := notes(t, second, "db-1"); got != "first" {
+		t.Errorf("notes = %q, want theirs", got)
+	}
+}
+
+func TestSyncConflictOutsideConfiguration(t *testing.T) {
+	first, second := syncClones(t)
+	setNotes(t, first, "db-1", "first")
+	setNotes(t, second, "web-1", "second")
+	for i, filename := range []string{first, second} {
+		dir := filepath.Dir(filename)
+		writeFile(t, filepath.Join(dir, "README"), []string{"first\n", "second\n"}[i])
+		git(t, dir, "commit", "--quiet", "-am", "readme")
+	}
+	if _, err := SyncConfiguration(first, nil, unresolved); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := SyncConfiguration(second, nil, unresolved)
+	if !errors.Is(err, inventory.ErrInvalid) || !strings.Contains(err.Error(), "README") {
+		t.Fatalf("err = %v, want the conflicting README", err)
+	}
+	dir := filepath.Dir(second)
+	if _, err := os.Stat(filepath.Join(dir, ".git", "MERGE_HEAD")); err == nil {
+		t.Error("merge left in progress")
+	}
+	if status := git(t, dir, "status", "--porcelain", "--untracked-files=no"); status != "" {
+		t.Errorf("work tree not clean after the aborted merge:\n%s", status)
+	}
+}
@@ -0,0 +1,63 @@
+package chop
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"palexus/chop/pkg/inventory"
+	"regexp"
+	"strings"
+)
+
+// invalidInstanceChars matches what instance names may not contain
+var invalidInstanceChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// SpawnName returns a fresh machine name for a template: the template name and a random suffix
+func SpawnName(template string) string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	base := strings.Trim(invalidInstanceChars.ReplaceAllString(strings.ToLower(template), "-"), "-")
+	if base == "" || base[0] < 'a' || base[0] > 'z' {
+		base = "chop-" + base
+	}
+	return base + "-" + hex.EncodeToString(suffix)
+}
+
+// SpawnMachine creates a machine from a template of the project and adds it to the inventory
+func (c *Client) SpawnMachine(account string, project string, template string, name string) (inventory.Machine, error) {
+	proj, err := c.GetProject(account, project)
+	if err != nil {
+		return inventory.Machine{}, err
+	}
+	tmpl, exists := proj.Templates[template]
+	if !exists {
+		return inventory.Machine{}, fmt.Errorf("%w: %s", inventory.ErrTemplateNotFound, template)
+	}
+	if _, exists := proj.Machines[name]; exists {
+		return inventory.Machine{}, fmt.Errorf("%w: machine %q already exists in the project", inventory.ErrInvalid, name)
+	}
+
+	machine, err := c.Provider.CreateMachine(account, project, name, tmpl)
+	if err != nil {
+		return inventory.Machine{}, err
+	}
+	if err := c.MergeMachines(account, project, []inventory.Machine{machine}); err != nil {
+		return inventory.Machine{}, err
+	}
+	if err := c.TouchMachine(account, project, name); err != nil {
+		return inventory.Machine{}, err
+	}
+	return c.ResolveMachine(account, project, name)
+}
+
+// DestroyMachine deletes a machine in the cloud and removes it from the inventory
+func (c *Client) DestroyMachine(account string, project string, machine string) error {
+	mach, err := c.ResolveMachine(account, project, machine)
+	if err != nil {
+		return err
+	}
+	if err := c.Provider.DeleteMachine(account, project, mach); err != nil {
+		return err
+	}
+	return c.DeleteMachine(account, project, machine)
+}
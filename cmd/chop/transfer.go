@@ -0,0 +1,227 @@
+package chop
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"strings"
+)
+
+// Transfer describes a copy between the local machine and one machine of the inventory
+type Transfer struct {
+	Upload    bool     // Local files to the machine, otherwise files of the machine to the local machine
+	Sources   []string // Paths on the sending side
+	Target    string   // Path on the receiving side
+	Recursive bool
+}
+
+// paths returns the source and target arguments of scp-like commands, with the remote side prefixed by "remote:"
+func (transfer Transfer) paths(remote string) []string {
+	paths := make([]string, 0, len(transfer.Sources)+1)
+	for _, source := range transfer.Sources {
+		if !transfer.Upload {
+			source = remote + ":" + source
+		}
+		paths = append(paths, source)
+	}
+	if transfer.Upload {
+		return append(paths, remote+":"+transfer.Target)
+	}
+	return append(paths, transfer.Target)
+}
+
+// Location is a path on the local machine or, if Machine is set, on a machine of the inventory
+type Location struct {
+	Machine *inventory.MachineRef
+	Path    string
+}
+
+// String formats the location the way it is written on the command line
+func (location Location) String() string {
+	if location.Machine == nil {
+		return location.Path
+	}
+	return location.Machine.String() + ":" + location.Path
+}
+
+// ParseLocation reads a location written like scp does: "machine:path" for a path on a machine,
+// anything else for a local path. Local paths containing a colon can be written as ./name.
+// The machine can be given by any name ResolveName understands.
+func (c *Client) ParseLocation(arg string) (Location, error) {
+	name, path, found := strings.Cut(arg, ":")
+	if !found || name == "" || strings.Contains(name, "/") {
+		return Location{Path: arg}, nil
+	}
+	ref, err := c.ResolveName(name)
+	if err != nil {
+		return Location{}, err
+	}
+	return Location{Machine: &ref, Path: path}, nil
+}
+
+// Copy copies files between the local machine and machines of the inventory with the providers'
+// copy commands (scp), showing their progress. All sources must be on the same side. Copies from
+// one machine to another are staged in a local temporary directory.
+func (c *Client) Copy(sources []Location, target Location, recursive bool) error {
+	if len(sources) == 0 {
+		return errors.New("no source given")
+	}
+	from := sources[0].Machine
+	paths := make([]string, 0, len(sources))
+	for _, source := range sources {
+		if (source.Machine == nil) != (from == nil) || (from != nil && *source.Machine != *from) {
+			return errors.New("all sources must be on the same machine, or all local")
+		}
+		paths = append(paths, source.Path)
+	}
+
+	switch {
+	case from == nil && target.Machine == nil:
+		return errors.New("neither source nor target is on a machine, use 'cp' for local copies")
+
+	case from == nil:
+		fmt.Fprintf(c.stdout(), "Uploading %s to %s\n", countPaths(paths), target)
+		return c.transfer(*target.Machine, Transfer{Upload: true, Sources: paths, Target: target.Path, Recursive: recursive})
+
+	case target.Machine == nil:
+		fmt.Fprintf(c.stdout(), "Downloading %s from %s\n", countPaths(paths), from)
+		return c.transfer(*from, Transfer{Sources: paths, Target: target.Path, Recursive: recursive})
+	}
+
+	// Machine to machine: download everything, then upload what arrived
+	staging, err := os.MkdirTemp("", "chop-cp-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	fmt.Fprintf(c.stdout(), "(1/2) Downloading %s from %s\n", countPaths(paths), from)
+	if err := c.transfer(*from, Transfer{Sources: paths, Target: staging, Recursive: recursive}); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return fmt.Errorf("failed to read staging directory: %w", err)
+	}
+	staged := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		staged = append(staged, filepath.Join(staging, entry.Name()))
+	}
+	if len(staged) == 0 {
+		return errors.New("nothing was downloaded")
+	}
+
+	fmt.Fprintf(c.stdout(), "(2/2) Uploading %s to %s\n", countPaths(staged), target)
+	return c.transfer(*target.Machine, Transfer{Upload: true, Sources: staged, Target: target.Path, Recursive: recursive})
+}
+
+// transfer runs the provider's copy command for a machine and records its usage
+func (c *Client) transfer(ref inventory.MachineRef, transfer Transfer) error {
+	machine, err := c.ResolveMachine(ref.Account, ref.Project, ref.Machine)
+	if err != nil {
+		return err
+	}
+
+	cmd := c.Provider.CopyCommand(ref.Account, ref.Project, machine, transfer)
+	c.attach(cmd)
+	if err := cmd.Run(); err != nil {
+		return &CommandError{"copy", "", err}
+	}
+	return c.TouchMachine(ref.Account, ref.Project, ref.Machine)
+}
+
+// countPaths describes a list of paths for progress messages
+func countPaths(paths []string) string {
+	if len(paths) == 1 {
+		return paths[0]
+	}
+	return fmt.Sprintf("%d paths", len(paths))
+}
+
+// SyncOptions tune 'rsync' runs
+type SyncOptions struct {
+	Delete   bool     // Remove files on the target that are missing on the source
+	DryRun   bool     // Only show what would be transferred
+	Excludes []string // rsync exclude patterns
+}
+
+// SyncCommand builds the rsync command that mirrors source into target. Exactly one of them must be
+// on a machine. rsync talks to the machine with plain ssh, configured like 'chop ssh-config' does,
+// so cloud machines need the key that 'gcloud compute ssh' deploys on first use.
+func (c *Client) SyncCommand(source Location, target Location, options SyncOptions) (*exec.Cmd, error) {
+	if (source.Machine == nil) == (target.Machine == nil) {
+		return nil, errors.New("exactly one of source and target must be on a machine")
+	}
+	ref := source.Machine
+	if ref == nil {
+		ref = target.Machine
+	}
+
+	machine, err := c.ResolveMachine(ref.Account, ref.Project, ref.Machine)
+	if err != nil {
+		return nil, err
+	}
+	settings := sshConfigSettings(*ref, machine)
+	if settings == nil {
+		return nil, fmt.Errorf("no IP known for %s, run 'chop fetch machines'", ref)
+	}
+
+	args := []string{"-az", "--progress", "-e", rsyncShell(settings)}
+	if options.Delete {
+		args = append(args, "--delete")
+	}
+	if options.DryRun {
+		args = append(args, "--dry-run")
+	}
+	for _, exclude := range options.Excludes {
+		args = append(args, "--exclude", exclude)
+	}
+
+	// The host name only has to match the ssh options, HostName carries the real address
+	host := inventory.SSHHostName(*ref)
+	if source.Machine != nil {
+		return exec.Command("rsync", append(args, host+":"+source.Path, target.Path)...), nil
+	}
+	return exec.Command("rsync", append(args, source.Path, host+":"+target.Path)...), nil
+}
+
+// Sync mirrors source into target with rsync and records the usage of the machine
+func (c *Client) Sync(source Location, target Location, options SyncOptions) error {
+	cmd, err := c.SyncCommand(source, target, options)
+	if err != nil {
+		return err
+	}
+	ref := source.Machine
+	if ref == nil {
+		ref = target.Machine
+	}
+	err = c.Journal.Record(AuditEntry{Action: ActionConnect, Account: ref.Account, Project: ref.Project, Machine: ref.Machine, Detail: "rsync"})
+	if err != nil {
+		return fmt.Errorf("recording connection: %w", err)
+	}
+
+	fmt.Fprintf(c.stdout(), "Syncing %s to %s\n", source, target)
+	c.attach(cmd)
+	if err := cmd.Run(); err != nil {
+		return &CommandError{"rsync", "", err}
+	}
+	return c.TouchMachine(ref.Account, ref.Project, ref.Machine)
+}
+
+// rsyncShell builds the remote shell for 'rsync -e'. rsync splits it at blanks but keeps quoted values together.
+func rsyncShell(settings [][2]string) string {
+	parts := []string{"ssh"}
+	for _, setting := range settings {
+		option := setting[0] + "=" + setting[1]
+		if strings.ContainsAny(option, " \t'\"\\") {
+			// Inside double quotes rsync only unescapes \" and \\
+			option = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(option) + `"`
+		}
+		parts = append(parts, "-o", option)
+	}
+	return strings.Join(parts, " ")
+}
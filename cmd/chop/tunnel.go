@@ -0,0 +1,171 @@
+package chop
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// TunnelDir returns the directory for tunnel state and log files next to the configuration file
+func TunnelDir(filename string) string {
+	return filepath.Join(filepath.Dir(filename), "tunnels")
+}
+
+// TunnelState is written while a tunnel runs in the background
+type TunnelState struct {
+	inventory.TunnelRef
+	PID     int
+	Started time.Time
+}
+
+// Running reports whether the background process of the tunnel is still alive
+func (state TunnelState) Running() bool {
+	process, err := os.FindProcess(state.PID)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+// SaveTunnelState writes the state file of a running tunnel
+func SaveTunnelState(dir string, state TunnelState) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create tunnel directory: %w", err)
+	}
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode tunnel state: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, state.Key()+".json"), content, 0o644); err != nil {
+		return fmt.Errorf("failed to write tunnel state: %w", err)
+	}
+	return nil
+}
+
+// ReadTunnelState reads the state file of a tunnel. It returns os.ErrNotExist if the tunnel is not up.
+func ReadTunnelState(dir string, ref inventory.TunnelRef) (TunnelState, error) {
+	content, err := os.ReadFile(filepath.Join(dir, ref.Key()+".json"))
+	if err != nil {
+		return TunnelState{}, err
+	}
+	var state TunnelState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return TunnelState{}, fmt.Errorf("failed to decode tunnel state: %w", err)
+	}
+	return state, nil
+}
+
+// RemoveTunnelState deletes the state file of a tunnel
+func RemoveTunnelState(dir string, ref inventory.TunnelRef) error {
+	err := os.Remove(filepath.Join(dir, ref.Key()+".json"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove tunnel state: %w", err)
+	}
+	return nil
+}
+
+// TunnelLogFile returns the log file of a tunnel's background process
+func TunnelLogFile(dir string, ref inventory.TunnelRef) string {
+	return filepath.Join(dir, ref.Key()+".log")
+}
+
+// CheckLocalPort returns an error if something already listens on a local port
+func CheckLocalPort(port int) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("localhost", fmt.Sprint(port)))
+	if err != nil {
+		return fmt.Errorf("local port %d is already in use", port)
+	}
+	return listener.Close()
+}
+
+// TunnelStartTimeout is how long 'chop tunnel up' waits for the local port of a new tunnel
+const TunnelStartTimeout = 30 * time.Second
+
+// ErrTunnelNotReady is returned when the local port of a tunnel does not accept connections in time
+var ErrTunnelNotReady = errors.New("tunnel is not ready yet")
+
+// WaitForTunnel waits until the local port of a tunnel accepts connections. It fails when exited
+// reports the end of the tunnel's process first, and with ErrTunnelNotReady after the timeout.
+func WaitForTunnel(port int, exited <-chan error, timeout time.Duration) error {
+	address := net.JoinHostPort("localhost", fmt.Sprint(port))
+	deadline := time.After(timeout)
+	for {
+		if conn, err := net.DialTimeout("tcp", address, time.Second); err == nil {
+			return conn.Close()
+		}
+		select {
+		case err := <-exited:
+			if err == nil {
+				return fmt.Errorf("tunnel process exited before local port %d accepted connections", port)
+			}
+			return fmt.Errorf("tunnel process exited before local port %d accepted connections: %w", port, err)
+		case <-deadline:
+			return fmt.Errorf("%w: local port %d does not accept connections after %s", ErrTunnelNotReady, port, timeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+const (
+	tunnelMinUptime   = 10 * time.Second // Runs shorter than this count as failed attempts
+	tunnelMaxFailures = 5                // Give up after this many failed attempts in a row
+	tunnelMaxBackoff  = 30 * time.Second
+)
+
+// SuperviseTunnel runs the tunnel command and restarts it whenever it drops,
+// until ctx is cancelled. It gives up when the tunnel keeps failing right after start.
+func SuperviseTunnel(ctx context.Context, newCommand func() *exec.Cmd, log io.Writer) error {
+	failures := 0
+	backoff := time.Second
+	for {
+		cmd := newCommand()
+		cmd.Stdout = log
+		cmd.Stderr = log
+
+		started := time.Now()
+		fmt.Fprintln(log, started.Format(time.RFC3339), "starting:", strings.Join(cmd.Args, " "))
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("failed to start tunnel: %w", err)
+		}
+
+		// Stop the tunnel as soon as the supervisor is asked to
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		var err error
+		select {
+		case <-ctx.Done():
+			cmd.Process.Signal(os.Interrupt)
+			<-done
+			return nil
+		case err = <-done:
+		}
+
+		// Reset the backoff after a tunnel that was up for a while
+		if time.Since(started) < tunnelMinUptime {
+			failures++
+		} else {
+			failures, backoff = 0, time.Second
+		}
+		fmt.Fprintln(log, time.Now().Format(time.RFC3339), "tunnel dropped:", err)
+		if failures >= tunnelMaxFailures {
+			return fmt.Errorf("tunnel failed %d times in a row, see the log for details", failures)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, tunnelMaxBackoff)
+	}
+}
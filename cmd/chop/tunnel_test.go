@@ -0,0 +1,84 @@
+package chop
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"palexus/chop/pkg/inventory"
+	"testing"
+	"time"
+)
+
+// freePort returns a local port nothing listens on
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestWaitForTunnel(t *testing.T) {
+	t.Run("port accepts connections", func(t *testing.T) {
+		port := freePort(t)
+		listening := make(chan net.Listener, 1)
+		go func() {
+			// The tunnel comes up a little after its process started
+			time.Sleep(200 * time.Millisecond)
+			listener, err := net.Listen("tcp", net.JoinHostPort("localhost", fmt.Sprint(port)))
+			if err != nil {
+				close(listening)
+				return
+			}
+			listening <- listener
+		}()
+		if err := WaitForTunnel(port, make(chan error), 5*time.Second); err != nil {
+			t.Errorf("err = %v, want the tunnel up", err)
+		}
+		if listener, ok := <-listening; ok {
+			listener.Close()
+		}
+	})
+
+	t.Run("process exits", func(t *testing.T) {
+		exited := make(chan error, 1)
+		exited <- errors.New("exit status 1")
+		err := WaitForTunnel(freePort(t), exited, 5*time.Second)
+		if err == nil || errors.Is(err, ErrTunnelNotReady) {
+			t.Errorf("err = %v, want the exit of the process", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		err := WaitForTunnel(freePort(t), make(chan error), 300*time.Millisecond)
+		if !errors.Is(err, ErrTunnelNotReady) {
+			t.Errorf("err = %v, want ErrTunnelNotReady", err)
+		}
+	})
+}
+
+func TestTunnelStateKeys(t *testing.T) {
+	dir := t.TempDir()
+	// Joined with "_" these two references used to share their state file
+	refs := []inventory.TunnelRef{
+		{Account: "acme", Project: "web_db", Machine: "1", Name: "pg"},
+		{Account: "acme", Project: "web", Machine: "db_1", Name: "pg"},
+		{Account: "me@example.com", Project: "a/b", Machine: "db-1", Name: "../pg"},
+	}
+	for i, ref := range refs {
+		if err := SaveTunnelState(dir, TunnelState{TunnelRef: ref, PID: 100 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, ref := range refs {
+		state, err := ReadTunnelState(dir, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.PID != 100+i {
+			t.Errorf("state of %+v has pid %d, want %d", ref, state.PID, 100+i)
+		}
+	}
+}
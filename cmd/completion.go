@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"palexus/chop/pkg/inventory"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// completionAccount returns the account given with --account, or the active account
+func completionAccount(cmd *cobra.Command) string {
+	a := appFrom(cmd)
+	if flag := cmd.Flags().Lookup("account"); flag != nil && flag.Value.String() != "" {
+		return flag.Value.String()
+	}
+	return a.config.ActiveAccount
+}
+
+// completionProject returns the project given with --project, or the active project of the account
+func completionProject(cmd *cobra.Command, account string) string {
+	a := appFrom(cmd)
+	if flag := cmd.Flags().Lookup("project"); flag != nil && flag.Value.String() != "" {
+		return flag.Value.String()
+	}
+	return a.config.ActiveProjects[account]
+}
+
+// filterCompletions keeps the names that start with toComplete and were not given as arguments yet
+func filterCompletions(names []string, args []string, toComplete string) []string {
+	completions := make([]string, 0, len(names))
+	for _, name := range names {
+		if strings.HasPrefix(name, toComplete) && !slices.Contains(args, name) {
+			completions = append(completions, name)
+		}
+	}
+	return completions
+}
+
+// completeAccounts completes account names
+func completeAccounts(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	a := appFrom(cmd)
+	return filterCompletions(a.config.AccountNames(), args, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeProjects completes the projects of the account given with --account (or the active account)
+func completeProjects(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	a := appFrom(cmd)
+	account := completionAccount(cmd)
+	return filterCompletions(a.config.ProjectNames(account), args, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeMachines completes the machines of the chosen project, described by zone and status
+func completeMachines(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	a := appFrom(cmd)
+	account := completionAccount(cmd)
+	project := completionProject(cmd, account)
+
+	completions := []string{}
+	for _, machine := range a.config.Machines(account, project) {
+		if !strings.HasPrefix(machine.Name, toComplete) || slices.Contains(args, machine.Name) {
+			continue
+		}
+		completions = append(completions, machine.Name+"\t"+machineDescription(machine))
+	}
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeAliases completes existing aliases, described by the machine they point to
+func completeAliases(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	a := appFrom(cmd)
+	completions := []string{}
+	for alias, ref := range a.config.AliasNames() {
+		if strings.HasPrefix(alias, toComplete) && !slices.Contains(args, alias) {
+			completions = append(completions, alias+"\t"+ref.String())
+		}
+	}
+	slices.Sort(completions)
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+// machineDescription summarizes a machine for completion menus
+func machineDescription(machine inventory.Machine) string {
+	details := []string{}
+	if machine.Zone != "" {
+		details = append(details, machine.Zone)
+	}
+	if machine.Status != "" {
+		details = append(details, machine.Status)
+	}
+	if len(details) == 0 && !machine.LastUsage.IsZero() {
+		details = append(details, "last used "+machine.LastUsage.Format("2006-01-02"))
+	}
+	return strings.Join(details, ", ")
+}
+
+// registerCompletions wires the dynamic completions. It must run after all flags are defined.
+func registerCompletions() {
+	// Arguments naming existing entries
+	setAccountCmd.ValidArgsFunction = completeAccounts
+	setProjectCmd.ValidArgsFunction = completeProjects
+	rmAccountCmd.ValidArgsFunction = completeAccounts
+	rmProjectCmd.ValidArgsFunction = completeProjects
+	rmMachineCmd.ValidArgsFunction = completeMachines
+	rmAliasCmd.ValidArgsFunction = completeAliases
+	addAliasCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		// Only the first argument names an existing machine
+		if len(args) > 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		return completeMachines(cmd, args, toComplete)
+	}
+
+	// Arguments naming new entries have nothing to complete
+	addAccountCmd.ValidArgsFunction = cobra.NoFileCompletions
+	addProjectCmd.ValidArgsFunction = cobra.NoFileCompletions
+	addMachineCmd.ValidArgsFunction = cobra.NoFileCompletions
+
+	// --account and --project flags
+	for _, cmd := range []*cobra.Command{addProjectCmd, addMachineCmd, addAliasCmd, setProjectCmd, unsetProjectCmd, rmProjectCmd, rmMachineCmd, fetchProjectCmd, fetchMachineCmd} {
+		cmd.RegisterFlagCompletionFunc("account", completeAccounts)
+	}
+	for _, cmd := range []*cobra.Command{addMachineCmd, addAliasCmd, rmMachineCmd, fetchMachineCmd, setTransportCmd} {
+		cmd.RegisterFlagCompletionFunc("project", completeProjects)
+	}
+	setSSHCmd.ValidArgsFunction = completeMachines
+	setSSHCmd.RegisterFlagCompletionFunc("account", completeAccounts)
+	setSSHCmd.RegisterFlagCompletionFunc("project", completeProjects)
+	setTransportCmd.RegisterFlagCompletionFunc("account", completeAccounts)
+	setTransportCmd.RegisterFlagCompletionFunc("machine", completeMachines)
+}
@@ -0,0 +1,479 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
+	"strings"
+	"time"
+
+	"github.com/alexeyco/simpletable"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage how and where the configuration is stored",
+}
+
+// Copy the configuration into another storage backend
+var configConvertCmd = &cobra.Command{
+	Use:   "convert [destination]",
+	Short: "Copy the configuration into a file of another storage backend",
+	Long: `Copies the configuration into a new file. The backend follows from the extension:
+.db and .bolt files are bbolt databases, which only write the machines that changed and
+lock the file while chop saves; all other files are YAML.
+
+Either way chop saves by applying what a command changed to the configuration as it is
+stored at that moment, so that concurrent chops keep each other's changes. Only the
+database makes this safe against chops saving at the very same time.
+
+Databases cannot be encrypted or merged with system and team layers, so encrypted
+configurations and configurations with such layers are only converted to YAML.
+
+chop keeps using its current configuration file until CHOP_CONFIG points to the new one.`,
+	Example: `  chop config convert ~/.config/chop/chop.db
+  export CHOP_CONFIG=~/.config/chop/chop.db
+  chop config convert --from ~/.config/chop/chop.db ~/chop-export.yaml`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		from, _ := cmd.Flags().GetString("from")
+		force, _ := cmd.Flags().GetBool("force")
+		destination := args[0]
+
+		if from == "" {
+			from = a.configFile
+		}
+		if from == destination {
+			return fmt.Errorf("converting configuration: %w: source and destination are the same file", inventory.ErrInvalid)
+		}
+		if _, err := os.Stat(destination); err == nil && !force {
+			return fmt.Errorf("converting configuration: %w: %s exists, use --force to replace it", inventory.ErrInvalid, destination)
+		}
+		if force {
+			// A database would otherwise keep what the old file contained besides the configuration
+			if err := os.Remove(destination); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("converting configuration: %w", err)
+			}
+		}
+
+		configs, err := chop.ConvertStore(from, destination, a.keySource)
+		if err != nil {
+			return fmt.Errorf("converting configuration: %w", err)
+		}
+
+		machines := 0
+		for _, account := range configs.Accounts {
+			for _, project := range account.Projects {
+				machines += len(project.Machines)
+			}
+		}
+		fmt.Fprintf(a.stdout, "Converted %d account(s) with %d machine(s) from %s (%s) to %s (%s)\n",
+			len(configs.Accounts), machines, from, chop.Backend(from), destination, chop.Backend(destination))
+		if destination != a.configFile {
+			fmt.Fprintln(a.stdout, "Set CHOP_CONFIG="+destination, "to use it.")
+		}
+		return nil
+	},
+}
+
+// Show which configuration layer supplied each value
+var configExplainCmd = &cobra.Command{
+	Use:   "explain [path]",
+	Short: "Show which configuration layer supplied each value",
+	Long: `Lists the configuration layers and, for every value at or below path, the layer it
+comes from. Paths join the keys of the YAML file with slashes.
+
+The layers are merged in this order, later ones win value by value:
+
+  system  /etc/chop/chop.yaml, or the file in CHOP_SYSTEM_CONFIG
+  team    the file named by 'teamfile:' in the system or your file, or CHOP_TEAM_CONFIG
+  user    your own configuration file
+
+The team layer may be an https URL, e.g. of an artifact server or a raw file in Git.
+It is cached next to your configuration, revalidated with ETag and If-Modified-Since
+every few minutes, and used from the cache while the server cannot be reached.
+
+chop only writes your own file, and only what differs from the shared layers. Removing
+something a shared layer defines hides it for you with a null value.`,
+	Example: `  chop config explain
+  chop config explain accounts/acme/projects/web/machines/db-1
+  chop config explain activeaccount`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		if chop.Backend(a.configFile) != chop.BackendYAML {
+			return fmt.Errorf("explaining configuration: %w: layers need a YAML configuration file", inventory.ErrInvalid)
+		}
+		layers, _, err := chop.ConfigLayers(a.configFile, a.keySource)
+		if err != nil {
+			return fmt.Errorf("explaining configuration: %w", err)
+		}
+		_, provenance, err := inventory.MergeLayers(layers)
+		if err != nil {
+			return fmt.Errorf("explaining configuration: %w", err)
+		}
+
+		path := ""
+		if len(args) > 0 {
+			path = args[0]
+		}
+		paths := provenance.Paths(path)
+		if path != "" && len(paths) == 0 {
+			return fmt.Errorf("explaining configuration: %w: no value is set at %s", inventory.ErrInvalid, path)
+		}
+
+		fmt.Fprintln(a.stdout, "Layers, later ones win:")
+		for _, layer := range layers {
+			fmt.Fprintf(a.stdout, "  %-6s  %s\n", layer.Name, layer.Source)
+		}
+		fmt.Fprintln(a.stdout)
+
+		table := simpletable.New()
+		table.Header = &simpletable.Header{
+			Cells: []*simpletable.Cell{
+				{Text: "PATH"},
+				{Text: "VALUE"},
+				{Text: "LAYER"},
+			},
+		}
+		for _, path := range paths {
+			origin := provenance[path]
+			table.Body.Cells = append(table.Body.Cells, []*simpletable.Cell{
+				{Text: path},
+				{Text: formatValue(origin.Value)},
+				{Text: origin.Layer},
+			})
+		}
+		table.SetStyle(simpletable.StyleDefault)
+		fmt.Fprintln(a.stdout, table.String())
+		return nil
+	},
+}
+
+// Synchronize the configuration with a Git repository
+var configSyncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Commit, merge and push the configuration kept in a Git repository",
+	Long: `Synchronizes your configuration file with the upstream branch of the Git repository it
+lives in, e.g. a dotfiles repository shared by your computers:
+
+  1. commits local changes to the file
+  2. fetches and merges the upstream branch
+  3. pushes what the upstream branch does not have yet
+
+The configuration is not merged line by line. Accounts, projects and machines are merged
+key by key, so adding, changing or deleting different machines on two computers never
+conflicts. Tags and aliases are merged as sets, the later last usage of a machine wins,
+and the active account and projects stay as they are on this computer.
+
+Only values both sides changed differently are conflicts. chop asks which side to keep
+for each of them, or keeps one side for all with --ours or --theirs. Without a terminal
+and without these flags, sync commits local changes but stops before merging and lists
+all conflicts.`,
+	Example: `  chop config sync
+  chop config sync --theirs`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		ours, _ := cmd.Flags().GetBool("ours")
+		theirs, _ := cmd.Flags().GetBool("theirs")
+
+		resolve := func(conflict inventory.Conflict) (bool, error) {
+			switch {
+			case ours || theirs:
+				return theirs, nil
+			case !a.interactive():
+				return false, chop.ErrUnresolved
+			}
+			fmt.Fprintf(a.stdout, "Conflict at %s\n", conflict)
+			fmt.Fprintf(a.stdout, "  base:   %s\n", formatSide(conflict.Base, conflict.InBase))
+			fmt.Fprintf(a.stdout, "  ours:   %s\n", formatSide(conflict.Ours, conflict.InOurs))
+			fmt.Fprintf(a.stdout, "  theirs: %s\n", formatSide(conflict.Theirs, conflict.InTheirs))
+			for {
+				fmt.Fprint(a.stdout, "Keep ours or take theirs? [ours/theirs]: ")
+				input, err := bufio.NewReader(a.stdin).ReadString('\n')
+				if err != nil {
+					return false, chop.ErrUnresolved
+				}
+				switch strings.TrimSpace(strings.ToLower(input)) {
+				case "ours", "o":
+					return false, nil
+				case "theirs", "t":
+					return true, nil
+				}
+			}
+		}
+
+		// Merging replaces the file, keep what it was for 'chop undo'
+		if err := a.client.Journal.Check(); err != nil {
+			return fmt.Errorf("syncing configuration: %w", err)
+		}
+		if err := a.takeSnapshot(); err != nil {
+			return fmt.Errorf("syncing configuration: %w", err)
+		}
+		result, err := chop.SyncConfiguration(a.configFile, a.keySource, resolve)
+		a.dropSnapshotIfUnchanged()
+		var conflicts *chop.ConflictError
+		if errors.As(err, &conflicts) {
+			return fmt.Errorf("syncing configuration: %w\nChoose a side with --ours or --theirs", err)
+		}
+		if err != nil {
+			return fmt.Errorf("syncing configuration: %w", err)
+		}
+
+		if result.Pulled {
+			detail := "pulled from " + result.Upstream
+			if result.Merged {
+				detail = "merged from " + result.Upstream
+			}
+			if err := a.recordReplaced(chop.AuditEntry{Action: chop.ActionSync, Detail: detail}, a.saved); err != nil {
+				return fmt.Errorf("syncing configuration: %w", err)
+			}
+		}
+		if result.Committed {
+			fmt.Fprintln(a.stdout, "Committed local changes")
+		}
+		switch {
+		case result.Merged:
+			fmt.Fprintf(a.stdout, "Merged changes from %s, %d conflict(s) resolved\n", result.Upstream, len(result.Conflicts))
+		case result.Pulled:
+			fmt.Fprintf(a.stdout, "Pulled changes from %s\n", result.Upstream)
+		}
+		if result.Pushed {
+			fmt.Fprintf(a.stdout, "Pushed to %s\n", result.Upstream)
+		}
+		if !result.Committed && !result.Pulled && !result.Pushed {
+			fmt.Fprintf(a.stdout, "Already in sync with %s\n", result.Upstream)
+		}
+		return nil
+	},
+}
+
+// Encrypt the configuration file
+var configEncryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt the configuration file, or some fields of every machine",
+	Long: `Encrypts your configuration file with age, using a passphrase or an age key file.
+
+Without --fields the whole file is encrypted. With --fields only those fields of every
+machine are, e.g. notes, ssh or ssh/user; the rest stays readable and diffable, which
+suits files kept in Git. Fields that did not change keep their ciphertext.
+
+chop decrypts the file whenever it reads it and encrypts it again when it saves. It takes
+the key from CHOP_AGE_KEY_FILE, or the passphrase from CHOP_PASSPHRASE, and otherwise asks
+for the passphrase. Commands running in the background, like tunnels, need one of the
+variables.
+
+The snapshots of 'chop history' are removed, they would keep the plain text.`,
+	Example: `  chop config encrypt
+  chop config encrypt --fields notes,ssh
+  age-keygen -o ~/.config/chop/key.txt && chop config encrypt --key-file ~/.config/chop/key.txt`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		fields, _ := cmd.Flags().GetStringSlice("fields")
+		keyFile, _ := cmd.Flags().GetString("key-file")
+		if chop.Backend(a.configFile) != chop.BackendYAML {
+			return fmt.Errorf("encrypting configuration: %w: only YAML configuration files can be encrypted", inventory.ErrInvalid)
+		}
+
+		// An encrypted file keeps its keys unless others are given, use rekey to change them
+		if keyFile != "" || a.config.Encryption == nil {
+			keys, found, err := chop.KeysFromEnvironment()
+			if keyFile != "" || !found {
+				keys, err = a.newKeys(keyFile, "CHOP_PASSPHRASE")
+			}
+			if err != nil {
+				return fmt.Errorf("encrypting configuration: %w", err)
+			}
+			a.keys, a.rekeyed = &keys, true
+		}
+		encryption, err := inventory.NewEncryption(fields, a.keySource)
+		if err != nil {
+			return fmt.Errorf("encrypting configuration: %w", err)
+		}
+		a.config.Encryption = encryption
+		if err := a.save(); err != nil {
+			return err
+		}
+		if err := a.removeSnapshots(); err != nil {
+			return fmt.Errorf("encrypting configuration: %w", err)
+		}
+
+		what := "the whole file"
+		if len(fields) > 0 {
+			what = "the fields " + strings.Join(fields, ", ") + " of every machine in"
+		}
+		keys, err := a.keySource()
+		if err != nil {
+			return fmt.Errorf("encrypting configuration: %w", err)
+		}
+		fmt.Fprintf(a.stdout, "Encrypted %s %s with the %s\n", what, a.configFile, keySourceName(keys))
+		if keyFile != "" && os.Getenv("CHOP_AGE_KEY_FILE") != keyFile {
+			fmt.Fprintln(a.stdout, "Set CHOP_AGE_KEY_FILE="+keyFile, "so chop can read it.")
+		}
+		return nil
+	},
+}
+
+// Decrypt the configuration file
+var configDecryptCmd = &cobra.Command{
+	Use:   "decrypt",
+	Short: "Store the configuration file as plain text again",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		if a.config.Encryption == nil {
+			fmt.Fprintln(a.stdout, a.configFile, "is not encrypted")
+			return nil
+		}
+		a.config.Encryption = nil
+		if err := a.save(); err != nil {
+			return err
+		}
+		fmt.Fprintln(a.stdout, "Decrypted", a.configFile)
+		return nil
+	},
+}
+
+// Encrypt the configuration file with new keys
+var configRekeyCmd = &cobra.Command{
+	Use:   "rekey",
+	Short: "Encrypt the configuration file with a new passphrase or key file",
+	Long: `Decrypts the configuration file with the current keys and encrypts it with a new
+passphrase or age key file. Encrypted fields also get a new data key. The snapshots of
+'chop history' are removed, they could still be read with the old keys.
+
+The new passphrase is read from CHOP_NEW_PASSPHRASE, or asked for twice.`,
+	Example: `  chop config rekey
+  chop config rekey --key-file ~/.config/chop/key.txt`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		keyFile, _ := cmd.Flags().GetString("key-file")
+		if a.config.Encryption == nil {
+			return fmt.Errorf("rekeying configuration: %w: %s is not encrypted, use 'chop config encrypt'", inventory.ErrInvalid, a.configFile)
+		}
+
+		keys, err := a.newKeys(keyFile, "CHOP_NEW_PASSPHRASE")
+		if err != nil {
+			return fmt.Errorf("rekeying configuration: %w", err)
+		}
+		a.keys, a.rekeyed = &keys, true
+		if !a.config.Encryption.File {
+			if a.config.Encryption, err = inventory.NewEncryption(a.config.Encryption.Fields, a.keySource); err != nil {
+				return fmt.Errorf("rekeying configuration: %w", err)
+			}
+		}
+		if err := a.save(); err != nil {
+			return err
+		}
+		if err := a.removeSnapshots(); err != nil {
+			return fmt.Errorf("rekeying configuration: %w", err)
+		}
+		fmt.Fprintf(a.stdout, "Encrypted %s with the new %s\n", a.configFile, keySourceName(keys))
+		return nil
+	},
+}
+
+// removeSnapshots deletes the snapshots after encrypting or rekeying: they hold the
+// configuration in plain text or under the old keys, which may be what is to be left behind
+func (a *app) removeSnapshots() error {
+	removed, err := chop.RemoveSnapshots(a.configFile)
+	a.snapshot = nil
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		fmt.Fprintf(a.stdout, "Removed %d snapshot(s) readable without the new keys, 'chop undo' starts over\n", removed)
+	}
+	return nil
+}
+
+// newKeys returns the keys of an age key file or of a new passphrase, which is taken from
+// the environment variable env or asked for twice
+func (a *app) newKeys(keyFile string, env string) (inventory.Keys, error) {
+	if keyFile != "" {
+		return inventory.KeysFromFile(keyFile)
+	}
+	if passphrase := os.Getenv(env); passphrase != "" {
+		return inventory.KeysFromPassphrase(passphrase)
+	}
+	if !a.interactive() {
+		return inventory.Keys{}, fmt.Errorf("%w: use --key-file or set %s", inventory.ErrNoKey, env)
+	}
+	passphrase, err := a.askPassphrase("New passphrase: ")
+	if err != nil {
+		return inventory.Keys{}, err
+	}
+	repeated, err := a.askPassphrase("Repeat the passphrase: ")
+	if err != nil {
+		return inventory.Keys{}, err
+	}
+	if passphrase != repeated {
+		return inventory.Keys{}, fmt.Errorf("%w: the passphrases differ", inventory.ErrInvalid)
+	}
+	return inventory.KeysFromPassphrase(passphrase)
+}
+
+// keySourceName describes where keys come from
+func keySourceName(keys inventory.Keys) string {
+	if keys.Source == "passphrase" {
+		return "passphrase"
+	}
+	return "key file " + keys.Source
+}
+
+// formatSide prints one side of a merge conflict
+func formatSide(value any, present bool) string {
+	if !present {
+		return "(not set)"
+	}
+	if _, ok := value.(map[string]any); ok {
+		out, err := yaml.Marshal(value)
+		if err == nil {
+			return "\n    " + strings.ReplaceAll(strings.TrimSpace(string(out)), "\n", "\n    ")
+		}
+	}
+	return formatValue(value)
+}
+
+// formatValue prints a configuration value on one line
+func formatValue(value any) string {
+	switch value := value.(type) {
+	case time.Time:
+		return value.Format(time.RFC3339)
+	case []any:
+		items := make([]string, len(value))
+		for i, item := range value {
+			items[i] = formatValue(item)
+		}
+		return strings.Join(items, ", ")
+	}
+	return fmt.Sprint(value)
+}
+
+func init() {
+	// ********** CONFIG ************
+	configConvertCmd.Flags().String("from", "", "Configuration file to convert (default the one chop uses)")
+	configConvertCmd.Flags().BoolP("force", "f", false, "Replace an existing destination file")
+	configCmd.AddCommand(configConvertCmd)
+	configCmd.AddCommand(configExplainCmd)
+	configSyncCmd.Flags().Bool("ours", false, "Keep this computer's value for every conflict")
+	configSyncCmd.Flags().Bool("theirs", false, "Take the upstream value for every conflict")
+	configSyncCmd.MarkFlagsMutuallyExclusive("ours", "theirs")
+	configCmd.AddCommand(configSyncCmd)
+	configEncryptCmd.Flags().StringSlice("fields", nil, "Encrypt only these fields of every machine, e.g. notes,ssh/user")
+	configEncryptCmd.Flags().String("key-file", "", "Encrypt with an age key file instead of a passphrase")
+	configCmd.AddCommand(configEncryptCmd)
+	configCmd.AddCommand(configDecryptCmd)
+	configRekeyCmd.Flags().String("key-file", "", "Encrypt with this age key file instead of a new passphrase")
+	configCmd.AddCommand(configRekeyCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Connect to a machine of the active (or given) project
+var connectCmd = &cobra.Command{
+	Use:   "connect [machine_name]",
+	Short: "SSH into a machine",
+	Long: `Opens an SSH session to a machine of the active project using 'gcloud compute ssh'.
+Cloud machines are checked first: a stopped machine is started after asking (or right
+away with --start), and chop waits until it runs and SSH answers before connecting.`,
+	Args: cobra.ExactArgs(1), // Ensure that exactly one machine name is passed
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return err
+		}
+
+		start, _ := cmd.Flags().GetBool("start")
+		noCheck, _ := cmd.Flags().GetBool("no-check")
+		wait, _ := cmd.Flags().GetDuration("wait")
+
+		if !noCheck {
+			confirm := func(status string) bool {
+				return start || a.askYesNo(fmt.Sprintf("%s is %s. Start it?", args[0], status))
+			}
+			progress := func(message string) { fmt.Fprintln(a.stdout, message) }
+			err := a.client.EnsureRunning(account, project, args[0], wait, confirm, progress)
+			if err != nil {
+				// Keep the status and IPs learned on the way
+				return errors.Join(fmt.Errorf("preparing machine: %w", err), a.save())
+			}
+		}
+
+		err = a.client.Connect(account, project, args[0])
+		if err != nil {
+			return fmt.Errorf("connecting to machine: %w", err)
+		}
+
+		// Save the configuration to remember the last usage
+		return a.save()
+	},
+}
+
+func init() {
+	// ********** CONNECT ************
+	connectCmd.Flags().String("account", "", "Account of the machine (if not provided, active account will be used)")
+	connectCmd.Flags().String("project", "", "Project of the machine (if not provided, active project will be used)")
+	connectCmd.Flags().Bool("start", false, "Start the machine without asking if it is stopped")
+	connectCmd.Flags().Bool("no-check", false, "Connect right away without checking the status of the machine")
+	connectCmd.Flags().Duration("wait", 3*time.Minute, "How long to wait for a starting machine to answer")
+	connectCmd.ValidArgsFunction = completeMachines
+	connectCmd.RegisterFlagCompletionFunc("account", completeAccounts)
+	connectCmd.RegisterFlagCompletionFunc("project", completeProjects)
+	rootCmd.AddCommand(connectCmd)
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"palexus/chop/cmd/chop"
+
+	"github.com/spf13/cobra"
+)
+
+// Open synchronized sessions to many machines
+var csshCmd = &cobra.Command{
+	Use:   "cssh [machines...]",
+	Short: "Open one tmux pane per machine with input sent to all of them",
+	Long: `Opens a tmux window with an SSH session per machine, either the given machines (a unique
+part of a name is enough) or all machines matching --account, --project and --tag (the
+active project if none of them is given). What you type goes to every pane. Press the tmux prefix followed by ` + chop.ClusterToggleKey + ` to
+toggle between typing into all panes and only the selected one. The key only does so in
+windows opened by chop cssh, elsewhere it keeps its previous binding.
+
+Inside tmux the window is added to the current session, otherwise a new session is attached.`,
+	Example: `  chop cssh --tag web
+  chop cssh web-1 web-2 db-1
+  chop cssh --project staging --session staging`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		session, _ := cmd.Flags().GetString("session")
+
+		// The panes show which machines were picked, so parts of names are fine
+		refs, err := selectMachines(cmd, args, true)
+		if err != nil {
+			return err
+		}
+
+		// Sessions may have been opened even if attaching failed, so save the usage either way
+		err = a.client.ClusterSSH(refs, session)
+		if err != nil {
+			return errors.Join(fmt.Errorf("opening sessions: %w", err), a.save())
+		}
+		return a.save()
+	},
+}
+
+func init() {
+	// ********** CSSH ************
+	addSelectionFlags(csshCmd)
+	csshCmd.Flags().String("session", "chop-cssh", "Name of the tmux session to create when not inside tmux")
+	rootCmd.AddCommand(csshCmd)
+}
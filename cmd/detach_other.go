@@ -0,0 +1,10 @@
+//go:build !unix
+
+package cmd
+
+import "syscall"
+
+// detachedProcAttr has nothing to add on platforms without sessions
+func detachedProcAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build unix
+
+package cmd
+
+import "syscall"
+
+// detachedProcAttr starts background processes in their own session,
+// so they survive the terminal that started them
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
+	"strings"
+)
+
+// Exit codes of chop, so scripts can tell failures apart:
+//
+//	0  success, also when a confirmation was declined
+//	1  any other failure, e.g. the configuration could not be saved
+//	2  an account, project, machine, alias, tunnel or template does not exist
+//	3  the cloud provider or a tool like gcloud, ssh, rsync or git failed
+//	4  wrong usage: bad arguments or flags, no active account or project, an ambiguous name
+const (
+	exitOK       = 0
+	exitFailure  = 1
+	exitNotFound = 2
+	exitProvider = 3
+	exitUsage    = 4
+)
+
+// usageError marks errors found before a command started to work
+type usageError struct {
+	err error
+}
+
+func (e usageError) Error() string { return e.err.Error() }
+func (e usageError) Unwrap() error { return e.err }
+
+// silentError ends chop with the exit code of err without printing it
+type silentError struct {
+	err error
+}
+
+func (e silentError) Error() string { return e.err.Error() }
+func (e silentError) Unwrap() error { return e.err }
+
+// batchError reports that an operation failed on some of many machines.
+// The failures were shown per machine already, only the count is printed.
+type batchError struct {
+	total  int
+	failed []error
+}
+
+func (e batchError) Error() string {
+	return fmt.Sprintf("failed on %d of %d machines", len(e.failed), e.total)
+}
+func (e batchError) Unwrap() []error { return e.failed }
+
+// exitCode maps an error returned by a command to the exit code of chop
+func exitCode(err error) int {
+	var commandErr *chop.CommandError
+	var usage usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, inventory.ErrAccountNotFound), errors.Is(err, inventory.ErrProjectNotFound),
+		errors.Is(err, inventory.ErrMachineNotFound), errors.Is(err, inventory.ErrAliasNotFound),
+		errors.Is(err, inventory.ErrTunnelNotFound), errors.Is(err, inventory.ErrTemplateNotFound):
+		return exitNotFound
+	case errors.As(err, &commandErr), errors.Is(err, chop.ErrNotManaged), errors.Is(err, chop.ErrNotRunning):
+		return exitProvider
+	case errors.As(err, &usage), errors.Is(err, inventory.ErrNoActiveAccount), errors.Is(err, inventory.ErrNoActiveProject),
+		errors.Is(err, inventory.ErrAmbiguous), errors.Is(err, inventory.ErrInvalid):
+		return exitUsage
+	}
+	return exitFailure
+}
+
+// printError writes an error to stderr, one line per joined error
+func printError(a *app, err error) {
+	var silent silentError
+	if errors.As(err, &silent) {
+		return
+	}
+	for _, line := range strings.Split(err.Error(), "\n") {
+		fmt.Fprintln(a.stderr, "Error:", line)
+	}
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
+	"strings"
+	"time"
+
+	"github.com/alexeyco/simpletable"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// Run a command on many machines at once
+var execCmd = &cobra.Command{
+	Use:   "exec [machines...] -- [command...]",
+	Short: "Run a command on several machines in parallel",
+	Long: `Runs a shell command on the given machines, or on all machines matching --account,
+--project and --tag (the active project if none of them is given). Output is streamed
+line by line, prefixed with the machine, or with --group printed per machine once it
+finishes. A summary of exit codes and durations follows. chop exits with 1 if the
+command failed anywhere.`,
+	Example: `  chop exec --tag web -- uptime
+  chop exec web-1 db-1 -- df -h /
+  chop exec --project staging --parallel 4 --group -- 'sudo apt-get -qq update'
+  chop exec --tag web --json -- systemctl is-active nginx`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if cmd.ArgsLenAtDash() < 0 || cmd.ArgsLenAtDash() == len(args) {
+			return fmt.Errorf("the command must follow --, e.g. chop exec --tag web -- uptime")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		group, _ := cmd.Flags().GetBool("group")
+		asJSON, _ := cmd.Flags().GetBool("json")
+		parallel, _ := cmd.Flags().GetInt("parallel")
+
+		refs, err := selectMachines(cmd, args[:cmd.ArgsLenAtDash()], false)
+		if err != nil {
+			return err
+		}
+
+		labels := execLabels(refs)
+		options := chop.ExecOptions{Parallel: parallel}
+		switch {
+		case asJSON:
+			// Output is collected into the results
+		case group:
+			options.Done = func(result chop.ExecResult) {
+				fmt.Fprintln(a.stdout, color.New(color.Bold).Sprintf("==> %s <==", labels[result.Machine]))
+				fmt.Fprint(a.stdout, result.Stdout)
+				fmt.Fprint(a.stderr, result.Stderr)
+				if result.Error != "" {
+					fmt.Fprintln(a.stderr, result.Error)
+				}
+			}
+		default:
+			width := 0
+			for _, label := range labels {
+				width = max(width, len(label))
+			}
+			prefix := color.New(color.FgCyan).SprintFunc()
+			options.Stream = func(machine inventory.MachineRef, stderr bool, line string) {
+				out := a.stdout
+				if stderr {
+					out = a.stderr
+				}
+				fmt.Fprintf(out, "%s | %s\n", prefix(fmt.Sprintf("%-*s", width, labels[machine])), line)
+			}
+			options.Done = func(result chop.ExecResult) {
+				if result.Error != "" {
+					fmt.Fprintf(a.stderr, "%s | %s\n", prefix(fmt.Sprintf("%-*s", width, labels[result.Machine])), result.Error)
+				}
+			}
+		}
+
+		command := strings.Join(args[cmd.ArgsLenAtDash():], " ")
+		results, err := a.client.Exec(refs, command, options)
+		if err != nil {
+			return fmt.Errorf("running command: %w", err)
+		}
+
+		if asJSON {
+			encoder := json.NewEncoder(a.stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(results)
+		} else {
+			a.printExecSummary(results, labels)
+		}
+
+		// Save the configuration to remember the last usage
+		if err := a.save(); err != nil {
+			return err
+		}
+
+		batch := batchError{total: len(results)}
+		for _, result := range results {
+			if result.Failed() {
+				batch.failed = append(batch.failed, fmt.Errorf("%s: %s", labels[result.Machine], ternary(result.Error != "", result.Error, fmt.Sprint("exit code ", result.ExitCode))))
+			}
+		}
+		if len(batch.failed) > 0 {
+			return batch
+		}
+		return nil
+	},
+}
+
+// execLabels names machines by their plain name, or account/project/machine where names repeat
+func execLabels(refs []inventory.MachineRef) map[inventory.MachineRef]string {
+	count := map[string]int{}
+	for _, ref := range refs {
+		count[ref.Machine]++
+	}
+	labels := map[inventory.MachineRef]string{}
+	for _, ref := range refs {
+		labels[ref] = ternary(count[ref.Machine] > 1, ref.String(), ref.Machine)
+	}
+	return labels
+}
+
+// printExecSummary prints exit codes and durations of all machines
+func (a *app) printExecSummary(results []chop.ExecResult, labels map[inventory.MachineRef]string) {
+	okColor := color.New(color.FgGreen).SprintFunc()
+	failedColor := color.New(color.FgRed).SprintFunc()
+
+	table := simpletable.New()
+	table.Header = &simpletable.Header{
+		Cells: []*simpletable.Cell{
+			{Text: "MACHINE"},
+			{Text: "EXIT"},
+			{Text: "DURATION"},
+		},
+	}
+
+	failed := 0
+	for _, result := range results {
+		exit := okColor(result.ExitCode)
+		if result.Failed() {
+			exit = failedColor(ternary(result.ExitCode == -1, "error", fmt.Sprint(result.ExitCode)))
+			failed++
+		}
+		table.Body.Cells = append(table.Body.Cells, []*simpletable.Cell{
+			{Text: labels[result.Machine]},
+			{Text: exit},
+			{Text: result.Duration.Round(10 * time.Millisecond).String()},
+		})
+	}
+
+	table.SetStyle(simpletable.StyleDefault)
+	fmt.Fprintln(a.stdout)
+	fmt.Fprintln(a.stdout, table.String())
+	fmt.Fprintf(a.stdout, "%d of %d machines succeeded\n", len(results)-failed, len(results))
+}
+
+func init() {
+	// ********** EXEC ************
+	addSelectionFlags(execCmd)
+	execCmd.Flags().IntP("parallel", "p", 10, "Maximum number of machines running the command at once (0 for all)")
+	execCmd.Flags().Bool("group", false, "Print the output per machine when it finishes instead of streaming it")
+	execCmd.Flags().Bool("json", false, "Print the results including the output as JSON")
+	execCmd.MarkFlagsMutuallyExclusive("group", "json")
+	rootCmd.AddCommand(execCmd)
+}
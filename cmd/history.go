@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"fmt"
+	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
+	"strconv"
+	"time"
+
+	"github.com/alexeyco/simpletable"
+	"github.com/spf13/cobra"
+)
+
+// skipLoad replaces the root hook for commands that work on the configuration file itself,
+// so that they also help when it cannot be read
+func skipLoad(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+	appFrom(cmd).started = true
+	return nil
+}
+
+// List the snapshots of the configuration
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "List the snapshots taken before the configuration changed",
+	Long: fmt.Sprintf(`Before a command changes the configuration, chop copies the file into the backups
+directory next to it. This lists the copies, the newest first, with the command that
+changed the configuration after each was taken. The last %d are kept.
+
+Revert the last change with 'chop undo', or go back to any snapshot with 'chop restore'.`, chop.SnapshotsKept),
+	Args:              cobra.NoArgs,
+	PersistentPreRunE: skipLoad,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		snapshots, err := chop.Snapshots(a.configFile)
+		if err != nil {
+			return fmt.Errorf("listing snapshots: %w", err)
+		}
+		if len(snapshots) == 0 {
+			fmt.Fprintln(a.stdout, "No snapshots yet")
+			return nil
+		}
+
+		table := simpletable.New()
+		table.Header = &simpletable.Header{
+			Cells: []*simpletable.Cell{
+				{Text: "ID"},
+				{Text: "TIME"},
+				{Text: "CHANGED BY"},
+			},
+		}
+		for _, snapshot := range snapshots {
+			table.Body.Cells = append(table.Body.Cells, []*simpletable.Cell{
+				{Align: simpletable.AlignRight, Text: strconv.Itoa(snapshot.ID)},
+				{Text: snapshot.Time.Local().Format("2006-01-02 15:04:05")},
+				{Text: snapshot.Command},
+			})
+		}
+		table.SetStyle(simpletable.StyleDefault)
+		fmt.Fprintln(a.stdout, table.String())
+		return nil
+	},
+}
+
+// Revert the last change of the configuration
+var undoCmd = &cobra.Command{
+	Use:   "undo",
+	Short: "Revert the last change of the configuration",
+	Long: `Restores the configuration from before the last command that changed it. Running
+undo again goes back one more change.
+
+The configuration from before the undo is kept as a snapshot, so 'chop restore' brings
+it back if the undo was a mistake.`,
+	Args:              cobra.NoArgs,
+	PersistentPreRunE: skipLoad,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		if err := a.client.Journal.Check(); err != nil {
+			return fmt.Errorf("undoing: %w", err)
+		}
+		before := a.stored()
+		snapshot, err := chop.Undo(a.configFile, time.Now())
+		if err != nil {
+			return fmt.Errorf("undoing: %w", err)
+		}
+		if err := a.recordReplaced(chop.AuditEntry{Action: chop.ActionUndo, Detail: snapshot.Command}, before); err != nil {
+			return fmt.Errorf("undoing: %w", err)
+		}
+		fmt.Fprintf(a.stdout, "Undid '%s' of %s\n", snapshot.Command, snapshot.Time.Local().Format("2006-01-02 15:04:05"))
+		return nil
+	},
+}
+
+// Bring back a snapshot of the configuration
+var restoreCmd = &cobra.Command{
+	Use:   "restore [id]",
+	Short: "Bring back the configuration of a snapshot",
+	Long: `Replaces the configuration by a snapshot listed by 'chop history'. The configuration
+it replaces is kept as a new snapshot.`,
+	Example: `  chop history
+  chop restore 12`,
+	Args:              cobra.ExactArgs(1),
+	PersistentPreRunE: skipLoad,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("restoring snapshot: %w: id %s", inventory.ErrInvalid, args[0])
+		}
+		if err := a.client.Journal.Check(); err != nil {
+			return fmt.Errorf("restoring snapshot: %w", err)
+		}
+		before := a.stored()
+		if err := chop.RestoreSnapshot(a.configFile, id, a.command, time.Now()); err != nil {
+			return fmt.Errorf("restoring snapshot: %w", err)
+		}
+		if err := a.recordReplaced(chop.AuditEntry{Action: chop.ActionRestore, Detail: "snapshot " + args[0]}, before); err != nil {
+			return fmt.Errorf("restoring snapshot: %w", err)
+		}
+		fmt.Fprintln(a.stdout, "Restored snapshot", id)
+		return nil
+	},
+}
+
+// stored returns the configuration as it is stored, nil if it cannot be read, e.g. when
+// a broken edit is undone
+func (a *app) stored() *inventory.Configuration {
+	configs := inventory.NewConfiguration()
+	if err := a.store.Load(&configs); err != nil {
+		return nil
+	}
+	return &configs
+}
+
+// recordReplaced journals a command that replaced the configuration file: the entry, then
+// the changes from before to what is stored now, as far as both can be read. The app takes
+// over what is stored now, so that the ssh config include file follows it.
+func (a *app) recordReplaced(entry chop.AuditEntry, before *inventory.Configuration) error {
+	if err := a.client.Journal.Record(entry); err != nil {
+		return err
+	}
+	after := a.stored()
+	if after == nil {
+		return nil
+	}
+	*a.config = *after
+	if before != nil {
+		if err := a.client.Journal.RecordChanges(inventory.Changes(before, after), entry.Action); err != nil {
+			return err
+		}
+	}
+	return a.refreshSSHConfig()
+}
+
+func init() {
+	// ********** HISTORY / UNDO / RESTORE ************
+	rootCmd.AddCommand(historyCmd)
+	rootCmd.AddCommand(undoCmd)
+	rootCmd.AddCommand(restoreCmd)
+}
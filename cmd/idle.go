@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
+	"time"
+
+	"github.com/alexeyco/simpletable"
+	"github.com/spf13/cobra"
+)
+
+// Find running machines nobody uses
+var idleCmd = &cobra.Command{
+	Use:   "idle [machines...]",
+	Short: "Report running machines nobody connected to recently",
+	Long: `Checks the live status of all cloud machines (or those given, or matching --account,
+--project and --tag) and lists the RUNNING ones that chop has not used for --days days:
+no connect, exec, cp, sync, proxy or cssh, and no tunnel up. With --stop they are stopped
+after confirmation, --yes skips the question for scheduled runs.
+
+Running machines chop has never used are listed as unknown, since they may well be used
+without chop. --never-used counts them as idle, so that --stop stops them, too.
+
+chop exits with 1 if a machine could not be checked or stopped, so that scheduled runs
+notice machines that may keep running.`,
+	Example: `  chop idle --days 7
+  chop idle --project staging --stop
+  # Nightly, e.g. from cron:
+  chop idle --days 7 --stop --yes --report ~/chop-idle.json`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		days, _ := cmd.Flags().GetInt("days")
+		neverUsed, _ := cmd.Flags().GetBool("never-used")
+		stop, _ := cmd.Flags().GetBool("stop")
+		yes, _ := cmd.Flags().GetBool("yes")
+		asJSON, _ := cmd.Flags().GetBool("json")
+		reportFile, _ := cmd.Flags().GetString("report")
+
+		// Unlike other batch commands the whole inventory is checked by default
+		selection := inventory.Selection{Names: args}
+		selection.Account, _ = cmd.Flags().GetString("account")
+		selection.Project, _ = cmd.Flags().GetString("project")
+		selection.Tags, _ = cmd.Flags().GetStringArray("tag")
+		refs, err := a.config.SelectMachines(selection)
+		if err != nil {
+			return fmt.Errorf("selecting machines: %w", err)
+		}
+
+		report := a.client.IdleMachines(refs, days, neverUsed, chop.TunnelDir(a.configFile), time.Now())
+		if !asJSON {
+			a.printIdleReport(report)
+		}
+
+		if stop && len(report.Machines) > 0 {
+			if yes || a.askYesNo(fmt.Sprintf("Stop %d idle machine(s)?", len(report.Machines))) {
+				a.client.StopIdle(&report)
+				if !asJSON {
+					for _, idle := range report.Machines {
+						fmt.Fprintln(a.stdout, idle.Machine.String()+":", ternary(idle.Stopped, "stopped", "not stopped, "+idle.Error))
+					}
+				}
+			}
+		}
+
+		if asJSON {
+			encoder := json.NewEncoder(a.stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(report)
+		}
+		if reportFile != "" {
+			if err := report.Write(reportFile); err != nil {
+				// Still remember status and IPs
+				return errors.Join(fmt.Errorf("writing report: %w", err), a.save())
+			}
+		}
+
+		// Save the configuration to remember status and IPs
+		if err := a.save(); err != nil {
+			return err
+		}
+
+		batch := batchError{total: len(refs)}
+		for _, unchecked := range report.Unchecked {
+			batch.failed = append(batch.failed, errors.New("checking "+unchecked))
+		}
+		for _, idle := range report.Machines {
+			if idle.Error != "" {
+				batch.failed = append(batch.failed, fmt.Errorf("stopping %s: %s", idle.Machine, idle.Error))
+			}
+		}
+		if len(batch.failed) > 0 {
+			return batch
+		}
+		return nil
+	},
+}
+
+// printIdleReport prints the idle machines and the machines that could not be checked
+func (a *app) printIdleReport(report chop.IdleReport) {
+	if len(report.Machines) == 0 {
+		fmt.Fprintf(a.stdout, "No running machine has been idle for %d days.\n", report.Days)
+	} else {
+		table := simpletable.New()
+		table.Header = &simpletable.Header{
+			Cells: []*simpletable.Cell{
+				{Text: "MACHINE"},
+				{Text: "ZONE"},
+				{Text: "LAST USED"},
+				{Text: "IDLE DAYS"},
+			},
+		}
+		for _, idle := range report.Machines {
+			lastUsed, idleDays := "never", "-"
+			if !idle.LastUsage.IsZero() {
+				lastUsed = idle.LastUsage.Format("2006-01-02 15:04")
+				idleDays = fmt.Sprint(idle.IdleDays)
+			}
+			table.Body.Cells = append(table.Body.Cells, []*simpletable.Cell{
+				{Text: idle.Machine.String()},
+				{Text: idle.Zone},
+				{Text: lastUsed},
+				{Text: idleDays},
+			})
+		}
+		table.SetStyle(simpletable.StyleDefault)
+		fmt.Fprintln(a.stdout, table.String())
+	}
+
+	for _, unchecked := range report.Unchecked {
+		fmt.Fprintln(a.stdout, "Could not check", unchecked)
+	}
+	for _, unknown := range report.Unknown {
+		fmt.Fprintln(a.stdout, "Never used with chop, not counted as idle:", unknown)
+	}
+}
+
+func init() {
+	// ********** IDLE ************
+	addSelectionFlags(idleCmd)
+	idleCmd.Flags().Int("days", 7, "Days without usage after which a running machine counts as idle")
+	idleCmd.Flags().Bool("never-used", false, "Count running machines chop has never used as idle")
+	idleCmd.Flags().Bool("stop", false, "Stop the idle machines after confirmation")
+	idleCmd.Flags().BoolP("yes", "y", false, "Stop without asking, for scheduled runs")
+	idleCmd.Flags().Bool("json", false, "Print the report as JSON")
+	idleCmd.Flags().String("report", "", "Also write the report as JSON to this file")
+	rootCmd.AddCommand(idleCmd)
+}
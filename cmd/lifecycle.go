@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
+	"strings"
+
+	"github.com/alexeyco/simpletable"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// Start machines
+var startCmd = &cobra.Command{
+	Use:   "start [machines...]",
+	Short: "Start machines",
+	Long:  "Starts the given machines, or all machines matching --account, --project and --tag (the active project if none is given).",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		return runBatch(cmd, args, "Starting", "", a.client.StartMachines)
+	},
+}
+
+// Stop machines
+var stopCmd = &cobra.Command{
+	Use:   "stop [machines...]",
+	Short: "Stop machines",
+	Long: `Stops the given machines, or all machines matching --account, --project and --tag.
+Machines have to be named or selected, and chop asks before stopping them unless --yes is given.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		return runBatch(cmd, args, "Stopping", "Stop", a.client.StopMachines)
+	},
+}
+
+// Reset machines
+var resetCmd = &cobra.Command{
+	Use:   "reset [machines...]",
+	Short: "Hard-reset machines",
+	Long: `Hard-resets the given machines, or all machines matching --account, --project and --tag.
+Machines have to be named or selected, and chop asks before resetting them unless --yes is given.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		return runBatch(cmd, args, "Resetting", "Hard-reset", a.client.ResetMachines)
+	},
+}
+
+// Show the current status of machines
+var statusCmd = &cobra.Command{
+	Use:   "status [machines...]",
+	Short: "Show the current status of machines",
+	Long:  "Asks the cloud for the status of the given machines, or all machines matching --account, --project and --tag (the active project if none is given).",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		refs, err := selectMachines(cmd, args, false)
+		if err != nil {
+			return err
+		}
+
+		results := a.client.RefreshMachines(refs)
+		a.printStatusTable(results)
+
+		// Save the configuration to remember status and IPs
+		return a.save()
+	},
+}
+
+// runBatch runs an operation on the selected machines and reports the outcome per machine.
+// Operations that interrupt machines pass the verb of the question to confirm them: they
+// never fall back to the active project, and the machines are listed before asking.
+// It returns a batchError if the operation failed on any machine.
+func runBatch(cmd *cobra.Command, args []string, verb string, confirm string, operation func([]inventory.MachineRef) []chop.BatchResult) error {
+	a := appFrom(cmd)
+	if confirm != "" && len(args) == 0 && !hasSelectionFlags(cmd) {
+		return fmt.Errorf("%w: name the machines or select them with --account, --project or --tag", inventory.ErrInvalid)
+	}
+	refs, err := selectMachines(cmd, args, false)
+	if err != nil {
+		return err
+	}
+	if confirm != "" {
+		yes, _ := cmd.Flags().GetBool("yes")
+		if !yes {
+			for _, ref := range refs {
+				fmt.Fprintln(a.stdout, " ", ref)
+			}
+			if !a.askYesNo(fmt.Sprintf("%s %d machine(s)?", confirm, len(refs))) {
+				fmt.Fprintln(a.stdout, "You declined: Aborting...")
+				return nil
+			}
+		}
+	}
+
+	fmt.Fprintf(a.stdout, "%s %d machine(s) ...\n", verb, len(refs))
+	results := operation(refs)
+	a.printStatusTable(results)
+
+	// Save the configuration after changing machines
+	if err := a.save(); err != nil {
+		return err
+	}
+
+	batch := batchError{total: len(results)}
+	for _, result := range results {
+		if result.Err != nil {
+			batch.failed = append(batch.failed, fmt.Errorf("%s: %w", result.Machine, result.Err))
+		}
+	}
+	if len(batch.failed) > 0 {
+		return batch
+	}
+	return nil
+}
+
+// printStatusTable prints status, zone and IP of machines after a batch operation
+func (a *app) printStatusTable(results []chop.BatchResult) {
+	runningColor := color.New(color.FgGreen).SprintFunc()
+	errorColor := color.New(color.FgRed).SprintFunc()
+
+	table := simpletable.New()
+	table.Header = &simpletable.Header{
+		Cells: []*simpletable.Cell{
+			{Text: "MACHINE"},
+			{Text: "STATUS"},
+			{Text: "ZONE"},
+			{Text: "IP"},
+		},
+	}
+	for _, result := range results {
+		ref := result.Machine
+		machine, _ := a.config.GetMachine(ref.Account, ref.Project, ref.Machine)
+		status := result.Status
+		switch {
+		case errors.Is(result.Err, chop.ErrNotManaged):
+			status = "not managed (plain SSH)"
+		case result.Err != nil:
+			status = errorColor(result.Err.Error())
+		case status == chop.StatusRunning:
+			status = runningColor(status)
+		}
+		table.Body.Cells = append(table.Body.Cells, []*simpletable.Cell{
+			{Text: ref.String()},
+			{Text: status},
+			{Text: ternary(machine.Zone != "", machine.Zone, "-")},
+			{Text: ternary(machine.ExternalIP != "", machine.ExternalIP, ternary(machine.InternalIP != "", machine.InternalIP, "-"))},
+		})
+	}
+	table.SetStyle(simpletable.StyleDefault)
+	fmt.Fprintln(a.stdout, table.String())
+}
+
+// interactive reports whether questions can be asked, i.e. stdin is a terminal
+func (a *app) interactive() bool {
+	if file, ok := a.stdin.(*os.File); ok {
+		if info, err := file.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// askYesNo asks a question on the terminal. Without a terminal the answer is no.
+func (a *app) askYesNo(question string) bool {
+	if !a.interactive() {
+		return false
+	}
+
+	fmt.Fprint(a.stdout, question+" [yes/no]: ")
+	input, err := bufio.NewReader(a.stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	input = strings.TrimSpace(strings.ToLower(input))
+	return input == "yes" || input == "y"
+}
+
+func init() {
+	// ********** START / STOP / RESET / STATUS ************
+	for _, cmd := range []*cobra.Command{startCmd, stopCmd, resetCmd, statusCmd} {
+		addSelectionFlags(cmd)
+		rootCmd.AddCommand(cmd)
+	}
+	stopCmd.Flags().BoolP("yes", "y", false, "Stop without asking")
+	resetCmd.Flags().BoolP("yes", "y", false, "Reset without asking")
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"palexus/chop/cmd/chop"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// Print the active account and project for shell prompts
+var promptCmd = &cobra.Command{
+	Use:   "prompt",
+	Short: "Print the active account and project for shell prompts",
+	Long: `Print the active account and project in a form suitable for PS1, starship or tmux.
+
+The command only reads a small cached state file next to the configuration and
+never calls gcloud, so it is cheap enough to run on every prompt. Nothing is
+printed when no account is active.
+
+The --format template understands the placeholders {account} and {project}.
+Colors in PS1 need --shell, which marks the escape sequences as invisible so that
+the shell does not miscount the width of the prompt.
+
+Examples:
+  PS1='$(chop prompt --color --shell bash) \$ '
+  PROMPT='$(chop prompt --color --shell zsh) %# '   # with setopt PROMPT_SUBST
+  set -g status-right '#(chop prompt --format "{project}")'`,
+	Args: cobra.NoArgs,
+	// Skip loading the full configuration, the cached state is all we need
+	PersistentPreRunE: skipLoad,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		format, _ := cmd.Flags().GetString("format")
+		forceColor, _ := cmd.Flags().GetBool("color")
+		shell, _ := cmd.Flags().GetString("shell")
+
+		// Report an unknown shell even when there is nothing to print
+		if shell != "" {
+			if _, err := chop.MarkPromptEscapes("", shell); err != nil {
+				return err
+			}
+		}
+
+		state, err := chop.LoadPromptState(a.configFile, chop.EnvironmentKeys)
+		if err != nil || state.Account == "" {
+			// A prompt segment must never break the prompt, so stay silent
+			return nil
+		}
+
+		// Without an explicit format, leave out the separator when no project is active
+		if !cmd.Flags().Changed("format") && state.Project == "" {
+			format = "{account}"
+		}
+
+		if forceColor {
+			color.NoColor = false
+		}
+		// Use the same colors as 'chop list' for the active account and project
+		accountColor := color.New(color.FgGreen).SprintFunc()
+		projectColor := color.New(color.FgCyan).SprintFunc()
+
+		replacer := strings.NewReplacer(
+			"{account}", accountColor(state.Account),
+			"{project}", projectColor(state.Project),
+		)
+		segment := replacer.Replace(format)
+		if shell != "" {
+			segment, _ = chop.MarkPromptEscapes(segment, shell)
+		}
+		fmt.Fprintln(a.stdout, segment)
+		return nil
+	},
+}
+
+func init() {
+	// ********** PROMPT ************
+	promptCmd.Flags().String("format", "{account}/{project}", "Output template with {account} and {project} placeholders")
+	promptCmd.Flags().Bool("color", false, "Force colored output even when stdout is not a terminal")
+	promptCmd.Flags().String("shell", "", "Mark the colors as invisible for the prompt of this shell (bash or zsh)")
+	rootCmd.AddCommand(promptCmd)
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+// Act as ssh ProxyCommand for machines of the inventory
+var proxyCmd = &cobra.Command{
+	Use:   "proxy [host] [port]",
+	Short: "Connect stdin/stdout to a machine, for use as ssh ProxyCommand",
+	Long: `Resolves host through the inventory (alias, account.project.machine or machine name,
+never a part of a name) and pipes stdin/stdout to the port of that machine. IAP
+machines are reached through an IAP tunnel, all others with a direct TCP connection.
+
+Add this to ~/.ssh/config to let every SSH-speaking tool understand chop's names:
+
+  Match exec "chop proxy --check %h"
+      ProxyCommand chop proxy %h %p`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		check, _ := cmd.Flags().GetBool("check")
+
+		ref, err := a.config.ResolveName(args[0])
+		if check {
+			// Only tell ssh whether the host is ours, through the exit code
+			if err != nil {
+				return silentError{err}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("chop proxy: %w", err)
+		}
+
+		port := 22
+		if len(args) > 1 {
+			port, err = strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("chop proxy: %w: port %s", inventory.ErrInvalid, args[1])
+			}
+		}
+
+		machine, err := a.config.ResolveMachine(ref.Account, ref.Project, ref.Machine)
+		if err != nil {
+			return fmt.Errorf("chop proxy: %w", err)
+		}
+
+		// Remember the usage before the session starts, the proxy may be killed at the end
+		a.config.TouchMachine(ref.Account, ref.Project, ref.Machine)
+		if err := a.save(); err != nil {
+			fmt.Fprintln(a.stderr, "chop proxy: error saving configuration:", err)
+		}
+
+		err = a.client.Journal.Record(chop.AuditEntry{Action: chop.ActionConnect, Account: ref.Account, Project: ref.Project, Machine: ref.Machine, Detail: fmt.Sprintf("proxy port %d", port)})
+		if err != nil {
+			return fmt.Errorf("chop proxy: recording connection: %w", err)
+		}
+		err = chop.Proxy(a.client.Provider, ref.Account, ref.Project, machine, port, a.stdin, a.stdout, a.stderr)
+		if err != nil {
+			return fmt.Errorf("chop proxy: %w", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	// ********** PROXY ************
+	proxyCmd.Flags().Bool("check", false, "Only check whether the host is known to chop (exit code 0) or not (non-zero)")
+	rootCmd.AddCommand(proxyCmd)
+}
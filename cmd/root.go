@@ -5,9 +5,12 @@ package cmd
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
 	"sort"
 	"strings"
 
@@ -16,10 +19,6 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var config chop.Configuration
-
-var configFile = "/Users/alexanderpreis/Projects/infologistix/cloudHopper/chop.yaml"
-
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "chop",
@@ -31,21 +30,45 @@ var rootCmd = &cobra.Command{
 \__/_/\___/\_,_/\_,_/_//_/\___/ .__/ .__/\__/_/   
                              /_/  /_/             
 This little tool helps you to navigate and log into your various machines
-	in the different projects of your different accounts.`,
+	in the different projects of your different accounts.
+
+Exit codes:
+  0  success
+  1  any other failure
+  2  account, project, machine, alias, tunnel or template not found
+  3  cloud provider, ssh, rsync or git failed
+  4  wrong usage, no active account or project, ambiguous name`,
+	// Load the configuration before any subcommand runs. Commands that must stay
+	// cheap (like 'prompt') override this hook.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// The arguments are fine at this point, failures from here on need no usage text
+		cmd.SilenceUsage = true
+		appFrom(cmd).started = true
+		if err := appFrom(cmd).load(); err != nil {
+			return fmt.Errorf("failed to load configuration: %w", err)
+		}
+		return nil
+	},
+	// Errors are printed by Execute, together with the exit code
+	SilenceErrors: true,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("Use one of the subcommands: add, delete, list, save, load")
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		fmt.Fprintln(a.stdout, "Use one of the subcommands: add, delete, list, save, load")
+		return nil
 	},
 }
 
 // Set subcommands for 'set'
 var setCmd = &cobra.Command{
 	Use:   "set",
-	Short: "Set the active account or project",
-	Run: func(cmd *cobra.Command, args []string) {
+	Short: "Set the active account or project, or the transport of machines",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
 		// Provide a default message if no subcommand is provided
-		fmt.Println("Please specify 'account' or 'project' to set")
+		fmt.Fprintln(a.stdout, "Please specify 'account' or 'project' to set")
+		return nil
 	},
 }
 
@@ -54,22 +77,19 @@ var setAccountCmd = &cobra.Command{
 	Use:   "account [account_name]",
 	Short: "Set the active account",
 	Args:  cobra.ExactArgs(1), // Ensure that exactly one argument (account name) is passed
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
 		account := args[0]
 
 		// Set the active account
-		err := config.SetActiveAccount(account)
+		err := a.config.SetActiveAccount(account)
 		if err != nil {
-			fmt.Println("Error setting account:", err)
-		} else {
-			fmt.Println("Active account set to:", account)
+			return fmt.Errorf("setting account: %w", err)
 		}
+		fmt.Fprintln(a.stdout, "Active account set to:", account)
 
 		// Save configuration after adding
-		save_err := config.SaveConfigurationToYAML(configFile)
-		if save_err != nil {
-			fmt.Println("Error saving configuration:", save_err)
-		}
+		return a.save()
 	},
 }
 
@@ -78,41 +98,144 @@ var setProjectCmd = &cobra.Command{
 	Use:   "project [project_name]",
 	Short: "Set the active project for the active account",
 	Args:  cobra.ExactArgs(1), // Ensure that exactly one argument (project name) is passed
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
 		project := args[0]
-		account, _ := cmd.Flags().GetString("account")
-
-		// If no account is provided via flag or argument, use the active account
-		if account == "" {
-			if config.ActiveAccount == "" {
-				fmt.Fprintln(os.Stderr, "No active account set or provided. Use --account flag or provide account argument.")
-				cmd.Help()
-				return
-			}
-			account = config.ActiveAccount
+		// If no account is provided via flag, use the active account
+		account, err := resolveAccount(cmd)
+		if err != nil {
+			return err
 		}
 
 		// Set the active project for the specified account
-		err := config.SetActiveProjectForAccount(account, project)
+		err = a.config.SetActiveProjectForAccount(account, project)
 		if err != nil {
-			fmt.Println("Error setting project:", err)
-		} else {
-			fmt.Println("Active project for account", account, "set to:", project)
+			return fmt.Errorf("setting project: %w", err)
 		}
+		fmt.Fprintln(a.stdout, "Active project for account", account, "set to:", project)
 
 		// Save configuration after adding
-		save_err := config.SaveConfigurationToYAML(configFile)
-		if save_err != nil {
-			fmt.Println("Error saving configuration:", save_err)
+		return a.save()
+	},
+}
+
+// Set how machines of a project, or a single machine, are reached
+var setTransportCmd = &cobra.Command{
+	Use:   "transport [external|internal|iap|auto]",
+	Short: "Set how machines of the active project are reached",
+	Long: `Set how chop connects to the machines of a project, or with --machine to a single machine.
+
+  external  SSH to the external IP
+  internal  SSH to the internal IP (e.g. over VPN)
+  iap       SSH through an Identity-Aware Proxy tunnel
+  auto      use IAP for machines without external IP, external otherwise`,
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: append(inventory.Transports, "auto"),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return err
+		}
+		machine, _ := cmd.Flags().GetString("machine")
+		transport := ternary(args[0] == "auto", "", args[0])
+
+		if machine != "" {
+			err = a.config.SetMachineTransport(account, project, machine, transport)
+		} else {
+			err = a.config.SetProjectTransport(account, project, transport)
+		}
+		if err != nil {
+			return fmt.Errorf("setting transport: %w", err)
+		}
+		fmt.Fprintln(a.stdout, "Transport for", ternary(machine != "", machine, project), "set to:", args[0])
+
+		// Save configuration after the change
+		return a.save()
+	},
+}
+
+// Set the ssh settings of a machine that is reached without a cloud CLI
+var setSSHCmd = &cobra.Command{
+	Use:   "ssh [machine_name]",
+	Short: "Set how to reach a machine with the system ssh binary",
+	Long: `Set ssh_config style settings of a machine, e.g. an on-prem box that no cloud CLI knows.
+
+Machines with a host name are reached with the system ssh binary, which also takes
+care of known_hosts checking and the ssh agent. Only the given flags are changed. A machine
+needs a host name for its other settings, unless 'chop set transport ssh' selected the
+ssh binary for it or its project.`,
+	Example: `  chop add machine lab-1
+  chop set ssh lab-1 --host 10.1.2.3 --user admin --identity ~/.ssh/lab --jump bastion.example.com
+  chop set ssh lab-1 --option ServerAliveInterval=30 --forward-agent`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return err
+		}
+
+		machine, err := a.config.GetMachine(account, project, args[0])
+		if err != nil {
+			return fmt.Errorf("setting ssh settings: %w", err)
+		}
+
+		// Only change what was given on the command line
+		settings := machine.SSH
+		flags := cmd.Flags()
+		if flags.Changed("host") {
+			settings.HostName, _ = flags.GetString("host")
+		}
+		if flags.Changed("port") {
+			settings.Port, _ = flags.GetInt("port")
+		}
+		if flags.Changed("user") {
+			settings.User, _ = flags.GetString("user")
+		}
+		if flags.Changed("identity") {
+			settings.IdentityFile, _ = flags.GetString("identity")
 		}
+		if flags.Changed("jump") {
+			settings.ProxyJump, _ = flags.GetString("jump")
+		}
+		if flags.Changed("forward-agent") {
+			settings.ForwardAgent, _ = flags.GetBool("forward-agent")
+		}
+		options, _ := flags.GetStringArray("option")
+		for _, option := range options {
+			key, value, found := strings.Cut(option, "=")
+			if !found {
+				return fmt.Errorf("setting ssh settings: %w: options must look like Key=Value, got %s", inventory.ErrInvalid, option)
+			}
+			if settings.Options == nil {
+				settings.Options = make(map[string]string)
+			}
+			if value == "" {
+				delete(settings.Options, key) // Key= removes an option
+			} else {
+				settings.Options[key] = value
+			}
+		}
+
+		err = a.config.SetMachineSSH(account, project, args[0], settings)
+		if err != nil {
+			return fmt.Errorf("setting ssh settings: %w", err)
+		}
+		fmt.Fprintln(a.stdout, "SSH settings of", args[0], "updated")
+
+		// Save configuration after the change
+		return a.save()
 	},
 }
 
 var unsetCmd = &cobra.Command{
 	Use:   "unset",
 	Short: "Unset account or project",
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("Please specify 'account' or 'project' to unset")
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		fmt.Fprintln(a.stdout, "Please specify 'account' or 'project' to unset")
+		return nil
 	},
 }
 
@@ -120,9 +243,16 @@ var unsetCmd = &cobra.Command{
 var unsetAccountCmd = &cobra.Command{
 	Use:   "account",
 	Short: "Unset the active account",
-	Run: func(cmd *cobra.Command, args []string) {
-		config.UnsetActiveAccount()
-		fmt.Println("Active account unset")
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		err := a.config.UnsetActiveAccount()
+		if err != nil {
+			return fmt.Errorf("unsetting account: %w", err)
+		}
+		fmt.Fprintln(a.stdout, "Active account unset")
+
+		// Save configuration after unsetting
+		return a.save()
 	},
 }
 
@@ -130,28 +260,29 @@ var unsetAccountCmd = &cobra.Command{
 var unsetProjectCmd = &cobra.Command{
 	Use:   "project",
 	Short: "Unset the active project for the active account",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
 		account, _ := cmd.Flags().GetString("account")
 
-		set_err := config.UnsetActiveProjectForAccount(account)
+		account, set_err := a.config.UnsetActiveProjectForAccount(account)
 		if set_err != nil {
-			fmt.Println("Error unsetting project:", set_err)
+			return fmt.Errorf("unsetting project: %w", set_err)
 		}
+		fmt.Fprintln(a.stdout, "Active project unset for account:", account)
 
 		// Save configuration after adding
-		err := config.SaveConfigurationToYAML(configFile)
-		if err != nil {
-			fmt.Println("Error saving configuration:", err)
-		}
+		return a.save()
 	},
 }
 
 // Add subcommands for 'add'
 var addCmd = &cobra.Command{
 	Use:   "add",
-	Short: "Add accounts, projects, or machines",
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("Please specify 'account', 'project', or 'machine' to add")
+	Short: "Add accounts, projects, machines or aliases",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		fmt.Fprintln(a.stdout, "Please specify 'account', 'project', 'machine' or 'alias' to add")
+		return nil
 	},
 }
 
@@ -160,17 +291,15 @@ var addAccountCmd = &cobra.Command{
 	Use:   "account [account_names...]",
 	Short: "Add one or more accounts",
 	Args:  cobra.MinimumNArgs(1), // Ensure at least one account name is provided
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
 		for _, account := range args {
 			// Add each account
-			config.AddAccount(account)
-			fmt.Println("Account added:", account)
+			a.config.AddAccount(account)
+			fmt.Fprintln(a.stdout, "Account added:", account)
 		}
 		// Save the configuration after adding accounts
-		err := config.SaveConfigurationToYAML(configFile)
-		if err != nil {
-			fmt.Println("Error saving configuration:", err)
-		}
+		return a.save()
 	},
 }
 
@@ -179,35 +308,27 @@ var addProjectCmd = &cobra.Command{
 	Use:   "project [project_names...]",
 	Short: "Add one or more projects to an account",
 	Args:  cobra.MinimumNArgs(1), // Ensure at least one project name is provided
-	Run: func(cmd *cobra.Command, args []string) {
-		// Get the --account flag value
-		account, _ := cmd.Flags().GetString("account")
-
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
 		// If no account is provided via flag, use the active account
-		if account == "" {
-			if config.ActiveAccount == "" {
-				fmt.Fprintln(os.Stderr, "No account set. Please provide an account using the --account flag or 'chop set account <account>'")
-				cmd.Help()
-				return
-			}
-			account = config.ActiveAccount
+		account, err := resolveAccount(cmd)
+		if err != nil {
+			return err
 		}
 
+		var errs []error
 		for _, project := range args {
 			// Add each project to the specified account
-			err := config.AddProjectToActiveAccount(account, project)
+			err := a.config.AddProjectToActiveAccount(account, project)
 			if err != nil {
-				fmt.Println("Error adding project:", err)
-			} else {
-				fmt.Println("Project added to", account, ":", project)
+				errs = append(errs, fmt.Errorf("adding project: %w", err))
+				continue
 			}
+			fmt.Fprintln(a.stdout, "Project added to", account, ":", project)
 		}
 
-		// Save the configuration after adding projects
-		err := config.SaveConfigurationToYAML(configFile)
-		if err != nil {
-			fmt.Println("Error saving configuration:", err)
-		}
+		// Save the configuration after adding projects, also when some failed
+		return errors.Join(append(errs, a.save())...)
 	},
 }
 
@@ -216,47 +337,56 @@ var addMachineCmd = &cobra.Command{
 	Use:   "machine [machine_names...]",
 	Short: "Add one or more machines to the active project in the active account",
 	Args:  cobra.MinimumNArgs(1), // Ensure at least one machine name is provided
-	Run: func(cmd *cobra.Command, args []string) {
-		// Get the --account and --project flags
-		account, _ := cmd.Flags().GetString("account")
-		project, _ := cmd.Flags().GetString("project")
-
-		// Ensure the account is set (either via flag or active account)
-		if account == "" {
-			if config.ActiveAccount == "" {
-				fmt.Fprintln(os.Stderr, "No active account set. Please provide an account using --account or 'chop set account <account>'")
-				cmd.Help()
-				return
-			}
-			account = config.ActiveAccount
-		}
-
-		// Ensure the project is set (either via flag or active project)
-		if project == "" {
-			activeProject, activeExists := config.ActiveProjects[account]
-			if !activeExists || activeProject == "" {
-				fmt.Fprintln(os.Stderr, "No active project for the active account. Please provide a project using --project or 'chop set project <project>'")
-				cmd.Help()
-				return
-			}
-			project = activeProject
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		// Use the --account and --project flags, or the active ones
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return err
 		}
 
+		var errs []error
 		for _, machine := range args {
 			// Add each machine to the specified project of the specified account
-			err := config.AddMachineToActiveProject(account, machine)
+			err := a.config.AddMachineToActiveProject(account, machine)
 			if err != nil {
-				fmt.Println("Error adding machine:", err)
-			} else {
-				fmt.Println("Machine added to", account, "->", project, ":", machine)
+				errs = append(errs, fmt.Errorf("adding machine: %w", err))
+				continue
 			}
+			fmt.Fprintln(a.stdout, "Machine added to", account, "->", project, ":", machine)
 		}
 
-		// Save the configuration after adding machines
-		err := config.SaveConfigurationToYAML(configFile)
+		// Save the configuration after adding machines, also when some failed
+		return errors.Join(append(errs, a.save())...)
+	},
+}
+
+// Add aliases to a machine
+var addAliasCmd = &cobra.Command{
+	Use:   "alias [machine_name] [aliases...]",
+	Short: "Add one or more aliases to a machine",
+	Args:  cobra.MinimumNArgs(2), // Ensure a machine and at least one alias are provided
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		account, project, err := resolveAccountProject(cmd)
 		if err != nil {
-			fmt.Println("Error saving configuration:", err)
+			return err
+		}
+
+		machine := args[0]
+		var errs []error
+		for _, alias := range args[1:] {
+			// Add each alias to the machine
+			err := a.config.AddAlias(account, project, machine, alias)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("adding alias: %w", err))
+				continue
+			}
+			fmt.Fprintln(a.stdout, "Alias added to", machine, ":", alias)
 		}
+
+		// Save the configuration after adding aliases, also when some failed
+		return errors.Join(append(errs, a.save())...)
 	},
 }
 
@@ -268,10 +398,46 @@ func ternary(condition bool, trueValue, falseValue string) string {
 	return falseValue
 }
 
+// resolveAccount returns the --account flag, falling back to the active account.
+// It fails with inventory.ErrNoActiveAccount when neither is set.
+func resolveAccount(cmd *cobra.Command) (string, error) {
+	a := appFrom(cmd)
+	account, _ := cmd.Flags().GetString("account")
+	if account != "" {
+		return account, nil
+	}
+	if a.config.ActiveAccount == "" {
+		return "", fmt.Errorf("%w: provide one with --account or 'chop set account <account>'", inventory.ErrNoActiveAccount)
+	}
+	return a.config.ActiveAccount, nil
+}
+
+// resolveAccountProject returns the --account and --project flags, falling back to the active ones.
+// It fails with inventory.ErrNoActiveAccount or ErrNoActiveProject when either cannot be determined.
+func resolveAccountProject(cmd *cobra.Command) (account string, project string, err error) {
+	a := appFrom(cmd)
+	account, err = resolveAccount(cmd)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Ensure the project is set (either via flag or active project)
+	project, _ = cmd.Flags().GetString("project")
+	if project == "" {
+		activeProject, activeExists := a.config.ActiveProjects[account]
+		if !activeExists || activeProject == "" {
+			return "", "", fmt.Errorf("%w: provide one with --project or 'chop set project <project>'", inventory.ErrNoActiveProject)
+		}
+		project = activeProject
+	}
+	return account, project, nil
+}
+
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all accounts, projects, and machines",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
 		// Define colors for active account and project
 		activeAccountColor := color.New(color.FgGreen).SprintFunc()
 		activeProjectColor := color.New(color.FgCyan).SprintFunc()
@@ -287,17 +453,17 @@ var listCmd = &cobra.Command{
 		}
 
 		// Collect account names and sort them
-		accountNames := make([]string, 0, len(config.Accounts))
-		for accountName := range config.Accounts {
+		accountNames := make([]string, 0, len(a.config.Accounts))
+		for accountName := range a.config.Accounts {
 			accountNames = append(accountNames, accountName)
 		}
 		sort.Strings(accountNames)
 
 		// Iterate through the sorted accounts and populate the table rows
 		for _, accountName := range accountNames {
-			account := config.Accounts[accountName]
+			account := a.config.Accounts[accountName]
 			accountDisplay := accountName
-			if accountName == config.ActiveAccount {
+			if accountName == a.config.ActiveAccount {
 				accountDisplay = activeAccountColor(accountName) + " (active)"
 			}
 
@@ -314,7 +480,7 @@ var listCmd = &cobra.Command{
 			for _, projectName := range projectNames {
 				project := account.Projects[projectName]
 				projectDisplay := projectName
-				if config.ActiveProjects[accountName] == projectName {
+				if a.config.ActiveProjects[accountName] == projectName {
 					projectDisplay = activeProjectColor(projectName) + " (active)"
 				}
 
@@ -378,8 +544,9 @@ var listCmd = &cobra.Command{
 			table.SetStyle(style)
 
 			// Print the table
-			fmt.Println(table.String())
+			fmt.Fprintln(a.stdout, table.String())
 		}
+		return nil
 	},
 }
 
@@ -393,21 +560,20 @@ var rmAccountCmd = &cobra.Command{
 	Use:   "account [account_name]",
 	Short: "Remove an account",
 	Args:  cobra.MinimumNArgs(1), // Ensure at least one account name is provided
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		var errs []error
 		for _, account := range args {
 			// Remove each account
-			err := config.DeleteAccount(account)
+			err := a.config.DeleteAccount(account)
 			if err != nil {
-				fmt.Println("Error removing account:", err)
-			} else {
-				fmt.Println("Account removed:", account)
+				errs = append(errs, fmt.Errorf("removing account: %w", err))
+				continue
 			}
+			fmt.Fprintln(a.stdout, "Account removed:", account)
 		}
-		// Save configuration after changes
-		save_err := config.SaveConfigurationToYAML(configFile)
-		if save_err != nil {
-			fmt.Println("Error saving configuration:", save_err)
-		}
+		// Save configuration after changes, also when some failed
+		return errors.Join(append(errs, a.save())...)
 	},
 }
 
@@ -416,35 +582,27 @@ var rmProjectCmd = &cobra.Command{
 	Use:   "project [project_names...]",
 	Short: "Remove one or more projects from an account",
 	Args:  cobra.MinimumNArgs(1), // Ensure at least one project name is provided
-	Run: func(cmd *cobra.Command, args []string) {
-		// Get the --account flag value
-		account, _ := cmd.Flags().GetString("account")
-
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
 		// If no account is provided via flag, use the active account
-		if account == "" {
-			if config.ActiveAccount == "" {
-				fmt.Fprintln(os.Stderr, "No account set. Please provide an account using the --account flag or 'chop set account <account>'")
-				cmd.Help()
-				return
-			}
-			account = config.ActiveAccount
+		account, err := resolveAccount(cmd)
+		if err != nil {
+			return err
 		}
 
+		var errs []error
 		for _, project := range args {
 			// Remove each project from the specified account
-			err := config.DeleteProject(account, project)
+			err := a.config.DeleteProject(account, project)
 			if err != nil {
-				fmt.Println("Error removing project:", err)
-			} else {
-				fmt.Println("Project removed from", account, ":", project)
+				errs = append(errs, fmt.Errorf("removing project: %w", err))
+				continue
 			}
+			fmt.Fprintln(a.stdout, "Project removed from", account, ":", project)
 		}
 
-		// Save the configuration after removing projects
-		err := config.SaveConfigurationToYAML(configFile)
-		if err != nil {
-			fmt.Println("Error saving configuration:", err)
-		}
+		// Save the configuration after removing projects, also when some failed
+		return errors.Join(append(errs, a.save())...)
 	},
 }
 
@@ -453,68 +611,71 @@ var rmMachineCmd = &cobra.Command{
 	Use:   "machine [machine_names...]",
 	Short: "Remove one or more machines from a project",
 	Args:  cobra.MinimumNArgs(1), // Ensure at least one machine name is provided
-	Run: func(cmd *cobra.Command, args []string) {
-		// Get the --account and --project flags
-		account, _ := cmd.Flags().GetString("account")
-		project, _ := cmd.Flags().GetString("project")
-
-		// Ensure the account is set (either via flag or active account)
-		if account == "" {
-			if config.ActiveAccount == "" {
-				fmt.Fprintln(os.Stderr, "No active account set. Please provide an account using --account or 'chop set account <account>'")
-				cmd.Help()
-				return
-			}
-			account = config.ActiveAccount
-		}
-
-		// Ensure the project is set (either via flag or active project)
-		if project == "" {
-			activeProject, activeExists := config.ActiveProjects[account]
-			if !activeExists || activeProject == "" {
-				fmt.Fprintln(os.Stderr, "No active project for the active account. Please provide a project using --project or 'chop set project <project>'")
-				cmd.Help()
-				return
-			}
-			project = activeProject
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		// Use the --account and --project flags, or the active ones
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return err
 		}
 
+		var errs []error
 		for _, machine := range args {
 			// Remove each machine from the specified project of the specified account
-			err := config.DeleteMachine(account, project, machine)
+			err := a.config.DeleteMachine(account, project, machine)
 			if err != nil {
-				fmt.Println("Error removing machine:", err)
-			} else {
-				fmt.Println("Machine removed from", account, "->", project, ":", machine)
+				errs = append(errs, fmt.Errorf("removing machine: %w", err))
+				continue
 			}
+			fmt.Fprintln(a.stdout, "Machine removed from", account, "->", project, ":", machine)
 		}
 
-		// Save the configuration after removing machines
-		err := config.SaveConfigurationToYAML(configFile)
-		if err != nil {
-			fmt.Println("Error saving configuration:", err)
+		// Save the configuration after removing machines, also when some failed
+		return errors.Join(append(errs, a.save())...)
+	},
+}
+
+// Remove aliases, wherever they are defined
+var rmAliasCmd = &cobra.Command{
+	Use:   "alias [aliases...]",
+	Short: "Remove one or more aliases",
+	Args:  cobra.MinimumNArgs(1), // Ensure at least one alias is provided
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		var errs []error
+		for _, alias := range args {
+			// Remove each alias
+			err := a.config.DeleteAlias(alias)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("removing alias: %w", err))
+				continue
+			}
+			fmt.Fprintln(a.stdout, "Alias removed:", alias)
 		}
+
+		// Save the configuration after removing aliases, also when some failed
+		return errors.Join(append(errs, a.save())...)
 	},
 }
 
 var pruneCmd = &cobra.Command{
 	Use:   "prune",
 	Short: "Prune the entire configuration",
-	Run: func(cmd *cobra.Command, args []string) {
-		config.ActiveAccount = ""
-		config.ActiveProjects = make(map[string]string)
-		config.Accounts = make(map[string]chop.Account)
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		a.config.ActiveAccount = ""
+		a.config.ActiveProjects = make(map[string]string)
+		a.config.Accounts = make(map[string]inventory.Account)
 
-		reader := bufio.NewReader(os.Stdin)
+		reader := bufio.NewReader(a.stdin)
 
 		// Prompt the user
-		fmt.Print("Are you sure you want to do it? [yes/no]: ")
+		fmt.Fprint(a.stdout, "Are you sure you want to do it? [yes/no]: ")
 
 		// Read user input
 		input, err := reader.ReadString('\n')
 		if err != nil {
-			fmt.Println("Error reading input:", err)
-			return
+			return fmt.Errorf("reading input: %w", err)
 		}
 
 		// Normalize the input
@@ -523,21 +684,20 @@ var pruneCmd = &cobra.Command{
 		// Process the input
 		switch input {
 		case "yes", "y":
-			fmt.Println("You confirmed: Proceeding...")
+			fmt.Fprintln(a.stdout, "You confirmed: Proceeding...")
 		case "no", "n":
-			fmt.Println("You declined: Aborting...")
-			return
+			fmt.Fprintln(a.stdout, "You declined: Aborting...")
+			return nil
 		default:
-			fmt.Println("Invalid input. Please type 'yes' or 'no'.")
-			return
+			return fmt.Errorf("%w: please type 'yes' or 'no'", inventory.ErrInvalid)
 		}
 
 		// Save the configuration after removing machines
-		save_err := config.SaveConfigurationToYAML(configFile)
-		if save_err != nil {
-			fmt.Println("Error saving configuration:", save_err)
+		if err := a.save(); err != nil {
+			return err
 		}
-		fmt.Println("Done.")
+		fmt.Fprintln(a.stdout, "Done.")
+		return nil
 	},
 }
 
@@ -551,8 +711,17 @@ var fetchAccountCmd = &cobra.Command{
 	Use:   "accounts",
 	Short: "fetches accounts",
 	Long:  "Fetches accounts from your gcloud configurations. (Azure, AWS are not supported, yet)",
-	Run: func(cmd *cobra.Command, args []string) {
-		config.ReadAccounts()
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		accounts, err := a.client.FetchAccounts()
+		if err != nil {
+			return fmt.Errorf("fetching accounts: %w", err)
+		}
+		for _, account := range accounts {
+			fmt.Fprintln(a.stdout, "Adding account:", account)
+		}
+
+		return a.save()
 	},
 }
 
@@ -560,43 +729,81 @@ var fetchProjectCmd = &cobra.Command{
 	Use:   "projects",
 	Short: "fetches accounts",
 	Long:  "Fetches accounts from your gcloud configurations. (Azure, AWS are not supported, yet)",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
 		account, _ := cmd.Flags().GetString("account")
-		config.ReadProjects(account)
+		projects, err := a.client.FetchProjects(account)
+		if err != nil {
+			return fmt.Errorf("fetching projects: %w", err)
+		}
+		for _, project := range projects {
+			fmt.Fprintln(a.stdout, "Adding project:", project)
+		}
+
+		return a.save()
+	},
+}
+
+var fetchMachineCmd = &cobra.Command{
+	Use:   "machines",
+	Short: "fetches machines",
+	Long:  "Fetches the machines of a project from GCP, including their zone and status. (Azure, AWS are not supported, yet)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return err
+		}
+
+		machines, err := a.client.FetchMachines(account, project)
+		if err != nil {
+			return fmt.Errorf("fetching machines: %w", err)
+		}
+		for _, machine := range machines {
+			fmt.Fprintln(a.stdout, "Adding machine:", machine.Name, "("+machine.Zone+", "+machine.Status+")")
+			if resolved, _ := a.config.ResolveMachine(account, project, machine.Name); resolved.Transport == inventory.TransportIAP {
+				fmt.Fprintln(a.stdout, "  connecting through IAP, the machine has no external access")
+			}
+		}
+
+		return a.save()
 	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// Errors are printed to stderr and end chop with the exit code documented in errors.go.
 func Execute() {
-	err := rootCmd.Execute()
+	configFile := defaultConfigFile
+	if file := os.Getenv("CHOP_CONFIG"); file != "" {
+		configFile = file
+	}
+	a := newApp(configFile, chop.DefaultProvider)
+	a.command = chop.CommandLine(os.Args[1:])
+	a.client.Journal.Command = a.command
+	err := rootCmd.ExecuteContext(withApp(context.Background(), a))
 	if err != nil {
-		os.Exit(1)
+		// Errors from cobra itself, like unknown commands or bad flags, come before any command started
+		if !a.started {
+			err = usageError{err}
+		}
+		printError(a, err)
+		os.Exit(exitCode(err))
 	}
 }
 
 func init() {
-	// Load the configuration file at startup, if it exists
-	err := config.ReadConfigurationFromYAML(configFile)
-	if err != nil {
-		fmt.Println("Error loading configuration:", err)
-	}
-
-	// Ensure the accounts map is initialized if no data was loaded
-	if config.Accounts == nil {
-		config.Accounts = make(map[string]chop.Account)
-		config.SaveConfigurationToYAML(configFile)
-		fmt.Println("Created empty configuration file at:", configFile)
-	}
-
 	// ************ ADD ***************
 	// Add the subcommands to the 'add' parent command
 	addCmd.AddCommand(addAccountCmd)
 	addCmd.AddCommand(addProjectCmd)
 	addCmd.AddCommand(addMachineCmd)
+	addCmd.AddCommand(addAliasCmd)
 	addProjectCmd.Flags().String("account", "", "The Account where you want to set the Project")
 	addMachineCmd.Flags().String("account", "", "The Account where you want to set the Machine")
 	addMachineCmd.Flags().String("project", "", "The Project where you want to set the Machine")
+	addAliasCmd.Flags().String("account", "", "The Account of the Machine")
+	addAliasCmd.Flags().String("project", "", "The Project of the Machine")
 	rootCmd.AddCommand(addCmd)
 
 	// ********** LIST ***********
@@ -606,6 +813,20 @@ func init() {
 	setProjectCmd.Flags().String("account", "", "Account to set the project for (optional)")
 	setCmd.AddCommand(setAccountCmd)
 	setCmd.AddCommand(setProjectCmd)
+	setTransportCmd.Flags().String("account", "", "Account of the project (optional)")
+	setTransportCmd.Flags().String("project", "", "Project to set the transport for (optional)")
+	setTransportCmd.Flags().String("machine", "", "Set the transport of a single machine instead of the whole project")
+	setCmd.AddCommand(setTransportCmd)
+	setSSHCmd.Flags().String("account", "", "Account of the machine (optional)")
+	setSSHCmd.Flags().String("project", "", "Project of the machine (optional)")
+	setSSHCmd.Flags().String("host", "", "Host name or IP to connect to (defaults to the machine name)")
+	setSSHCmd.Flags().Int("port", 0, "SSH port")
+	setSSHCmd.Flags().String("user", "", "Remote user")
+	setSSHCmd.Flags().String("identity", "", "Identity file (private key)")
+	setSSHCmd.Flags().String("jump", "", "Jump host, [user@]host[:port]")
+	setSSHCmd.Flags().Bool("forward-agent", false, "Forward the ssh agent")
+	setSSHCmd.Flags().StringArray("option", nil, "Additional ssh_config option as Key=Value, Key= removes it (repeatable)")
+	setCmd.AddCommand(setSSHCmd)
 	rootCmd.AddCommand(setCmd)
 
 	// ******** REMOVE *************
@@ -615,6 +836,7 @@ func init() {
 	rmCmd.AddCommand(rmAccountCmd)
 	rmCmd.AddCommand(rmProjectCmd)
 	rmCmd.AddCommand(rmMachineCmd)
+	rmCmd.AddCommand(rmAliasCmd)
 	rootCmd.AddCommand(rmCmd)
 
 	// ********* UNSET ***********
@@ -630,5 +852,11 @@ func init() {
 	rootCmd.AddCommand(fetchCmd)
 	fetchCmd.AddCommand(fetchAccountCmd)
 	fetchCmd.AddCommand(fetchProjectCmd)
+	fetchCmd.AddCommand(fetchMachineCmd)
 	fetchProjectCmd.Flags().String("account", "", "In which account do you wish to fetch the projects?")
+	fetchMachineCmd.Flags().String("account", "", "In which account do you wish to fetch the machines?")
+	fetchMachineCmd.Flags().String("project", "", "In which project do you wish to fetch the machines?")
+
+	// ******** COMPLETION *********
+	registerCompletions()
 }
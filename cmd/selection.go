@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"palexus/chop/pkg/inventory"
+
+	"github.com/spf13/cobra"
+)
+
+// addSelectionFlags adds the flags of commands that work on many machines at once
+func addSelectionFlags(cmd *cobra.Command) {
+	cmd.Flags().String("account", "", "Only machines of this account")
+	cmd.Flags().String("project", "", "Only machines of this project")
+	cmd.Flags().StringArray("tag", nil, "Only machines with this tag (repeatable, all must match)")
+	cmd.ValidArgsFunction = completeMachines
+	cmd.RegisterFlagCompletionFunc("account", completeAccounts)
+	cmd.RegisterFlagCompletionFunc("project", completeProjects)
+}
+
+// hasSelectionFlags reports whether any of the selection flags was given
+func hasSelectionFlags(cmd *cobra.Command) bool {
+	return cmd.Flags().Changed("account") || cmd.Flags().Changed("project") || cmd.Flags().Changed("tag")
+}
+
+// selectMachines returns the machines named in names, or all machines matching the selection
+// flags. Without names and flags the machines of the active project are selected. fuzzy also
+// accepts unique parts of machine names, see ResolveNameFuzzy.
+func selectMachines(cmd *cobra.Command, names []string, fuzzy bool) ([]inventory.MachineRef, error) {
+	a := appFrom(cmd)
+	selection := inventory.Selection{Names: names, Fuzzy: fuzzy}
+	selection.Account, _ = cmd.Flags().GetString("account")
+	selection.Project, _ = cmd.Flags().GetString("project")
+	selection.Tags, _ = cmd.Flags().GetStringArray("tag")
+	if len(selection.Names) == 0 && !hasSelectionFlags(cmd) {
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return nil, err
+		}
+		selection.Account, selection.Project = account, project
+	}
+
+	refs, err := a.config.SelectMachines(selection)
+	if err != nil {
+		return nil, fmt.Errorf("selecting machines: %w", err)
+	}
+	return refs, nil
+}
@@ -0,0 +1,272 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alexeyco/simpletable"
+	"github.com/spf13/cobra"
+)
+
+var templateCmd = &cobra.Command{
+	Use:   "template",
+	Short: "Manage machine templates for 'chop spawn'",
+	Long:  "Store named machine templates (zone, machine type, image, disk, labels) in a project.",
+}
+
+// Add a template to a project
+var templateAddCmd = &cobra.Command{
+	Use:   "add [template]",
+	Short: "Add a machine template to the active project",
+	Example: `  chop template add debug --zone europe-west3-a --machine-type e2-small \
+    --image-family debian-12 --image-project debian-cloud --disk-size 20 --label team=ops`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return err
+		}
+
+		var template inventory.Template
+		flags := cmd.Flags()
+		template.Zone, _ = flags.GetString("zone")
+		template.MachineType, _ = flags.GetString("machine-type")
+		template.ImageFamily, _ = flags.GetString("image-family")
+		template.ImageProject, _ = flags.GetString("image-project")
+		template.DiskSizeGB, _ = flags.GetInt("disk-size")
+		labels, _ := flags.GetStringArray("label")
+		for _, label := range labels {
+			key, value, found := strings.Cut(label, "=")
+			if !found || key == "" {
+				return fmt.Errorf("adding template: %w: labels must look like key=value, got %s", inventory.ErrInvalid, label)
+			}
+			if template.Labels == nil {
+				template.Labels = make(map[string]string)
+			}
+			template.Labels[key] = value
+		}
+
+		err = a.config.AddTemplate(account, project, args[0], template)
+		if err != nil {
+			return fmt.Errorf("adding template: %w", err)
+		}
+		fmt.Fprintln(a.stdout, "Template added to", project, ":", args[0])
+
+		// Save the configuration after adding the template
+		return a.save()
+	},
+}
+
+// Remove a template from a project
+var templateRmCmd = &cobra.Command{
+	Use:   "rm [template]",
+	Short: "Remove a machine template from the active project",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return err
+		}
+
+		err = a.config.DeleteTemplate(account, project, args[0])
+		if err != nil {
+			return fmt.Errorf("removing template: %w", err)
+		}
+		fmt.Fprintln(a.stdout, "Template removed from", project, ":", args[0])
+
+		// Save the configuration after removing the template
+		return a.save()
+	},
+}
+
+// List the templates of a project
+var templateLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the machine templates of the active project",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return err
+		}
+
+		table := simpletable.New()
+		table.Header = &simpletable.Header{
+			Cells: []*simpletable.Cell{
+				{Text: "TEMPLATE"},
+				{Text: "ZONE"},
+				{Text: "MACHINE TYPE"},
+				{Text: "IMAGE"},
+				{Text: "DISK"},
+				{Text: "LABELS"},
+			},
+		}
+		proj, _ := a.config.GetProject(account, project)
+		for _, name := range a.config.TemplateNames(account, project) {
+			template := proj.Templates[name]
+			labels := make([]string, 0, len(template.Labels))
+			for key, value := range template.Labels {
+				labels = append(labels, key+"="+value)
+			}
+			sort.Strings(labels)
+			table.Body.Cells = append(table.Body.Cells, []*simpletable.Cell{
+				{Text: name},
+				{Text: template.Zone},
+				{Text: ternary(template.MachineType != "", template.MachineType, "default")},
+				{Text: ternary(template.ImageFamily != "", template.ImageProject+"/"+template.ImageFamily, "default")},
+				{Text: ternary(template.DiskSizeGB != 0, fmt.Sprintf("%d GB", template.DiskSizeGB), "default")},
+				{Text: strings.Join(labels, ", ")},
+			})
+		}
+
+		table.SetStyle(simpletable.StyleDefault)
+		fmt.Fprintln(a.stdout, table.String())
+		return nil
+	},
+}
+
+// Create a throwaway machine, connect to it and delete it afterwards
+var spawnCmd = &cobra.Command{
+	Use:   "spawn [template]",
+	Short: "Create a machine from a template, connect and delete it on exit",
+	Long: `Creates a machine from a template of the active project, adds it to the inventory,
+waits until SSH answers and connects. When the session ends chop asks whether to delete
+the machine again (--delete and --keep answer up front).`,
+	Example: `  chop spawn debug
+  chop spawn debug --name debug-ticket-42 --keep`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return err
+		}
+		name, _ := cmd.Flags().GetString("name")
+		deleteAfter, _ := cmd.Flags().GetBool("delete")
+		keep, _ := cmd.Flags().GetBool("keep")
+		wait, _ := cmd.Flags().GetDuration("wait")
+		if !slices.Contains(a.config.TemplateNames(account, project), args[0]) {
+			return fmt.Errorf("creating machine: %w: %s, see 'chop template ls'", inventory.ErrTemplateNotFound, args[0])
+		}
+		if name == "" {
+			name = chop.SpawnName(args[0])
+		}
+
+		fmt.Fprintln(a.stdout, "Creating", name, "from template", args[0], "...")
+		_, err = a.client.SpawnMachine(account, project, args[0], name)
+		if err != nil {
+			return fmt.Errorf("creating machine: %w", err)
+		}
+
+		// Save right away, the machine exists now even if the session goes wrong
+		if err := a.save(); err != nil {
+			return err
+		}
+
+		// Failures of the session still lead to the question whether to delete the machine
+		var errs []error
+		progress := func(message string) { fmt.Fprintln(a.stdout, message) }
+		err = a.client.WaitUntilReady(account, project, name, wait, progress)
+		if err == nil {
+			err = a.client.Connect(account, project, name)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("connecting to machine: %w", err))
+			fmt.Fprintln(a.stderr, "Error connecting to machine:", err)
+		}
+
+		if keep || (!deleteAfter && !a.askYesNo(fmt.Sprintf("Delete %s?", name))) {
+			fmt.Fprintln(a.stdout, "Keeping", name, "- delete it later with 'chop destroy", name+"'")
+		} else {
+			fmt.Fprintln(a.stdout, "Deleting", name, "...")
+			if err := a.client.DestroyMachine(account, project, name); err != nil {
+				errs = append(errs, fmt.Errorf("deleting machine: %w", err))
+			}
+		}
+
+		return errors.Join(append(errs, a.save())...)
+	},
+}
+
+// Delete a machine in the cloud and in the inventory
+var destroyCmd = &cobra.Command{
+	Use:   "destroy [machine_name]",
+	Short: "Delete a machine in the cloud and remove it from the inventory",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return err
+		}
+		yes, _ := cmd.Flags().GetBool("yes")
+		if !yes && !a.askYesNo(fmt.Sprintf("Delete %s in the cloud? This cannot be undone.", args[0])) {
+			fmt.Fprintln(a.stdout, "You declined: Aborting...")
+			return nil
+		}
+
+		err = a.client.DestroyMachine(account, project, args[0])
+		if err != nil {
+			return fmt.Errorf("deleting machine: %w", err)
+		}
+		fmt.Fprintln(a.stdout, "Machine deleted:", args[0])
+
+		// Save the configuration after removing the machine
+		return a.save()
+	},
+}
+
+// completeTemplates completes the templates of the chosen project
+func completeTemplates(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	a := appFrom(cmd)
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	account := completionAccount(cmd)
+	project := completionProject(cmd, account)
+	return filterCompletions(a.config.TemplateNames(account, project), args, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+func init() {
+	// ********** TEMPLATE ************
+	for _, cmd := range []*cobra.Command{templateAddCmd, templateRmCmd, templateLsCmd, spawnCmd, destroyCmd} {
+		cmd.Flags().String("account", "", "Account of the project (if not provided, active account will be used)")
+		cmd.Flags().String("project", "", "Project (if not provided, active project will be used)")
+		cmd.RegisterFlagCompletionFunc("account", completeAccounts)
+		cmd.RegisterFlagCompletionFunc("project", completeProjects)
+	}
+	templateAddCmd.Flags().String("zone", "", "Zone to create machines in")
+	templateAddCmd.Flags().String("machine-type", "", "Machine type, e.g. e2-small")
+	templateAddCmd.Flags().String("image-family", "", "Boot image family, e.g. debian-12")
+	templateAddCmd.Flags().String("image-project", "", "Project of the image family, e.g. debian-cloud")
+	templateAddCmd.Flags().Int("disk-size", 0, "Boot disk size in GB")
+	templateAddCmd.Flags().StringArray("label", nil, "Label as key=value (repeatable)")
+	templateAddCmd.MarkFlagRequired("zone")
+	templateRmCmd.ValidArgsFunction = completeTemplates
+
+	templateCmd.AddCommand(templateAddCmd)
+	templateCmd.AddCommand(templateRmCmd)
+	templateCmd.AddCommand(templateLsCmd)
+	rootCmd.AddCommand(templateCmd)
+
+	// ********** SPAWN / DESTROY ************
+	spawnCmd.Flags().String("name", "", "Name of the new machine (defaults to the template name with a random suffix)")
+	spawnCmd.Flags().Bool("delete", false, "Delete the machine after the session without asking")
+	spawnCmd.Flags().Bool("keep", false, "Keep the machine after the session without asking")
+	spawnCmd.Flags().Duration("wait", 3*time.Minute, "How long to wait for the new machine to answer")
+	spawnCmd.MarkFlagsMutuallyExclusive("delete", "keep")
+	spawnCmd.ValidArgsFunction = completeTemplates
+	destroyCmd.Flags().BoolP("yes", "y", false, "Delete without asking")
+	destroyCmd.ValidArgsFunction = completeMachines
+	rootCmd.AddCommand(spawnCmd)
+	rootCmd.AddCommand(destroyCmd)
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"palexus/chop/cmd/chop"
+
+	"github.com/spf13/cobra"
+)
+
+// Render the inventory as an ssh config include file
+var sshConfigCmd = &cobra.Command{
+	Use:   "ssh-config",
+	Short: "Write the machines as Host blocks of an ssh config include file",
+	Long: `Writes one Host block per machine, named account.project.machine and by its aliases,
+so that ssh, scp, rsync, VS Code Remote or Ansible can use chop's names directly.
+
+The file is refreshed whenever chop changes the configuration, e.g. after 'chop fetch
+machines', 'chop undo' or 'chop config sync'. Include it from ~/.ssh/config:
+
+  Include ~/.ssh/chop_config`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		stdout, _ := cmd.Flags().GetBool("stdout")
+		if stdout {
+			if err := a.client.RenderSSHConfig(a.stdout); err != nil {
+				return fmt.Errorf("rendering ssh config: %w", err)
+			}
+			return nil
+		}
+
+		output, _ := cmd.Flags().GetString("output")
+		if output == "" {
+			output = a.config.SSHConfigFile
+		}
+		if output == "" {
+			output = chop.DefaultSSHConfigFile()
+		}
+
+		if err := a.client.WriteSSHConfig(output); err != nil {
+			return fmt.Errorf("writing ssh config: %w", err)
+		}
+		fmt.Fprintln(a.stdout, "SSH config written to:", output)
+		if a.config.SSHConfigFile != output {
+			fmt.Fprintln(a.stdout, "Add 'Include "+output+"' at the top of ~/.ssh/config to use it.")
+		}
+
+		// Remember the file so that it can be refreshed after each change
+		a.config.SSHConfigFile = output
+		return a.save()
+	},
+}
+
+// refreshSSHConfig rewrites the ssh config include file, if 'chop ssh-config' was used before
+func (a *app) refreshSSHConfig() error {
+	if a.config.SSHConfigFile == "" {
+		return nil
+	}
+	if err := a.client.WriteSSHConfig(a.config.SSHConfigFile); err != nil {
+		return fmt.Errorf("refreshing ssh config: %w", err)
+	}
+	return nil
+}
+
+func init() {
+	// ******** SSH-CONFIG *********
+	sshConfigCmd.Flags().StringP("output", "o", "", "Include file to write (default ~/.ssh/chop_config, or the last one used)")
+	sshConfigCmd.Flags().Bool("stdout", false, "Print the config instead of writing the include file")
+	rootCmd.AddCommand(sshConfigCmd)
+}
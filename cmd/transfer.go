@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"palexus/chop/cmd/chop"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Copy files between the local machine and machines
+var cpCmd = &cobra.Command{
+	Use:   "cp [sources...] [target]",
+	Short: "Copy files from and to machines",
+	Long: `Copies files like scp. Paths on machines are written as machine:path, where machine is
+an alias, account.project.machine or a machine name. Machines are reached with their
+transport ('gcloud compute scp', IAP or the system scp). Copies from one machine to
+another are staged in a local temporary directory.`,
+	Example: `  chop cp local.txt web-1:/tmp/
+  chop cp web-1:/var/log/syslog web-1:/var/log/auth.log logs/
+  chop cp -r db-1:backups/ web-1:restore/`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		recursive, _ := cmd.Flags().GetBool("recursive")
+
+		locations, err := a.parseLocations(args)
+		if err != nil {
+			return fmt.Errorf("copying files: %w", err)
+		}
+
+		err = a.client.Copy(locations[:len(locations)-1], locations[len(locations)-1], recursive)
+		if err != nil {
+			return fmt.Errorf("copying files: %w", err)
+		}
+
+		// Save the configuration to remember the last usage
+		return a.save()
+	},
+}
+
+// Mirror a directory between the local machine and a machine
+var syncCmd = &cobra.Command{
+	Use:   "sync [source] [target]",
+	Short: "Mirror a directory from or to a machine with rsync",
+	Long: `Mirrors source into target with rsync, which must be installed locally and on the machine.
+Exactly one side is written as machine:path. Trailing slashes mean the same as for rsync.
+Cloud machines are reached with the key 'gcloud compute ssh' deploys, so connect once first.`,
+	Example: `  chop sync site/ web-1:site/
+  chop sync --delete --exclude node_modules app/ web-1:app/
+  chop sync db-1:backups/ backups/`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		var options chop.SyncOptions
+		options.Delete, _ = cmd.Flags().GetBool("delete")
+		options.DryRun, _ = cmd.Flags().GetBool("dry-run")
+		options.Excludes, _ = cmd.Flags().GetStringArray("exclude")
+
+		locations, err := a.parseLocations(args)
+		if err != nil {
+			return fmt.Errorf("syncing files: %w", err)
+		}
+
+		err = a.client.Sync(locations[0], locations[1], options)
+		if err != nil {
+			return fmt.Errorf("syncing files: %w", err)
+		}
+
+		// Save the configuration to remember the last usage
+		return a.save()
+	},
+}
+
+// parseLocations resolves the machine:path arguments of cp and sync
+func (a *app) parseLocations(args []string) ([]chop.Location, error) {
+	locations := make([]chop.Location, 0, len(args))
+	for _, arg := range args {
+		location, err := a.client.ParseLocation(arg)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, location)
+	}
+	return locations, nil
+}
+
+// completeLocations offers the machines of the active project and all aliases as "name:",
+// and falls back to local files once nothing matches
+func completeLocations(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	a := appFrom(cmd)
+	if strings.Contains(toComplete, ":") {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+
+	names := []string{}
+	for _, machine := range a.config.Machines(a.config.ActiveAccount, a.config.ActiveProjects[a.config.ActiveAccount]) {
+		names = append(names, machine.Name)
+	}
+	for alias := range a.config.AliasNames() {
+		names = append(names, alias)
+	}
+
+	completions := []string{}
+	for _, name := range filterCompletions(names, nil, toComplete) {
+		completions = append(completions, name+":")
+	}
+	if len(completions) == 0 {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	return completions, cobra.ShellCompDirectiveNoSpace
+}
+
+func init() {
+	// ********** CP ************
+	cpCmd.Flags().BoolP("recursive", "r", false, "Copy directories recursively")
+	cpCmd.ValidArgsFunction = completeLocations
+	rootCmd.AddCommand(cpCmd)
+
+	// ********** SYNC ************
+	syncCmd.Flags().Bool("delete", false, "Delete files on the target that do not exist on the source")
+	syncCmd.Flags().BoolP("dry-run", "n", false, "Only show what would be transferred")
+	syncCmd.Flags().StringArray("exclude", nil, "Exclude files matching the pattern (repeatable)")
+	syncCmd.ValidArgsFunction = completeLocations
+	rootCmd.AddCommand(syncCmd)
+}
@@ -0,0 +1,663 @@
+// Package tui implements 'chop ui', a three-pane browser for accounts, projects and machines.
+//
+// The Model only talks to the outside world through a chop.Provider and a save
+// function, so it can be driven headlessly by feeding messages to Update.
+package tui
+
+import (
+	"errors"
+	"fmt"
+	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// pane identifies one of the three lists
+type pane int
+
+const (
+	accountsPane pane = iota
+	projectsPane
+	machinesPane
+)
+
+// mode tells Update how to interpret key presses
+type mode int
+
+const (
+	browsing mode = iota
+	filtering
+	editingTags
+	editingNotes
+	confirmingDelete
+	confirmingStart
+)
+
+// startTimeout is how long connecting waits for a started machine to answer, like
+// 'chop connect' does by default
+const startTimeout = 3 * time.Minute
+
+// operationDoneMsg reports the end of an asynchronous provider call
+type operationDoneMsg struct {
+	action   string // "start", "stop" or "refetch"
+	account  string
+	project  string
+	machine  string
+	machines []inventory.Machine // Result of a refetch
+	err      error
+}
+
+// readyMsg reports whether the machine to connect to runs, after checking or starting it
+type readyMsg struct {
+	account string
+	project string
+	name    string
+	machine inventory.Machine // As the checks left it in a copy of the configuration, if found
+	stopped string            // Status of a machine that has to be started first
+	err     error
+}
+
+// connectDoneMsg reports the end of an interactive session
+type connectDoneMsg struct {
+	account string
+	project string
+	machine string
+	err     error
+}
+
+// Model is the bubbletea model of the inventory browser
+type Model struct {
+	config   *inventory.Configuration
+	provider chop.Provider
+	save     func() error
+
+	focus   pane
+	cursor  [3]int
+	filter  string // Live filter of the focused pane
+	mode    mode
+	input   string // Text being edited in editingTags/editingNotes
+	status  string
+	stopped string // Status of the machine confirmingStart asks to start
+	pending int    // Number of running provider calls
+
+	width  int
+	height int
+}
+
+// New creates a browser positioned on the active account and project.
+// save is called after every change to the configuration.
+func New(config *inventory.Configuration, provider chop.Provider, save func() error) Model {
+	m := Model{config: config, provider: provider, save: save, width: 100, height: 30}
+
+	for i, name := range m.items(accountsPane) {
+		if name == config.ActiveAccount {
+			m.cursor[accountsPane] = i
+		}
+	}
+	for i, name := range m.items(projectsPane) {
+		if name == config.ActiveProjects[m.selected(accountsPane)] {
+			m.cursor[projectsPane] = i
+		}
+	}
+	return m
+}
+
+// Run starts the browser on the alternate screen and blocks until it is closed
+func Run(config *inventory.Configuration, provider chop.Provider, save func() error) error {
+	_, err := tea.NewProgram(New(config, provider, save), tea.WithAltScreen()).Run()
+	return err
+}
+
+// Init implements tea.Model
+func (m Model) Init() tea.Cmd {
+	return nil
+}
+
+// items returns the entries of a pane, filtered if the pane has the focus
+func (m Model) items(p pane) []string {
+	var names []string
+	switch p {
+	case accountsPane:
+		names = m.config.AccountNames()
+	case projectsPane:
+		names = m.config.ProjectNames(m.selected(accountsPane))
+	case machinesPane:
+		for _, machine := range m.config.Machines(m.selected(accountsPane), m.selected(projectsPane)) {
+			names = append(names, machine.Name)
+		}
+	}
+
+	if p != m.focus || m.filter == "" {
+		return names
+	}
+	filtered := []string{}
+	for _, name := range names {
+		if strings.Contains(strings.ToLower(name), strings.ToLower(m.filter)) {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered
+}
+
+// selected returns the entry under the cursor of a pane, or "" if the pane is empty
+func (m Model) selected(p pane) string {
+	items := m.items(p)
+	if len(items) == 0 {
+		return ""
+	}
+	return items[min(m.cursor[p], len(items)-1)]
+}
+
+// selectedMachine returns the machine under the cursor with its effective transport
+func (m Model) selectedMachine() (inventory.Machine, bool) {
+	machine, err := m.config.ResolveMachine(m.selected(accountsPane), m.selected(projectsPane), m.selected(machinesPane))
+	return machine, err == nil
+}
+
+// Update implements tea.Model
+func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		return m, nil
+
+	case operationDoneMsg:
+		m.pending--
+		return m.finishOperation(msg), nil
+
+	case readyMsg:
+		m.pending--
+		return m.finishReady(msg)
+
+	case connectDoneMsg:
+		if msg.err != nil {
+			m.status = fmt.Sprintf("Session on %s failed: %v", msg.machine, msg.err)
+			return m, nil
+		}
+		m.config.TouchMachine(msg.account, msg.project, msg.machine)
+		m.status = "Session on " + msg.machine + " closed"
+		return m.persist(), nil
+
+	case tea.KeyMsg:
+		switch m.mode {
+		case filtering:
+			return m.updateFilter(msg), nil
+		case editingTags, editingNotes:
+			return m.updateInput(msg), nil
+		case confirmingDelete:
+			return m.updateConfirmDelete(msg), nil
+		case confirmingStart:
+			return m.updateConfirmStart(msg)
+		}
+		return m.updateBrowsing(msg)
+	}
+	return m, nil
+}
+
+// updateBrowsing handles keys while navigating the panes
+func (m Model) updateBrowsing(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "q", "ctrl+c":
+		return m, tea.Quit
+
+	case "tab", "right", "l":
+		m = m.focusPane(min(m.focus+1, machinesPane))
+	case "shift+tab", "left", "h":
+		m = m.focusPane(max(m.focus-1, accountsPane))
+
+	case "up", "k":
+		m = m.moveCursor(-1)
+	case "down", "j":
+		m = m.moveCursor(1)
+
+	case "/":
+		m.mode = filtering
+	case "esc":
+		m.filter = ""
+
+	case "enter":
+		if m.focus == machinesPane {
+			return m.prepareConnect(false)
+		}
+		m = m.activate()
+
+	case "s":
+		return m.runOperation("start")
+	case "x":
+		return m.runOperation("stop")
+	case "r":
+		return m.runOperation("refetch")
+
+	case "t":
+		if machine, ok := m.selectedMachine(); ok && m.focus == machinesPane {
+			m.mode, m.input = editingTags, strings.Join(machine.Tags, ", ")
+		}
+	case "n":
+		if machine, ok := m.selectedMachine(); ok && m.focus == machinesPane {
+			m.mode, m.input = editingNotes, machine.Notes
+		}
+	case "d":
+		if m.selected(m.focus) != "" {
+			m.mode = confirmingDelete
+		}
+	}
+	return m, nil
+}
+
+// focusPane moves the focus and drops the filter of the previous pane
+func (m Model) focusPane(p pane) Model {
+	if p != m.focus {
+		// Keep the cursor on the same entry once the filter is gone
+		name := m.selected(m.focus)
+		m.filter = ""
+		for i, item := range m.items(m.focus) {
+			if item == name {
+				m.cursor[m.focus] = i
+			}
+		}
+		m.focus = p
+	}
+	return m
+}
+
+// moveCursor moves the cursor of the focused pane and resets the panes to its right
+func (m Model) moveCursor(delta int) Model {
+	count := len(m.items(m.focus))
+	if count == 0 {
+		return m
+	}
+	m.cursor[m.focus] = max(0, min(m.cursor[m.focus]+delta, count-1))
+	for p := m.focus + 1; p <= machinesPane; p++ {
+		m.cursor[p] = 0
+	}
+	return m
+}
+
+// updateFilter edits the live filter
+func (m Model) updateFilter(msg tea.KeyMsg) Model {
+	switch msg.Type {
+	case tea.KeyEnter:
+		m.mode = browsing
+	case tea.KeyEsc:
+		m.mode, m.filter = browsing, ""
+	case tea.KeyBackspace:
+		m.filter = dropLastRune(m.filter)
+	case tea.KeyRunes, tea.KeySpace:
+		m.filter += string(msg.Runes)
+	}
+	m.cursor[m.focus] = 0
+	return m
+}
+
+// updateInput edits the tags or notes of the selected machine
+func (m Model) updateInput(msg tea.KeyMsg) Model {
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.mode, m.input = browsing, ""
+	case tea.KeyBackspace:
+		m.input = dropLastRune(m.input)
+	case tea.KeyRunes, tea.KeySpace:
+		m.input += string(msg.Runes)
+	case tea.KeyEnter:
+		account, project, machine := m.selected(accountsPane), m.selected(projectsPane), m.selected(machinesPane)
+		var err error
+		if m.mode == editingTags {
+			err = m.config.SetMachineTags(account, project, machine, parseTags(m.input))
+		} else {
+			err = m.config.SetMachineNotes(account, project, machine, strings.TrimSpace(m.input))
+		}
+		m.mode, m.input = browsing, ""
+		if err != nil {
+			m.status = "Error updating machine: " + err.Error()
+			return m
+		}
+		m.status = "Updated " + machine
+		return m.persist()
+	}
+	return m
+}
+
+// updateConfirmDelete deletes the selected entry once the user typed y
+func (m Model) updateConfirmDelete(msg tea.KeyMsg) Model {
+	m.mode = browsing
+	if msg.String() != "y" && msg.String() != "Y" {
+		m.status = "Delete aborted"
+		return m
+	}
+
+	account, project, machine := m.selected(accountsPane), m.selected(projectsPane), m.selected(machinesPane)
+	var err error
+	var name string
+	switch m.focus {
+	case accountsPane:
+		err, name = m.config.DeleteAccount(account), account
+	case projectsPane:
+		err, name = m.config.DeleteProject(account, project), project
+	case machinesPane:
+		err, name = m.config.DeleteMachine(account, project, machine), machine
+	}
+	if err != nil {
+		m.status = "Error deleting: " + err.Error()
+		return m
+	}
+
+	m.filter = ""
+	m.cursor[m.focus] = max(0, m.cursor[m.focus]-1)
+	m.status = "Deleted " + name
+	return m.persist()
+}
+
+// updateConfirmStart starts the stopped machine to connect to once the user typed y
+func (m Model) updateConfirmStart(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.mode, m.stopped = browsing, ""
+	if msg.String() != "y" && msg.String() != "Y" {
+		m.status = "Connect aborted"
+		return m, nil
+	}
+	return m.prepareConnect(true)
+}
+
+// activate makes the selected account or project the active one
+func (m Model) activate() Model {
+	account, project := m.selected(accountsPane), m.selected(projectsPane)
+	if account == "" {
+		return m
+	}
+
+	if m.config.ActiveAccount != account {
+		if err := m.config.SetActiveAccount(account); err != nil {
+			m.status = "Error setting account: " + err.Error()
+			return m
+		}
+	}
+	m.status = "Active account set to " + account
+
+	if m.focus == projectsPane && project != "" {
+		if err := m.config.SetActiveProjectForAccount(account, project); err != nil {
+			m.status = "Error setting project: " + err.Error()
+			return m
+		}
+		m.status = "Active project for " + account + " set to " + project
+	}
+	return m.persist()
+}
+
+// prepareConnect makes sure the selected machine runs and answers before connecting, like
+// 'chop connect' does. A stopped machine is only started with start, otherwise the user is
+// asked first. The checks work on a copy of the configuration in the background, what they
+// learn is merged in Update.
+func (m Model) prepareConnect(start bool) (tea.Model, tea.Cmd) {
+	account, project, machine := m.selected(accountsPane), m.selected(projectsPane), m.selected(machinesPane)
+	if _, ok := m.selectedMachine(); !ok {
+		return m, nil
+	}
+	config, err := m.config.Clone()
+	if err != nil {
+		m.status = "Error connecting: " + err.Error()
+		return m, nil
+	}
+
+	m.pending++
+	m.status = "Checking " + machine + "..."
+	if start {
+		m.status = "Starting " + machine + ", waiting until it answers..."
+	}
+	client := &chop.Client{Configuration: &config, Provider: m.provider}
+	return m, func() tea.Msg {
+		msg := readyMsg{account: account, project: project, name: machine}
+		confirm := func(status string) bool {
+			msg.stopped = status
+			return start
+		}
+		msg.err = client.EnsureRunning(account, project, machine, startTimeout, confirm, func(string) {})
+		if checked, err := config.GetMachine(account, project, machine); err == nil {
+			msg.machine = checked
+		}
+		return msg
+	}
+}
+
+// finishReady records what the checks learned about the machine and connects to it, or
+// asks whether to start it
+func (m Model) finishReady(msg readyMsg) (tea.Model, tea.Cmd) {
+	// Keep the status and IPs learned on the way, also when the machine cannot be reached
+	if msg.machine.Name != "" {
+		m.config.MergeMachines(msg.account, msg.project, []inventory.Machine{msg.machine})
+		m = m.persist()
+	}
+	switch {
+	case errors.Is(msg.err, chop.ErrNotRunning) && msg.stopped != "":
+		m.mode, m.stopped = confirmingStart, msg.stopped
+		return m, nil
+	case msg.err != nil:
+		m.status = fmt.Sprintf("Cannot connect to %s: %v", msg.name, msg.err)
+		return m, nil
+	}
+	return m.connect(msg.account, msg.project, msg.name)
+}
+
+// connect hands the terminal over to an SSH session on a machine
+func (m Model) connect(account string, project string, name string) (tea.Model, tea.Cmd) {
+	machine, err := m.config.ResolveMachine(account, project, name)
+	if err != nil {
+		m.status = "Error connecting: " + err.Error()
+		return m, nil
+	}
+
+	m.status = "Connecting to " + name + "..."
+	cmd := m.provider.ConnectCommand(account, project, machine)
+	return m, tea.ExecProcess(cmd, func(err error) tea.Msg {
+		return connectDoneMsg{account: account, project: project, machine: machine.Name, err: err}
+	})
+}
+
+// runOperation runs a provider call in the background. Its result is applied
+// to the configuration in Update, so the configuration is never shared with
+// the background goroutine.
+func (m Model) runOperation(action string) (tea.Model, tea.Cmd) {
+	account, project := m.selected(accountsPane), m.selected(projectsPane)
+	if project == "" {
+		return m, nil
+	}
+
+	provider := m.provider
+	if action == "refetch" {
+		m.pending++
+		m.status = "Fetching machines of " + project + "..."
+		return m, func() tea.Msg {
+			machines, err := provider.ListMachines(account, project)
+			return operationDoneMsg{action: action, account: account, project: project, machines: machines, err: err}
+		}
+	}
+
+	machine, ok := m.selectedMachine()
+	if !ok || m.focus != machinesPane {
+		return m, nil
+	}
+	m.pending++
+	m.status = map[string]string{"start": "Starting ", "stop": "Stopping "}[action] + machine.Name + "..."
+	return m, func() tea.Msg {
+		var err error
+		if action == "start" {
+			err = provider.StartMachine(account, project, machine)
+		} else {
+			err = provider.StopMachine(account, project, machine)
+		}
+		return operationDoneMsg{action: action, account: account, project: project, machine: machine.Name, err: err}
+	}
+}
+
+// finishOperation records the result of a provider call
+func (m Model) finishOperation(msg operationDoneMsg) Model {
+	if msg.err != nil {
+		m.status = fmt.Sprintf("Error during %s: %v", msg.action, msg.err)
+		return m
+	}
+
+	switch msg.action {
+	case "refetch":
+		m.config.MergeMachines(msg.account, msg.project, msg.machines)
+		m.status = fmt.Sprintf("Fetched %d machines of %s", len(msg.machines), msg.project)
+	case "start":
+		m.config.SetMachineStatus(msg.account, msg.project, msg.machine, chop.StatusRunning)
+		m.status = "Started " + msg.machine
+	case "stop":
+		m.config.SetMachineStatus(msg.account, msg.project, msg.machine, chop.StatusTerminated)
+		m.status = "Stopped " + msg.machine
+	}
+	return m.persist()
+}
+
+// persist saves the configuration and reports failures in the status line
+func (m Model) persist() Model {
+	if err := m.save(); err != nil {
+		m.status = "Error saving configuration: " + err.Error()
+	}
+	return m
+}
+
+// parseTags splits a comma separated list into trimmed, non-empty tags
+func parseTags(input string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(input, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// dropLastRune removes the last character of s
+func dropLastRune(s string) string {
+	runes := []rune(s)
+	if len(runes) == 0 {
+		return s
+	}
+	return string(runes[:len(runes)-1])
+}
+
+var (
+	titleStyle         = lipgloss.NewStyle().Bold(true)
+	paneStyle          = lipgloss.NewStyle().Border(lipgloss.RoundedBorder()).Padding(0, 1)
+	focusedPaneStyle   = paneStyle.BorderForeground(lipgloss.Color("12"))
+	cursorStyle        = lipgloss.NewStyle().Reverse(true)
+	activeAccountStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("2")) // Same colors as 'chop list'
+	activeProjectStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("6"))
+	helpStyle          = lipgloss.NewStyle().Faint(true)
+)
+
+// View implements tea.Model
+func (m Model) View() string {
+	paneWidth := max(12, (m.width-6*3)/3)
+	listHeight := max(3, m.height-14)
+
+	panes := make([]string, 0, 3)
+	for p, title := range []string{"ACCOUNTS", "PROJECTS", "MACHINES"} {
+		panes = append(panes, m.viewPane(pane(p), title, paneWidth, listHeight))
+	}
+
+	sections := []string{
+		lipgloss.JoinHorizontal(lipgloss.Top, panes...),
+		m.viewDetails(),
+		m.viewStatus(),
+		helpStyle.Render("tab/←→ switch  ↑↓ move  / filter  enter activate/connect  s start  x stop  t tags  n notes  d delete  r refetch  q quit"),
+	}
+	return lipgloss.JoinVertical(lipgloss.Left, sections...)
+}
+
+// viewPane renders one list, scrolled so that the cursor stays visible
+func (m Model) viewPane(p pane, title string, width int, height int) string {
+	items := m.items(p)
+	cursor := min(m.cursor[p], max(0, len(items)-1))
+	offset := max(0, cursor-height+1)
+
+	lines := []string{titleStyle.Render(title)}
+	if p == m.focus && (m.filter != "" || m.mode == filtering) {
+		lines[0] += " /" + m.filter
+	}
+	for i := offset; i < len(items) && i < offset+height; i++ {
+		line := items[i]
+		switch {
+		case p == accountsPane && line == m.config.ActiveAccount:
+			line = activeAccountStyle.Render(line + " (active)")
+		case p == projectsPane && line == m.config.ActiveProjects[m.selected(accountsPane)]:
+			line = activeProjectStyle.Render(line + " (active)")
+		}
+		if i == cursor && p == m.focus {
+			line = cursorStyle.Render(line)
+		}
+		lines = append(lines, line)
+	}
+
+	style := paneStyle
+	if p == m.focus {
+		style = focusedPaneStyle
+	}
+	return style.Width(width).Height(height + 1).Render(strings.Join(lines, "\n"))
+}
+
+// viewDetails renders the metadata of the selected machine
+func (m Model) viewDetails() string {
+	machine, ok := m.selectedMachine()
+	if !ok {
+		return paneStyle.Render("No machine selected")
+	}
+
+	lastUsage := "never"
+	if !machine.LastUsage.IsZero() {
+		lastUsage = machine.LastUsage.Format("2006-01-02 15:04")
+	}
+	details := []string{
+		titleStyle.Render(machine.Name),
+		"Zone:       " + orDash(machine.Zone),
+		"Status:     " + orDash(machine.Status),
+		"IP:         " + orDash(strings.Join(nonEmpty(machine.ExternalIP, machine.InternalIP), " / ")),
+		"Transport:  " + machine.Transport,
+		"Last usage: " + lastUsage,
+		"Tags:       " + orDash(strings.Join(machine.Tags, ", ")),
+		"Notes:      " + orDash(machine.Notes),
+	}
+	return paneStyle.Render(strings.Join(details, "\n"))
+}
+
+// viewStatus renders the prompt of the current mode or the last status message
+func (m Model) viewStatus() string {
+	switch m.mode {
+	case editingTags:
+		return "Tags (comma separated): " + m.input + "█"
+	case editingNotes:
+		return "Notes: " + m.input + "█"
+	case confirmingDelete:
+		kind := []string{"account", "project", "machine"}[m.focus]
+		return fmt.Sprintf("Delete %s %s? [y/N]", kind, m.selected(m.focus))
+	case confirmingStart:
+		return fmt.Sprintf("%s is %s. Start it? [y/N]", m.selected(machinesPane), m.stopped)
+	}
+	if m.pending > 0 && m.status == "" {
+		return "Working..."
+	}
+	return m.status
+}
+
+// orDash replaces empty values with a dash, like 'chop list' does
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// nonEmpty drops empty strings
+func nonEmpty(values ...string) []string {
+	kept := []string{}
+	for _, value := range values {
+		if value != "" {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,504 @@
+package tui
+
+import (
+	"errors"
+	"os/exec"
+	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// fakeProvider answers the provider calls of the browser without a cloud, failing all of
+// them when fail is set
+type fakeProvider struct {
+	fail     bool
+	statuses map[string]string // Cloud status by machine, machines without one are not managed by a cloud
+	connects map[string]int    // Sessions opened by machine
+}
+
+func (p fakeProvider) err() error {
+	if p.fail {
+		return errors.New("boom")
+	}
+	return nil
+}
+
+func (p fakeProvider) ListMachines(account string, project string) ([]inventory.Machine, error) {
+	return []inventory.Machine{{Name: "cache-1", Status: chop.StatusRunning}}, p.err()
+}
+
+func (p fakeProvider) StartMachine(account string, project string, machine inventory.Machine) error {
+	if p.statuses != nil && !p.fail {
+		p.statuses[machine.Name] = chop.StatusRunning
+	}
+	return p.err()
+}
+
+func (p fakeProvider) StopMachine(account string, project string, machine inventory.Machine) error {
+	return p.err()
+}
+
+func (p fakeProvider) DescribeMachine(account string, project string, machine inventory.Machine) (inventory.Machine, error) {
+	status, ok := p.statuses[machine.Name]
+	if !ok && !p.fail {
+		return machine, chop.ErrNotManaged
+	}
+	machine.Status = status
+	return machine, p.err()
+}
+
+func (p fakeProvider) CreateMachine(account string, project string, name string, template inventory.Template) (inventory.Machine, error) {
+	return inventory.Machine{Name: name}, p.err()
+}
+
+func (p fakeProvider) UpdateMachine(account string, project string, machine inventory.Machine, update chop.MachineUpdate) error {
+	return p.err()
+}
+
+func (p fakeProvider) DeleteMachine(account string, project string, machine inventory.Machine) error {
+	return p.err()
+}
+
+func (p fakeProvider) ResetMachine(account string, project string, machine inventory.Machine) error {
+	return p.err()
+}
+
+func (p fakeProvider) ConnectCommand(account string, project string, machine inventory.Machine) *exec.Cmd {
+	if p.connects != nil {
+		p.connects[machine.Name]++
+	}
+	return exec.Command("true")
+}
+
+func (p fakeProvider) TunnelCommand(account string, project string, machine inventory.Machine, tunnel inventory.Tunnel) *exec.Cmd {
+	return exec.Command("true")
+}
+
+// ProxyCommand answers the probe of a started machine with an SSH banner
+func (p fakeProvider) ProxyCommand(account string, project string, machine inventory.Machine, port int) *exec.Cmd {
+	return exec.Command("echo", "SSH-2.0-OpenSSH_9.6")
+}
+
+func (p fakeProvider) RunCommand(account string, project string, machine inventory.Machine, command string) *exec.Cmd {
+	return exec.Command("true")
+}
+
+func (p fakeProvider) CopyCommand(account string, project string, machine inventory.Machine, transfer chop.Transfer) *exec.Cmd {
+	return exec.Command("true")
+}
+
+// testConfiguration holds the accounts acme and beta. acme is active with the projects
+// data and web, web is active and has the machines db-1 and web-1.
+func testConfiguration(t *testing.T) *inventory.Configuration {
+	t.Helper()
+	config := inventory.NewConfiguration()
+	config.AddAccount("acme")
+	config.AddAccount("beta")
+	for _, err := range []error{
+		config.SetActiveAccount("acme"),
+		config.AddProjectToActiveAccount("acme", "data"),
+		config.AddProjectToActiveAccount("acme", "web"),
+		config.SetActiveProjectForAccount("acme", "web"),
+		config.AddMachineToActiveProject("acme", "db-1"),
+		config.AddMachineToActiveProject("acme", "web-1"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &config
+}
+
+// key builds the message of a key press. Names of special keys are translated, anything
+// else is typed as runes.
+func key(name string) tea.KeyMsg {
+	special := map[string]tea.KeyType{
+		"tab":       tea.KeyTab,
+		"shift+tab": tea.KeyShiftTab,
+		"enter":     tea.KeyEnter,
+		"esc":       tea.KeyEsc,
+		"backspace": tea.KeyBackspace,
+		"up":        tea.KeyUp,
+		"down":      tea.KeyDown,
+		"ctrl+c":    tea.KeyCtrlC,
+	}
+	if keyType, ok := special[name]; ok {
+		return tea.KeyMsg{Type: keyType}
+	}
+	return tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(name)}
+}
+
+// press feeds the keys to the model. The commands they return are run right away and their
+// messages fed back, like the bubbletea runtime does, so provider calls complete before the
+// next key. press reports whether a command asked to quit.
+func press(m Model, keys ...string) (Model, bool) {
+	quit := false
+	for _, name := range keys {
+		next, cmd := m.Update(key(name))
+		m = next.(Model)
+		if cmd == nil {
+			continue
+		}
+		msg := cmd()
+		if _, ok := msg.(tea.QuitMsg); ok {
+			quit = true
+			continue
+		}
+		next, _ = m.Update(msg)
+		m = next.(Model)
+	}
+	return m, quit
+}
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []string
+		fail     bool
+		focus    pane
+		selected []string // Selection of the accounts, projects and machines panes
+		mode     mode
+		filter   string
+		status   string
+		saves    int
+		quit     bool
+	}{
+		{
+			name:     "starts on the active project",
+			selected: []string{"acme", "web", "db-1"},
+		},
+		{
+			name:     "tab moves the focus right",
+			keys:     []string{"tab", "tab", "tab"},
+			focus:    machinesPane,
+			selected: []string{"acme", "web", "db-1"},
+		},
+		{
+			name:     "h moves the focus left",
+			keys:     []string{"tab", "tab", "h"},
+			focus:    projectsPane,
+			selected: []string{"acme", "web", "db-1"},
+		},
+		{
+			name:     "j moves the cursor down",
+			keys:     []string{"tab", "tab", "j", "j"},
+			focus:    machinesPane,
+			selected: []string{"acme", "web", "web-1"},
+		},
+		{
+			name:     "moving the cursor resets the panes to its right",
+			keys:     []string{"tab", "tab", "j", "shift+tab", "k"},
+			focus:    projectsPane,
+			selected: []string{"acme", "data", ""},
+		},
+		{
+			name:     "another account has no projects",
+			keys:     []string{"down"},
+			selected: []string{"beta", "", ""},
+		},
+		{
+			name:     "filter narrows the focused pane",
+			keys:     []string{"tab", "tab", "/", "w", "e", "enter"},
+			focus:    machinesPane,
+			selected: []string{"acme", "web", "web-1"},
+			filter:   "we",
+		},
+		{
+			name:     "backspace edits the filter",
+			keys:     []string{"tab", "tab", "/", "w", "x", "backspace"},
+			focus:    machinesPane,
+			selected: []string{"acme", "web", "web-1"},
+			mode:     filtering,
+			filter:   "w",
+		},
+		{
+			name:     "esc drops the filter",
+			keys:     []string{"tab", "tab", "/", "w", "esc"},
+			focus:    machinesPane,
+			selected: []string{"acme", "web", "db-1"},
+		},
+		{
+			name:     "leaving a pane keeps its selection without the filter",
+			keys:     []string{"tab", "tab", "/", "w", "enter", "shift+tab"},
+			focus:    projectsPane,
+			selected: []string{"acme", "web", "web-1"},
+		},
+		{
+			name:     "enter activates a project",
+			keys:     []string{"tab", "k", "enter"},
+			focus:    projectsPane,
+			selected: []string{"acme", "data", ""},
+			status:   "Active project for acme set to data",
+			saves:    1,
+		},
+		{
+			name:     "enter activates an account",
+			keys:     []string{"j", "enter"},
+			selected: []string{"beta", "", ""},
+			status:   "Active account set to beta",
+			saves:    1,
+		},
+		{
+			name:     "t edits the tags",
+			keys:     []string{"tab", "tab", "t", "a, b", "enter"},
+			focus:    machinesPane,
+			selected: []string{"acme", "web", "db-1"},
+			status:   "Updated db-1",
+			saves:    1,
+		},
+		{
+			name:     "esc cancels editing the notes",
+			keys:     []string{"tab", "tab", "n", "note", "esc"},
+			focus:    machinesPane,
+			selected: []string{"acme", "web", "db-1"},
+		},
+		{
+			name:     "d asks before deleting",
+			keys:     []string{"tab", "tab", "d"},
+			focus:    machinesPane,
+			selected: []string{"acme", "web", "db-1"},
+			mode:     confirmingDelete,
+		},
+		{
+			name:     "anything but y aborts the delete",
+			keys:     []string{"tab", "tab", "d", "n"},
+			focus:    machinesPane,
+			selected: []string{"acme", "web", "db-1"},
+			status:   "Delete aborted",
+		},
+		{
+			name:     "y deletes",
+			keys:     []string{"tab", "tab", "j", "d", "y"},
+			focus:    machinesPane,
+			selected: []string{"acme", "web", "db-1"},
+			status:   "Deleted web-1",
+			saves:    1,
+		},
+		{
+			name:     "s starts the machine",
+			keys:     []string{"tab", "tab", "s"},
+			focus:    machinesPane,
+			selected: []string{"acme", "web", "db-1"},
+			status:   "Started db-1",
+			saves:    1,
+		},
+		{
+			name:     "s does nothing outside the machines pane",
+			keys:     []string{"s"},
+			selected: []string{"acme", "web", "db-1"},
+		},
+		{
+			name:     "failed provider calls are reported",
+			keys:     []string{"tab", "tab", "x"},
+			fail:     true,
+			focus:    machinesPane,
+			selected: []string{"acme", "web", "db-1"},
+			status:   "Error during stop: boom",
+		},
+		{
+			name:     "r refetches the project",
+			keys:     []string{"r"},
+			selected: []string{"acme", "web", "cache-1"},
+			status:   "Fetched 1 machines of web",
+			saves:    1,
+		},
+		{
+			name:     "q quits",
+			keys:     []string{"q"},
+			selected: []string{"acme", "web", "db-1"},
+			quit:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			saves := 0
+			m := New(testConfiguration(t), fakeProvider{fail: test.fail}, func() error {
+				saves++
+				return nil
+			})
+
+			m, quit := press(m, test.keys...)
+			if m.focus != test.focus {
+				t.Errorf("focus = %d, want %d", m.focus, test.focus)
+			}
+			selected := []string{m.selected(accountsPane), m.selected(projectsPane), m.selected(machinesPane)}
+			if strings.Join(selected, "/") != strings.Join(test.selected, "/") {
+				t.Errorf("selected %v, want %v", selected, test.selected)
+			}
+			if m.mode != test.mode {
+				t.Errorf("mode = %d, want %d", m.mode, test.mode)
+			}
+			if m.filter != test.filter {
+				t.Errorf("filter = %q, want %q", m.filter, test.filter)
+			}
+			if m.status != test.status {
+				t.Errorf("status = %q, want %q", m.status, test.status)
+			}
+			if m.pending != 0 {
+				t.Errorf("%d provider calls still pending", m.pending)
+			}
+			if saves != test.saves {
+				t.Errorf("saved %d times, want %d", saves, test.saves)
+			}
+			if quit != test.quit {
+				t.Errorf("quit = %v, want %v", quit, test.quit)
+			}
+		})
+	}
+}
+
+func TestUpdateChangesTheConfiguration(t *testing.T) {
+	config := testConfiguration(t)
+	m := New(config, fakeProvider{}, func() error { return nil })
+
+	press(m, "tab", "tab", "t", "a, ,b ", "enter", "n", "primary", "enter", "j", "d", "y")
+	machine, err := config.GetMachine("acme", "web", "db-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(machine.Tags, ",") != "a,b" {
+		t.Errorf("tags = %v, want [a b]", machine.Tags)
+	}
+	if machine.Notes != "primary" {
+		t.Errorf("notes = %q, want primary", machine.Notes)
+	}
+	if _, err := config.GetMachine("acme", "web", "web-1"); err == nil {
+		t.Error("web-1 was not deleted")
+	}
+
+	m, _ = press(New(config, fakeProvider{}, func() error { return errors.New("disk full") }), "j", "enter")
+	if m.status != "Error saving configuration: disk full" {
+		t.Errorf("status = %q, want the save error", m.status)
+	}
+}
+
+func TestConnectEnsuresTheMachineRuns(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   string // Cloud status of db-1, none if it is not managed by a cloud
+		fail     bool
+		keys     []string
+		mode     mode
+		view     string
+		connects int
+		want     string // Status of db-1 afterwards
+	}{
+		{"not managed by a cloud", "", false, nil, browsing, "Connecting to db-1...", 1, ""},
+		{"running", chop.StatusRunning, false, nil, browsing, "Connecting to db-1...", 1, chop.StatusRunning},
+		{"stopped asks first", chop.StatusTerminated, false, nil, confirmingStart, "db-1 is TERMINATED. Start it? [y/N]", 0, chop.StatusTerminated},
+		{"start declined", chop.StatusTerminated, false, []string{"n"}, browsing, "Connect aborted", 0, chop.StatusTerminated},
+		{"start confirmed", chop.StatusTerminated, false, []string{"y"}, browsing, "Connecting to db-1...", 1, chop.StatusRunning},
+		{"neither running nor stopped", "SUSPENDED", false, nil, browsing, "Cannot connect to db-1: machine is not running (SUSPENDED)", 0, "SUSPENDED"},
+		{"check fails", chop.StatusRunning, true, nil, browsing, "Cannot connect to db-1: failed to check status: boom", 0, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := fakeProvider{fail: test.fail, statuses: map[string]string{}, connects: map[string]int{}}
+			if test.status != "" {
+				provider.statuses["db-1"] = test.status
+			}
+			config := testConfiguration(t)
+			m, _ := press(New(config, provider, func() error { return nil }), append([]string{"tab", "tab", "enter"}, test.keys...)...)
+
+			if m.mode != test.mode {
+				t.Errorf("mode = %d, want %d", m.mode, test.mode)
+			}
+			if view := m.View(); !strings.Contains(view, test.view) {
+				t.Errorf("view does not show %q:\n%s", test.view, view)
+			}
+			if provider.connects["db-1"] != test.connects {
+				t.Errorf("connected %d times, want %d", provider.connects["db-1"], test.connects)
+			}
+			if m.pending != 0 {
+				t.Errorf("%d provider calls still pending", m.pending)
+			}
+			machine, err := config.GetMachine("acme", "web", "db-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if machine.Status != test.want {
+				t.Errorf("status = %q, want %q", machine.Status, test.want)
+			}
+		})
+	}
+}
+
+func TestView(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "panes and details",
+			want: []string{"ACCOUNTS", "PROJECTS", "MACHINES", "acme (active)", "web (active)", "db-1", "web-1", "Zone:       -", "Transport:  external", "q quit"},
+		},
+		{
+			name: "filter in the title",
+			keys: []string{"tab", "tab", "/", "we"},
+			want: []string{"MACHINES /we", "web-1"},
+		},
+		{
+			name:    "filtered entries are hidden",
+			keys:    []string{"tab", "tab", "/", "we", "enter"},
+			notWant: []string{"db-1"},
+		},
+		{
+			name: "tags prompt",
+			keys: []string{"tab", "tab", "t", "a, b"},
+			want: []string{"Tags (comma separated): a, b█"},
+		},
+		{
+			name: "notes prompt",
+			keys: []string{"tab", "tab", "n"},
+			want: []string{"Notes: █"},
+		},
+		{
+			name: "delete prompt",
+			keys: []string{"tab", "d"},
+			want: []string{"Delete project web? [y/N]"},
+		},
+		{
+			name: "status line",
+			keys: []string{"tab", "tab", "t", "x", "enter"},
+			want: []string{"Updated db-1", "Tags:       x"},
+		},
+		{
+			name: "project without machines",
+			keys: []string{"tab", "k"},
+			want: []string{"No machine selected"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, _ := press(New(testConfiguration(t), fakeProvider{}, func() error { return nil }), test.keys...)
+			view := m.View()
+			for _, want := range test.want {
+				if !strings.Contains(view, want) {
+					t.Errorf("view does not show %q:\n%s", want, view)
+				}
+			}
+			for _, notWant := range test.notWant {
+				if strings.Contains(view, notWant) {
+					t.Errorf("view shows %q:\n%s", notWant, view)
+				}
+			}
+		})
+	}
+}
+
+func TestViewFollowsTheWindowSize(t *testing.T) {
+	m := New(testConfiguration(t), fakeProvider{}, func() error { return nil })
+	next, _ := m.Update(tea.WindowSizeMsg{Width: 60, Height: 20})
+	for _, line := range strings.Split(next.View(), "\n") {
+		// The help line is the only one that may be wider than the window, the others are
+		// padded to its width
+		if width := len([]rune(strings.TrimRight(line, " "))); width > 60 && !strings.Contains(line, "quit") {
+			t.Errorf("line is %d wide in a 60 column window: %q", width, line)
+		}
+	}
+}
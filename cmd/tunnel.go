@@ -0,0 +1,351 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"palexus/chop/cmd/chop"
+	"palexus/chop/pkg/inventory"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/alexeyco/simpletable"
+	"github.com/spf13/cobra"
+)
+
+var tunnelCmd = &cobra.Command{
+	Use:   "tunnel",
+	Short: "Manage port forwarding profiles",
+	Long:  "Store named port forwarding profiles on machines and run them in the background.",
+}
+
+// Add a tunnel profile to a machine
+var tunnelAddCmd = &cobra.Command{
+	Use:   "add [machine_name] [profile]",
+	Short: "Add a tunnel profile to a machine",
+	Example: `  chop tunnel add db-1 postgres --local 5432 --remote 5432
+  chop tunnel add bastion admin --local 8080 --remote admin.internal:80
+  chop tunnel add notebook jupyter --local 8888 --remote 8888 --iap`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return err
+		}
+		localPort, _ := cmd.Flags().GetInt("local")
+		remote, _ := cmd.Flags().GetString("remote")
+		iap, _ := cmd.Flags().GetBool("iap")
+
+		remoteHost, remotePort, err := parseRemote(remote)
+		if err != nil {
+			return fmt.Errorf("adding tunnel: %w", err)
+		}
+		if localPort == 0 {
+			localPort = remotePort
+		}
+
+		tunnel := inventory.Tunnel{LocalPort: localPort, RemoteHost: remoteHost, RemotePort: remotePort, IAP: iap}
+		err = a.config.AddTunnel(account, project, args[0], args[1], tunnel)
+		if err != nil {
+			return fmt.Errorf("adding tunnel: %w", err)
+		}
+		fmt.Fprintln(a.stdout, "Tunnel added to", args[0], ":", args[1], fmt.Sprintf("(localhost:%d -> %s)", localPort, tunnel.Remote()))
+
+		// Save the configuration after adding the tunnel
+		return a.save()
+	},
+}
+
+// Remove a tunnel profile from a machine
+var tunnelRmCmd = &cobra.Command{
+	Use:   "rm [machine_name] [profile]",
+	Short: "Remove a tunnel profile from a machine",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		account, project, err := resolveAccountProject(cmd)
+		if err != nil {
+			return err
+		}
+
+		err = a.config.DeleteTunnel(account, project, args[0], args[1])
+		if err != nil {
+			return fmt.Errorf("removing tunnel: %w", err)
+		}
+		fmt.Fprintln(a.stdout, "Tunnel removed from", args[0], ":", args[1])
+
+		// Save the configuration after removing the tunnel
+		return a.save()
+	},
+}
+
+// List all tunnel profiles and whether they are up
+var tunnelLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List tunnel profiles",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		account, _ := cmd.Flags().GetString("account")
+		project, _ := cmd.Flags().GetString("project")
+		machine, _ := cmd.Flags().GetString("machine")
+
+		table := simpletable.New()
+		table.Header = &simpletable.Header{
+			Cells: []*simpletable.Cell{
+				{Text: "PROFILE"},
+				{Text: "MACHINE"},
+				{Text: "LOCAL"},
+				{Text: "REMOTE"},
+				{Text: "VIA"},
+				{Text: "STATE"},
+			},
+		}
+
+		dir := chop.TunnelDir(a.configFile)
+		for _, ref := range a.config.Tunnels(account, project, machine) {
+			state := "down"
+			if running, err := chop.ReadTunnelState(dir, ref); err == nil && running.Running() {
+				state = fmt.Sprintf("up (pid %d)", running.PID)
+			}
+			table.Body.Cells = append(table.Body.Cells, []*simpletable.Cell{
+				{Text: ref.Name},
+				{Text: ref.Account + "/" + ref.Project + "/" + ref.Machine},
+				{Text: strconv.Itoa(ref.Tunnel.LocalPort)},
+				{Text: ref.Tunnel.Remote()},
+				{Text: ternary(ref.Tunnel.IAP, "iap", "ssh")},
+				{Text: state},
+			})
+		}
+
+		table.SetStyle(simpletable.StyleDefault)
+		fmt.Fprintln(a.stdout, table.String())
+		return nil
+	},
+}
+
+// Start a tunnel in the background
+var tunnelUpCmd = &cobra.Command{
+	Use:   "up [profile]",
+	Short: "Start a tunnel in the background",
+	Long: `Starts a tunnel in the background and waits until its local port accepts connections.
+It is restarted whenever the connection drops, until 'chop tunnel down' is called.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		ref, err := findTunnel(cmd, args[0])
+		if err != nil {
+			return err
+		}
+
+		// Refuse to start twice and clean up after tunnels that died
+		dir := chop.TunnelDir(a.configFile)
+		if state, err := chop.ReadTunnelState(dir, ref); err == nil {
+			if state.Running() {
+				fmt.Fprintln(a.stdout, "Tunnel", ref.Name, "is already up (pid", state.PID, ")")
+				return nil
+			}
+			chop.RemoveTunnelState(dir, ref)
+		}
+
+		if err := chop.CheckLocalPort(ref.Tunnel.LocalPort); err != nil {
+			return fmt.Errorf("starting tunnel: %w", err)
+		}
+
+		// Run the supervisor as a detached copy of ourselves
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("starting tunnel: %w", err)
+		}
+		logFile, err := os.OpenFile(chop.TunnelLogFile(dir, ref), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("starting tunnel: %w", err)
+		}
+		defer logFile.Close()
+
+		executable, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("starting tunnel: %w", err)
+		}
+		supervisor := exec.Command(executable, "tunnel", "run", ref.Name,
+			"--account", ref.Account, "--project", ref.Project, "--machine", ref.Machine)
+		supervisor.Stdout = logFile
+		supervisor.Stderr = logFile
+		supervisor.SysProcAttr = detachedProcAttr()
+		if err := supervisor.Start(); err != nil {
+			return fmt.Errorf("starting tunnel: %w", err)
+		}
+
+		exited := make(chan error, 1)
+		go func() { exited <- supervisor.Wait() }()
+
+		state := chop.TunnelState{TunnelRef: ref, PID: supervisor.Process.Pid, Started: time.Now()}
+		if err := chop.SaveTunnelState(dir, state); err != nil {
+			fmt.Fprintln(a.stderr, "Error saving tunnel state:", err)
+		}
+
+		// Only report the tunnel as up once its local port accepts connections
+		err = chop.WaitForTunnel(ref.Tunnel.LocalPort, exited, chop.TunnelStartTimeout)
+		if errors.Is(err, chop.ErrTunnelNotReady) {
+			fmt.Fprintf(a.stdout, "Tunnel %s is not up yet, it keeps trying in the background (log: %s)\n",
+				ref.Name, chop.TunnelLogFile(dir, ref))
+			return nil
+		} else if err != nil {
+			chop.RemoveTunnelState(dir, ref)
+			return fmt.Errorf("starting tunnel: %w, see %s", err, chop.TunnelLogFile(dir, ref))
+		}
+
+		fmt.Fprintf(a.stdout, "Tunnel %s is up: localhost:%d -> %s on %s (log: %s)\n",
+			ref.Name, ref.Tunnel.LocalPort, ref.Tunnel.Remote(), ref.Machine, chop.TunnelLogFile(dir, ref))
+		return nil
+	},
+}
+
+// Stop a background tunnel
+var tunnelDownCmd = &cobra.Command{
+	Use:   "down [profile]",
+	Short: "Stop a background tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		ref, err := findTunnel(cmd, args[0])
+		if err != nil {
+			return err
+		}
+
+		dir := chop.TunnelDir(a.configFile)
+		state, err := chop.ReadTunnelState(dir, ref)
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintln(a.stdout, "Tunnel", ref.Name, "is not up")
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("stopping tunnel: %w", err)
+		}
+
+		if state.Running() {
+			process, _ := os.FindProcess(state.PID)
+			if err := process.Signal(syscall.SIGTERM); err != nil {
+				process.Kill()
+			}
+		}
+		if err := chop.RemoveTunnelState(dir, ref); err != nil {
+			return fmt.Errorf("stopping tunnel: %w", err)
+		}
+		fmt.Fprintln(a.stdout, "Tunnel", ref.Name, "is down")
+		return nil
+	},
+}
+
+// Keep a tunnel running in the foreground. This is what 'tunnel up' starts in the background.
+var tunnelRunCmd = &cobra.Command{
+	Use:    "run [profile]",
+	Short:  "Run a tunnel in the foreground and restart it when it drops",
+	Args:   cobra.ExactArgs(1),
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		ref, err := findTunnel(cmd, args[0])
+		if err != nil {
+			return err
+		}
+		machine, err := a.config.ResolveMachine(ref.Account, ref.Project, ref.Machine)
+		if err != nil {
+			return fmt.Errorf("running tunnel: %w", err)
+		}
+		defer chop.RemoveTunnelState(chop.TunnelDir(a.configFile), ref)
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		newCommand := func() *exec.Cmd {
+			return a.client.Provider.TunnelCommand(ref.Account, ref.Project, machine, ref.Tunnel)
+		}
+		if err := chop.SuperviseTunnel(ctx, newCommand, a.stdout); err != nil {
+			return fmt.Errorf("running tunnel: %w", err)
+		}
+		return nil
+	},
+}
+
+// findTunnel resolves a profile name, narrowed down by the --account, --project and --machine flags
+func findTunnel(cmd *cobra.Command, name string) (inventory.TunnelRef, error) {
+	a := appFrom(cmd)
+	account, _ := cmd.Flags().GetString("account")
+	project, _ := cmd.Flags().GetString("project")
+	machine, _ := cmd.Flags().GetString("machine")
+
+	ref, err := a.config.FindTunnel(name, account, project, machine)
+	if err != nil {
+		return inventory.TunnelRef{}, fmt.Errorf("finding tunnel: %w", err)
+	}
+	return ref, nil
+}
+
+// parseRemote accepts "port" for the machine itself or "host:port"
+func parseRemote(remote string) (string, int, error) {
+	host, port := "localhost", remote
+	if h, p, err := net.SplitHostPort(remote); err == nil {
+		host, port = h, p
+	}
+	number, err := strconv.Atoi(port)
+	if err != nil || number < 1 || number > 65535 {
+		return "", 0, fmt.Errorf("%w: remote port %q", inventory.ErrInvalid, port)
+	}
+	return host, number, nil
+}
+
+// completeTunnels completes the names of tunnel profiles
+func completeTunnels(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	a := appFrom(cmd)
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	account, _ := cmd.Flags().GetString("account")
+	project, _ := cmd.Flags().GetString("project")
+	machine, _ := cmd.Flags().GetString("machine")
+
+	names := []string{}
+	for _, ref := range a.config.Tunnels(account, project, machine) {
+		names = append(names, ref.Name+"\t"+ref.Machine+" "+ref.Tunnel.Remote())
+	}
+	return filterCompletions(names, args, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+func init() {
+	// ********** TUNNEL ************
+	for _, cmd := range []*cobra.Command{tunnelAddCmd, tunnelRmCmd} {
+		cmd.Flags().String("account", "", "Account of the machine (if not provided, active account will be used)")
+		cmd.Flags().String("project", "", "Project of the machine (if not provided, active project will be used)")
+		cmd.RegisterFlagCompletionFunc("account", completeAccounts)
+		cmd.RegisterFlagCompletionFunc("project", completeProjects)
+		cmd.ValidArgsFunction = completeMachines
+	}
+	tunnelAddCmd.Flags().Int("local", 0, "Local port to listen on (defaults to the remote port)")
+	tunnelAddCmd.Flags().String("remote", "", "Remote port, or host:port as seen from the machine")
+	tunnelAddCmd.Flags().Bool("iap", false, "Forward through Identity-Aware Proxy instead of SSH")
+	tunnelAddCmd.MarkFlagRequired("remote")
+
+	for _, cmd := range []*cobra.Command{tunnelLsCmd, tunnelUpCmd, tunnelDownCmd, tunnelRunCmd} {
+		cmd.Flags().String("account", "", "Only consider tunnels of this account")
+		cmd.Flags().String("project", "", "Only consider tunnels of this project")
+		cmd.Flags().String("machine", "", "Only consider tunnels of this machine")
+		cmd.RegisterFlagCompletionFunc("account", completeAccounts)
+		cmd.RegisterFlagCompletionFunc("project", completeProjects)
+		cmd.RegisterFlagCompletionFunc("machine", completeMachines)
+	}
+	tunnelUpCmd.ValidArgsFunction = completeTunnels
+	tunnelDownCmd.ValidArgsFunction = completeTunnels
+
+	tunnelCmd.AddCommand(tunnelAddCmd)
+	tunnelCmd.AddCommand(tunnelRmCmd)
+	tunnelCmd.AddCommand(tunnelLsCmd)
+	tunnelCmd.AddCommand(tunnelUpCmd)
+	tunnelCmd.AddCommand(tunnelDownCmd)
+	tunnelCmd.AddCommand(tunnelRunCmd)
+	rootCmd.AddCommand(tunnelCmd)
+}
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"fmt"
+	"palexus/chop/cmd/tui"
+
+	"github.com/spf13/cobra"
+)
+
+// Browse the inventory in a full-screen terminal UI
+var uiCmd = &cobra.Command{
+	Use:   "ui",
+	Short: "Browse accounts, projects and machines interactively",
+	Long: `Opens a full-screen browser with one pane for accounts, projects and machines.
+
+From there you can set the active account and project, connect to machines,
+start and stop them, edit their tags and notes, delete entries and refetch
+the machines of a project. Press / to filter the focused pane.
+
+Like 'chop connect', connecting checks cloud machines first: a stopped machine
+is started after asking, and the session opens once it runs and SSH answers.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := appFrom(cmd)
+		err := tui.Run(a.config, a.client.Provider, a.save)
+		if err != nil {
+			return fmt.Errorf("running UI: %w", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	// ************* UI **************
+	rootCmd.AddCommand(uiCmd)
+}
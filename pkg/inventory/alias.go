@@ -0,0 +1,79 @@
+package inventory
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// validAlias matches the aliases that can be used as they are, on the command line and as
+// ssh host names
+var validAlias = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// MachineRef identifies a machine by its account and project
+type MachineRef struct {
+	Account string
+	Project string
+	Machine string
+}
+
+// String formats the reference as account/project/machine
+func (ref MachineRef) String() string {
+	return ref.Account + "/" + ref.Project + "/" + ref.Machine
+}
+
+// FindAlias returns the machine that carries an alias
+func (configs *Configuration) FindAlias(alias string) (MachineRef, bool) {
+	for accName, acc := range configs.Accounts {
+		for projName, proj := range acc.Projects {
+			for machName, mach := range proj.Machines {
+				if slices.Contains(mach.Aliases, alias) {
+					return MachineRef{accName, projName, machName}, true
+				}
+			}
+		}
+	}
+	return MachineRef{}, false
+}
+
+// AddAlias gives a machine an additional short name
+func (configs *Configuration) AddAlias(account string, project string, machine string, alias string) error {
+	if !validAlias.MatchString(alias) {
+		return fmt.Errorf("%w: alias %q, aliases may only contain letters, digits, '.', '_' and '-'", ErrInvalid, alias)
+	}
+	if owner, exists := configs.FindAlias(alias); exists {
+		if owner == (MachineRef{account, project, machine}) {
+			return nil // Alias already set
+		}
+		return fmt.Errorf("%w: alias %q is already used by %s", ErrInvalid, alias, owner)
+	}
+	return configs.UpdateMachine(account, project, machine, func(m *Machine) {
+		m.Aliases = append(m.Aliases, alias)
+	})
+}
+
+// DeleteAlias removes an alias from the machine that carries it
+func (configs *Configuration) DeleteAlias(alias string) error {
+	owner, exists := configs.FindAlias(alias)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrAliasNotFound, alias)
+	}
+	return configs.UpdateMachine(owner.Account, owner.Project, owner.Machine, func(m *Machine) {
+		m.Aliases = slices.DeleteFunc(m.Aliases, func(a string) bool { return a == alias })
+	})
+}
+
+// AliasNames returns all aliases with the machines they point to
+func (configs *Configuration) AliasNames() map[string]MachineRef {
+	aliases := make(map[string]MachineRef)
+	for accName, acc := range configs.Accounts {
+		for projName, proj := range acc.Projects {
+			for machName, mach := range proj.Machines {
+				for _, alias := range mach.Aliases {
+					aliases[alias] = MachineRef{accName, projName, machName}
+				}
+			}
+		}
+	}
+	return aliases
+}
@@ -0,0 +1,368 @@
+// Package boltstore keeps chop's inventory in a bbolt database.
+//
+// Unlike the YAML file, every machine is stored under its own key, so single machines
+// and aliases are found without decoding the whole inventory, saves only write what
+// changed, and updates run as transactions that other chop processes wait for.
+//
+// The database is laid out in buckets:
+//
+//	meta             format, active account, ssh config include file
+//	active_projects  account -> active project
+//	accounts         account -> project -> "settings" (the project without machines)
+//	                                     -> machines -> machine
+//	aliases          alias -> machine reference, an index kept in sync on save
+//
+// Values are YAML documents of the inventory types, like in the YAML file.
+package boltstore
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"palexus/chop/pkg/inventory"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+)
+
+// format is the layout version written to the meta bucket
+const format = "1"
+
+// lockTimeout is how long to wait for another chop process that holds the database
+const lockTimeout = 10 * time.Second
+
+var (
+	metaBucket           = []byte("meta")
+	activeProjectsBucket = []byte("active_projects")
+	accountsBucket       = []byte("accounts")
+	aliasesBucket        = []byte("aliases")
+	machinesBucket       = []byte("machines")
+
+	formatKey        = []byte("format")
+	activeAccountKey = []byte("active_account")
+	sshConfigFileKey = []byte("ssh_config_file")
+	settingsKey      = []byte("settings")
+)
+
+// Store keeps the configuration in a bbolt database file. The database is only opened
+// for the duration of a call, so long running commands do not block others.
+type Store struct {
+	Filename string
+}
+
+// Load reads the whole configuration
+func (store Store) Load(configs *inventory.Configuration) error {
+	db, err := store.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		return read(tx, configs)
+	})
+}
+
+// Save writes the configuration, changing only the keys whose value differs
+func (store Store) Save(configs *inventory.Configuration) error {
+	db, err := store.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		return write(tx, configs)
+	})
+}
+
+// Update loads, changes and saves the configuration in a single transaction
+func (store Store) Update(fn func(configs *inventory.Configuration) error) error {
+	if _, err := os.Stat(store.Filename); err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	db, err := store.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		configs := inventory.NewConfiguration()
+		if err := read(tx, &configs); err != nil {
+			return err
+		}
+		if err := fn(&configs); err != nil {
+			return err
+		}
+		return write(tx, &configs)
+	})
+}
+
+// Machine looks up a single machine
+func (store Store) Machine(account string, project string, machine string) (inventory.Machine, error) {
+	var found inventory.Machine
+	db, err := store.open(true)
+	if err != nil {
+		return found, err
+	}
+	defer db.Close()
+	err = db.View(func(tx *bolt.Tx) error {
+		accountBucket := bucket(tx, accountsBucket, []byte(account))
+		if accountBucket == nil {
+			return fmt.Errorf("%w: %s", inventory.ErrAccountNotFound, account)
+		}
+		projectBucket := accountBucket.Bucket([]byte(project))
+		if projectBucket == nil {
+			return fmt.Errorf("%w: %s", inventory.ErrProjectNotFound, project)
+		}
+		value := projectBucket.Bucket(machinesBucket).Get([]byte(machine))
+		if value == nil {
+			return fmt.Errorf("%w: %s", inventory.ErrMachineNotFound, machine)
+		}
+		return decode(value, &found)
+	})
+	return found, err
+}
+
+// Alias looks up the machine that carries an alias
+func (store Store) Alias(alias string) (inventory.MachineRef, error) {
+	var ref inventory.MachineRef
+	db, err := store.open(true)
+	if err != nil {
+		return ref, err
+	}
+	defer db.Close()
+	err = db.View(func(tx *bolt.Tx) error {
+		value := bucket(tx, aliasesBucket).Get([]byte(alias))
+		if value == nil {
+			return fmt.Errorf("%w: %s", inventory.ErrAliasNotFound, alias)
+		}
+		return decode(value, &ref)
+	})
+	return ref, err
+}
+
+// open opens the database, waiting for other processes that hold it.
+// Read-only opens do not create a missing file but fail with fs.ErrNotExist.
+func (store Store) open(readOnly bool) (*bolt.DB, error) {
+	if readOnly {
+		if _, err := os.Stat(store.Filename); err != nil {
+			return nil, fmt.Errorf("failed to open database: %w", err)
+		}
+	}
+	db, err := bolt.Open(store.Filename, 0o600, &bolt.Options{Timeout: lockTimeout, ReadOnly: readOnly})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("failed to open database: another chop is using %s", store.Filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	return db, nil
+}
+
+// read decodes the configuration from all buckets
+func read(tx *bolt.Tx, configs *inventory.Configuration) error {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		// Opening for writing creates an empty database, that is no configuration yet
+		return fmt.Errorf("failed to read database: %w", fs.ErrNotExist)
+	}
+	if version := string(meta.Get(formatKey)); version != format {
+		return fmt.Errorf("failed to read database: unknown format %q", version)
+	}
+	configs.ActiveAccount = string(meta.Get(activeAccountKey))
+	configs.SSHConfigFile = string(meta.Get(sshConfigFileKey))
+
+	configs.ActiveProjects = make(map[string]string)
+	err := tx.Bucket(activeProjectsBucket).ForEach(func(account, project []byte) error {
+		configs.ActiveProjects[string(account)] = string(project)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	configs.Accounts = make(map[string]inventory.Account)
+	accounts := tx.Bucket(accountsBucket)
+	return accounts.ForEachBucket(func(accountName []byte) error {
+		account := inventory.Account{Name: string(accountName), Projects: make(map[string]inventory.Project)}
+		accountBucket := accounts.Bucket(accountName)
+		err := accountBucket.ForEachBucket(func(projectName []byte) error {
+			projectBucket := accountBucket.Bucket(projectName)
+			var project inventory.Project
+			if err := decode(projectBucket.Get(settingsKey), &project); err != nil {
+				return err
+			}
+			project.Machines = make(map[string]inventory.Machine)
+			err := projectBucket.Bucket(machinesBucket).ForEach(func(machineName, value []byte) error {
+				var machine inventory.Machine
+				if err := decode(value, &machine); err != nil {
+					return err
+				}
+				project.Machines[string(machineName)] = machine
+				return nil
+			})
+			account.Projects[string(projectName)] = project
+			return err
+		})
+		configs.Accounts[account.Name] = account
+		return err
+	})
+}
+
+// write brings all buckets in line with the configuration
+func write(tx *bolt.Tx, configs *inventory.Configuration) error {
+	buckets := map[string]*bolt.Bucket{}
+	for _, name := range [][]byte{metaBucket, activeProjectsBucket, accountsBucket, aliasesBucket} {
+		b, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return fmt.Errorf("failed to create bucket: %w", err)
+		}
+		buckets[string(name)] = b
+	}
+
+	meta := map[string][]byte{string(formatKey): []byte(format)}
+	if configs.ActiveAccount != "" {
+		meta[string(activeAccountKey)] = []byte(configs.ActiveAccount)
+	}
+	if configs.SSHConfigFile != "" {
+		meta[string(sshConfigFileKey)] = []byte(configs.SSHConfigFile)
+	}
+	if err := syncValues(buckets[string(metaBucket)], meta); err != nil {
+		return err
+	}
+
+	activeProjects := map[string][]byte{}
+	for account, project := range configs.ActiveProjects {
+		activeProjects[account] = []byte(project)
+	}
+	if err := syncValues(buckets[string(activeProjectsBucket)], activeProjects); err != nil {
+		return err
+	}
+
+	aliases := map[string][]byte{}
+	accounts := buckets[string(accountsBucket)]
+	if err := dropBuckets(accounts, keys(configs.Accounts)); err != nil {
+		return err
+	}
+	for accountName, account := range configs.Accounts {
+		accountBucket, err := accounts.CreateBucketIfNotExists([]byte(accountName))
+		if err != nil {
+			return fmt.Errorf("failed to create bucket: %w", err)
+		}
+		if err := dropBuckets(accountBucket, keys(account.Projects)); err != nil {
+			return err
+		}
+		for projectName, project := range account.Projects {
+			projectBucket, err := accountBucket.CreateBucketIfNotExists([]byte(projectName))
+			if err != nil {
+				return fmt.Errorf("failed to create bucket: %w", err)
+			}
+			settings := project
+			settings.Machines = nil
+			if err := syncValues(projectBucket, map[string][]byte{string(settingsKey): encode(settings)}); err != nil {
+				return err
+			}
+
+			machines := map[string][]byte{}
+			for machineName, machine := range project.Machines {
+				machines[machineName] = encode(machine)
+				for _, alias := range machine.Aliases {
+					aliases[alias] = encode(inventory.MachineRef{Account: accountName, Project: projectName, Machine: machineName})
+				}
+			}
+			machineBucket, err := projectBucket.CreateBucketIfNotExists(machinesBucket)
+			if err != nil {
+				return fmt.Errorf("failed to create bucket: %w", err)
+			}
+			if err := syncValues(machineBucket, machines); err != nil {
+				return err
+			}
+		}
+	}
+	return syncValues(buckets[string(aliasesBucket)], aliases)
+}
+
+// syncValues puts the values that changed and deletes the keys that are gone.
+// Nested buckets are left alone.
+func syncValues(b *bolt.Bucket, values map[string][]byte) error {
+	var stale [][]byte
+	err := b.ForEach(func(key, value []byte) error {
+		if _, keep := values[string(key)]; !keep && value != nil {
+			stale = append(stale, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if err := b.Delete(key); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+	}
+	for key, value := range values {
+		if string(b.Get([]byte(key))) == string(value) {
+			continue
+		}
+		if err := b.Put([]byte(key), value); err != nil {
+			return fmt.Errorf("failed to write %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// dropBuckets deletes the nested buckets whose name is not kept
+func dropBuckets(b *bolt.Bucket, keep map[string]bool) error {
+	var stale [][]byte
+	err := b.ForEachBucket(func(key []byte) error {
+		if !keep[string(key)] {
+			stale = append(stale, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if err := b.DeleteBucket(key); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// bucket follows a path of nested buckets, nil if one is missing
+func bucket(tx *bolt.Tx, path ...[]byte) *bolt.Bucket {
+	b := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(name)
+	}
+	return b
+}
+
+// keys returns the keys of a map as a set
+func keys[V any](m map[string]V) map[string]bool {
+	set := make(map[string]bool, len(m))
+	for key := range m {
+		set[key] = true
+	}
+	return set
+}
+
+// encode marshals a value as YAML. The inventory types always marshal.
+func encode(value any) []byte {
+	data, _ := yaml.Marshal(value)
+	return data
+}
+
+// decode unmarshals a value written by encode
+func decode(data []byte, value any) error {
+	if err := yaml.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("failed to decode database value: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package boltstore
+
+import (
+	"errors"
+	"io/fs"
+	"palexus/chop/pkg/inventory"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// testConfiguration holds acme with the projects data and web. db-1 in web carries the
+// aliases db and primary.
+func testConfiguration(t *testing.T) inventory.Configuration {
+	t.Helper()
+	configs := inventory.NewConfiguration()
+	configs.AddAccount("acme")
+	for _, err := range []error{
+		configs.SetActiveAccount("acme"),
+		configs.AddProjectToActiveAccount("acme", "data"),
+		configs.AddProjectToActiveAccount("acme", "web"),
+		configs.SetActiveProjectForAccount("acme", "web"),
+		configs.SetProjectTransport("acme", "web", inventory.TransportIAP),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	used := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	configs.Accounts["acme"].Projects["web"].Machines["db-1"] = inventory.Machine{Name: "db-1", LastUsage: used, Zone: "europe-west3-a",
+		Tags: []string{"db"}, Aliases: []string{"db", "primary"}}
+	configs.Accounts["acme"].Projects["web"].Machines["web-1"] = inventory.Machine{Name: "web-1", LastUsage: used}
+	configs.Accounts["acme"].Projects["data"].Machines["etl-1"] = inventory.Machine{Name: "etl-1", Aliases: []string{"etl"}}
+	configs.SSHConfigFile = "/home/me/.ssh/chop_config"
+	return configs
+}
+
+// assertLoads checks that the store holds want
+func assertLoads(t *testing.T, store Store, want *inventory.Configuration) {
+	t.Helper()
+	loaded := inventory.NewConfiguration()
+	if err := store.Load(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := yaml.Marshal(&loaded)
+	wanted, _ := yaml.Marshal(want)
+	if string(got) != string(wanted) {
+		t.Errorf("loaded:\n%s\nwant:\n%s", got, wanted)
+	}
+}
+
+func TestStore(t *testing.T) {
+	store := Store{Filename: filepath.Join(t.TempDir(), "chop.db")}
+	configs := inventory.NewConfiguration()
+	if err := store.Load(&configs); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("err = %v, want fs.ErrNotExist before the first save", err)
+	}
+
+	configs = testConfiguration(t)
+	if err := store.Save(&configs); err != nil {
+		t.Fatal(err)
+	}
+	assertLoads(t, store, &configs)
+	for alias, want := range map[string]string{"db": "db-1", "primary": "db-1", "etl": "etl-1"} {
+		ref, err := store.Alias(alias)
+		if err != nil || ref.Machine != want {
+			t.Errorf("alias %s = %+v, %v, want %s", alias, ref, err, want)
+		}
+	}
+	if machine, err := store.Machine("acme", "web", "db-1"); err != nil || machine.Zone != "europe-west3-a" {
+		t.Errorf("db-1 = %+v, %v", machine, err)
+	}
+
+	// Removing a project drops its machines and their aliases
+	err := store.Update(func(configs *inventory.Configuration) error {
+		if err := configs.DeleteProject("acme", "data"); err != nil {
+			return err
+		}
+		return configs.UpdateMachine("acme", "web", "db-1", func(m *inventory.Machine) { m.Aliases = []string{"primary"} })
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs.DeleteProject("acme", "data")
+	configs.UpdateMachine("acme", "web", "db-1", func(m *inventory.Machine) { m.Aliases = []string{"primary"} })
+	assertLoads(t, store, &configs)
+	if _, err := store.Machine("acme", "data", "etl-1"); !errors.Is(err, inventory.ErrProjectNotFound) {
+		t.Errorf("err = %v, want ErrProjectNotFound", err)
+	}
+	for _, alias := range []string{"db", "etl"} {
+		if _, err := store.Alias(alias); !errors.Is(err, inventory.ErrAliasNotFound) {
+			t.Errorf("alias %s: err = %v, want ErrAliasNotFound", alias, err)
+		}
+	}
+
+	// A failing update saves nothing
+	failed := errors.New("failed")
+	err = store.Update(func(configs *inventory.Configuration) error {
+		configs.DeleteMachine("acme", "web", "web-1")
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Errorf("err = %v, want the error of the update", err)
+	}
+	assertLoads(t, store, &configs)
+}
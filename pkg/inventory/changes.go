@@ -0,0 +1,171 @@
+package inventory
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Actions of changes, named after the methods of Configuration that usually make them
+const (
+	ChangeAddAccount       = "AddAccount"
+	ChangeDeleteAccount    = "DeleteAccount"
+	ChangeAddProject       = "AddProject"
+	ChangeDeleteProject    = "DeleteProject"
+	ChangeUpdateProject    = "UpdateProject"
+	ChangeAddMachine       = "AddMachine"
+	ChangeDeleteMachine    = "DeleteMachine"
+	ChangeUpdateMachine    = "UpdateMachine"
+	ChangeSetActiveAccount = "SetActiveAccount"
+	ChangeSetActiveProject = "SetActiveProject"
+	ChangeUpdateSettings   = "UpdateSettings"
+)
+
+// Change is one difference between two configurations, e.g. for an audit journal
+type Change struct {
+	Action  string
+	Account string
+	Project string
+	Machine string
+	Fields  []string // YAML keys of the values that changed, for updates
+}
+
+// Changes lists what turned before into after: added and deleted accounts, projects and
+// machines, updated projects and machines with the fields that changed, and changes of the
+// active account, active projects and settings. The last usage of machines is left out,
+// using a machine is no change to the inventory.
+func Changes(before *Configuration, after *Configuration) []Change {
+	var changes []Change
+	for _, account := range unionKeys(before.Accounts, after.Accounts) {
+		oldAccount, hadAccount := before.Accounts[account]
+		newAccount, hasAccount := after.Accounts[account]
+		switch {
+		case !hasAccount:
+			changes = append(changes, Change{Action: ChangeDeleteAccount, Account: account})
+			continue
+		case !hadAccount:
+			changes = append(changes, Change{Action: ChangeAddAccount, Account: account})
+		}
+
+		for _, project := range unionKeys(oldAccount.Projects, newAccount.Projects) {
+			oldProject, hadProject := oldAccount.Projects[project]
+			newProject, hasProject := newAccount.Projects[project]
+			switch {
+			case !hasProject:
+				changes = append(changes, Change{Action: ChangeDeleteProject, Account: account, Project: project})
+				continue
+			case !hadProject:
+				changes = append(changes, Change{Action: ChangeAddProject, Account: account, Project: project})
+			default:
+				if fields := changedFields(oldProject, newProject); len(fields) > 0 {
+					changes = append(changes, Change{Action: ChangeUpdateProject, Account: account, Project: project, Fields: fields})
+				}
+			}
+
+			for _, machine := range unionKeys(oldProject.Machines, newProject.Machines) {
+				oldMachine, hadMachine := oldProject.Machines[machine]
+				newMachine, hasMachine := newProject.Machines[machine]
+				change := Change{Account: account, Project: project, Machine: machine}
+				switch {
+				case !hasMachine:
+					change.Action = ChangeDeleteMachine
+				case !hadMachine:
+					change.Action = ChangeAddMachine
+				default:
+					if change.Fields = changedFields(oldMachine, newMachine); len(change.Fields) == 0 {
+						continue
+					}
+					change.Action = ChangeUpdateMachine
+				}
+				changes = append(changes, change)
+			}
+		}
+	}
+
+	if before.ActiveAccount != after.ActiveAccount {
+		changes = append(changes, Change{Action: ChangeSetActiveAccount, Account: after.ActiveAccount})
+	}
+	for _, account := range unionKeys(before.ActiveProjects, after.ActiveProjects) {
+		if before.ActiveProjects[account] != after.ActiveProjects[account] {
+			changes = append(changes, Change{Action: ChangeSetActiveProject, Account: account, Project: after.ActiveProjects[account]})
+		}
+	}
+	if fields := changedFields(*before, *after); len(fields) > 0 {
+		changes = append(changes, Change{Action: ChangeUpdateSettings, Fields: fields})
+	}
+	return changes
+}
+
+// String describes a change in one line, e.g. "UpdateMachine acme/web/db-1 (tags, notes)"
+func (change Change) String() string {
+	names := []string{}
+	for _, name := range []string{change.Account, change.Project, change.Machine} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	text := strings.TrimSpace(change.Action + " " + strings.Join(names, "/"))
+	if len(change.Fields) > 0 {
+		text += " (" + strings.Join(change.Fields, ", ") + ")"
+	}
+	return text
+}
+
+// Clone returns a deep copy of the configuration
+func (configs *Configuration) Clone() (Configuration, error) {
+	clone := NewConfiguration()
+	data, err := yaml.Marshal(configs)
+	if err != nil {
+		return clone, fmt.Errorf("failed to encode configuration: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &clone); err != nil {
+		return clone, fmt.Errorf("failed to decode configuration: %w", err)
+	}
+	return clone, nil
+}
+
+// changesSkipped are fields changedFields does not compare: names, nested inventories
+// that Changes compares on their own, what Changes tracks separately, and usage
+var changesSkipped = map[string]bool{
+	"name": true, "accounts": true, "projects": true, "machines": true,
+	"activeaccount": true, "activeprojects": true, "lastusage": true,
+}
+
+// changedFields returns the YAML keys of the fields of two structs of the same type that differ
+func changedFields(a any, b any) []string {
+	valueA, valueB := reflect.ValueOf(a), reflect.ValueOf(b)
+	fields := []string{}
+	for i := 0; i < valueA.NumField(); i++ {
+		key := strings.ToLower(valueA.Type().Field(i).Name)
+		if changesSkipped[key] {
+			continue
+		}
+		fieldA, fieldB := valueA.Field(i), valueB.Field(i)
+		// Nil and empty maps and lists are the same in the YAML file
+		if (fieldA.Kind() == reflect.Map || fieldA.Kind() == reflect.Slice) && fieldA.Len() == 0 && fieldB.Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(fieldA.Interface(), fieldB.Interface()) {
+			fields = append(fields, key)
+		}
+	}
+	return fields
+}
+
+// unionKeys returns the keys of two maps, sorted
+func unionKeys[V any](a map[string]V, b map[string]V) []string {
+	keys := []string{}
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,457 @@
+package inventory
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// Encryption tells how a YAML configuration is encrypted at rest with age.
+// Either the whole file is encrypted, or only some fields of every machine.
+type Encryption struct {
+	File   bool     `yaml:",omitempty"` // Encrypt the whole file
+	Fields []string `yaml:",omitempty"` // Machine fields encrypted in place, e.g. notes or ssh/user
+	Key    string   `yaml:",omitempty"` // Data key of the fields, encrypted with the passphrase or key file
+}
+
+// Keys are what encrypts and decrypts a configuration: a passphrase or an age key file
+type Keys struct {
+	Identities []age.Identity
+	Recipients []age.Recipient
+	Source     string // e.g. "passphrase" or the key file
+
+	// Data keys of encrypted fields that these keys decrypted or made. Deriving the key from
+	// a passphrase is slow on purpose, so each data key is only decrypted once per Keys.
+	dataKeys *dataKeyCache
+}
+
+// dataKeyCache holds decrypted data keys by their encrypted form
+type dataKeyCache struct {
+	mutex      sync.Mutex
+	identities map[string]*age.X25519Identity
+}
+
+// KeySource returns the keys whenever an encrypted configuration is read or written. It is
+// never called for configurations that are not encrypted, so it may e.g. ask for a passphrase.
+// A nil KeySource has no keys: encrypted configurations fail with ErrNoKey.
+type KeySource func() (Keys, error)
+
+// keys returns the keys of the source
+func (source KeySource) keys() (Keys, error) {
+	if source == nil {
+		return Keys{}, ErrNoKey
+	}
+	return source()
+}
+
+// KeysFromPassphrase returns keys that derive the encryption key from a passphrase
+func KeysFromPassphrase(passphrase string) (Keys, error) {
+	if passphrase == "" {
+		return Keys{}, fmt.Errorf("%w: the passphrase is empty", ErrInvalid)
+	}
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return Keys{}, err
+	}
+	identity, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return Keys{}, err
+	}
+	return Keys{Identities: []age.Identity{identity}, Recipients: []age.Recipient{recipient}, Source: "passphrase", dataKeys: newDataKeyCache()}, nil
+}
+
+// KeysFromFile reads an age key file, as written by age-keygen
+func KeysFromFile(filename string) (Keys, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return Keys{}, fmt.Errorf("failed to open key file: %w", err)
+	}
+	defer file.Close()
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return Keys{}, fmt.Errorf("%w: key file %s: %v", ErrInvalid, filename, err)
+	}
+	keys := Keys{Identities: identities, Source: filename, dataKeys: newDataKeyCache()}
+	for _, identity := range identities {
+		x25519, ok := identity.(*age.X25519Identity)
+		if !ok {
+			return Keys{}, fmt.Errorf("%w: key file %s holds a key chop cannot encrypt to", ErrInvalid, filename)
+		}
+		keys.Recipients = append(keys.Recipients, x25519.Recipient())
+	}
+	return keys, nil
+}
+
+// NewEncryption returns the settings for encrypting the whole file, or with fields only
+// those fields of every machine. Fields are the YAML keys of a machine, nested keys are
+// joined with slashes, e.g. notes, ssh or ssh/user. The data key of the fields is
+// encrypted with keys.
+func NewEncryption(fields []string, keys KeySource) (*Encryption, error) {
+	if len(fields) == 0 {
+		return &Encryption{File: true}, nil
+	}
+	for _, field := range fields {
+		if !hasField(reflect.TypeOf(Machine{}), strings.Split(field, "/")) || field == "name" {
+			return nil, fmt.Errorf("%w: %s is not a field of a machine that can be encrypted", ErrInvalid, field)
+		}
+	}
+	key, err := newDataKey(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &Encryption{Fields: fields, Key: key}, nil
+}
+
+// hasField tells if the YAML keys of path lead to a value of typ. Below a map any key does,
+// e.g. ssh/options/ServerAliveInterval.
+func hasField(typ reflect.Type, path []string) bool {
+	if len(path) == 0 {
+		return true
+	}
+	if path[0] == "" {
+		return false
+	}
+	switch typ.Kind() {
+	case reflect.Pointer:
+		return hasField(typ.Elem(), path)
+	case reflect.Map:
+		return hasField(typ.Elem(), path[1:])
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			if strings.ToLower(typ.Field(i).Name) == path[0] {
+				return hasField(typ.Field(i).Type, path[1:])
+			}
+		}
+	}
+	return false
+}
+
+// encryptedPrefix starts the value of an encrypted field, the base64 age ciphertext follows up to a ]
+const encryptedPrefix = "ENC[age,"
+
+// newDataKeyCache returns an empty cache of data keys
+func newDataKeyCache() *dataKeyCache {
+	return &dataKeyCache{identities: map[string]*age.X25519Identity{}}
+}
+
+// get returns a cached data key, a Keys without cache caches nothing
+func (cache *dataKeyCache) get(key string) (*age.X25519Identity, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	identity, ok := cache.identities[key]
+	return identity, ok
+}
+
+// put caches a data key
+func (cache *dataKeyCache) put(key string, identity *age.X25519Identity) {
+	if cache == nil {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.identities[key] = identity
+}
+
+// newDataKey generates the key fields are encrypted with and returns it encrypted with keys
+func newDataKey(source KeySource) (string, error) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return "", err
+	}
+	keys, err := source.keys()
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := encrypt([]byte(identity.String()), keys.Recipients...)
+	if err != nil {
+		return "", err
+	}
+	key := base64.StdEncoding.EncodeToString(ciphertext)
+	keys.dataKeys.put(key, identity)
+	return key, nil
+}
+
+// dataKey decrypts the data key of encrypted fields with keys
+func dataKey(key string, source KeySource) (*age.X25519Identity, error) {
+	if key == "" {
+		return nil, fmt.Errorf("%w: encrypted fields need encryption/key", ErrInvalid)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: encryption/key: %v", ErrInvalid, err)
+	}
+	keys, err := source.keys()
+	if err != nil {
+		return nil, err
+	}
+	if identity, ok := keys.dataKeys.get(key); ok {
+		return identity, nil
+	}
+	plaintext, err := decrypt(ciphertext, keys.Identities...)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := age.ParseX25519Identity(strings.TrimSpace(string(plaintext)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: encryption/key: %v", ErrInvalid, err)
+	}
+	keys.dataKeys.put(key, identity)
+	return identity, nil
+}
+
+// DecryptYAML returns the plain YAML document of an encrypted file or a file with
+// encrypted fields, decrypted with keys. Other documents are returned as they are.
+func DecryptYAML(data []byte, keys KeySource) ([]byte, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header)) {
+		fileKeys, err := keys.keys()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt configuration: %w", err)
+		}
+		if data, err = decrypt(data, fileKeys.Identities...); err != nil {
+			return nil, err
+		}
+	}
+	if !bytes.Contains(data, []byte(encryptedPrefix)) {
+		return data, nil
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to decode YAML: %w", err)
+	}
+	var identity *age.X25519Identity
+	err := walkEncrypted(&document, "", func(node *yaml.Node, path string, ciphertext []byte) error {
+		if identity == nil {
+			var err error
+			if identity, err = dataKey(lookupScalar(&document, "encryption", "key"), keys); err != nil {
+				return fmt.Errorf("failed to decrypt configuration: %w", err)
+			}
+		}
+		plaintext, err := decrypt(ciphertext, identity)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", path, err)
+		}
+		var value yaml.Node
+		if err := yaml.Unmarshal(plaintext, &value); err != nil || len(value.Content) == 0 {
+			return fmt.Errorf("%w: decrypted %s is no YAML value", ErrInvalid, path)
+		}
+		*node = *value.Content[0]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(&document)
+}
+
+// EncryptYAML encrypts a plain YAML document with keys as encryption says, nil leaves it
+// plain. Encrypted fields whose value did not change keep their ciphertext from previous,
+// the document as it was last written, so that they do not change with every save.
+func EncryptYAML(data []byte, encryption *Encryption, previous []byte, keys KeySource) ([]byte, error) {
+	switch {
+	case encryption == nil:
+		return data, nil
+	case encryption.File:
+		fileKeys, err := keys.keys()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt configuration: %w", err)
+		}
+		var out bytes.Buffer
+		writer := armor.NewWriter(&out)
+		if err := encryptTo(writer, data, fileKeys.Recipients...); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		out.WriteByte('\n')
+		return out.Bytes(), nil
+	case len(encryption.Fields) == 0:
+		return data, nil
+	}
+
+	identity, err := dataKey(encryption.Key, keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt configuration: %w", err)
+	}
+	// Ciphertexts of the previous document that the data key still decrypts, by path
+	unchanged := map[string]string{}
+	var old yaml.Node
+	if yaml.Unmarshal(previous, &old) == nil {
+		_ = walkEncrypted(&old, "", func(node *yaml.Node, path string, ciphertext []byte) error {
+			if plaintext, err := decrypt(ciphertext, identity); err == nil {
+				unchanged[path+"\x00"+string(plaintext)] = node.Value
+			}
+			return nil
+		})
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to decode YAML: %w", err)
+	}
+	for _, machine := range machineNodes(&document) {
+		for _, field := range encryption.Fields {
+			node := lookupNode(machine.node, strings.Split(field, "/")...)
+			if node == nil || node.Tag == "!!null" || strings.HasPrefix(node.Value, encryptedPrefix) {
+				continue
+			}
+			plaintext, err := yaml.Marshal(node)
+			if err != nil {
+				return nil, err
+			}
+			path := machine.path + "/" + field
+			value, ok := unchanged[path+"\x00"+string(plaintext)]
+			if !ok {
+				ciphertext, err := encrypt(plaintext, identity.Recipient())
+				if err != nil {
+					return nil, err
+				}
+				value = encryptedPrefix + base64.StdEncoding.EncodeToString(ciphertext) + "]"
+			}
+			*node = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+		}
+	}
+	return yaml.Marshal(&document)
+}
+
+// machineNode is the mapping of a machine in a YAML document, with its path
+type machineNode struct {
+	path string
+	node *yaml.Node
+}
+
+// machineNodes returns the machines of all projects of all accounts of a document
+func machineNodes(document *yaml.Node) []machineNode {
+	var machines []machineNode
+	eachEntry := func(node *yaml.Node, fn func(key string, value *yaml.Node)) {
+		if node != nil && node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				fn(node.Content[i].Value, node.Content[i+1])
+			}
+		}
+	}
+	eachEntry(lookupNode(document, "accounts"), func(account string, node *yaml.Node) {
+		eachEntry(lookupNode(node, "projects"), func(project string, node *yaml.Node) {
+			eachEntry(lookupNode(node, "machines"), func(machine string, node *yaml.Node) {
+				path := strings.Join([]string{"accounts", account, "projects", project, "machines", machine}, "/")
+				machines = append(machines, machineNode{path, node})
+			})
+		})
+	})
+	return machines
+}
+
+// lookupNode follows keys through nested mappings, nil if one is missing
+func lookupNode(node *yaml.Node, keys ...string) *yaml.Node {
+	if node != nil && node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, key := range keys {
+		if node == nil || node.Kind != yaml.MappingNode {
+			return nil
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				next = node.Content[i+1]
+			}
+		}
+		node = next
+	}
+	return node
+}
+
+// lookupScalar returns the value of a scalar in nested mappings, "" if it is missing
+func lookupScalar(node *yaml.Node, keys ...string) string {
+	if node = lookupNode(node, keys...); node != nil && node.Kind == yaml.ScalarNode {
+		return node.Value
+	}
+	return ""
+}
+
+// walkEncrypted calls fn for every encrypted value below node
+func walkEncrypted(node *yaml.Node, path string, fn func(node *yaml.Node, path string, ciphertext []byte) error) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for i, child := range node.Content {
+			childPath := path
+			if node.Kind == yaml.SequenceNode {
+				childPath = fmt.Sprintf("%s/%d", path, i)
+			}
+			if err := walkEncrypted(child, childPath, fn); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if err := walkEncrypted(node.Content[i+1], strings.TrimPrefix(path+"/"+node.Content[i].Value, "/"), fn); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		value, found := strings.CutPrefix(node.Value, encryptedPrefix)
+		if !found || !strings.HasSuffix(value, "]") {
+			return nil
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(value, "]"))
+		if err != nil {
+			return fmt.Errorf("%w: encrypted value at %s: %v", ErrInvalid, path, err)
+		}
+		return fn(node, path, ciphertext)
+	}
+	return nil
+}
+
+// encrypt encrypts plaintext with age
+func encrypt(plaintext []byte, recipients ...age.Recipient) ([]byte, error) {
+	var out bytes.Buffer
+	if err := encryptTo(&out, plaintext, recipients...); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// encryptTo writes plaintext encrypted with age to out
+func encryptTo(out io.Writer, plaintext []byte, recipients ...age.Recipient) error {
+	writer, err := age.Encrypt(out, recipients...)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt: %w", err)
+	}
+	if _, err := writer.Write(plaintext); err != nil {
+		return fmt.Errorf("failed to encrypt: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to encrypt: %w", err)
+	}
+	return nil
+}
+
+// decrypt decrypts an age ciphertext, armored or binary
+func decrypt(ciphertext []byte, identities ...age.Identity) ([]byte, error) {
+	var in io.Reader = bytes.NewReader(ciphertext)
+	if bytes.HasPrefix(bytes.TrimSpace(ciphertext), []byte(armor.Header)) {
+		in = armor.NewReader(bytes.NewReader(bytes.TrimSpace(ciphertext)))
+	}
+	reader, err := age.Decrypt(in, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoKey, err)
+	}
+	plaintext, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,85 @@
+package inventory
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// testKeys returns a key source with a fresh age key
+func testKeys(t *testing.T) KeySource {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := Keys{Identities: []age.Identity{identity}, Recipients: []age.Recipient{identity.Recipient()}, Source: "test"}
+	return func() (Keys, error) { return keys, nil }
+}
+
+func TestNewEncryption(t *testing.T) {
+	tests := []struct {
+		fields []string
+		valid  bool
+	}{
+		{[]string{"notes", "ssh"}, true},
+		{[]string{"ssh/user", "ssh/identityfile"}, true},
+		{[]string{"ssh/options/ServerAliveInterval"}, true},
+		{[]string{"tunnels/pg/remoteport"}, true},
+		{[]string{"bogus"}, false},
+		{[]string{"name"}, false},
+		{[]string{"ssh/bogus"}, false},
+		{[]string{"ssh/"}, false},
+		{[]string{"notes/more"}, false},
+	}
+	keys := testKeys(t)
+	for _, test := range tests {
+		encryption, err := NewEncryption(test.fields, keys)
+		if test.valid && (err != nil || encryption.Key == "") {
+			t.Errorf("%v: err = %v, want a data key", test.fields, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalid) {
+			t.Errorf("%v: err = %v, want ErrInvalid", test.fields, err)
+		}
+	}
+}
+
+func TestSaveConfigurationToYAMLEncrypts(t *testing.T) {
+	keys := testKeys(t)
+	configs := NewConfiguration()
+	configs.AddAccount("acme")
+	configs.AddProjectToActiveAccount("acme", "web")
+	configs.Accounts["acme"].Projects["web"].Machines["db-1"] = Machine{Name: "db-1", SSH: SSHConfig{HostName: "10.1.2.3", User: "admin"}}
+	encryption, err := NewEncryption([]string{"ssh/user"}, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs.Encryption = encryption
+
+	filename := filepath.Join(t.TempDir(), "chop.yaml")
+	if err := configs.SaveConfigurationToYAML(filename, keys); err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(written), "admin") || !strings.Contains(string(written), encryptedPrefix) {
+		t.Errorf("ssh/user is not encrypted:\n%s", written)
+	}
+
+	read := NewConfiguration()
+	if err := read.ReadConfigurationFromYAML(filename, nil); !errors.Is(err, ErrNoKey) {
+		t.Errorf("err = %v, want ErrNoKey without keys", err)
+	}
+	if err := read.ReadConfigurationFromYAML(filename, keys); err != nil {
+		t.Fatal(err)
+	}
+	if user := read.Accounts["acme"].Projects["web"].Machines["db-1"].SSH.User; user != "admin" {
+		t.Errorf("user = %q, want admin", user)
+	}
+}
@@ -0,0 +1,23 @@
+// Package inventory is chop's model of accounts, projects and machines.
+//
+// A Configuration holds the accounts with their projects and machines, the active
+// account and the active project per account. Everything chop knows about a machine
+// lives here: tags, notes, aliases, tunnel profiles, SSH settings, transports,
+// templates and the desired state for 'chop apply'.
+//
+// A Store keeps the configuration. YAMLStore is the single YAML file chop always used,
+// the boltstore package keeps it in a database with indexed lookups and transactions.
+// YAML files may be encrypted with age, entirely or field by field, see Encryption.
+//
+// The package has no side effects besides reading and writing the store it is
+// asked to: it never prints, never talks to a cloud and never runs commands. Methods
+// report failures as errors that wrap the sentinels below, so callers can tell them
+// apart with errors.Is:
+//
+//	ErrAccountNotFound, ErrProjectNotFound, ErrMachineNotFound,
+//	ErrAliasNotFound, ErrTunnelNotFound, ErrTemplateNotFound,
+//	ErrNoActiveAccount, ErrNoActiveProject, ErrAmbiguous, ErrInvalid, ErrNoKey
+//
+// Exported types, their YAML layout and the methods of Configuration are the stable
+// surface of the package; the chop CLI uses nothing else.
+package inventory
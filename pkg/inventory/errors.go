@@ -0,0 +1,18 @@
+package inventory
+
+import "errors"
+
+// Errors returned by the inventory, usually wrapped together with the name that caused them
+var (
+	ErrAccountNotFound  = errors.New("account does not exist")
+	ErrProjectNotFound  = errors.New("project does not exist in the account")
+	ErrMachineNotFound  = errors.New("machine does not exist")
+	ErrAliasNotFound    = errors.New("alias does not exist")
+	ErrTunnelNotFound   = errors.New("tunnel profile does not exist")
+	ErrTemplateNotFound = errors.New("template does not exist in the project")
+	ErrNoActiveAccount  = errors.New("no active account set")
+	ErrNoActiveProject  = errors.New("no active project set for the account")
+	ErrAmbiguous        = errors.New("name is ambiguous")
+	ErrInvalid          = errors.New("invalid value")
+	ErrNoKey            = errors.New("no matching key to decrypt the configuration")
+)
@@ -1,7 +1,6 @@
-package chop
+package inventory
 
 import (
-	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -11,14 +10,31 @@ import (
 
 // Machine represents a machine in a project
 type Machine struct {
-	Name      string
-	LastUsage time.Time
+	Name        string
+	LastUsage   time.Time
+	Zone        string            `yaml:",omitempty"` // Filled by 'chop fetch machines'
+	Status      string            `yaml:",omitempty"` // Instance status at the time of the last fetch
+	Tags        []string          `yaml:",omitempty"` // Free-form labels like "web" or "staging"
+	Notes       string            `yaml:",omitempty"`
+	Tunnels     map[string]Tunnel `yaml:",omitempty"` // Named port forwarding profiles
+	Transport   string            `yaml:",omitempty"` // How to reach the machine, overrides the project setting
+	ExternalIP  string            `yaml:",omitempty"` // Filled by 'chop fetch machines', empty if the machine has none right now
+	External    bool              `yaml:",omitempty"` // Filled by 'chop fetch machines', the machine gets an external IP when it runs
+	InternalIP  string            `yaml:",omitempty"`
+	SSH         SSHConfig         `yaml:",omitempty"` // Settings for machines reached with the system ssh binary
+	Aliases     []string          `yaml:",omitempty"` // Short names, unique across all accounts
+	MachineType string            `yaml:",omitempty"` // Filled by 'chop fetch machines'
+	Labels      map[string]string `yaml:",omitempty"` // Cloud labels as fetched, unlike Tags they live in the cloud
+	Applied     *Template         `yaml:",omitempty"` // What 'chop apply' last applied, only set for machines chop manages
 }
 
 // Project represents a project in an account
 type Project struct {
-	Name     string
-	Machines map[string]Machine
+	Name      string
+	Machines  map[string]Machine
+	Transport string              `yaml:",omitempty"` // How to reach the machines of the project
+	Templates map[string]Template `yaml:",omitempty"` // Blueprints for 'chop spawn'
+	Desired   map[string]Template `yaml:",omitempty"` // Machines 'chop apply' creates and keeps in shape, by name
 }
 
 // Account represents an account with multiple projects
@@ -32,6 +48,9 @@ type Configuration struct {
 	Accounts       map[string]Account
 	ActiveAccount  string            // Tracks the currently active account
 	ActiveProjects map[string]string // Tracks active projects per account
+	SSHConfigFile  string            `yaml:",omitempty"` // Include file kept up to date by 'chop ssh-config'
+	TeamFile       string            `yaml:",omitempty"` // Shared configuration merged under this one, see Layer
+	Encryption     *Encryption       `yaml:",omitempty"` // How the YAML file is encrypted at rest, nil for plain text
 }
 
 // Initializes a new configuration
@@ -46,6 +65,9 @@ func (configs *Configuration) AddAccount(account string) {
 	if _, exists := configs.Accounts[account]; exists {
 		return // Account already exists
 	}
+	if configs.Accounts == nil {
+		configs.Accounts = make(map[string]Account)
+	}
 	configs.Accounts[account] = Account{
 		Name:     account,
 		Projects: make(map[string]Project),
@@ -55,7 +77,7 @@ func (configs *Configuration) AddAccount(account string) {
 // Sets the active account
 func (configs *Configuration) SetActiveAccount(account string) error {
 	if _, exists := configs.Accounts[account]; !exists {
-		return errors.New("account does not exist")
+		return fmt.Errorf("%w: %s", ErrAccountNotFound, account)
 	}
 	configs.ActiveAccount = account
 	configs.ActiveProjects = make(map[string]string) // Reset the active project
@@ -67,7 +89,7 @@ func (configs *Configuration) AddProjectToActiveAccount(account string, project
 	// Ensure the account exists
 	acc, exists := configs.Accounts[account]
 	if !exists {
-		return errors.New("account does not exist")
+		return fmt.Errorf("%w: %s", ErrAccountNotFound, account)
 	}
 
 	// Check if the project already exists
@@ -91,15 +113,9 @@ func (configs *Configuration) AddProjectToActiveAccount(account string, project
 
 // Sets the active project for a specific account
 func (configs *Configuration) SetActiveProjectForAccount(account string, project string) error {
-	// Ensure the account exists
-	acc, exists := configs.Accounts[account]
-	if !exists {
-		return errors.New("account does not exist")
-	}
-
 	// Ensure the project exists in the account
-	if _, exists := acc.Projects[project]; !exists {
-		return errors.New("project does not exist in the account")
+	if _, err := configs.GetProject(account, project); err != nil {
+		return err
 	}
 
 	// Set the active project for the account
@@ -113,21 +129,20 @@ func (configs *Configuration) SetActiveProjectForAccount(account string, project
 // Adds a machine to the active project for a specific account
 func (configs *Configuration) AddMachineToActiveProject(account string, machine string) error {
 	// Ensure the account exists
-	acc, exists := configs.Accounts[account]
-	if !exists {
-		return errors.New("account does not exist")
+	if _, exists := configs.Accounts[account]; !exists {
+		return fmt.Errorf("%w: %s", ErrAccountNotFound, account)
 	}
 
 	// Ensure the account has an active project
 	activeProject, activeExists := configs.ActiveProjects[account]
 	if !activeExists || activeProject == "" {
-		return errors.New("no active project for the specified account")
+		return fmt.Errorf("%w: %s", ErrNoActiveProject, account)
 	}
 
 	// Get the active project
-	project, exists := acc.Projects[activeProject]
-	if !exists {
-		return errors.New("active project not found in the account")
+	project, err := configs.GetProject(account, activeProject)
+	if err != nil {
+		return err
 	}
 
 	// Add the machine to the active project
@@ -135,19 +150,21 @@ func (configs *Configuration) AddMachineToActiveProject(account string, machine
 		return nil // Machine already exists
 	}
 
+	if project.Machines == nil {
+		project.Machines = make(map[string]Machine)
+	}
 	project.Machines[machine] = Machine{
 		Name:      machine,
 		LastUsage: time.Now(),
 	}
-	acc.Projects[activeProject] = project
-	configs.Accounts[account] = acc
+	configs.Accounts[account].Projects[activeProject] = project
 	return nil
 }
 
 // DeleteAccount removes an account and all its projects and machines
 func (configs *Configuration) DeleteAccount(account string) error {
 	if _, exists := configs.Accounts[account]; !exists {
-		return errors.New("account does not exist")
+		return fmt.Errorf("%w: %s", ErrAccountNotFound, account)
 	}
 
 	delete(configs.Accounts, account)
@@ -155,25 +172,18 @@ func (configs *Configuration) DeleteAccount(account string) error {
 	// If the active account is deleted, unset it
 	if configs.ActiveAccount == account {
 		configs.ActiveAccount = ""
-		delete(configs.ActiveProjects, account)
 	}
+	delete(configs.ActiveProjects, account)
 	return nil
 }
 
 // DeleteProject removes a project from an account
 func (configs *Configuration) DeleteProject(account string, project string) error {
-	// Ensure the account exists
-	acc, exists := configs.Accounts[account]
-	if !exists {
-		return errors.New("account does not exist")
-	}
-
-	// Ensure the project exists
-	if _, exists := acc.Projects[project]; !exists {
-		return errors.New("project does not exist")
+	if _, err := configs.GetProject(account, project); err != nil {
+		return err
 	}
 
-	delete(acc.Projects, project)
+	delete(configs.Accounts[account].Projects, project)
 
 	// If the active project for the account is deleted, unset it
 	if configs.ActiveProjects[account] == project {
@@ -184,100 +194,61 @@ func (configs *Configuration) DeleteProject(account string, project string) erro
 
 // DeleteMachine removes a machine from a project in an account
 func (configs *Configuration) DeleteMachine(account string, project string, machine string) error {
-	// Ensure the account exists
-	acc, exists := configs.Accounts[account]
-	if !exists {
-		return errors.New("account does not exist")
-	}
-
-	// Ensure the project exists
-	proj, exists := acc.Projects[project]
-	if !exists {
-		return errors.New("project does not exist in the account")
+	if _, err := configs.GetMachine(account, project, machine); err != nil {
+		return err
 	}
 
-	// Ensure the machine exists
-	if _, exists := proj.Machines[machine]; !exists {
-		return errors.New("machine does not exist in the project")
-	}
-
-	delete(proj.Machines, machine)
-	//acc.Projects[project] = proj
-	//configs.Accounts[account] = acc
+	delete(configs.Accounts[account].Projects[project].Machines, machine)
 	return nil
 }
 
 // UnsetActiveAccount unsets the currently active account
-func (configs *Configuration) UnsetActiveAccount() {
+func (configs *Configuration) UnsetActiveAccount() error {
 	if configs.ActiveAccount == "" {
-		fmt.Println("No active account set")
-		return
+		return ErrNoActiveAccount
 	}
 	configs.ActiveAccount = ""
+	return nil
 }
 
-// UnsetActiveProjectForAccount unsets the active project for a specific account
-func (configs *Configuration) UnsetActiveProjectForAccount(account string) error {
-	// If no account is provided, unset the active project for the active account
+// UnsetActiveProjectForAccount unsets the active project of an account and returns the account.
+// An empty account means the active account.
+func (configs *Configuration) UnsetActiveProjectForAccount(account string) (string, error) {
 	if account == "" {
 		if configs.ActiveAccount == "" {
-			return errors.New("no active account set")
-
-		}
-		if _, exists := configs.ActiveProjects[configs.ActiveAccount]; !exists {
-			return errors.New("no active project set for the active account")
+			return "", ErrNoActiveAccount
 		}
-		// Unset the active project for the account
-		delete(configs.ActiveProjects, configs.ActiveAccount)
-		fmt.Println("Active project unset for account:", configs.ActiveAccount)
-		return nil
+		account = configs.ActiveAccount
+	} else if _, exists := configs.Accounts[account]; !exists {
+		return "", fmt.Errorf("%w: %s", ErrAccountNotFound, account)
 	}
 
-	// If account is specified via flag, unset the active project for that account
-	if _, exists := configs.Accounts[account]; !exists {
-		return errors.New("account does not exist")
-	}
 	if _, exists := configs.ActiveProjects[account]; !exists {
-		return errors.New("no active project set for the specified account")
+		return "", fmt.Errorf("%w: %s", ErrNoActiveProject, account)
 	}
-	// Unset the active project for the specified account
 	delete(configs.ActiveProjects, account)
-	fmt.Println("Active project unset for account:", account)
-	return nil
+	return account, nil
 }
 
-// SaveConfigurationToYAML saves the Configuration to a YAML file
-func (configs *Configuration) SaveConfigurationToYAML(filename string) error {
-	// Create the file
-	file, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
-	}
-	defer file.Close()
-
-	// Encode the configuration to YAML
-	encoder := yaml.NewEncoder(file)
-	defer encoder.Close()
-
-	if err := encoder.Encode(configs); err != nil {
-		return fmt.Errorf("failed to encode configuration to YAML: %w", err)
-	}
-
-	return nil
+// SaveConfigurationToYAML saves the Configuration to a YAML file, encrypted with keys as its
+// Encryption says, see WriteYAMLFile
+func (configs *Configuration) SaveConfigurationToYAML(filename string, keys KeySource) error {
+	return WriteYAMLFile(filename, configs, configs.Encryption, keys)
 }
 
-// ReadConfigurationFromYAML loads a Configuration from a YAML file
-func (configs *Configuration) ReadConfigurationFromYAML(filename string) error {
-	// Open the YAML file
-	file, err := os.Open(filename)
+// ReadConfigurationFromYAML loads a Configuration from a YAML file, decrypting it with keys
+// if it is encrypted
+func (configs *Configuration) ReadConfigurationFromYAML(filename string, keys KeySource) error {
+	data, err := os.ReadFile(filename)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
 	}
-	defer file.Close()
+	if data, err = DecryptYAML(data, keys); err != nil {
+		return err
+	}
 
 	// Decode the YAML into the Configuration struct
-	decoder := yaml.NewDecoder(file)
-	if err := decoder.Decode(configs); err != nil {
+	if err := yaml.Unmarshal(data, configs); err != nil {
 		return fmt.Errorf("failed to decode YAML into configuration: %w", err)
 	}
 
@@ -0,0 +1,240 @@
+package inventory
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Layer is one YAML document of a stack of configurations, e.g. a system wide file, a file
+// shared by a team and the user's own file. Layers are merged value by value: a later layer
+// overrides what earlier layers set, maps are merged key by key and a null value removes
+// what earlier layers set.
+type Layer struct {
+	Name   string         // e.g. "team"
+	Source string         // Where the layer was read from
+	Values map[string]any // The decoded document, nil for an empty layer
+}
+
+// Provenance tells for the path of every value of a merged configuration which layer set it.
+// Paths join the YAML keys with slashes, e.g. accounts/acme/projects/web/machines/db-1/zone.
+type Provenance map[string]Origin
+
+// Origin is a merged value and the name of the layer it comes from
+type Origin struct {
+	Layer string
+	Value any
+}
+
+// Paths returns the paths of the provenance in order, only those at or below prefix if given
+func (provenance Provenance) Paths(prefix string) []string {
+	prefix = strings.Trim(prefix, "/")
+	paths := []string{}
+	for path := range provenance {
+		if prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// ReadLayer decodes a YAML document into a layer, decrypting it with keys if it is encrypted
+func ReadLayer(name string, source string, data []byte, keys KeySource) (Layer, error) {
+	layer := Layer{Name: name, Source: source}
+	data, err := DecryptYAML(data, keys)
+	if err != nil {
+		return layer, fmt.Errorf("failed to read %s layer %s: %w", name, source, err)
+	}
+	if err := yaml.Unmarshal(data, &layer.Values); err != nil {
+		return layer, fmt.Errorf("failed to decode %s layer %s: %w", name, source, err)
+	}
+	return layer, nil
+}
+
+// MergeLayers merges layers in order into a configuration and tells where each value came from
+func MergeLayers(layers []Layer) (Configuration, Provenance, error) {
+	merged := map[string]any{}
+	provenance := Provenance{}
+	for _, layer := range layers {
+		mergeValues(merged, layer.Values, "", layer.Name, provenance)
+	}
+
+	configs := NewConfiguration()
+	data, err := yaml.Marshal(merged)
+	if err != nil {
+		return configs, nil, fmt.Errorf("failed to encode merged configuration: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &configs); err != nil {
+		return configs, nil, fmt.Errorf("failed to decode merged configuration: %w", err)
+	}
+	if configs.Accounts == nil {
+		configs.Accounts = make(map[string]Account)
+	}
+	return configs, provenance, nil
+}
+
+// Overlay returns the document of the layer that, merged on top of lower, gives configs.
+// It holds only the values that differ from the lower layers, nulls for what configs
+// removed, and keeps the field order of the configuration.
+func Overlay(lower []Layer, configs *Configuration) (*yaml.Node, error) {
+	base := map[string]any{}
+	for _, layer := range lower {
+		mergeValues(base, layer.Values, "", layer.Name, Provenance{})
+	}
+
+	var document yaml.Node
+	if err := document.Encode(configs); err != nil {
+		return nil, fmt.Errorf("failed to encode configuration: %w", err)
+	}
+	overlay, err := diffNode(&document, base)
+	if err != nil {
+		return nil, err
+	}
+	return overlay, nil
+}
+
+// mergeValues merges src into dst and records the layer of every value it sets
+func mergeValues(dst map[string]any, src map[string]any, prefix string, layer string, provenance Provenance) {
+	for key, value := range src {
+		path := strings.TrimPrefix(prefix+"/"+key, "/")
+		if value == nil {
+			delete(dst, key)
+			forget(provenance, path)
+			continue
+		}
+		if values, ok := value.(map[string]any); ok {
+			existing, ok := dst[key].(map[string]any)
+			if !ok {
+				existing = map[string]any{}
+				dst[key] = existing
+				forget(provenance, path)
+			}
+			mergeValues(existing, values, path, layer, provenance)
+			continue
+		}
+		dst[key] = value
+		forget(provenance, path)
+		provenance[path] = Origin{Layer: layer, Value: value}
+	}
+}
+
+// forget drops the provenance of a path and everything below it
+func forget(provenance Provenance, path string) {
+	for existing := range provenance {
+		if existing == path || strings.HasPrefix(existing, path+"/") {
+			delete(provenance, existing)
+		}
+	}
+}
+
+// diffNode returns a copy of the mapping node without the values that equal base,
+// with null values added for the keys of base that node lacks
+func diffNode(node *yaml.Node, base map[string]any) (*yaml.Node, error) {
+	mapping := node
+	if mapping.Kind == yaml.DocumentNode {
+		mapping = mapping.Content[0]
+	}
+	diff := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], mapping.Content[i+1]
+		seen[key.Value] = true
+		baseValue, exists := base[key.Value]
+		if !exists {
+			// Zero values decode the same whether they are written or not. Writing them would
+			// keep a machine the lower layers later remove alive as an empty one.
+			kept, err := withoutZeros(value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compare %s: %w", key.Value, err)
+			}
+			if kept != nil {
+				diff.Content = append(diff.Content, key, kept)
+			}
+			continue
+		}
+
+		if baseMap, ok := baseValue.(map[string]any); ok && value.Kind == yaml.MappingNode {
+			nested, err := diffNode(value, baseMap)
+			if err != nil {
+				return nil, err
+			}
+			if len(nested.Content) > 0 {
+				diff.Content = append(diff.Content, key, nested)
+			}
+			continue
+		}
+
+		var decoded any
+		if err := value.Decode(&decoded); err != nil {
+			return nil, fmt.Errorf("failed to compare %s: %w", key.Value, err)
+		}
+		if !equalValues(decoded, baseValue) {
+			diff.Content = append(diff.Content, key, value)
+		}
+	}
+
+	// What the lower layers have and the configuration lost is removed with a null
+	removed := []string{}
+	for key := range base {
+		if !seen[key] {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(removed)
+	for _, key := range removed {
+		diff.Content = append(diff.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"})
+	}
+	return diff, nil
+}
+
+// withoutZeros returns a copy of a node without the zero values and the mappings that hold
+// nothing else, nil if nothing is left
+func withoutZeros(node *yaml.Node) (*yaml.Node, error) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		kept := &yaml.Node{Kind: yaml.MappingNode, Tag: node.Tag, Style: node.Style}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			value, err := withoutZeros(node.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			if value != nil {
+				kept.Content = append(kept.Content, node.Content[i], value)
+			}
+		}
+		if len(kept.Content) == 0 {
+			return nil, nil
+		}
+		return kept, nil
+	case yaml.SequenceNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return node, nil
+	case yaml.ScalarNode:
+		var decoded any
+		if err := node.Decode(&decoded); err != nil {
+			return nil, err
+		}
+		if decoded == nil || reflect.ValueOf(decoded).IsZero() {
+			return nil, nil
+		}
+	}
+	return node, nil
+}
+
+// equalValues compares decoded YAML values, times by the instant they stand for
+func equalValues(a any, b any) bool {
+	if timeA, ok := a.(time.Time); ok {
+		timeB, ok := b.(time.Time)
+		return ok && timeA.Equal(timeB)
+	}
+	return reflect.DeepEqual(a, b)
+}
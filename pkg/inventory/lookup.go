@@ -0,0 +1,35 @@
+package inventory
+
+import "sort"
+
+// AccountNames returns the names of all accounts, sorted
+func (configs *Configuration) AccountNames() []string {
+	names := make([]string, 0, len(configs.Accounts))
+	for name := range configs.Accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ProjectNames returns the names of all projects of an account, sorted
+func (configs *Configuration) ProjectNames(account string) []string {
+	acc := configs.Accounts[account]
+	names := make([]string, 0, len(acc.Projects))
+	for name := range acc.Projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Machines returns all machines of a project in an account, sorted by name
+func (configs *Configuration) Machines(account string, project string) []Machine {
+	proj := configs.Accounts[account].Projects[project]
+	machines := make([]Machine, 0, len(proj.Machines))
+	for _, machine := range proj.Machines {
+		machines = append(machines, machine)
+	}
+	sort.Slice(machines, func(i, j int) bool { return machines[i].Name < machines[j].Name })
+	return machines
+}
@@ -0,0 +1,105 @@
+package inventory
+
+import (
+	"fmt"
+	"time"
+)
+
+// GetProject returns a project from an account
+func (configs *Configuration) GetProject(account string, project string) (Project, error) {
+	// Ensure the account exists
+	acc, exists := configs.Accounts[account]
+	if !exists {
+		return Project{}, fmt.Errorf("%w: %s", ErrAccountNotFound, account)
+	}
+
+	// Ensure the project exists
+	proj, exists := acc.Projects[project]
+	if !exists {
+		return Project{}, fmt.Errorf("%w: %s", ErrProjectNotFound, project)
+	}
+	return proj, nil
+}
+
+// GetMachine returns a machine from a project in an account
+func (configs *Configuration) GetMachine(account string, project string, machine string) (Machine, error) {
+	proj, err := configs.GetProject(account, project)
+	if err != nil {
+		return Machine{}, err
+	}
+
+	// Ensure the machine exists
+	mach, exists := proj.Machines[machine]
+	if !exists {
+		return Machine{}, fmt.Errorf("%w: %s", ErrMachineNotFound, machine)
+	}
+	return mach, nil
+}
+
+// UpdateMachine applies change to an existing machine and stores the result
+func (configs *Configuration) UpdateMachine(account string, project string, machine string, change func(*Machine)) error {
+	mach, err := configs.GetMachine(account, project, machine)
+	if err != nil {
+		return err
+	}
+	change(&mach)
+	configs.Accounts[account].Projects[project].Machines[machine] = mach
+	return nil
+}
+
+// SetMachineTags replaces the tags of a machine
+func (configs *Configuration) SetMachineTags(account string, project string, machine string, tags []string) error {
+	return configs.UpdateMachine(account, project, machine, func(m *Machine) {
+		m.Tags = tags
+	})
+}
+
+// SetMachineNotes replaces the notes of a machine
+func (configs *Configuration) SetMachineNotes(account string, project string, machine string, notes string) error {
+	return configs.UpdateMachine(account, project, machine, func(m *Machine) {
+		m.Notes = notes
+	})
+}
+
+// SetMachineStatus records the last known status of a machine
+func (configs *Configuration) SetMachineStatus(account string, project string, machine string, status string) error {
+	return configs.UpdateMachine(account, project, machine, func(m *Machine) {
+		m.Status = status
+	})
+}
+
+// TouchMachine records that a machine has just been used
+func (configs *Configuration) TouchMachine(account string, project string, machine string) error {
+	return configs.UpdateMachine(account, project, machine, func(m *Machine) {
+		m.LastUsage = time.Now()
+	})
+}
+
+// MergeMachines adds fetched machines to a project or refreshes their zone, status, IPs, type and labels.
+// Known machines keep their usage history, tags and notes.
+func (configs *Configuration) MergeMachines(account string, project string, machines []Machine) error {
+	proj, err := configs.GetProject(account, project)
+	if err != nil {
+		return err
+	}
+
+	if proj.Machines == nil {
+		proj.Machines = make(map[string]Machine)
+	}
+	for _, fetched := range machines {
+		machine := proj.Machines[fetched.Name]
+		machine.Name = fetched.Name
+		machine.Zone = fetched.Zone
+		machine.Status = fetched.Status
+		machine.ExternalIP = fetched.ExternalIP
+		machine.External = fetched.External
+		machine.InternalIP = fetched.InternalIP
+		if fetched.MachineType != "" {
+			machine.MachineType = fetched.MachineType
+			machine.Labels = fetched.Labels
+		}
+		proj.Machines[fetched.Name] = machine
+	}
+	configs.Accounts[account].Projects[project] = proj
+	return nil
+}
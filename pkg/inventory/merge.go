@@ -0,0 +1,212 @@
+package inventory
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Conflict is a value that two sides of a three-way merge changed in different ways
+type Conflict struct {
+	Path                     []string // YAML keys from the top of the document
+	Base, Ours, Theirs       any
+	InBase, InOurs, InTheirs bool // false where the side removed the value or never had it
+}
+
+// String formats the path of the conflict like Provenance paths
+func (conflict Conflict) String() string {
+	return strings.Join(conflict.Path, "/")
+}
+
+// Apply puts the value of one side of the conflict into a merged document
+func (conflict Conflict) Apply(document map[string]any, theirs bool) {
+	value, present := conflict.Ours, conflict.InOurs
+	if theirs {
+		value, present = conflict.Theirs, conflict.InTheirs
+	}
+	node := document
+	for _, key := range conflict.Path[:len(conflict.Path)-1] {
+		next, ok := node[key].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			node[key] = next
+		}
+		node = next
+	}
+	last := conflict.Path[len(conflict.Path)-1]
+	if present {
+		node[last] = value
+	} else {
+		delete(node, last)
+	}
+}
+
+// MergeThreeWay merges two decoded YAML documents of a configuration that both descend
+// from base. Accounts, projects and machines are merged key by key, so that changes to
+// different machines, or to different values of one machine, never conflict. Beyond that:
+//
+//   - lists like tags and aliases are merged as sets
+//   - of two different times, like the last usage of a machine, the later one wins
+//   - the active account and projects are kept as in ours, they belong to one computer
+//
+// Everything else two sides changed differently is a conflict. The merged document holds
+// ours for conflicts, Conflict.Apply switches one to theirs.
+func MergeThreeWay(base map[string]any, ours map[string]any, theirs map[string]any) (map[string]any, []Conflict) {
+	merged := map[string]any{}
+	var conflicts []Conflict
+	mergeMaps(nil, base, ours, theirs, merged, &conflicts)
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].String() < conflicts[j].String() })
+	return merged, conflicts
+}
+
+// MergeConfigurations merges ours and theirs, two configurations that both descend from
+// base, with MergeThreeWay. Conflicts keep ours. It lets a save keep what another process
+// stored since base was loaded.
+func MergeConfigurations(base *Configuration, ours *Configuration, theirs *Configuration) (Configuration, error) {
+	var documents [3]map[string]any
+	for i, configs := range []*Configuration{base, ours, theirs} {
+		data, err := yaml.Marshal(configs)
+		if err != nil {
+			return Configuration{}, fmt.Errorf("failed to encode configuration: %w", err)
+		}
+		documents[i] = map[string]any{}
+		if err := yaml.Unmarshal(data, &documents[i]); err != nil {
+			return Configuration{}, fmt.Errorf("failed to decode configuration: %w", err)
+		}
+	}
+	merged, _ := MergeThreeWay(documents[0], documents[1], documents[2])
+
+	configs := NewConfiguration()
+	data, err := yaml.Marshal(merged)
+	if err != nil {
+		return configs, fmt.Errorf("failed to encode merged configuration: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &configs); err != nil {
+		return configs, fmt.Errorf("failed to decode merged configuration: %w", err)
+	}
+	if configs.Accounts == nil {
+		configs.Accounts = make(map[string]Account)
+	}
+	return configs, nil
+}
+
+// mergeMaps merges the keys of three maps into merged
+func mergeMaps(path []string, base, ours, theirs map[string]any, merged map[string]any, conflicts *[]Conflict) {
+	keys := map[string]bool{}
+	for _, values := range []map[string]any{base, ours, theirs} {
+		for key := range values {
+			keys[key] = true
+		}
+	}
+	for key := range keys {
+		baseValue, inBase := base[key]
+		oursValue, inOurs := ours[key]
+		theirsValue, inTheirs := theirs[key]
+		conflict := Conflict{
+			Path: append(slices.Clone(path), key),
+			Base: baseValue, Ours: oursValue, Theirs: theirsValue,
+			InBase: inBase, InOurs: inOurs, InTheirs: inTheirs,
+		}
+		if value, present := mergeValue(conflict, conflicts); present {
+			merged[key] = value
+		}
+	}
+}
+
+// mergeValue merges the three sides of one value, recording a conflict if it cannot
+func mergeValue(c Conflict, conflicts *[]Conflict) (any, bool) {
+	same := func(a any, inA bool, b any, inB bool) bool {
+		return inA == inB && (!inA || equalValues(a, b) || equalDocuments(a, b))
+	}
+	switch {
+	case same(c.Ours, c.InOurs, c.Theirs, c.InTheirs):
+		return c.Ours, c.InOurs
+	case same(c.Base, c.InBase, c.Ours, c.InOurs):
+		return c.Theirs, c.InTheirs
+	case same(c.Base, c.InBase, c.Theirs, c.InTheirs):
+		return c.Ours, c.InOurs
+	}
+
+	// Both sides changed the value
+	if c.InOurs && c.InTheirs {
+		oursMap, oursIsMap := c.Ours.(map[string]any)
+		theirsMap, theirsIsMap := c.Theirs.(map[string]any)
+		if oursIsMap && theirsIsMap {
+			baseMap, _ := c.Base.(map[string]any)
+			merged := map[string]any{}
+			mergeMaps(c.Path, baseMap, oursMap, theirsMap, merged, conflicts)
+			return merged, true
+		}
+
+		oursList, oursIsList := c.Ours.([]any)
+		theirsList, theirsIsList := c.Theirs.([]any)
+		if oursIsList && theirsIsList {
+			baseList, _ := c.Base.([]any)
+			return mergeSets(baseList, oursList, theirsList), true
+		}
+
+		oursTime, oursIsTime := c.Ours.(time.Time)
+		theirsTime, theirsIsTime := c.Theirs.(time.Time)
+		if oursIsTime && theirsIsTime {
+			if theirsTime.After(oursTime) {
+				return c.Theirs, true
+			}
+			return c.Ours, true
+		}
+	}
+
+	if c.Path[0] == "activeaccount" || c.Path[0] == "activeprojects" {
+		return c.Ours, c.InOurs
+	}
+	*conflicts = append(*conflicts, c)
+	return c.Ours, c.InOurs
+}
+
+// mergeSets keeps what is in ours or theirs unless one of them removed it from base
+func mergeSets(base []any, ours []any, theirs []any) []any {
+	contains := func(list []any, item any) bool {
+		return slices.ContainsFunc(list, func(other any) bool { return equalValues(item, other) })
+	}
+	merged := []any{}
+	for _, item := range append(slices.Clone(ours), theirs...) {
+		if contains(merged, item) {
+			continue
+		}
+		removed := contains(base, item) && (!contains(ours, item) || !contains(theirs, item))
+		if !removed {
+			merged = append(merged, item)
+		}
+	}
+	return merged
+}
+
+// equalDocuments compares decoded YAML values by their printed form, which treats
+// equal times in different locations as equal also inside maps and lists
+func equalDocuments(a any, b any) bool {
+	return fmt.Sprintf("%v", normalizeTimes(a)) == fmt.Sprintf("%v", normalizeTimes(b))
+}
+
+// normalizeTimes returns a copy of a decoded YAML value with all times in UTC
+func normalizeTimes(value any) any {
+	switch value := value.(type) {
+	case time.Time:
+		return value.UTC()
+	case map[string]any:
+		normalized := make(map[string]any, len(value))
+		for key, item := range value {
+			normalized[key] = normalizeTimes(item)
+		}
+		return normalized
+	case []any:
+		normalized := make([]any, len(value))
+		for i, item := range value {
+			normalized[i] = normalizeTimes(item)
+		}
+		return normalized
+	}
+	return value
+}
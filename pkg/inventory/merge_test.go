@@ -0,0 +1,161 @@
+package inventory
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mergeBase is the configuration both sides of TestMergeConfigurations start from:
+// acme/web with db-1 and web-1
+func mergeBase(t *testing.T) Configuration {
+	t.Helper()
+	configs := NewConfiguration()
+	configs.AddAccount("acme")
+	configs.AddAccount("beta")
+	for _, err := range []error{
+		configs.SetActiveAccount("acme"),
+		configs.AddProjectToActiveAccount("acme", "web"),
+		configs.SetActiveProjectForAccount("acme", "web"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	used := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	setMachine(&configs, Machine{Name: "db-1", Zone: "europe-west3-a", Tags: []string{"db"}, Aliases: []string{"db"}, LastUsage: used})
+	setMachine(&configs, Machine{Name: "web-1", Zone: "europe-west3-a", LastUsage: used})
+	return configs
+}
+
+// setMachine adds or replaces a machine of acme/web
+func setMachine(configs *Configuration, machine Machine) {
+	configs.Accounts["acme"].Projects["web"].Machines[machine.Name] = machine
+}
+
+// change returns a function that changes a machine of acme/web
+func change(name string, fn func(m *Machine)) func(configs *Configuration) {
+	return func(configs *Configuration) {
+		machine := configs.Accounts["acme"].Projects["web"].Machines[name]
+		fn(&machine)
+		setMachine(configs, machine)
+	}
+}
+
+// remove returns a function that deletes a machine of acme/web
+func remove(name string) func(configs *Configuration) {
+	return func(configs *Configuration) {
+		delete(configs.Accounts["acme"].Projects["web"].Machines, name)
+	}
+}
+
+// add returns a function that adds a machine to acme/web
+func add(name string) func(configs *Configuration) {
+	return func(configs *Configuration) {
+		setMachine(configs, Machine{Name: name, Zone: "europe-west3-b"})
+	}
+}
+
+// all combines changes
+func all(changes ...func(configs *Configuration)) func(configs *Configuration) {
+	return func(configs *Configuration) {
+		for _, change := range changes {
+			change(configs)
+		}
+	}
+}
+
+func TestMergeConfigurations(t *testing.T) {
+	later := time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)
+	latest := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	notes := func(notes string) func(m *Machine) { return func(m *Machine) { m.Notes = notes } }
+	tests := []struct {
+		name   string
+		ours   func(configs *Configuration)
+		theirs func(configs *Configuration)
+		want   func(configs *Configuration) // Applied to the base
+	}{
+		{"add different machines", add("cache-1"), add("cache-2"), all(add("cache-1"), add("cache-2"))},
+		{"add the same machine", add("cache-1"), add("cache-1"), add("cache-1")},
+		{"delete different machines", remove("db-1"), remove("web-1"), all(remove("db-1"), remove("web-1"))},
+		{"delete the same machine", remove("db-1"), remove("db-1"), remove("db-1")},
+		{"delete one machine and update another", remove("db-1"), change("web-1", notes("frontend")),
+			all(remove("db-1"), change("web-1", notes("frontend")))},
+		{"update different values of a machine", change("db-1", notes("primary")), change("db-1", func(m *Machine) { m.Zone = "europe-west3-c" }),
+			change("db-1", func(m *Machine) { m.Notes, m.Zone = "primary", "europe-west3-c" })},
+		{"update the same value alike", change("db-1", notes("primary")), change("db-1", notes("primary")), change("db-1", notes("primary"))},
+		{"update the same value differently keeps ours", change("db-1", notes("ours")), change("db-1", notes("theirs")), change("db-1", notes("ours"))},
+		{"delete a machine the other side updated keeps ours", remove("db-1"), change("db-1", notes("primary")), remove("db-1")},
+		{"tags are merged as sets", change("db-1", func(m *Machine) { m.Tags = []string{"db", "prod"} }), change("db-1", func(m *Machine) { m.Tags = []string{"db", "eu"} }),
+			change("db-1", func(m *Machine) { m.Tags = []string{"db", "prod", "eu"} })},
+		{"removed tags stay removed", change("db-1", func(m *Machine) { m.Tags = []string{"prod"} }), change("db-1", func(m *Machine) { m.Tags = []string{"db", "eu"} }),
+			change("db-1", func(m *Machine) { m.Tags = []string{"prod", "eu"} })},
+		{"aliases are merged as sets", change("db-1", func(m *Machine) { m.Aliases = []string{"db", "pg"} }), change("db-1", func(m *Machine) { m.Aliases = []string{"db", "primary"} }),
+			change("db-1", func(m *Machine) { m.Aliases = []string{"db", "pg", "primary"} })},
+		{"the later last usage of theirs wins", change("db-1", func(m *Machine) { m.LastUsage = later }), change("db-1", func(m *Machine) { m.LastUsage = latest }),
+			change("db-1", func(m *Machine) { m.LastUsage = latest })},
+		{"the later last usage of ours wins", change("db-1", func(m *Machine) { m.LastUsage = latest }), change("db-1", func(m *Machine) { m.LastUsage = later }),
+			change("db-1", func(m *Machine) { m.LastUsage = latest })},
+		{"the active account stays ours",
+			func(configs *Configuration) { configs.ActiveAccount = "beta" },
+			func(configs *Configuration) { configs.ActiveAccount = "" },
+			func(configs *Configuration) { configs.ActiveAccount = "beta" }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := mergeBase(t)
+			ours, theirs, want := mergeBase(t), mergeBase(t), mergeBase(t)
+			test.ours(&ours)
+			test.theirs(&theirs)
+			test.want(&want)
+
+			merged, err := MergeConfigurations(&base, &ours, &theirs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := yaml.Marshal(&merged)
+			wanted, _ := yaml.Marshal(&want)
+			if string(got) != string(wanted) {
+				t.Errorf("merged:\n%s\nwant:\n%s", got, wanted)
+			}
+		})
+	}
+}
+
+func TestMergeThreeWay(t *testing.T) {
+	machine := func(notes string) map[string]any {
+		return map[string]any{"accounts": map[string]any{"acme": map[string]any{"projects": map[string]any{"web": map[string]any{
+			"machines": map[string]any{"db-1": map[string]any{"name": "db-1", "notes": notes}}}}}}}
+	}
+	base, ours, theirs := machine("base"), machine("ours"), machine("theirs")
+	ours["activeaccount"], theirs["activeaccount"] = "acme", "beta"
+
+	merged, conflicts := MergeThreeWay(base, ours, theirs)
+	if len(conflicts) != 1 {
+		t.Fatalf("conflicts = %v, want only the notes", conflicts)
+	}
+	conflict := conflicts[0]
+	if conflict.String() != "accounts/acme/projects/web/machines/db-1/notes" {
+		t.Errorf("conflict at %s, want the notes of db-1", conflict)
+	}
+	if conflict.Base != "base" || conflict.Ours != "ours" || conflict.Theirs != "theirs" || !conflict.InBase || !conflict.InOurs || !conflict.InTheirs {
+		t.Errorf("conflict = %+v, want all three sides", conflict)
+	}
+	if !reflect.DeepEqual(merged, ours) {
+		t.Errorf("merged = %v, want ours for the conflict", merged)
+	}
+
+	conflict.Apply(merged, true)
+	if !reflect.DeepEqual(merged["accounts"], theirs["accounts"]) || merged["activeaccount"] != "acme" {
+		t.Errorf("merged = %v, want theirs for the conflict and our active account", merged)
+	}
+
+	// A value removed on one side and changed on the other is a conflict, too
+	delete(ours, "accounts")
+	_, conflicts = MergeThreeWay(base, ours, theirs)
+	if len(conflicts) != 1 || conflicts[0].String() != "accounts" || conflicts[0].InOurs {
+		t.Errorf("conflicts = %+v, want the removed accounts", conflicts)
+	}
+}
@@ -0,0 +1,91 @@
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ResolveName finds the machine meant by a name, trying in this order:
+// an alias, an ssh host name (account.project.machine) and a machine name.
+// Machines of the active project win over machines of the same name elsewhere.
+func (configs *Configuration) ResolveName(name string) (MachineRef, error) {
+	if ref, exists := configs.FindAlias(name); exists {
+		return ref, nil
+	}
+
+	all := configs.MachineRefs()
+	for _, ref := range all {
+		if SSHHostName(ref) == name {
+			return ref, nil
+		}
+	}
+
+	exact := []MachineRef{}
+	for _, ref := range all {
+		if ref.Machine == name {
+			exact = append(exact, ref)
+		}
+	}
+	return configs.pickMatch(name, exact)
+}
+
+// ResolveNameFuzzy is ResolveName that also accepts a case-insensitive substring of a
+// machine name when nothing matches exactly. Only meant for interactive commands, where
+// the user sees what was picked: it would match names nobody meant, like hosts of ssh.
+func (configs *Configuration) ResolveNameFuzzy(name string) (MachineRef, error) {
+	ref, err := configs.ResolveName(name)
+	if !errors.Is(err, ErrMachineNotFound) {
+		return ref, err
+	}
+
+	fuzzy := []MachineRef{}
+	for _, ref := range configs.MachineRefs() {
+		if strings.Contains(strings.ToLower(ref.Machine), strings.ToLower(name)) {
+			fuzzy = append(fuzzy, ref)
+		}
+	}
+	return configs.pickMatch(name, fuzzy)
+}
+
+// pickMatch returns the only match, or the only match in the active project
+func (configs *Configuration) pickMatch(name string, matches []MachineRef) (MachineRef, error) {
+	switch len(matches) {
+	case 0:
+		return MachineRef{}, fmt.Errorf("%w: nothing matches %q", ErrMachineNotFound, name)
+	case 1:
+		return matches[0], nil
+	}
+
+	active := []MachineRef{}
+	for _, ref := range matches {
+		if ref.Account == configs.ActiveAccount && ref.Project == configs.ActiveProjects[ref.Account] {
+			active = append(active, ref)
+		}
+	}
+	if len(active) == 1 {
+		return active[0], nil
+	}
+
+	names := make([]string, 0, len(matches))
+	for _, ref := range matches {
+		names = append(names, ref.String())
+	}
+	sort.Strings(names)
+	return MachineRef{}, fmt.Errorf("%w: %q matches %s", ErrAmbiguous, name, strings.Join(names, ", "))
+}
+
+// MachineRefs returns references to all machines of the configuration, sorted
+func (configs *Configuration) MachineRefs() []MachineRef {
+	refs := []MachineRef{}
+	for accName, acc := range configs.Accounts {
+		for projName, proj := range acc.Projects {
+			for machName := range proj.Machines {
+				refs = append(refs, MachineRef{accName, projName, machName})
+			}
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].String() < refs[j].String() })
+	return refs
+}
@@ -0,0 +1,65 @@
+package inventory
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Selection chooses machines by name or by account, project and tags
+type Selection struct {
+	Names   []string // Machines as understood by ResolveName, the filters below are ignored if given
+	Fuzzy   bool     // Resolve Names with ResolveNameFuzzy, for interactive commands
+	Account string   // Only machines of this account
+	Project string   // Only machines of this project
+	Tags    []string // Only machines carrying all of these tags
+}
+
+// SelectMachines returns the machines of a selection, sorted
+func (configs *Configuration) SelectMachines(selection Selection) ([]MachineRef, error) {
+	if len(selection.Names) > 0 {
+		refs := []MachineRef{}
+		resolve := configs.ResolveName
+		if selection.Fuzzy {
+			resolve = configs.ResolveNameFuzzy
+		}
+		for _, name := range selection.Names {
+			ref, err := resolve(name)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Contains(refs, ref) {
+				refs = append(refs, ref)
+			}
+		}
+		return refs, nil
+	}
+
+	refs := []MachineRef{}
+	for _, ref := range configs.MachineRefs() {
+		if selection.Account != "" && ref.Account != selection.Account {
+			continue
+		}
+		if selection.Project != "" && ref.Project != selection.Project {
+			continue
+		}
+		machine := configs.Accounts[ref.Account].Projects[ref.Project].Machines[ref.Machine]
+		if !hasTags(machine, selection.Tags) {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("%w: no machine matches the selection", ErrMachineNotFound)
+	}
+	return refs, nil
+}
+
+// hasTags reports whether a machine carries all tags
+func hasTags(machine Machine, tags []string) bool {
+	for _, tag := range tags {
+		if !slices.Contains(machine.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
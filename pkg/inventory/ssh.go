@@ -0,0 +1,53 @@
+package inventory
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TransportSSH reaches machines directly with the system ssh binary, without a cloud CLI
+const TransportSSH = "ssh"
+
+// SSHConfig holds the settings of machines reached with the system ssh binary.
+// The field names follow the ssh_config keywords they map to.
+type SSHConfig struct {
+	HostName     string            `yaml:",omitempty"` // Defaults to the machine name
+	Port         int               `yaml:",omitempty"`
+	User         string            `yaml:",omitempty"`
+	IdentityFile string            `yaml:",omitempty"`
+	ProxyJump    string            `yaml:",omitempty"` // Jump host, [user@]host[:port]
+	ForwardAgent bool              `yaml:",omitempty"`
+	Options      map[string]string `yaml:",omitempty"` // Any other ssh_config keyword, passed with -o
+}
+
+// SetMachineSSH replaces the SSH settings of a machine. Settings without a host name would
+// leave the machine on the transport of its cloud, so they are refused unless the ssh
+// transport was set for the machine or its project, or they are cleared entirely.
+func (configs *Configuration) SetMachineSSH(account string, project string, machine string, settings SSHConfig) error {
+	mach, err := configs.GetMachine(account, project, machine)
+	if err != nil {
+		return err
+	}
+	mach.SSH = settings
+	cleared := settings.Port == 0 && settings.User == "" && settings.IdentityFile == "" &&
+		settings.ProxyJump == "" && !settings.ForwardAgent && len(settings.Options) == 0
+	if !cleared && configs.Accounts[account].Projects[project].resolveTransport(mach) != TransportSSH {
+		return fmt.Errorf("%w: %s has no host name, so it would still be reached through its cloud; set the host name too", ErrInvalid, machine)
+	}
+	return configs.UpdateMachine(account, project, machine, func(m *Machine) {
+		m.SSH = settings
+	})
+}
+
+// unsafeHostChars matches characters that ssh would not take literally in a host name, like the @ of account e-mails
+var unsafeHostChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// SSHHostName returns the ssh host name of a machine: account.project.machine
+func SSHHostName(ref MachineRef) string {
+	parts := []string{ref.Account, ref.Project, ref.Machine}
+	for i, part := range parts {
+		parts[i] = unsafeHostChars.ReplaceAllString(part, "_")
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,102 @@
+package inventory
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Store keeps a Configuration, e.g. in a YAML file or in a database
+type Store interface {
+	// Load reads the stored configuration into configs. A store that was never
+	// saved fails with an error wrapping fs.ErrNotExist.
+	Load(configs *Configuration) error
+	// Save replaces the stored configuration with configs
+	Save(configs *Configuration) error
+	// Update loads the stored configuration, changes it with fn and saves it again
+	// as one transaction. Nothing is saved when fn fails.
+	Update(fn func(configs *Configuration) error) error
+}
+
+// YAMLStore keeps the configuration in a single YAML file, the format chop always used
+type YAMLStore struct {
+	Filename string
+	Keys     KeySource // Keys of an encrypted file, only asked for when the file is encrypted
+}
+
+// Load reads the YAML file
+func (store YAMLStore) Load(configs *Configuration) error {
+	return configs.ReadConfigurationFromYAML(store.Filename, store.Keys)
+}
+
+// Save writes the YAML file
+func (store YAMLStore) Save(configs *Configuration) error {
+	return WriteYAMLFile(store.Filename, configs, configs.Encryption, store.Keys)
+}
+
+// WriteYAMLFile encodes value into a YAML file, encrypted with keys as encryption says if it
+// is not nil. The file is replaced at once, so that a failed or concurrent write never leaves
+// half a document behind.
+func WriteYAMLFile(filename string, value any, encryption *Encryption, keys KeySource) error {
+	// Replace the file a link points to, not the link, e.g. when a dotfile repository links it
+	if target, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = target
+	}
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	if err := encoder.Encode(value); err != nil {
+		return fmt.Errorf("failed to encode configuration to YAML: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("failed to flush configuration to YAML: %w", err)
+	}
+	previous, _ := os.ReadFile(filename)
+	data, err := EncryptYAML(buffer.Bytes(), encryption, previous, keys)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	if _, err := temp.Write(data); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	// Keep the permissions of an existing file, e.g. when it was made private
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.Chmod(temp.Name(), mode); err != nil {
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+	if err := os.Rename(temp.Name(), filename); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	return nil
+}
+
+// Update reads the YAML file, applies fn and writes it back.
+// Unlike database stores it does not lock the file: of two concurrent updates the last one wins.
+func (store YAMLStore) Update(fn func(configs *Configuration) error) error {
+	configs := NewConfiguration()
+	if err := store.Load(&configs); err != nil {
+		return err
+	}
+	if err := fn(&configs); err != nil {
+		return err
+	}
+	return store.Save(&configs)
+}
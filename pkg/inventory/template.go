@@ -0,0 +1,57 @@
+package inventory
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Template describes a machine that 'chop spawn' can create on demand
+type Template struct {
+	Zone         string
+	MachineType  string            `yaml:",omitempty"` // e.g. e2-small, the cloud's default if empty
+	ImageFamily  string            `yaml:",omitempty"` // e.g. debian-12
+	ImageProject string            `yaml:",omitempty"` // e.g. debian-cloud
+	DiskSizeGB   int               `yaml:",omitempty"`
+	Labels       map[string]string `yaml:",omitempty"`
+}
+
+// AddTemplate stores a named template in a project, replacing one with the same name
+func (configs *Configuration) AddTemplate(account string, project string, name string, template Template) error {
+	if template.Zone == "" {
+		return fmt.Errorf("%w: templates need a zone", ErrInvalid)
+	}
+	proj, err := configs.GetProject(account, project)
+	if err != nil {
+		return err
+	}
+	if proj.Templates == nil {
+		proj.Templates = make(map[string]Template)
+	}
+	proj.Templates[name] = template
+	configs.Accounts[account].Projects[project] = proj
+	return nil
+}
+
+// DeleteTemplate removes a template from a project
+func (configs *Configuration) DeleteTemplate(account string, project string, name string) error {
+	proj, err := configs.GetProject(account, project)
+	if err != nil {
+		return err
+	}
+	if _, exists := proj.Templates[name]; !exists {
+		return fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+	delete(proj.Templates, name)
+	return nil
+}
+
+// TemplateNames returns the names of the templates of a project, sorted
+func (configs *Configuration) TemplateNames(account string, project string) []string {
+	proj := configs.Accounts[account].Projects[project]
+	names := make([]string, 0, len(proj.Templates))
+	for name := range proj.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
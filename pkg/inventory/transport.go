@@ -0,0 +1,77 @@
+package inventory
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Transports decide how chop reaches a machine
+const (
+	TransportExternal = "external" // SSH to the external IP
+	TransportInternal = "internal" // SSH to the internal IP, e.g. over VPN
+	TransportIAP      = "iap"      // SSH through an Identity-Aware Proxy tunnel
+)
+
+// Transports lists the valid transport settings
+var Transports = []string{TransportExternal, TransportInternal, TransportIAP, TransportSSH}
+
+// validateTransport accepts the known transports and "" for automatic selection
+func validateTransport(transport string) error {
+	if transport != "" && !slices.Contains(Transports, transport) {
+		return fmt.Errorf("%w: unknown transport %q, use one of %v", ErrInvalid, transport, Transports)
+	}
+	return nil
+}
+
+// SetProjectTransport sets the transport of all machines in a project. "" selects it automatically.
+func (configs *Configuration) SetProjectTransport(account string, project string, transport string) error {
+	if err := validateTransport(transport); err != nil {
+		return err
+	}
+	proj, err := configs.GetProject(account, project)
+	if err != nil {
+		return err
+	}
+	proj.Transport = transport
+	configs.Accounts[account].Projects[project] = proj
+	return nil
+}
+
+// SetMachineTransport overrides the transport of a single machine. "" falls back to the project setting.
+func (configs *Configuration) SetMachineTransport(account string, project string, machine string, transport string) error {
+	if err := validateTransport(transport); err != nil {
+		return err
+	}
+	return configs.UpdateMachine(account, project, machine, func(m *Machine) {
+		m.Transport = transport
+	})
+}
+
+// ResolveMachine returns a machine with its effective transport filled in: the machine's
+// own setting, else plain SSH for machines with a host name, else the project's setting,
+// else IAP for fetched machines without external access.
+func (configs *Configuration) ResolveMachine(account string, project string, machine string) (Machine, error) {
+	mach, err := configs.GetMachine(account, project, machine)
+	if err != nil {
+		return Machine{}, err
+	}
+	mach.Transport = configs.Accounts[account].Projects[project].resolveTransport(mach)
+	return mach, nil
+}
+
+// resolveTransport picks the transport for a machine of the project
+func (proj Project) resolveTransport(machine Machine) string {
+	switch {
+	case machine.Transport != "":
+		return machine.Transport
+	case machine.SSH.HostName != "":
+		return TransportSSH
+	case proj.Transport != "":
+		return proj.Transport
+	case !machine.External && machine.ExternalIP == "" && machine.InternalIP != "":
+		// Only fetched machines know their IPs, hand-added ones keep the external default.
+		// A stopped machine has no external IP yet, but still the access that gives it one.
+		return TransportIAP
+	}
+	return TransportExternal
+}
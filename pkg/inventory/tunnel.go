@@ -0,0 +1,118 @@
+package inventory
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Tunnel forwards a local port to a host and port as seen from a machine
+type Tunnel struct {
+	LocalPort  int
+	RemoteHost string // "localhost" means the machine itself
+	RemotePort int
+	IAP        bool `yaml:",omitempty"` // Forward through Identity-Aware Proxy instead of SSH
+}
+
+// Remote returns the forwarding target as host:port
+func (tunnel Tunnel) Remote() string {
+	return net.JoinHostPort(tunnel.RemoteHost, fmt.Sprint(tunnel.RemotePort))
+}
+
+// TunnelRef identifies a tunnel profile together with the machine it belongs to
+type TunnelRef struct {
+	Account string
+	Project string
+	Machine string
+	Name    string
+	Tunnel  Tunnel
+}
+
+// AddTunnel stores a named tunnel profile on a machine, replacing one with the same name
+func (configs *Configuration) AddTunnel(account string, project string, machine string, name string, tunnel Tunnel) error {
+	if tunnel.IAP && tunnel.RemoteHost != "localhost" {
+		return fmt.Errorf("%w: IAP tunnels can only forward to ports of the machine itself", ErrInvalid)
+	}
+	return configs.UpdateMachine(account, project, machine, func(m *Machine) {
+		if m.Tunnels == nil {
+			m.Tunnels = make(map[string]Tunnel)
+		}
+		m.Tunnels[name] = tunnel
+	})
+}
+
+// DeleteTunnel removes a tunnel profile from a machine
+func (configs *Configuration) DeleteTunnel(account string, project string, machine string, name string) error {
+	mach, err := configs.GetMachine(account, project, machine)
+	if err != nil {
+		return err
+	}
+	if _, exists := mach.Tunnels[name]; !exists {
+		return fmt.Errorf("%w: %s on %s", ErrTunnelNotFound, name, machine)
+	}
+	delete(mach.Tunnels, name)
+	return nil
+}
+
+// Tunnels returns all tunnel profiles, optionally narrowed down to an account, project or machine
+func (configs *Configuration) Tunnels(account string, project string, machine string) []TunnelRef {
+	refs := []TunnelRef{}
+	for accName, acc := range configs.Accounts {
+		if account != "" && accName != account {
+			continue
+		}
+		for projName, proj := range acc.Projects {
+			if project != "" && projName != project {
+				continue
+			}
+			for machName, mach := range proj.Machines {
+				if machine != "" && machName != machine {
+					continue
+				}
+				for name, tunnel := range mach.Tunnels {
+					refs = append(refs, TunnelRef{accName, projName, machName, name, tunnel})
+				}
+			}
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Name != refs[j].Name {
+			return refs[i].Name < refs[j].Name
+		}
+		return refs[i].Account+"/"+refs[i].Project+"/"+refs[i].Machine < refs[j].Account+"/"+refs[j].Project+"/"+refs[j].Machine
+	})
+	return refs
+}
+
+// FindTunnel returns the only tunnel profile with the given name
+func (configs *Configuration) FindTunnel(name string, account string, project string, machine string) (TunnelRef, error) {
+	matches := []TunnelRef{}
+	for _, ref := range configs.Tunnels(account, project, machine) {
+		if ref.Name == name {
+			matches = append(matches, ref)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return TunnelRef{}, fmt.Errorf("%w: %s", ErrTunnelNotFound, name)
+	case 1:
+		return matches[0], nil
+	}
+	machines := make([]string, 0, len(matches))
+	for _, match := range matches {
+		machines = append(machines, match.Account+"/"+match.Project+"/"+match.Machine)
+	}
+	return TunnelRef{}, fmt.Errorf("%w: tunnel profile %q exists on %s", ErrAmbiguous, name, strings.Join(machines, ", "))
+}
+
+// Key identifies the tunnel in file names. Names may contain any character, so the key is the
+// profile name made safe for file names followed by a hash of the full reference.
+func (ref TunnelRef) Key() string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{ref.Account, ref.Project, ref.Machine, ref.Name}, "\x00")))
+	return unsafeHostChars.ReplaceAllString(ref.Name, "_") + "-" + hex.EncodeToString(sum[:8])
+}